@@ -0,0 +1,63 @@
+package dvara
+
+// bindAlias maps a member to the proxy of another member whose host name
+// resolves to the same address, when CollapseAliases is set. It reports
+// whether the member was mapped, in which case it needs no listener of its
+// own. The mappingMutex must be held.
+func (r *ReplicaSet) bindAlias(addr string, canonical func(string) string) bool {
+	if !r.CollapseAliases {
+		return false
+	}
+	target := canonical(addr)
+	for _, p := range r.proxies {
+		if canonical(p.MongoAddr) != target {
+			continue
+		}
+		if r.aliasReal == nil {
+			r.aliasReal = make(map[string]string)
+		}
+		r.Log.Infof("proxying %s through %s, it is the same server as %s", addr, p.ProxyAddr, p.MongoAddr)
+		r.aliasReal[addr] = p.MongoAddr
+		delete(r.pendingReal, addr)
+		return true
+	}
+	return false
+}
+
+// resolveAliases resolves the canonical addresses of the member and of the
+// proxied members when CollapseAliases is set, so bindAlias can be given them
+// without resolving host names while holding the mappingMutex. Members
+// proxied after the addresses were resolved are not collapsed with it.
+func (r *ReplicaSet) resolveAliases(addr string) func(string) string {
+	if !r.CollapseAliases {
+		return nil
+	}
+	r.mappingMutex.RLock()
+	addrs := []string{addr}
+	for _, p := range r.proxies {
+		addrs = append(addrs, p.MongoAddr)
+	}
+	r.mappingMutex.RUnlock()
+
+	resolved := make(map[string]string, len(addrs))
+	for _, a := range addrs {
+		resolved[a] = r.DNSCache.canonical(a)
+	}
+	return func(a string) string {
+		if c, ok := resolved[a]; ok {
+			return c
+		}
+		return a
+	}
+}
+
+// removeAliases removes the members mapped to the proxy of the given member,
+// putting them back as pending. The mappingMutex must be held.
+func (r *ReplicaSet) removeAliases(mongoAddr string) {
+	for alias, real := range r.aliasReal {
+		if real == mongoAddr {
+			delete(r.aliasReal, alias)
+			r.pendingReal[alias] = struct{}{}
+		}
+	}
+}
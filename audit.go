@@ -0,0 +1,189 @@
+package dvara
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeCommands are the commands which mutate data or metadata and are
+// audited by default.
+var writeCommands = []string{
+	"collMod",
+	"convertToCapped",
+	"create",
+	"createIndexes",
+	"delete",
+	"drop",
+	"dropDatabase",
+	"dropIndexes",
+	"findAndModify",
+	"insert",
+	"renameCollection",
+	"update",
+}
+
+// maxSniffedReply is how much of a reply is kept to determine if the
+// operation succeeded.
+const maxSniffedReply = 16 * 1024
+
+// AuditEvent describes a proxied operation. Only metadata is included, never
+// the contents of documents.
+type AuditEvent struct {
+	Time      time.Time
+	Client    string
+	Backend   string
+	OpCode    OpCode
+	Command   string
+	Namespace string
+	Comment   string
+
+	// Error is empty if the operation succeeded. Mutation ops without a
+	// response are considered successful if they were proxied.
+	Error string
+}
+
+// AuditSink receives audit events. It is called synchronously after the
+// server responds and should not block.
+type AuditSink interface {
+	Audit(e *AuditEvent)
+}
+
+// JSONAuditSink writes one JSON object per audit event to Writer.
+type JSONAuditSink struct {
+	Writer io.Writer
+
+	mutex sync.Mutex
+}
+
+// Audit writes the event.
+func (s *JSONAuditSink) Audit(e *AuditEvent) {
+	b, err := json.Marshal(struct {
+		Time      time.Time `json:"time"`
+		Client    string    `json:"client"`
+		Backend   string    `json:"backend"`
+		Op        string    `json:"op"`
+		Command   string    `json:"command,omitempty"`
+		Namespace string    `json:"ns,omitempty"`
+		Comment   string    `json:"comment,omitempty"`
+		Error     string    `json:"error,omitempty"`
+	}{
+		Time:      e.Time,
+		Client:    e.Client,
+		Backend:   e.Backend,
+		Op:        e.OpCode.String(),
+		Command:   e.Command,
+		Namespace: e.Namespace,
+		Comment:   e.Comment,
+		Error:     e.Error,
+	})
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Writer.Write(append(b, '\n'))
+}
+
+// shouldAudit checks if the operation should be sent to the AuditSink.
+func (p *Proxy) shouldAudit(op *TracedOperation) bool {
+	if p.ReplicaSet.AuditSink == nil {
+		return false
+	}
+	return p.ReplicaSet.AuditAllCommands || op.OpCode.IsMutation() || op.Write
+}
+
+// isWriteCommand checks if the command mutates data or metadata. Aggregations
+// are writes if their pipeline has a $out or $merge stage.
+func isWriteCommand(cmd bson.D) bool {
+	if len(cmd) == 0 {
+		return false
+	}
+	name := cmd[0].Name
+	if strings.EqualFold(name, "aggregate") {
+		for _, e := range cmd[1:] {
+			if e.Name == "pipeline" {
+				stages, _ := e.Value.([]interface{})
+				return hasWriteStage(stages)
+			}
+		}
+		return false
+	}
+	for _, c := range writeCommands {
+		if strings.EqualFold(name, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasWriteStage checks if an aggregation pipeline writes its results.
+func hasWriteStage(stages []interface{}) bool {
+	for _, s := range stages {
+		stage, ok := s.(bson.D)
+		if !ok || len(stage) == 0 {
+			continue
+		}
+		if stage[0].Name == "$out" || stage[0].Name == "$merge" {
+			return true
+		}
+	}
+	return false
+}
+
+// audit sends an event for the proxied operation to the AuditSink.
+func (p *Proxy) audit(op *TracedOperation, client net.Addr, reply *replySniffer, err error) {
+	e := AuditEvent{
+		Time:      time.Now(),
+		Client:    client.String(),
+		Backend:   op.Backend,
+		OpCode:    op.OpCode,
+		Command:   op.Command,
+		Namespace: op.Namespace,
+		Comment:   op.Comment,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.Error = replyError(reply.b)
+	}
+	p.ReplicaSet.AuditSink.Audit(&e)
+}
+
+// replySniffer is a net.Conn which keeps the beginning of what is written to
+// it in order to inspect the reply.
+type replySniffer struct {
+	net.Conn
+	b []byte
+}
+
+func (s *replySniffer) Write(b []byte) (int, error) {
+	if n := maxSniffedReply - len(s.b); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		s.b = append(s.b, b[:n]...)
+	}
+	return s.Conn.Write(b)
+}
+
+// replyError extracts the error from the beginning of an OpReply or OpMsg. An
+// empty string is returned if there is no error or it cannot be determined.
+func replyError(b []byte) string {
+	s, ok := parseReplyStatus(b)
+	if !ok {
+		return ""
+	}
+	if !s.Ok {
+		if s.ErrMsg != "" {
+			return s.ErrMsg
+		}
+		return "command failed"
+	}
+	return s.WriteError
+}
@@ -0,0 +1,230 @@
+package dvara
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReplyError(t *testing.T) {
+	t.Parallel()
+	reply := func(flags responseFlags, v interface{}) []byte {
+		b, err := newReply(&messageHeader{}, flags, v)
+		ensure.Nil(t, err)
+		return b
+	}
+	msgReply := func(v interface{}) []byte {
+		b, err := newReply(&messageHeader{OpCode: OpMsg}, 0, v)
+		ensure.Nil(t, err)
+		return b
+	}
+	cases := []struct {
+		Name  string
+		Reply []byte
+		Error string
+	}{
+		{
+			Name:  "ok",
+			Reply: reply(0, bson.D{{Name: "ok", Value: 1.0}}),
+		},
+		{
+			Name:  "command failure",
+			Reply: reply(0, bson.D{{Name: "ok", Value: 0.0}, {Name: "errmsg", Value: "ns not found"}}),
+			Error: "ns not found",
+		},
+		{
+			Name:  "command failure without message",
+			Reply: reply(0, bson.D{{Name: "ok", Value: 0}}),
+			Error: "command failed",
+		},
+		{
+			Name:  "query failure",
+			Reply: reply(replyFlagQueryFailure, bson.D{{Name: "$err", Value: "bad query"}}),
+			Error: "bad query",
+		},
+		{
+			Name: "write error",
+			Reply: reply(0, bson.D{
+				{Name: "ok", Value: 1},
+				{Name: "writeErrors", Value: []bson.D{{{Name: "errmsg", Value: "duplicate key"}}}},
+			}),
+			Error: "duplicate key",
+		},
+		{
+			Name:  "op msg failure",
+			Reply: msgReply(bson.D{{Name: "ok", Value: 0}, {Name: "errmsg", Value: "unauthorized"}}),
+			Error: "unauthorized",
+		},
+		{
+			Name:  "truncated",
+			Reply: reply(0, bson.D{{Name: "ok", Value: 0}})[:headerLen+len(emptyPrefix)+4],
+		},
+		{
+			Name: "empty",
+		},
+	}
+	for _, c := range cases {
+		if actual := replyError(c.Reply); actual != c.Error {
+			t.Fatalf("expected %q for %s got %q", c.Error, c.Name, actual)
+		}
+	}
+}
+
+type fakeAuditSink chan *AuditEvent
+
+func (s fakeAuditSink) Audit(e *AuditEvent) {
+	s <- e
+}
+
+func TestIsWriteCommand(t *testing.T) {
+	t.Parallel()
+	aggregate := func(stages ...bson.D) bson.D {
+		return bson.D{
+			{Name: "aggregate", Value: "foo"},
+			{Name: "pipeline", Value: stages},
+			{Name: "cursor", Value: bson.D{}},
+		}
+	}
+	cases := []struct {
+		Name    string
+		Command bson.D
+		Write   bool
+	}{
+		{Name: "empty", Command: bson.D{}},
+		{Name: "find", Command: bson.D{{Name: "find", Value: "foo"}}},
+		{Name: "insert", Command: bson.D{{Name: "insert", Value: "foo"}}, Write: true},
+		{Name: "case insensitive", Command: bson.D{{Name: "findandmodify", Value: "foo"}}, Write: true},
+		{
+			Name: "read only aggregate",
+			Command: aggregate(
+				bson.D{{Name: "$match", Value: bson.D{{Name: "a", Value: 1}}}},
+				bson.D{{Name: "$group", Value: bson.D{{Name: "_id", Value: "$b"}}}},
+			),
+		},
+		{
+			Name:    "aggregate with $out",
+			Command: aggregate(bson.D{{Name: "$match", Value: bson.D{}}}, bson.D{{Name: "$out", Value: "bar"}}),
+			Write:   true,
+		},
+		{
+			Name: "aggregate with $merge",
+			Command: aggregate(
+				bson.D{{Name: "$project", Value: bson.D{{Name: "a", Value: 1}}}},
+				bson.D{{Name: "$merge", Value: bson.D{{Name: "into", Value: "bar"}}}},
+			),
+			Write: true,
+		},
+		{
+			Name: "$out in a nested pipeline is not a stage",
+			Command: aggregate(bson.D{{Name: "$lookup", Value: bson.D{
+				{Name: "from", Value: "bar"},
+				{Name: "pipeline", Value: []bson.D{{{Name: "$match", Value: bson.D{}}}}},
+				{Name: "as", Value: "$out"},
+			}}}),
+		},
+		{Name: "aggregate without pipeline", Command: bson.D{{Name: "aggregate", Value: "foo"}}},
+	}
+	for _, c := range cases {
+		// The pipeline is classified as it is decoded off the wire.
+		b, err := bson.Marshal(c.Command)
+		ensure.Nil(t, err)
+		var cmd bson.D
+		ensure.Nil(t, bson.Unmarshal(b, &cmd))
+		if actual := isWriteCommand(cmd); actual != c.Write {
+			t.Fatalf("failed %s: expected %v got %v", c.Name, c.Write, actual)
+		}
+	}
+}
+
+func TestAuditMutations(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		if bytes.Contains(body, []byte("drop")) {
+			b, err := newReply(h, 0, bson.D{{Name: "ok", Value: 0}, {Name: "errmsg", Value: "ns not found"}})
+			ensure.Nil(t, err)
+			return b
+		}
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	sink := make(fakeAuditSink, 10)
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{AuditSink: sink})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	roundTrip := func(collection string, v interface{}) {
+		h, body := fakeQuery(collection, v)
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+		ensure.Nil(t, err)
+	}
+
+	roundTrip("test.$cmd", bson.D{{Name: "insert", Value: "foo"}})
+	roundTrip("test.foo", bson.D{{Name: "a", Value: 1}})
+
+	doc, err := bson.Marshal(bson.D{{Name: "a", Value: 1}})
+	ensure.Nil(t, err)
+	insert := append([]byte{0, 0, 0, 0}, "test.bar\000"...)
+	insert = append(insert, doc...)
+	h := messageHeader{OpCode: OpInsert, MessageLength: int32(headerLen + len(insert))}
+	_, err = c.Write(append(h.ToWire(), insert...))
+	ensure.Nil(t, err)
+
+	roundTrip("test.$cmd", bson.D{{Name: "drop", Value: "baz"}})
+
+	expected := []AuditEvent{
+		{OpCode: OpQuery, Command: "insert", Namespace: "test.foo"},
+		{OpCode: OpInsert, Command: "insert", Namespace: "test.bar"},
+		{OpCode: OpQuery, Command: "drop", Namespace: "test.baz", Error: "ns not found"},
+	}
+	for _, e := range expected {
+		select {
+		case actual := <-sink:
+			ensure.DeepEqual(t, actual.Client, c.LocalAddr().String())
+			ensure.DeepEqual(t, actual.Backend, mongo.Addr())
+			actual.Time, actual.Client, actual.Backend = time.Time{}, "", ""
+			ensure.DeepEqual(t, *actual, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for audit event %+v", e)
+		}
+	}
+}
+
+func TestJSONAuditSink(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	s := JSONAuditSink{Writer: &b}
+	s.Audit(&AuditEvent{
+		Time:      time.Unix(0, 0).UTC(),
+		Client:    "1.2.3.4:5",
+		Backend:   "a:1",
+		OpCode:    OpQuery,
+		Command:   "insert",
+		Namespace: "test.foo",
+		Comment:   "tenant=foo",
+	})
+	var actual map[string]interface{}
+	ensure.Nil(t, json.Unmarshal(b.Bytes(), &actual))
+	ensure.DeepEqual(t, actual, map[string]interface{}{
+		"time":    "1970-01-01T00:00:00Z",
+		"client":  "1.2.3.4:5",
+		"backend": "a:1",
+		"op":      "QUERY",
+		"command": "insert",
+		"ns":      "test.foo",
+		"comment": "tenant=foo",
+	})
+}
@@ -0,0 +1,160 @@
+package dvara
+
+import (
+	"io"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BatchSizeRewriter enforces a ceiling on the number of documents returned in
+// a single cursor batch. The batch size requested by find, aggregate and
+// getMore commands, and the numberToReturn of legacy OpQuery and OpGetMore, is
+// clamped so the server returns smaller batches and clients fetch the rest
+// with getMore as usual. Single batch finds are left alone. ReplyBatchLimiter
+// limits the batches of replies instead.
+type BatchSizeRewriter struct {
+	// Max is the ceiling. Zero disables enforcement.
+	Max int32
+}
+
+// Enabled returns true if a ceiling has been configured.
+func (r *BatchSizeRewriter) Enabled() bool {
+	return r != nil && r.Max > 0
+}
+
+// RewriteCommand enforces the ceiling on a command document. Commands wrapped
+// in $query are rewritten within the wrapper. It returns the new document and
+// true if it was modified.
+func (r *BatchSizeRewriter) RewriteCommand(cmd bson.D) (bson.D, bool) {
+	if !r.Enabled() || len(cmd) == 0 {
+		return cmd, false
+	}
+	if isWrappedQuery(cmd) {
+		for i, e := range cmd {
+			if e.Name != "$query" {
+				continue
+			}
+			inner, ok := e.Value.(bson.D)
+			if !ok {
+				return cmd, false
+			}
+			newInner, ok := r.RewriteCommand(inner)
+			if !ok {
+				return cmd, false
+			}
+			newCmd := append(bson.D(nil), cmd...)
+			newCmd[i].Value = newInner
+			return newCmd, true
+		}
+		return cmd, false
+	}
+	switch strings.ToLower(cmd[0].Name) {
+	case "find":
+		// The server closes the cursor of a single batch find after the
+		// first batch, a smaller one would lose the rest of the results.
+		if isSingleBatch(cmd) {
+			return cmd, false
+		}
+		return r.clamp(cmd, true)
+	case "getmore":
+		return r.clamp(cmd, false)
+	case "aggregate":
+		return r.rewriteAggregate(cmd)
+	}
+	return cmd, false
+}
+
+// RewriteNumberToReturn enforces the ceiling on the numberToReturn of a non
+// command OpQuery. It returns the new value and true if it was modified. Zero,
+// which leaves the batch size to the server, is clamped. A negative value asks
+// for a single batch with the cursor closed after it and is kept, since
+// clamping it would drop results rather than defer them.
+func (r *BatchSizeRewriter) RewriteNumberToReturn(n int32) (int32, bool) {
+	if !r.Enabled() || n < 0 || n != 0 && n <= r.Max {
+		return n, false
+	}
+	return r.Max, true
+}
+
+// forwardGetMore forwards a legacy OpGetMore to the server, enforcing the
+// ceiling on its numberToReturn like on that of the OpQuery which opened the
+// cursor.
+func (r *BatchSizeRewriter) forwardGetMore(h *messageHeader, client io.Reader, server io.Writer) error {
+	var zero [4]byte
+	if _, err := io.ReadFull(client, zero[:]); err != nil {
+		return err
+	}
+	fullCollectionName, err := readCString(client)
+	if err != nil {
+		return err
+	}
+	var numberToReturn [4]byte
+	if _, err := io.ReadFull(client, numberToReturn[:]); err != nil {
+		return err
+	}
+	if n, ok := r.RewriteNumberToReturn(getInt32(numberToReturn[:], 0)); ok {
+		setInt32(numberToReturn[:], 0, n)
+	}
+
+	prefix := append(h.ToWire(), zero[:]...)
+	prefix = append(prefix, fullCollectionName...)
+	prefix = append(prefix, numberToReturn[:]...)
+	if _, err := server.Write(prefix); err != nil {
+		return err
+	}
+	return copyBody(server, client, int64(int(h.MessageLength)-len(prefix)))
+}
+
+// isSingleBatch checks if a find asks for a single batch, after which the
+// server closes the cursor.
+func isSingleBatch(cmd bson.D) bool {
+	for _, e := range cmd[1:] {
+		if e.Name == "singleBatch" {
+			single, _ := e.Value.(bool)
+			return single
+		}
+	}
+	return false
+}
+
+// rewriteAggregate clamps the batch size within the cursor document of an
+// aggregate command. Aggregations without one, such as those with an $out
+// stage sent by old drivers, do not return a cursor and are left alone.
+func (r *BatchSizeRewriter) rewriteAggregate(cmd bson.D) (bson.D, bool) {
+	for i, e := range cmd {
+		if e.Name != "cursor" {
+			continue
+		}
+		cursor, ok := e.Value.(bson.D)
+		if !ok {
+			return cmd, false
+		}
+		newCursor, ok := r.clamp(cursor, true)
+		if !ok {
+			return cmd, false
+		}
+		newCmd := append(bson.D(nil), cmd...)
+		newCmd[i].Value = newCursor
+		return newCmd, true
+	}
+	return cmd, false
+}
+
+// clamp sets batchSize to the ceiling if it is missing, not a positive number
+// or larger than the ceiling. A batchSize of 0 is kept if allowZero is set,
+// for the first batch where it asks for an empty one rather than the default.
+func (r *BatchSizeRewriter) clamp(d bson.D, allowZero bool) (bson.D, bool) {
+	for i, e := range d {
+		if e.Name != "batchSize" {
+			continue
+		}
+		if current, ok := int64Value(e.Value); ok && (current > 0 || allowZero && current == 0) && current <= int64(r.Max) {
+			return d, false
+		}
+		newD := append(bson.D(nil), d...)
+		newD[i].Value = r.Max
+		return newD, true
+	}
+	return append(d, bson.DocElem{Name: "batchSize", Value: r.Max}), true
+}
@@ -0,0 +1,295 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBatchSizeRewriteCommand(t *testing.T) {
+	t.Parallel()
+	r := &BatchSizeRewriter{Max: 100}
+	cases := []struct {
+		Name      string
+		In        bson.D
+		Out       bson.D
+		Rewritten bool
+	}{
+		{
+			Name:      "injected when absent",
+			In:        bson.D{{Name: "find", Value: "foo"}},
+			Out:       bson.D{{Name: "find", Value: "foo"}, {Name: "batchSize", Value: int32(100)}},
+			Rewritten: true,
+		},
+		{
+			Name:      "clamped when too large",
+			In:        bson.D{{Name: "find", Value: "foo"}, {Name: "batchSize", Value: int64(5000)}},
+			Out:       bson.D{{Name: "find", Value: "foo"}, {Name: "batchSize", Value: int32(100)}},
+			Rewritten: true,
+		},
+		{
+			Name:      "within the ceiling",
+			In:        bson.D{{Name: "find", Value: "foo"}, {Name: "batchSize", Value: 10}},
+			Out:       bson.D{{Name: "find", Value: "foo"}, {Name: "batchSize", Value: 10}},
+			Rewritten: false,
+		},
+		{
+			Name:      "empty first batch",
+			In:        bson.D{{Name: "find", Value: "foo"}, {Name: "batchSize", Value: int32(0)}},
+			Out:       bson.D{{Name: "find", Value: "foo"}, {Name: "batchSize", Value: int32(0)}},
+			Rewritten: false,
+		},
+		{
+			Name: "single batch find",
+			In: bson.D{
+				{Name: "find", Value: "foo"},
+				{Name: "singleBatch", Value: true},
+				{Name: "batchSize", Value: int32(5000)},
+			},
+			Out: bson.D{
+				{Name: "find", Value: "foo"},
+				{Name: "singleBatch", Value: true},
+				{Name: "batchSize", Value: int32(5000)},
+			},
+			Rewritten: false,
+		},
+		{
+			Name:      "getMore without limit",
+			In:        bson.D{{Name: "getMore", Value: int64(1)}, {Name: "batchSize", Value: int32(0)}},
+			Out:       bson.D{{Name: "getMore", Value: int64(1)}, {Name: "batchSize", Value: int32(100)}},
+			Rewritten: true,
+		},
+		{
+			Name: "aggregate cursor",
+			In: bson.D{
+				{Name: "aggregate", Value: "foo"},
+				{Name: "cursor", Value: bson.D{}},
+			},
+			Out: bson.D{
+				{Name: "aggregate", Value: "foo"},
+				{Name: "cursor", Value: bson.D{{Name: "batchSize", Value: int32(100)}}},
+			},
+			Rewritten: true,
+		},
+		{
+			Name:      "aggregate without cursor",
+			In:        bson.D{{Name: "aggregate", Value: "foo"}},
+			Out:       bson.D{{Name: "aggregate", Value: "foo"}},
+			Rewritten: false,
+		},
+		{
+			Name: "wrapped in $query",
+			In: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "find", Value: "foo"}}},
+				{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondary"}}},
+			},
+			Out: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "find", Value: "foo"}, {Name: "batchSize", Value: int32(100)}}},
+				{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondary"}}},
+			},
+			Rewritten: true,
+		},
+		{
+			Name: "unsupported command wrapped in $query",
+			In: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "count", Value: "foo"}}},
+			},
+			Out: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "count", Value: "foo"}}},
+			},
+			Rewritten: false,
+		},
+		{
+			Name:      "unsupported command",
+			In:        bson.D{{Name: "count", Value: "foo"}},
+			Out:       bson.D{{Name: "count", Value: "foo"}},
+			Rewritten: false,
+		},
+	}
+	for _, c := range cases {
+		out, rewritten := r.RewriteCommand(c.In)
+		ensure.DeepEqual(t, out, c.Out, c.Name)
+		ensure.DeepEqual(t, rewritten, c.Rewritten, c.Name)
+	}
+
+	var disabled *BatchSizeRewriter
+	in := bson.D{{Name: "find", Value: "foo"}}
+	out, rewritten := disabled.RewriteCommand(in)
+	ensure.DeepEqual(t, out, in)
+	ensure.False(t, rewritten)
+}
+
+func TestProxyMsgBatchSize(t *testing.T) {
+	t.Parallel()
+	p := &ProxyMsg{
+		Log:               &tLogger{TB: t},
+		MaxTimeMSRewriter: &MaxTimeMSRewriter{},
+		BatchSizeRewriter: &BatchSizeRewriter{Max: 2},
+	}
+	forwarded := func(cmd bson.D) bson.D {
+		h, body := fakeOpMsg(0, cmd)
+		var clientOut, serverIn bytes.Buffer
+		client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+		server := fakeReadWriter{
+			Reader: fakeSingleDocReply(bson.D{{Name: "ok", Value: 1}}),
+			Writer: &serverIn,
+		}
+		ensure.Nil(t, p.Proxy(h, client, server, &HeldBatches{}))
+		sh, err := readHeader(&serverIn)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, int(sh.MessageLength), headerLen+serverIn.Len())
+		m, err := readOpMsg(sh, &serverIn)
+		ensure.Nil(t, err)
+		actual, err := m.Command()
+		ensure.Nil(t, err)
+		return actual
+	}
+
+	// The unbounded first batch and the getMore continuing the cursor are both
+	// limited, so the server keeps the rest of the results for later batches.
+	ensure.DeepEqual(t, forwarded(bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "batchSize", Value: int32(1000)},
+		{Name: "$db", Value: "test"},
+	}), bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "batchSize", Value: 2},
+		{Name: "$db", Value: "test"},
+	})
+	ensure.DeepEqual(t, forwarded(bson.D{
+		{Name: "getMore", Value: int64(42)},
+		{Name: "collection", Value: "foo"},
+		{Name: "$db", Value: "test"},
+	}), bson.D{
+		{Name: "getMore", Value: int64(42)},
+		{Name: "collection", Value: "foo"},
+		{Name: "$db", Value: "test"},
+		{Name: "batchSize", Value: 2},
+	})
+}
+
+func TestBatchSizeRewriteNumberToReturn(t *testing.T) {
+	t.Parallel()
+	r := &BatchSizeRewriter{Max: 100}
+	cases := []struct {
+		In        int32
+		Out       int32
+		Rewritten bool
+	}{
+		{In: 0, Out: 100, Rewritten: true},
+		{In: 5000, Out: 100, Rewritten: true},
+		{In: 100, Out: 100},
+		{In: 1, Out: 1},
+		{In: -5000, Out: -5000},
+	}
+	for _, c := range cases {
+		out, rewritten := r.RewriteNumberToReturn(c.In)
+		ensure.DeepEqual(t, out, c.Out, c.In)
+		ensure.DeepEqual(t, rewritten, c.Rewritten, c.In)
+	}
+}
+
+func TestProxyQueryBatchSize(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{
+		Log:               &tLogger{TB: t},
+		MaxTimeMSRewriter: &MaxTimeMSRewriter{},
+		BatchSizeRewriter: &BatchSizeRewriter{Max: 2},
+	}
+	forwarded := func(collection string, numberToReturn int32, q bson.D) (int32, bson.D) {
+		h, body := fakeQuery(collection, q)
+		numberToReturnAt := 4 + len(collection) + 1 + 4
+		setInt32(body, numberToReturnAt, numberToReturn)
+		var clientOut, serverIn bytes.Buffer
+		client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+		server := fakeReadWriter{
+			Reader: fakeSingleDocReply(bson.D{{Name: "ok", Value: 1}}),
+			Writer: &serverIn,
+		}
+		var lastError LastError
+		ensure.Nil(t, p.Proxy(h, client, server, &lastError))
+		sh, err := readHeader(&serverIn)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, int(sh.MessageLength), headerLen+serverIn.Len())
+		b := serverIn.Bytes()
+		var doc bson.D
+		ensure.Nil(t, bson.Unmarshal(b[numberToReturnAt+4:], &doc))
+		return getInt32(b, numberToReturnAt), doc
+	}
+
+	n, doc := forwarded("test.foo", 1000, bson.D{{Name: "a", Value: 1}})
+	ensure.DeepEqual(t, n, int32(2))
+	ensure.DeepEqual(t, doc, bson.D{{Name: "a", Value: 1}})
+
+	n, doc = forwarded("test.$cmd", -1, bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "batchSize", Value: 1000},
+	})
+	ensure.DeepEqual(t, n, int32(-1))
+	ensure.DeepEqual(t, doc, bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "batchSize", Value: 2},
+	})
+
+	n, doc = forwarded("test.$cmd", -1, bson.D{
+		{Name: "$query", Value: bson.D{{Name: "find", Value: "foo"}}},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondary"}}},
+	})
+	ensure.DeepEqual(t, n, int32(-1))
+	ensure.DeepEqual(t, doc, bson.D{
+		{Name: "$query", Value: bson.D{{Name: "find", Value: "foo"}, {Name: "batchSize", Value: 2}}},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondary"}}},
+	})
+}
+
+func TestProxyGetMoreBatchSize(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		Log: &tLogger{TB: t},
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Minute,
+			ProxyQuery:     &ProxyQuery{BatchSizeRewriter: &BatchSizeRewriter{Max: 2}},
+		},
+	}
+	forwarded := func(numberToReturn int32) int32 {
+		body := append([]byte{0, 0, 0, 0}, "test.foo\000"...)
+		numberToReturnAt := len(body)
+		body = append(body, make([]byte, 4+8)...)
+		setInt32(body, numberToReturnAt, numberToReturn)
+		setInt32(body, numberToReturnAt+4, 42)
+		h := &messageHeader{OpCode: OpGetMore, MessageLength: int32(headerLen + len(body))}
+
+		clientProxy, client := net.Pipe()
+		serverProxy, server := net.Pipe()
+		defer clientProxy.Close()
+		defer serverProxy.Close()
+		go func() {
+			client.Write(body)
+			ioutil.ReadAll(client)
+		}()
+		received := make(chan []byte, 1)
+		go func() {
+			b := make([]byte, h.MessageLength)
+			io.ReadFull(server, b)
+			received <- b
+			server.Write(fakeReplyWithFlags(0, 0))
+		}()
+		var lastError LastError
+		ensure.Nil(t, p.proxyMessage(h, clientProxy, serverProxy, &lastError, &HeldBatches{}, time.Minute))
+		b := <-received
+		ensure.DeepEqual(t, b[headerLen:numberToReturnAt+headerLen], body[:numberToReturnAt])
+		ensure.DeepEqual(t, getInt32(b, headerLen+numberToReturnAt+4), int32(42))
+		return getInt32(b, headerLen+numberToReturnAt)
+	}
+
+	ensure.DeepEqual(t, forwarded(0), int32(2))
+	ensure.DeepEqual(t, forwarded(1000), int32(2))
+	ensure.DeepEqual(t, forwarded(1), int32(1))
+	ensure.DeepEqual(t, forwarded(-1000), int32(-1000))
+}
@@ -0,0 +1,309 @@
+package dvara
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxCommandPeekLength is the most read ahead of an OpQuery or OpMsg body to
+// find the name of the command.
+const maxCommandPeekLength = 256
+
+// peekCommand returns the name of the command from the start of an OpQuery or
+// OpMsg body, or an empty string if it is not a command or the name is not
+// within the given prefix.
+func peekCommand(h *messageHeader, prefix []byte) string {
+	var doc []byte
+	switch h.OpCode {
+	default:
+		return ""
+	case OpQuery:
+		// flags, fullCollectionName, numberToSkip, numberToReturn, query
+		if len(prefix) < 4 {
+			return ""
+		}
+		end := bytes.IndexByte(prefix[4:], 0)
+		if end < 0 || !strings.HasSuffix(string(prefix[4:4+end]), ".$cmd") {
+			return ""
+		}
+		doc = prefix[4+end+1:]
+		if len(doc) < 8 {
+			return ""
+		}
+		doc = doc[8:]
+	case OpMsg:
+		// flags, then the body section first
+		if len(prefix) < 5 || prefix[4] != 0 {
+			return ""
+		}
+		doc = prefix[5:]
+	}
+
+	// document length, element type, element name
+	if len(doc) < 5 {
+		return ""
+	}
+	end := bytes.IndexByte(doc[5:], 0)
+	if end < 0 {
+		return ""
+	}
+	return string(doc[5 : 5+end])
+}
+
+// commandDocument returns the command document of an OpQuery or OpMsg body, or
+// nil if it cannot be parsed.
+func commandDocument(h *messageHeader, body []byte) bson.D {
+	var doc bson.D
+	switch h.OpCode {
+	case OpQuery:
+		// flags, fullCollectionName, numberToSkip, numberToReturn, query
+		if len(body) < 4 {
+			return nil
+		}
+		end := bytes.IndexByte(body[4:], 0)
+		if end < 0 || len(body) < 4+end+1+8 {
+			return nil
+		}
+		if err := bson.Unmarshal(body[4+end+1+8:], &doc); err != nil {
+			return nil
+		}
+		if isWrappedQuery(doc) {
+			for _, e := range doc {
+				if e.Name == "$query" {
+					doc, _ = e.Value.(bson.D)
+				}
+			}
+		}
+	case OpMsg:
+		m, err := readOpMsg(&messageHeader{MessageLength: int32(headerLen + len(body))}, bytes.NewReader(body))
+		if err != nil {
+			return nil
+		}
+		if doc, err = m.Command(); err != nil {
+			return nil
+		}
+	}
+	return doc
+}
+
+// shutdownAllowed checks if the shutdown command is forwarded to the given
+// mongo server.
+func (r *ReplicaSet) shutdownAllowed(mongoAddr string) bool {
+	for _, addr := range r.AllowShutdown {
+		if addr == mongoAddr {
+			return true
+		}
+	}
+	return false
+}
+
+// isGlobalCommand checks if the command is one which changes the behavior of
+// the server for all its clients, and is only allowed as configured.
+func isGlobalCommand(name string) bool {
+	return strings.EqualFold(name, "profile") || strings.EqualFold(name, "setParameter")
+}
+
+// globalCommandAllowed checks if the profile or setParameter command is
+// allowed. Reading the profiling level, a level of -1 without any setting, is
+// always allowed, changing it or the settings only with AllowProfile.
+// setParameter is allowed if all the parameters it sets are AllowedParameters.
+func (r *ReplicaSet) globalCommandAllowed(doc bson.D) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	if strings.EqualFold(doc[0].Name, "profile") {
+		if r.AllowProfile {
+			return true
+		}
+		if level, ok := int64Value(doc[0].Value); !ok || level != -1 {
+			return false
+		}
+		// Settings such as slowms are changed whatever the level.
+		for _, e := range doc[1:] {
+			if !isCommandOption(e.Name) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, e := range doc[1:] {
+		if isCommandOption(e.Name) {
+			continue
+		}
+		if !r.parameterAllowed(e.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// isCommandOption checks if the field of a command document is one common to
+// all commands rather than an argument of the command.
+func isCommandOption(name string) bool {
+	return strings.HasPrefix(name, "$") || name == "lsid" || name == "comment"
+}
+
+func (r *ReplicaSet) parameterAllowed(name string) bool {
+	for _, p := range r.AllowedParameters {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readCommand reads enough of an OpQuery or OpMsg body to get its command
+// document. The whole body of OpQuery commands is read, OpMsg is read up to
+// and including its body section so that the document sequences following it,
+// which hold the documents of bulk writes, are still proxied as they come. It
+// returns what was read, and a nil document if the command cannot be parsed.
+// Queries which are not commands are only read ahead enough to tell.
+func readCommand(h *messageHeader, r io.Reader) ([]byte, bson.D, bool, error) {
+	length := int(h.MessageLength - headerLen)
+	if h.OpCode == OpMsg {
+		read, cmd, err := readMsgCommand(r, length)
+		return read, cmd, true, err
+	}
+
+	peek := length
+	if peek > maxCommandPeekLength {
+		peek = maxCommandPeekLength
+	}
+	body := make([]byte, peek, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, false, err
+	}
+	if ns, ok := queryNamespace(body); ok && !strings.HasSuffix(ns, ".$cmd") {
+		return body, nil, false, nil
+	}
+	body = body[:length]
+	if _, err := io.ReadFull(r, body[peek:]); err != nil {
+		return nil, nil, false, err
+	}
+	if ns, ok := queryNamespace(body); ok && !strings.HasSuffix(ns, ".$cmd") {
+		return body, nil, false, nil
+	}
+	return body, commandDocument(h, body), true, nil
+}
+
+// queryNamespace returns the full collection name from the start of an
+// OpQuery body, or false if it is not complete.
+func queryNamespace(body []byte) (string, bool) {
+	if len(body) < 4 {
+		return "", false
+	}
+	end := bytes.IndexByte(body[4:], 0)
+	if end < 0 {
+		return "", false
+	}
+	return string(body[4 : 4+end]), true
+}
+
+// readMsgCommand reads an OpMsg body of the given length up to and including
+// its body section, along with any document sequence before it. It returns
+// what was read and the command, which is nil if the sections are malformed.
+func readMsgCommand(r io.Reader, length int) ([]byte, bson.D, error) {
+	if length < 4 {
+		b := make([]byte, length)
+		_, err := io.ReadFull(r, b)
+		return b, nil, err
+	}
+	b := make([]byte, 4, maxCommandPeekLength)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, err
+	}
+	end := length
+	if uint32(getInt32(b, 0))&msgFlagChecksumPresent != 0 {
+		end -= 4
+	}
+	for len(b)+5 <= end {
+		pos := len(b)
+		b = append(b, make([]byte, 5)...)
+		if _, err := io.ReadFull(r, b[pos:]); err != nil {
+			return nil, nil, err
+		}
+		kind, size := b[pos], int(getInt32(b, pos+1))
+		if size < 5 || pos+1+size > end || kind != msgSectionBody && kind != msgSectionSequence {
+			return b, nil, nil
+		}
+		b = append(b, make([]byte, size-4)...)
+		if _, err := io.ReadFull(r, b[pos+5:]); err != nil {
+			return nil, nil, err
+		}
+		if kind == msgSectionBody {
+			var cmd bson.D
+			if err := bson.Unmarshal(b[pos+1:], &cmd); err != nil {
+				return b, nil, nil
+			}
+			return b, cmd, nil
+		}
+	}
+	return b, nil, nil
+}
+
+// rejectCommand replies with an error to commands which should not go through
+// a shared proxy: shutdown unless the backend is one of the AllowShutdown
+// servers, so clients cannot shut down a server by mistake, and profile or
+// setParameter unless allowed, since they change the server for all its
+// clients. Commands which cannot be parsed are rejected too, rather than risk
+// letting one of those through. The command is read with readCommand, the
+// returned net.Conn should be used to proxy the message if it was not
+// rejected, it replays what was read, along with the name of the command if
+// it is one.
+func (p *Proxy) rejectCommand(h *messageHeader, c net.Conn, backend *Proxy) (net.Conn, string, bool, error) {
+	if h.OpCode != OpQuery && h.OpCode != OpMsg || h.MessageLength <= headerLen {
+		return c, "", false, nil
+	}
+
+	c.SetReadDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	read, cmd, isCommand, err := readCommand(h, c)
+	if err != nil {
+		return nil, "", false, err
+	}
+	replay := newBufferedConn(c, read)
+	if !isCommand {
+		return replay, "", false, nil
+	}
+
+	var errmsg string
+	switch {
+	case len(cmd) == 0:
+		p.Log.Warnf("rejecting unparseable command from %s", c.RemoteAddr())
+		stats.BumpSum(p.stats, "client.rejected.unparseable.command", 1)
+		errmsg = "dvara: the command could not be parsed by the proxy"
+	case strings.EqualFold(cmd[0].Name, "shutdown") && !p.ReplicaSet.shutdownAllowed(backend.MongoAddr):
+		p.Log.Warnf("rejecting shutdown from %s for %s", c.RemoteAddr(), backend.MongoAddr)
+		stats.BumpSum(p.stats, "client.rejected.shutdown", 1)
+		errmsg = "dvara: shutdown is not allowed through the proxy"
+	case p.ReplicaSet.CommandClassifier.Classify("", cmd).Global && !p.ReplicaSet.globalCommandAllowed(cmd):
+		p.Log.Warnf("rejecting %s from %s", cmd[0].Name, c.RemoteAddr())
+		stats.BumpSum(p.stats, "client.rejected.global.command", 1)
+		errmsg = fmt.Sprintf("dvara: %s is not allowed through the proxy", cmd[0].Name)
+	default:
+		return replay, cmd[0].Name, false, nil
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, c, int64(int(h.MessageLength-headerLen)-len(read))); err != nil {
+		return nil, "", false, err
+	}
+	if h.OpCode == OpMsg && len(read) >= 4 && uint32(getInt32(read, 0))&msgFlagMoreToCome != 0 {
+		return c, "", true, nil
+	}
+	reply, err := newErrorReply(h, unauthorizedCode, errmsg)
+	if err != nil {
+		return nil, "", false, err
+	}
+	c.SetWriteDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	if _, err := c.Write(reply); err != nil {
+		return nil, "", false, err
+	}
+	return c, "", true, nil
+}
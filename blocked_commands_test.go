@@ -0,0 +1,423 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPeekCommand(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name    string
+		Header  *messageHeader
+		Body    []byte
+		Command string
+	}{
+		{Name: "query", Command: "shutdown"},
+		{Name: "op msg", Command: "shutdown"},
+		{Name: "not a command"},
+		{Name: "truncated"},
+		{Name: "insert", Header: &messageHeader{OpCode: OpInsert}, Body: make([]byte, 64)},
+	}
+	cases[0].Header, cases[0].Body = fakeQuery("admin.$cmd", bson.D{{Name: "shutdown", Value: 1}})
+	cases[1].Header, cases[1].Body = fakeOpMsg(0, bson.D{
+		{Name: "shutdown", Value: 1},
+		{Name: "$db", Value: "admin"},
+	})
+	cases[2].Header, cases[2].Body = fakeQuery("db.foo", bson.D{{Name: "shutdown", Value: 1}})
+	cases[3].Header, cases[3].Body = fakeQuery("admin.$cmd", bson.D{{Name: "shutdown", Value: 1}})
+	cases[3].Body = cases[3].Body[:len(cases[3].Body)-12]
+	for _, c := range cases {
+		ensure.DeepEqual(t, peekCommand(c.Header, c.Body), c.Command, c.Name)
+	}
+}
+
+func TestRejectShutdown(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name  string
+		Allow bool
+	}{
+		{Name: "blocked"},
+		{Name: "allowed", Allow: true},
+	}
+	for _, c := range cases {
+		var mutex sync.Mutex
+		var received []string
+		mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+			mutex.Lock()
+			received = append(received, peekCommand(h, body))
+			mutex.Unlock()
+			return okReply(h, body)
+		})
+		rs := &ReplicaSet{}
+		if c.Allow {
+			rs.AllowShutdown = []string{mongo.Addr()}
+		}
+		p := newFakeProxy(t, mongo.Addr(), rs)
+
+		conn, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		roundTrip := func(h *messageHeader, body []byte) bson.M {
+			_, err := conn.Write(append(h.ToWire(), body...))
+			ensure.Nil(t, err)
+			reply, err := readHeader(conn)
+			ensure.Nil(t, err)
+			b := make([]byte, reply.MessageLength-headerLen)
+			_, err = io.ReadFull(conn, b)
+			ensure.Nil(t, err)
+			if reply.OpCode == OpMsg {
+				b = b[5:]
+			} else {
+				b = b[len(emptyPrefix):]
+			}
+			var doc bson.M
+			ensure.Nil(t, bson.Unmarshal(b, &doc))
+			return doc
+		}
+
+		doc := roundTrip(fakeQuery("admin.$cmd", bson.D{{Name: "shutdown", Value: 1}}))
+		if c.Allow {
+			ensure.DeepEqual(t, doc, bson.M{"ok": 1}, c.Name)
+		} else {
+			ensure.DeepEqual(t, doc["code"], unauthorizedCode, c.Name)
+		}
+		doc = roundTrip(fakeOpMsg(0, bson.D{
+			{Name: "shutdown", Value: 1},
+			{Name: "$db", Value: "admin"},
+		}))
+		if c.Allow {
+			ensure.DeepEqual(t, doc, bson.M{"ok": 1}, c.Name)
+		} else {
+			ensure.DeepEqual(t, doc["code"], unauthorizedCode, c.Name)
+		}
+
+		// Other commands are proxied with the part read ahead.
+		doc = roundTrip(fakeQuery("admin.$cmd", bson.D{{Name: "ping", Value: 1}}))
+		ensure.DeepEqual(t, doc, bson.M{"ok": 1}, c.Name)
+
+		ensure.Nil(t, conn.Close())
+		ensure.Nil(t, p.Stop())
+		mongo.Stop()
+
+		expected := []string{"ping"}
+		if c.Allow {
+			expected = []string{"shutdown", "shutdown", "ping"}
+		}
+		mutex.Lock()
+		ensure.DeepEqual(t, received, expected, c.Name)
+		mutex.Unlock()
+	}
+}
+
+// fakeOpMsgSequenceFirst returns an OpMsg with a document sequence before its
+// body section.
+func fakeOpMsgSequenceFirst(cmd bson.D, sequence []byte) (*messageHeader, []byte) {
+	doc, err := bson.Marshal(cmd)
+	if err != nil {
+		panic(err)
+	}
+	body := []byte{0, 0, 0, 0}
+	body = append(body, sequence...)
+	body = append(body, msgSectionBody)
+	body = append(body, doc...)
+	return &messageHeader{OpCode: OpMsg, MessageLength: int32(headerLen + len(body))}, body
+}
+
+func TestReadCommand(t *testing.T) {
+	t.Parallel()
+	sequence := fakeDocSequence("documents", bson.D{{Name: "a", Value: 1}})
+	cases := []struct {
+		Name      string
+		Header    *messageHeader
+		Body      []byte
+		Command   string
+		IsCommand bool
+		Read      int // of the body, -1 for all of it
+	}{
+		{Name: "query", Command: "shutdown", IsCommand: true, Read: -1},
+		{Name: "wrapped query", Command: "shutdown", IsCommand: true, Read: -1},
+		{Name: "not a command", Read: -1},
+		{Name: "op msg", Command: "insert", IsCommand: true},
+		{Name: "op msg sequence first", Command: "shutdown", IsCommand: true, Read: -1},
+		{Name: "op msg without body", IsCommand: true, Read: -1},
+		{Name: "op msg unknown section", IsCommand: true, Read: 9},
+	}
+	cases[0].Header, cases[0].Body = fakeQuery("admin.$cmd", bson.D{{Name: "shutdown", Value: 1}})
+	cases[1].Header, cases[1].Body = fakeQuery("admin.$cmd", bson.D{
+		{Name: "$query", Value: bson.D{{Name: "shutdown", Value: 1}}},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "primary"}}},
+	})
+	cases[2].Header, cases[2].Body = fakeQuery("db.foo", bson.D{
+		{Name: "shutdown", Value: 1},
+		{Name: "padding", Value: strings.Repeat("x", 2*maxCommandPeekLength)},
+	})
+	cases[2].Read = maxCommandPeekLength
+	cases[3].Header, cases[3].Body = fakeOpMsg(0, bson.D{{Name: "insert", Value: "foo"}}, sequence)
+	cases[3].Read = len(cases[3].Body) - len(sequence)
+	cases[4].Header, cases[4].Body = fakeOpMsgSequenceFirst(bson.D{{Name: "shutdown", Value: 1}}, sequence)
+	cases[5].Body = append([]byte{0, 0, 0, 0}, sequence...)
+	cases[5].Header = &messageHeader{OpCode: OpMsg, MessageLength: int32(headerLen + len(cases[5].Body))}
+	cases[6].Header, cases[6].Body = fakeOpMsg(0, bson.D{{Name: "shutdown", Value: 1}})
+	cases[6].Body[4] = 2
+	for _, c := range cases {
+		read, cmd, isCommand, err := readCommand(c.Header, bytes.NewReader(c.Body))
+		ensure.Nil(t, err, c.Name)
+		var name string
+		if len(cmd) != 0 {
+			name = cmd[0].Name
+		}
+		ensure.DeepEqual(t, name, c.Command, c.Name)
+		ensure.DeepEqual(t, isCommand, c.IsCommand, c.Name)
+		if c.Read == -1 {
+			c.Read = len(c.Body)
+		}
+		ensure.DeepEqual(t, read, c.Body[:c.Read], c.Name)
+	}
+}
+
+func TestRejectHiddenShutdown(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	var received int
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		mutex.Lock()
+		received++
+		mutex.Unlock()
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{})
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer conn.Close()
+	roundTrip := func(h *messageHeader, body []byte) bson.M {
+		_, err := conn.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(conn)
+		ensure.Nil(t, err)
+		b := make([]byte, reply.MessageLength-headerLen)
+		_, err = io.ReadFull(conn, b)
+		ensure.Nil(t, err)
+		if reply.OpCode == OpMsg {
+			b = b[5:]
+		} else {
+			b = b[len(emptyPrefix):]
+		}
+		var doc bson.M
+		ensure.Nil(t, bson.Unmarshal(b, &doc))
+		return doc
+	}
+
+	// Wrapped along with a read preference.
+	doc := roundTrip(fakeQuery("admin.$cmd", bson.D{
+		{Name: "$query", Value: bson.D{{Name: "shutdown", Value: 1}}},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "primary"}}},
+	}))
+	ensure.DeepEqual(t, doc["code"], unauthorizedCode)
+	ensure.DeepEqual(t, doc["errmsg"], "dvara: shutdown is not allowed through the proxy")
+
+	// After a document sequence.
+	doc = roundTrip(fakeOpMsgSequenceFirst(
+		bson.D{{Name: "shutdown", Value: 1}, {Name: "$db", Value: "admin"}},
+		fakeDocSequence("documents", bson.D{{Name: "a", Value: 1}}),
+	))
+	ensure.DeepEqual(t, doc["code"], unauthorizedCode)
+	ensure.DeepEqual(t, doc["errmsg"], "dvara: shutdown is not allowed through the proxy")
+
+	// Sections which cannot be parsed.
+	h, body := fakeOpMsg(0, bson.D{{Name: "shutdown", Value: 1}, {Name: "$db", Value: "admin"}})
+	body[4] = 2
+	doc = roundTrip(h, body)
+	ensure.DeepEqual(t, doc["code"], unauthorizedCode)
+	ensure.DeepEqual(t, doc["errmsg"], "dvara: the command could not be parsed by the proxy")
+
+	mutex.Lock()
+	ensure.DeepEqual(t, received, 0)
+	mutex.Unlock()
+}
+
+func TestRejectShutdownAfterInsert(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	var received []OpCode
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		mutex.Lock()
+		received = append(received, h.OpCode)
+		mutex.Unlock()
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{})
+	defer p.Stop()
+
+	// The message following a mutation is read while holding on to the server
+	// connection for a getLastError, it is checked all the same.
+	insert := append([]byte{0, 0, 0, 0}, "test.foo\000"...)
+	doc, err := bson.Marshal(bson.D{{Name: "a", Value: 1}})
+	ensure.Nil(t, err)
+	insert = append(insert, doc...)
+	insertH := messageHeader{OpCode: OpInsert, MessageLength: int32(headerLen + len(insert))}
+	shutdownH, shutdown := fakeQuery("admin.$cmd", bson.D{{Name: "shutdown", Value: 1}})
+
+	conn, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer conn.Close()
+	var pipelined []byte
+	pipelined = append(pipelined, insertH.ToWire()...)
+	pipelined = append(pipelined, insert...)
+	pipelined = append(pipelined, shutdownH.ToWire()...)
+	pipelined = append(pipelined, shutdown...)
+	_, err = conn.Write(pipelined)
+	ensure.Nil(t, err)
+
+	var reply bson.M
+	r := &ReplyRW{Log: &tLogger{TB: t}}
+	_, _, _, err = r.ReadOne(conn, &reply)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, reply["code"], unauthorizedCode)
+
+	mutex.Lock()
+	ensure.DeepEqual(t, received, []OpCode{OpInsert})
+	mutex.Unlock()
+}
+
+func TestGlobalCommandAllowed(t *testing.T) {
+	t.Parallel()
+	rs := &ReplicaSet{AllowedParameters: []string{"logLevel", "cursorTimeoutMillis"}}
+	cases := []struct {
+		Name    string
+		Command bson.D
+		Allowed bool
+	}{
+		{
+			Name:    "read profiling level",
+			Command: bson.D{{Name: "profile", Value: -1}},
+			Allowed: true,
+		},
+		{
+			Name: "read profiling level in a session",
+			Command: bson.D{
+				{Name: "profile", Value: -1},
+				{Name: "$db", Value: "admin"},
+				{Name: "lsid", Value: bson.D{}},
+			},
+			Allowed: true,
+		},
+		{
+			Name:    "change profiling level",
+			Command: bson.D{{Name: "profile", Value: 2}},
+		},
+		{
+			Name:    "change profiling threshold",
+			Command: bson.D{{Name: "profile", Value: -1}, {Name: "slowms", Value: 0}},
+		},
+		{
+			Name:    "change profiling sample rate",
+			Command: bson.D{{Name: "profile", Value: -1}, {Name: "sampleRate", Value: 1.0}},
+		},
+		{
+			Name: "allowed parameter",
+			Command: bson.D{
+				{Name: "setParameter", Value: 1},
+				{Name: "logLevel", Value: 1},
+				{Name: "$db", Value: "admin"},
+				{Name: "lsid", Value: bson.D{}},
+			},
+			Allowed: true,
+		},
+		{
+			Name: "allowed parameters",
+			Command: bson.D{
+				{Name: "setParameter", Value: 1},
+				{Name: "logLevel", Value: 1},
+				{Name: "cursorTimeoutMillis", Value: 1000},
+			},
+			Allowed: true,
+		},
+		{
+			Name: "blocked parameter",
+			Command: bson.D{
+				{Name: "setParameter", Value: 1},
+				{Name: "logLevel", Value: 1},
+				{Name: "failpoint.maxTimeAlwaysTimeOut", Value: 1},
+			},
+		},
+		{
+			Name: "unparsed",
+		},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, rs.globalCommandAllowed(c.Command), c.Allowed, c.Name)
+	}
+	ensure.True(t, (&ReplicaSet{AllowProfile: true}).globalCommandAllowed(bson.D{{Name: "profile", Value: 1}}))
+	ensure.True(t, (&ReplicaSet{AllowProfile: true}).globalCommandAllowed(bson.D{
+		{Name: "profile", Value: -1},
+		{Name: "slowms", Value: 0},
+	}))
+}
+
+func TestRejectGlobalCommands(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	var received []string
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		mutex.Lock()
+		received = append(received, peekCommand(h, body))
+		mutex.Unlock()
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{AllowedParameters: []string{"logLevel"}})
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer conn.Close()
+	roundTrip := func(cmd bson.D) bson.M {
+		h, body := fakeOpMsg(0, append(cmd, bson.DocElem{Name: "$db", Value: "admin"}))
+		_, err := conn.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(conn)
+		ensure.Nil(t, err)
+		b := make([]byte, reply.MessageLength-headerLen)
+		_, err = io.ReadFull(conn, b)
+		ensure.Nil(t, err)
+		var doc bson.M
+		ensure.Nil(t, bson.Unmarshal(b[5:], &doc))
+		return doc
+	}
+
+	doc := roundTrip(bson.D{{Name: "profile", Value: 2}})
+	ensure.DeepEqual(t, doc["code"], unauthorizedCode)
+	ensure.DeepEqual(t, doc["errmsg"], "dvara: profile is not allowed through the proxy")
+	doc = roundTrip(bson.D{{Name: "profile", Value: -1}, {Name: "slowms", Value: 0}})
+	ensure.DeepEqual(t, doc["code"], unauthorizedCode)
+	ensure.DeepEqual(t, roundTrip(bson.D{{Name: "profile", Value: -1}}), bson.M{"ok": 1})
+
+	// A large command is read past the peeked prefix to check its parameters.
+	doc = roundTrip(bson.D{
+		{Name: "setParameter", Value: 1},
+		{Name: "logLevel", Value: 1},
+		{Name: "padding", Value: strings.Repeat("x", 2*maxCommandPeekLength)},
+	})
+	ensure.DeepEqual(t, doc["code"], unauthorizedCode)
+	ensure.DeepEqual(t, roundTrip(bson.D{
+		{Name: "setParameter", Value: 1},
+		{Name: "logLevel", Value: strings.Repeat("1", 2*maxCommandPeekLength)},
+	}), bson.M{"ok": 1})
+	ensure.DeepEqual(t, roundTrip(bson.D{{Name: "ping", Value: 1}}), bson.M{"ok": 1})
+
+	mutex.Lock()
+	ensure.DeepEqual(t, received, []string{"profile", "setParameter", "ping"})
+	mutex.Unlock()
+}
@@ -0,0 +1,159 @@
+package dvara
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// adminCommands are the commands which may only be run against the admin
+// database.
+var adminCommands = []string{
+	"currentOp",
+	"fsync",
+	"getCmdLineOpts",
+	"getParameter",
+	"listDatabases",
+	"logRotate",
+	"renameCollection",
+	"replSetFreeze",
+	"replSetGetStatus",
+	"replSetReconfig",
+	"replSetStepDown",
+	"setParameter",
+	"shutdown",
+}
+
+// cursorCommands are the commands which return a cursor.
+var cursorCommands = []string{
+	"aggregate",
+	"find",
+	"listCollections",
+	"listIndexes",
+}
+
+// CommandClass describes what a command does, as needed to restrict, route
+// and account for it.
+type CommandClass struct {
+	// Name is the command name as sent by the client.
+	Name string
+
+	// Namespace is the collection the command is on, for example
+	// "db.collection", or "db.$cmd" if it is not on a collection.
+	Namespace string
+
+	// Write is true for commands which mutate data or metadata, including
+	// aggregations writing their results with $out or $merge.
+	Write bool
+
+	// Admin is true for commands which may only be run against the admin
+	// database.
+	Admin bool
+
+	// Global is true for commands which change the behavior of the server for
+	// all its clients, and are only allowed as configured.
+	Global bool
+
+	// OpensCursor is true for commands which return a cursor, to be iterated
+	// with getMore on the same server.
+	OpensCursor bool
+
+	// ChangeStream is true for aggregations opening a change stream, whose
+	// cursor waits for new events like a tailable cursor.
+	ChangeStream bool
+
+	// RequiresPrimary is true for commands which must run on the primary
+	// whatever the read preference.
+	RequiresPrimary bool
+
+	// Session is true if the command carries a logical session id.
+	Session bool
+}
+
+// CommandClassifier classifies commands. The default classification covers
+// the standard commands, Custom allows classifying others or overriding it.
+type CommandClassifier struct {
+	// Custom if set is asked first, its class is used if it returns true.
+	Custom func(db string, cmd bson.D) (CommandClass, bool)
+}
+
+// Classify classifies a command sent against the given database. Commands
+// wrapped in $query are classified as is, like the server would see them
+// before unwrapping. A nil CommandClassifier uses the default classification.
+func (c *CommandClassifier) Classify(db string, cmd bson.D) CommandClass {
+	if c != nil && c.Custom != nil {
+		if class, ok := c.Custom(db, cmd); ok {
+			return class
+		}
+	}
+	return defaultClass(db, cmd)
+}
+
+// defaultClass classifies the standard commands.
+func defaultClass(db string, cmd bson.D) CommandClass {
+	if len(cmd) == 0 {
+		return CommandClass{}
+	}
+	name := cmd[0].Name
+	class := CommandClass{
+		Name:        name,
+		Write:       isWriteCommand(cmd),
+		Admin:       containsFold(adminCommands, name),
+		Global:      isGlobalCommand(name),
+		OpensCursor: containsFold(cursorCommands, name),
+	}
+	class.ChangeStream = strings.EqualFold(name, "aggregate") && opensChangeStream(cmd)
+	class.RequiresPrimary = class.Write || strings.EqualFold(name, "replSetReconfig") ||
+		strings.EqualFold(name, "replSetStepDown")
+	for _, e := range cmd[1:] {
+		if e.Name == "lsid" {
+			class.Session = true
+		}
+	}
+
+	if db == "" {
+		return class
+	}
+	class.Namespace = db + ".$cmd"
+	collection, ok := cmd[0].Value.(string)
+	if strings.EqualFold(name, "getMore") {
+		// The value of getMore is the cursor id, the collection has its own
+		// field.
+		for _, e := range cmd[1:] {
+			if e.Name == "collection" {
+				collection, ok = e.Value.(string)
+			}
+		}
+	}
+	if ok {
+		class.Namespace = db + "." + collection
+	}
+	return class
+}
+
+// opensChangeStream checks if the pipeline of an aggregate command starts with
+// a $changeStream stage.
+func opensChangeStream(cmd bson.D) bool {
+	for _, e := range cmd[1:] {
+		if e.Name != "pipeline" {
+			continue
+		}
+		stages, _ := e.Value.([]interface{})
+		if len(stages) == 0 {
+			return false
+		}
+		stage, _ := stages[0].(bson.D)
+		return len(stage) != 0 && stage[0].Name == "$changeStream"
+	}
+	return false
+}
+
+// containsFold checks if the list contains the name, ignoring case.
+func containsFold(list []string, name string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package dvara
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestClassify(t *testing.T) {
+	t.Parallel()
+	lsid := bson.DocElem{Name: "lsid", Value: bson.D{{Name: "id", Value: "x"}}}
+	cases := []struct {
+		Name     string
+		DB       string
+		Command  bson.D
+		Expected CommandClass
+	}{
+		{Name: "empty", DB: "test"},
+		{
+			Name:     "find",
+			DB:       "test",
+			Command:  bson.D{{Name: "find", Value: "foo"}},
+			Expected: CommandClass{Name: "find", Namespace: "test.foo", OpensCursor: true},
+		},
+		{
+			Name:     "find in a session",
+			DB:       "test",
+			Command:  bson.D{{Name: "find", Value: "foo"}, lsid},
+			Expected: CommandClass{Name: "find", Namespace: "test.foo", OpensCursor: true, Session: true},
+		},
+		{
+			Name:     "find without a database",
+			Command:  bson.D{{Name: "find", Value: "foo"}},
+			Expected: CommandClass{Name: "find", OpensCursor: true},
+		},
+		{
+			Name:     "count",
+			DB:       "test",
+			Command:  bson.D{{Name: "count", Value: "foo"}},
+			Expected: CommandClass{Name: "count", Namespace: "test.foo"},
+		},
+		{
+			Name: "aggregate",
+			DB:   "test",
+			Command: bson.D{
+				{Name: "aggregate", Value: "foo"},
+				{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$match", Value: bson.D{}}}}},
+			},
+			Expected: CommandClass{Name: "aggregate", Namespace: "test.foo", OpensCursor: true},
+		},
+		{
+			Name: "aggregate with $out",
+			DB:   "test",
+			Command: bson.D{
+				{Name: "aggregate", Value: "foo"},
+				{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$out", Value: "bar"}}}},
+			},
+			Expected: CommandClass{
+				Name:            "aggregate",
+				Namespace:       "test.foo",
+				Write:           true,
+				OpensCursor:     true,
+				RequiresPrimary: true,
+			},
+		},
+		{
+			Name: "change stream",
+			DB:   "test",
+			Command: bson.D{
+				{Name: "aggregate", Value: "foo"},
+				{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$changeStream", Value: bson.D{}}}}},
+			},
+			Expected: CommandClass{Name: "aggregate", Namespace: "test.foo", OpensCursor: true, ChangeStream: true},
+		},
+		{
+			Name:     "database aggregate",
+			DB:       "admin",
+			Command:  bson.D{{Name: "aggregate", Value: 1}},
+			Expected: CommandClass{Name: "aggregate", Namespace: "admin.$cmd", OpensCursor: true},
+		},
+		{
+			Name:     "getMore",
+			DB:       "test",
+			Command:  bson.D{{Name: "getMore", Value: int64(42)}, {Name: "collection", Value: "foo"}},
+			Expected: CommandClass{Name: "getMore", Namespace: "test.foo"},
+		},
+		{
+			Name:     "insert",
+			DB:       "test",
+			Command:  bson.D{{Name: "insert", Value: "foo"}, lsid},
+			Expected: CommandClass{Name: "insert", Namespace: "test.foo", Write: true, RequiresPrimary: true, Session: true},
+		},
+		{
+			Name:     "mixed case write",
+			DB:       "test",
+			Command:  bson.D{{Name: "findandmodify", Value: "foo"}},
+			Expected: CommandClass{Name: "findandmodify", Namespace: "test.foo", Write: true, RequiresPrimary: true},
+		},
+		{
+			Name:     "dropDatabase",
+			DB:       "test",
+			Command:  bson.D{{Name: "dropDatabase", Value: 1}},
+			Expected: CommandClass{Name: "dropDatabase", Namespace: "test.$cmd", Write: true, RequiresPrimary: true},
+		},
+		{
+			Name:    "renameCollection",
+			DB:      "admin",
+			Command: bson.D{{Name: "renameCollection", Value: "test.foo"}, {Name: "to", Value: "test.bar"}},
+			Expected: CommandClass{
+				Name:            "renameCollection",
+				Namespace:       "admin.test.foo",
+				Write:           true,
+				Admin:           true,
+				RequiresPrimary: true,
+			},
+		},
+		{
+			Name:     "listCollections",
+			DB:       "test",
+			Command:  bson.D{{Name: "listCollections", Value: 1}},
+			Expected: CommandClass{Name: "listCollections", Namespace: "test.$cmd", OpensCursor: true},
+		},
+		{
+			Name:     "listDatabases",
+			DB:       "admin",
+			Command:  bson.D{{Name: "listDatabases", Value: 1}},
+			Expected: CommandClass{Name: "listDatabases", Namespace: "admin.$cmd", Admin: true},
+		},
+		{
+			Name:     "replSetStepDown",
+			DB:       "admin",
+			Command:  bson.D{{Name: "replSetStepDown", Value: 60}},
+			Expected: CommandClass{Name: "replSetStepDown", Namespace: "admin.$cmd", Admin: true, RequiresPrimary: true},
+		},
+		{
+			Name:     "replSetGetStatus",
+			DB:       "admin",
+			Command:  bson.D{{Name: "replSetGetStatus", Value: 1}},
+			Expected: CommandClass{Name: "replSetGetStatus", Namespace: "admin.$cmd", Admin: true},
+		},
+		{
+			Name:     "setParameter",
+			DB:       "admin",
+			Command:  bson.D{{Name: "setParameter", Value: 1}, {Name: "logLevel", Value: 1}},
+			Expected: CommandClass{Name: "setParameter", Namespace: "admin.$cmd", Admin: true, Global: true},
+		},
+		{
+			Name:     "profile",
+			DB:       "test",
+			Command:  bson.D{{Name: "profile", Value: -1}},
+			Expected: CommandClass{Name: "profile", Namespace: "test.$cmd", Global: true},
+		},
+		{
+			Name:     "isMaster",
+			DB:       "admin",
+			Command:  bson.D{{Name: "isMaster", Value: 1}},
+			Expected: CommandClass{Name: "isMaster", Namespace: "admin.$cmd"},
+		},
+		{
+			Name:     "wrapped in $query",
+			DB:       "test",
+			Command:  bson.D{{Name: "$query", Value: bson.D{{Name: "insert", Value: "foo"}}}},
+			Expected: CommandClass{Name: "$query", Namespace: "test.$cmd"},
+		},
+	}
+	var classifier *CommandClassifier
+	for _, c := range cases {
+		ensure.DeepEqual(t, classifier.Classify(c.DB, c.Command), c.Expected, c.Name)
+	}
+}
+
+func TestClassifyCustom(t *testing.T) {
+	t.Parallel()
+	classifier := &CommandClassifier{
+		Custom: func(db string, cmd bson.D) (CommandClass, bool) {
+			if len(cmd) == 0 || cmd[0].Name != "purge" {
+				return CommandClass{}, false
+			}
+			return CommandClass{Name: "purge", Namespace: db + ".$cmd", Write: true, RequiresPrimary: true}, true
+		},
+	}
+	ensure.DeepEqual(t,
+		classifier.Classify("test", bson.D{{Name: "purge", Value: 1}}),
+		CommandClass{Name: "purge", Namespace: "test.$cmd", Write: true, RequiresPrimary: true},
+	)
+	ensure.DeepEqual(t,
+		classifier.Classify("test", bson.D{{Name: "find", Value: "foo"}}),
+		CommandClass{Name: "find", Namespace: "test.foo", OpensCursor: true},
+	)
+
+	// Custom write commands are rejected on read only listeners like the
+	// standard ones.
+	h, body := fakeOpMsg(0, bson.D{{Name: "purge", Value: 1}, {Name: "$db", Value: "test"}})
+	op := TracedOperation{OpCode: h.OpCode}
+	op.describe(body, classifier)
+	ensure.True(t, op.Write)
+	ensure.False(t, (&ListenerOverride{ReadOnly: true}).writeAllowed(&op))
+}
@@ -1,16 +1,60 @@
 package main
 
-import "log"
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
 
 // stdLogger provides a logger backed by the standard library logger. This is a
 // placeholder until we can open source our logger.
-type stdLogger struct{}
+type stdLogger struct {
+	// JSON if true writes one JSON object per line with the time, level and
+	// message instead of plain text.
+	JSON bool
 
-func (l *stdLogger) Error(args ...interface{})                 { log.Print(args...) }
-func (l *stdLogger) Errorf(format string, args ...interface{}) { log.Printf(format, args...) }
-func (l *stdLogger) Warn(args ...interface{})                  { log.Print(args...) }
-func (l *stdLogger) Warnf(format string, args ...interface{})  { log.Printf(format, args...) }
-func (l *stdLogger) Info(args ...interface{})                  { log.Print(args...) }
-func (l *stdLogger) Infof(format string, args ...interface{})  { log.Printf(format, args...) }
-func (l *stdLogger) Debug(args ...interface{})                 { log.Print(args...) }
-func (l *stdLogger) Debugf(format string, args ...interface{}) { log.Printf(format, args...) }
+	mutex sync.Mutex
+}
+
+func (l *stdLogger) Error(args ...interface{})                 { l.print("error", args...) }
+func (l *stdLogger) Errorf(format string, args ...interface{}) { l.printf("error", format, args...) }
+func (l *stdLogger) Warn(args ...interface{})                  { l.print("warn", args...) }
+func (l *stdLogger) Warnf(format string, args ...interface{})  { l.printf("warn", format, args...) }
+func (l *stdLogger) Info(args ...interface{})                  { l.print("info", args...) }
+func (l *stdLogger) Infof(format string, args ...interface{})  { l.printf("info", format, args...) }
+func (l *stdLogger) Debug(args ...interface{})                 { l.print("debug", args...) }
+func (l *stdLogger) Debugf(format string, args ...interface{}) { l.printf("debug", format, args...) }
+
+func (l *stdLogger) print(level string, args ...interface{}) {
+	l.output(level, fmt.Sprint(args...))
+}
+
+func (l *stdLogger) printf(level, format string, args ...interface{}) {
+	l.output(level, fmt.Sprintf(format, args...))
+}
+
+func (l *stdLogger) output(level, msg string) {
+	if !l.JSON {
+		log.Print(msg)
+		return
+	}
+	b, err := json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		Level   string    `json:"level"`
+		Message string    `json:"msg"`
+	}{
+		Time:    time.Now(),
+		Level:   level,
+		Message: msg,
+	})
+	if err != nil {
+		log.Print(msg)
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	os.Stderr.Write(append(b, '\n'))
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/facebookgo/dvara"
@@ -24,14 +26,72 @@ func main() {
 func Main() error {
 	messageTimeout := flag.Duration("message_timeout", 2*time.Minute, "timeout for one message to be proxied")
 	clientIdleTimeout := flag.Duration("client_idle_timeout", 60*time.Minute, "idle timeout for client connections")
+	saslReplayWindow := flag.Duration("sasl_replay_window", 0, "if non zero the time SCRAM client nonces are remembered, rejecting a saslStart which replays one")
+	clientWriteTimeout := flag.Duration("client_write_timeout", 0, "if non zero the time a client may stop reading a reply before it is disconnected")
+	clientHeaderTimeout := flag.Duration("client_header_timeout", 0, "if non zero the time clients have to finish sending a message header once started")
 	serverIdleTimeout := flag.Duration("server_idle_timeout", 1*time.Hour, "idle timeout for  server connections")
+	serverIdleStatsInterval := flag.Duration("server_idle_stats_interval", 0, "if non zero how often the number of idle server connections is reported")
 	serverClosePoolSize := flag.Uint("server_close_pool_size", 100, "number of goroutines that will handle closing server connections")
 	getLastErrorTimeout := flag.Duration("get_last_error_timeout", time.Minute, "timeout for getLastError pinning")
 	maxPerClientConnections := flag.Uint("max_per_client_connections", 100, "maximum number of connections per client")
 	maxConnections := flag.Uint("max_connections", 100, "maximum number of connections per mongo")
+	maxQueueDepth := flag.Uint("max_queue_depth", 0, "if non zero maximum number of requests waiting for a connection to a mongo once max_connections are in use")
+	prewarmConnections := flag.Uint("prewarm_connections", 0, "number of connections established to each mongo when it is proxied, before clients need them")
+	maxGlobalConnections := flag.Uint("max_global_connections", 0, "if non zero the maximum number of client connections across all mongos")
 	portStart := flag.Int("port_start", 6000, "start of port range")
 	portEnd := flag.Int("port_end", 6010, "end of port range")
+	maxListeners := flag.Int("max_listeners", 0, "if non zero the maximum number of members proxied")
+	collapseAliases := flag.Bool("collapse_aliases", false, "if true members whose host names resolve to the same address share a single proxy port")
+	lazyListeners := flag.Bool("lazy_listeners", false, "if true members other than the primary are only proxied once advertised to a client")
 	addrs := flag.String("addrs", "localhost:27017", "comma separated list of mongo addresses")
+	maxConcurrentDials := flag.Uint("max_concurrent_dials", 0, "if non zero the maximum number of mongo connections being established at once")
+	blankUnmappedPrimary := flag.Bool("blank_unmapped_primary", false, "if true isMaster responses with a primary that is not proxied are sent without a primary rather than closing the connection")
+	emptyHosts := flag.String("empty_hosts", "serve", "what to do when none of the hosts in an isMaster response are proxied: serve the empty list, close the connection, or serve the last_known list")
+	connectedMe := flag.Bool("connected_me", false, "if true isMaster responses report the address of the proxy the client connected to as me")
+	debugBackendAddrs := flag.Bool("debug_backend_addrs", false, "if true isMaster and replSetGetStatus responses include the member address behind each proxy address, for troubleshooting only")
+	stripArbiters := flag.Bool("strip_arbiters", false, "if true arbiters are removed from isMaster and serverStatus responses rather than mapped")
+	dnsCacheTTL := flag.Duration("dns_cache_ttl", 0, "if non zero mongo host name resolutions are cached for this long")
+	auditLog := flag.String("audit_log", "", "if set mutations are audited to this file")
+	auditAllCommands := flag.Bool("audit_all_commands", false, "if true all operations are audited rather than just mutations")
+	advertiseVersion := flag.String("advertise_version", "", "if set buildInfo reports this version when the server version is higher")
+	advertiseMaxWireVersion := flag.Int("advertise_max_wire_version", 0, "if non zero isMaster reports this maxWireVersion when the server one is higher")
+	healthAddr := flag.String("health_addr", "", "if set the health endpoint, and the effective configuration under /config and the last discovered topology under /topology, are served on this address")
+	drainPeriod := flag.Duration("drain_period", 0, "how long at most to wait for clients to leave, reporting draining on the health endpoint, before stopping")
+	pinPrimaryClients := flag.String("pin_primary_clients", "", "comma separated list of client IPs or CIDR ranges whose operations always go to the primary")
+	pinPrimaryAppNames := flag.String("pin_primary_app_names", "", "comma separated list of client application names whose operations always go to the primary")
+	quietClients := flag.String("quiet_clients", "", "comma separated list of client IPs or CIDR ranges, such as load balancer health checks, whose connections are not logged")
+	clientBandwidth := flag.Uint("client_bandwidth", 0, "if set maximum bytes per second sent to each client connection")
+	clientBandwidthBurst := flag.Uint("client_bandwidth_burst", 64*1024, "maximum bytes sent to a client connection at once when client_bandwidth is set")
+	clientByteQuota := flag.Uint("client_byte_quota", 0, "if non zero maximum bytes a client connection may send and receive before it is closed")
+	readOnlyListeners := flag.String("read_only_listeners", "", "comma separated list of listener ports or member roles, such as SECONDARY, on which writes are rejected")
+	maxNamespaces := flag.Uint("max_namespaces", 0, "if non zero maximum number of distinct collections a client connection may use")
+	allowedDatabases := flag.String("allowed_databases", "", "if set comma separated list of databases clients are restricted to")
+	uri := flag.String("uri", "", "if set a mongodb:// connection string used instead of addrs")
+	statsdAddr := flag.String("statsd_addr", "", "if set stats will be sent to this StatsD address")
+	maxReplyBatch := flag.Int("max_reply_batch", 0, "if non zero the maximum number of documents relayed in a cursor batch reply, the rest are held back for the next getMore")
+	maxHeldReplyBytes := flag.Int64("max_held_reply_bytes", dvara.DefaultMaxHeldBytes, "the maximum bytes of documents held back by max_reply_batch across all clients, batches over it are answered with an error")
+	maxBatchSize := flag.Int("max_batch_size", 0, "if non zero the maximum number of documents returned in a cursor batch for find, aggregate and getMore commands and legacy queries")
+	shadowAddr := flag.String("shadow_addr", "", "if set a sample of the reads is mirrored to this mongo server, discarding its replies")
+	shadowRate := flag.Float64("shadow_rate", 0, "the fraction of the reads mirrored to shadow_addr, between 0 and 1")
+	queryMaxTime := flag.Duration("query_max_time", 0, "if non zero the maximum time queries are allowed to run on the server")
+	coalesceIsMaster := flag.Bool("coalesce_ismaster", false, "if true concurrent identical isMaster requests share a single server round trip")
+	tcpDelay := flag.Bool("tcp_delay", false, "if true Nagle's algorithm is enabled on client and server connections")
+	writeBufferSize := flag.Int("write_buffer_size", 0, "if non zero the socket write buffer size of client and server connections")
+	allowShutdown := flag.String("allow_shutdown", "", "comma separated list of mongo addresses to which the shutdown command is forwarded, it is rejected for all others")
+	allowProfile := flag.Bool("allow_profile", false, "if true clients may change the profiling level of the servers")
+	allowedParameters := flag.String("allowed_parameters", "", "comma separated list of server parameters clients may change with setParameter")
+	localCommands := flag.Bool("local_commands", false, "if true ping and whatsmyuri are answered without a server round trip")
+	introspection := flag.Bool("introspection", false, "if true the dvara database answers with the state of the proxy")
+	logFormat := flag.String("log_format", "text", "log format, text or json")
+	rederiveClientRoles := flag.Bool("rederive_client_roles", false, "if true client connections are counted under the current role of their member rather than the role when opened")
+	memberGracePeriod := flag.Duration("member_grace_period", 0, "how long an unhealthy member is kept before it is dropped")
+	startupTimeout := flag.Duration("startup_timeout", 0, "if non zero how long to keep retrying the initial discovery of the replica set before giving up")
+	awaitDataTimeout := flag.Duration("await_data_timeout", 10*time.Minute, "timeout for a getMore on a tailable cursor opened with AwaitData or a change stream, overriding message_timeout as the server holds it until new data arrives")
+	databasePools := flag.String("database_pools", "", "comma separated list of database=connections pairs giving those databases a pool of their own of at most that many connections to each mongo node, like tenant=20")
+	commandTimeouts := flag.String("command_timeouts", "", "comma separated list of command=duration pairs overriding message_timeout for those commands, like aggregate=10m")
+	instabilityThreshold := flag.Uint("instability_threshold", 0, "if non zero the number of replica set changes within instability_window above which new clients are held until it settles")
+	instabilityWindow := flag.Duration("instability_window", 10*time.Second, "window over which replica set changes are counted, and the longest a new client is held")
+	instabilityMaxQueued := flag.Uint("instability_max_queued", 0, "if non zero the most new clients held while the replica set is unstable, further ones are told to retry")
 
 	flag.Parse()
 
@@ -39,22 +99,150 @@ func Main() error {
 		Addrs:                   *addrs,
 		PortStart:               *portStart,
 		PortEnd:                 *portEnd,
+		MaxListeners:            *maxListeners,
+		LazyListeners:           *lazyListeners,
+		CollapseAliases:         *collapseAliases,
 		MessageTimeout:          *messageTimeout,
+		AwaitDataTimeout:        *awaitDataTimeout,
 		ClientIdleTimeout:       *clientIdleTimeout,
+		ClientHeaderTimeout:     *clientHeaderTimeout,
+		ClientWriteTimeout:      *clientWriteTimeout,
+		SASLReplayWindow:        *saslReplayWindow,
 		ServerIdleTimeout:       *serverIdleTimeout,
+		ServerIdleStatsInterval: *serverIdleStatsInterval,
 		ServerClosePoolSize:     *serverClosePoolSize,
 		GetLastErrorTimeout:     *getLastErrorTimeout,
 		MaxConnections:          *maxConnections,
+		MaxQueueDepth:           *maxQueueDepth,
+		PrewarmConnections:      *prewarmConnections,
 		MaxPerClientConnections: *maxPerClientConnections,
+		MemberGracePeriod:       *memberGracePeriod,
+		StartupTimeout:          *startupTimeout,
+		InstabilityThreshold:    *instabilityThreshold,
+		InstabilityWindow:       *instabilityWindow,
+		InstabilityMaxQueued:    *instabilityMaxQueued,
+		RederiveClientRoles:     *rederiveClientRoles,
+		AuditAllCommands:        *auditAllCommands,
+		ClientBandwidth:         *clientBandwidth,
+		ClientBandwidthBurst:    *clientBandwidthBurst,
+		ClientByteQuota:         *clientByteQuota,
+		LocalCommands:           *localCommands,
+		MaxNamespaces:           *maxNamespaces,
+		Introspection:           *introspection,
+		AllowProfile:            *allowProfile,
+		TCPDelay:                *tcpDelay,
+		WriteBufferSize:         *writeBufferSize,
+	}
+	replicaSet.AllowedDatabases = splitList(*allowedDatabases)
+	replicaSet.QuietClients = splitList(*quietClients)
+	replicaSet.AllowShutdown = splitList(*allowShutdown)
+	replicaSet.AllowedParameters = splitList(*allowedParameters)
+	for _, pair := range splitList(*commandTimeouts) {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid command timeout %q, expected command=duration", pair)
+		}
+		timeout, err := time.ParseDuration(pair[i+1:])
+		if err != nil {
+			return fmt.Errorf("invalid command timeout %q: %s", pair, err)
+		}
+		if replicaSet.CommandTimeouts == nil {
+			replicaSet.CommandTimeouts = make(map[string]time.Duration)
+		}
+		replicaSet.CommandTimeouts[pair[:i]] = timeout
+	}
+	for _, pair := range splitList(*databasePools) {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid database pool %q, expected database=connections", pair)
+		}
+		max, err := strconv.ParseUint(pair[i+1:], 10, 0)
+		if err != nil || max == 0 {
+			return fmt.Errorf("invalid database pool %q: expected a positive number of connections", pair)
+		}
+		if replicaSet.DatabasePools == nil {
+			replicaSet.DatabasePools = make(map[string]uint)
+		}
+		replicaSet.DatabasePools[pair[:i]] = uint(max)
+	}
+	for _, l := range splitList(*readOnlyListeners) {
+		if replicaSet.ListenerOverrides == nil {
+			replicaSet.ListenerOverrides = make(map[string]*dvara.ListenerOverride)
+		}
+		replicaSet.ListenerOverrides[l] = &dvara.ListenerOverride{ReadOnly: true}
+	}
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		replicaSet.AuditSink = &dvara.JSONAuditSink{Writer: f}
+	}
+	if *uri != "" {
+		if err := replicaSet.ApplyConnectionString(*uri); err != nil {
+			return err
+		}
+	}
+
+	var statsClient stats.Client = &stats.HookClient{}
+	if *statsdAddr != "" {
+		statsClient = &dvara.StatsDClient{Addr: *statsdAddr}
 	}
 
-	var statsClient stats.HookClient
 	var log stdLogger
+	switch *logFormat {
+	default:
+		return fmt.Errorf("unknown log format %q", *logFormat)
+	case "text":
+	case "json":
+		log.JSON = true
+	}
+	var emptyHostsPolicy dvara.EmptyHostsPolicy
+	switch *emptyHosts {
+	default:
+		return fmt.Errorf("unknown empty hosts policy %q", *emptyHosts)
+	case "serve":
+		emptyHostsPolicy = dvara.EmptyHostsServe
+	case "close":
+		emptyHostsPolicy = dvara.EmptyHostsClose
+	case "last_known":
+		emptyHostsPolicy = dvara.EmptyHostsLastKnown
+	}
+
 	var graph inject.Graph
 	err := graph.Provide(
-		&inject.Object{Value: &log},
+		&inject.Object{Value: dvara.NewSafeLogger(&log, statsClient)},
 		&inject.Object{Value: &replicaSet},
-		&inject.Object{Value: &statsClient},
+		&inject.Object{Value: statsClient},
+		&inject.Object{Value: &dvara.MaxTimeMSRewriter{Max: *queryMaxTime}},
+		&inject.Object{Value: &dvara.BatchSizeRewriter{Max: int32(*maxBatchSize)}},
+		&inject.Object{Value: &dvara.ReplyBatchLimiter{
+			Max:          *maxReplyBatch,
+			MaxHeldBytes: *maxHeldReplyBytes,
+		}},
+		&inject.Object{Value: &dvara.ConnectionLimiter{Max: *maxGlobalConnections}},
+		&inject.Object{Value: &dvara.DialLimiter{Max: *maxConcurrentDials}},
+		&inject.Object{Value: &dvara.DNSCache{TTL: *dnsCacheTTL}},
+		&inject.Object{Value: &dvara.Shadow{Addr: *shadowAddr, Rate: *shadowRate}},
+		&inject.Object{Value: &dvara.IsMasterResponseRewriter{
+			StripArbiters:        *stripArbiters,
+			BlankUnmappedPrimary: *blankUnmappedPrimary,
+			ConnectedMe:          *connectedMe,
+			DebugBackendAddrs:    *debugBackendAddrs,
+			EmptyHosts:           emptyHostsPolicy,
+		}},
+		&inject.Object{Value: &dvara.ReplSetGetStatusResponseRewriter{DebugBackendAddrs: *debugBackendAddrs}},
+		&inject.Object{Value: &dvara.ServerStatusResponseRewriter{StripArbiters: *stripArbiters}},
+		&inject.Object{Value: &dvara.IsMasterCoalescer{Coalesce: *coalesceIsMaster}},
+		&inject.Object{Value: &dvara.PrimaryPin{
+			Clients:  splitList(*pinPrimaryClients),
+			AppNames: splitList(*pinPrimaryAppNames),
+		}},
+		&inject.Object{Value: &dvara.BuildInfoVersionOverride{
+			Version:        *advertiseVersion,
+			MaxWireVersion: *advertiseMaxWireVersion,
+		}},
 	)
 	if err != nil {
 		return err
@@ -64,14 +252,34 @@ func Main() error {
 	}
 	objects := graph.Objects()
 
+	// The health endpoint is served before starting so it reports the replica
+	// set as not ready while it is being discovered. The effective
+	// configuration is served alongside it under /config.
+	if *healthAddr != "" {
+		l, err := net.Listen("tcp", *healthAddr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/", &dvara.HealthHandler{ReplicaSet: &replicaSet})
+		mux.Handle("/config", &dvara.ConfigHandler{ReplicaSet: &replicaSet})
+		mux.Handle("/topology", &dvara.TopologyHandler{ReplicaSet: &replicaSet})
+		go http.Serve(l, mux)
+	}
+
 	if err := startstop.Start(objects, &log); err != nil {
 		return err
 	}
 	defer startstop.Stop(objects, &log)
 
-	ch := make(chan os.Signal, 2)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
-	<-ch
-	signal.Stop(ch)
-	return nil
+	return replicaSet.DrainOnSignal(*drainPeriod)
+}
+
+// splitList splits a comma separated flag value, returning nil if it is empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
 }
@@ -0,0 +1,138 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+)
+
+// IsMasterCoalescer shares a single server round trip between concurrent
+// identical isMaster and hello requests to the same server. This limits the
+// load on the servers when many clients reconnect at once.
+type IsMasterCoalescer struct {
+	Log Logger `inject:""`
+
+	// Coalesce enables coalescing.
+	Coalesce bool
+
+	mutex sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is an in flight request whose rewritten reply is shared.
+type coalescedCall struct {
+	done    chan struct{}
+	waiters int
+	reply   []byte
+	err     error
+}
+
+// coalescedReply is the buffer a coalesced reply is rewritten into. It has the
+// local address of the client connection, since the rewritten reply may depend
+// on the listener the client connected to.
+type coalescedReply struct {
+	bytes.Buffer
+	localAddr net.Addr
+}
+
+// LocalAddr returns the local address of the client connection.
+func (r *coalescedReply) LocalAddr() net.Addr {
+	return r.localAddr
+}
+
+// coalesceKey returns the key identifying identical requests to the same
+// server from clients of the same listener, or false if the server address is
+// unknown.
+func coalesceKey(server io.ReadWriter, request [][]byte, localAddr net.Addr) (string, bool) {
+	c, ok := server.(net.Conn)
+	if !ok || c.RemoteAddr() == nil {
+		return "", false
+	}
+	var key bytes.Buffer
+	key.WriteString(c.RemoteAddr().String())
+	if localAddr != nil {
+		key.WriteString(localAddr.String())
+	}
+	// Skip the header, the request id is different for every request.
+	for _, b := range request[1:] {
+		key.Write(b)
+	}
+	return key.String(), true
+}
+
+// Proxy sends the request to the server unless an identical one is already in
+// flight, and writes the rewritten reply to the client. The request must be
+// complete, including the header.
+func (c *IsMasterCoalescer) Proxy(
+	h *messageHeader,
+	request [][]byte,
+	client io.Writer,
+	server io.ReadWriter,
+	rewriter responseRewriter,
+) error {
+
+	var localAddr net.Addr
+	if c, ok := client.(localAddrer); ok {
+		localAddr = c.LocalAddr()
+	}
+	key, ok := coalesceKey(server, request, localAddr)
+	if !ok {
+		return c.roundTrip(request, client, server, rewriter)
+	}
+
+	c.mutex.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.mutex.Unlock()
+		<-call.done
+		if call.err != nil {
+			return call.err
+		}
+		c.Log.Debugf("coalesced %s", h)
+		// The reply is the same but for the request it responds to.
+		reply := append([]byte(nil), call.reply...)
+		setInt32(reply, 8, h.RequestID)
+		_, err := client.Write(reply)
+		return err
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	if c.calls == nil {
+		c.calls = make(map[string]*coalescedCall)
+	}
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	reply := coalescedReply{localAddr: localAddr}
+	call.err = c.roundTrip(request, &reply, server, rewriter)
+	if call.err == nil && reply.Len() < headerLen {
+		call.err = io.ErrUnexpectedEOF
+	}
+	call.reply = reply.Bytes()
+	c.mutex.Lock()
+	delete(c.calls, key)
+	c.mutex.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return call.err
+	}
+	_, err := client.Write(call.reply)
+	return err
+}
+
+func (c *IsMasterCoalescer) roundTrip(
+	request [][]byte,
+	client io.Writer,
+	server io.ReadWriter,
+	rewriter responseRewriter,
+) error {
+
+	for _, b := range request {
+		if _, err := server.Write(b); err != nil {
+			c.Log.Error(err)
+			return err
+		}
+	}
+	return rewriter.Rewrite(client, server)
+}
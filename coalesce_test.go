@@ -0,0 +1,109 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeServerConn echoes what is written to it.
+type fakeServerConn struct {
+	net.Conn
+	addr net.Addr
+	buf  bytes.Buffer
+}
+
+func (c *fakeServerConn) RemoteAddr() net.Addr        { return c.addr }
+func (c *fakeServerConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+func (c *fakeServerConn) Read(b []byte) (int, error)  { return c.buf.Read(b) }
+
+type blockingRewriter struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (r *blockingRewriter) Rewrite(client io.Writer, server io.Reader) error {
+	atomic.AddInt32(&r.calls, 1)
+	<-r.release
+	h, err := readHeader(server)
+	if err != nil {
+		return err
+	}
+	reply, err := newReply(h, 0, bson.M{"ismaster": true})
+	if err != nil {
+		return err
+	}
+	_, err = client.Write(reply)
+	return err
+}
+
+func TestIsMasterCoalescer(t *testing.T) {
+	t.Parallel()
+	const n = 10
+	c := &IsMasterCoalescer{Log: &tLogger{TB: t}, Coalesce: true}
+	server := &fakeServerConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 27017}}
+	rewriter := &blockingRewriter{release: make(chan struct{})}
+
+	var wg sync.WaitGroup
+	replies := make([]bytes.Buffer, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h, body := fakeQuery("admin.$cmd", bson.D{{Name: "isMaster", Value: 1}})
+			h.RequestID = int32(i + 1)
+			err := c.Proxy(h, [][]byte{h.ToWire(), body}, &replies[i], server, rewriter)
+			ensure.Nil(t, err)
+		}(i)
+	}
+
+	// Wait for everyone to be waiting on the first request.
+	for {
+		c.mutex.Lock()
+		waiters := 0
+		for _, call := range c.calls {
+			waiters = call.waiters
+		}
+		c.mutex.Unlock()
+		if waiters == n-1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(rewriter.release)
+	wg.Wait()
+
+	ensure.DeepEqual(t, atomic.LoadInt32(&rewriter.calls), int32(1))
+	for i := range replies {
+		h, err := readHeader(&replies[i])
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, h.ResponseTo, int32(i+1))
+		var doc bson.M
+		_, err = io.CopyN(ioutil.Discard, &replies[i], int64(len(emptyPrefix)))
+		ensure.Nil(t, err)
+		ensure.Nil(t, bson.Unmarshal(replies[i].Bytes(), &doc))
+		ensure.DeepEqual(t, doc, bson.M{"ismaster": true})
+	}
+	ensure.DeepEqual(t, len(c.calls), 0)
+}
+
+func TestIsMasterCoalescerUnknownServer(t *testing.T) {
+	t.Parallel()
+	c := &IsMasterCoalescer{Log: &tLogger{TB: t}, Coalesce: true}
+	rewriter := &blockingRewriter{release: make(chan struct{})}
+	close(rewriter.release)
+	var server bytes.Buffer
+	var clientOut bytes.Buffer
+	h, body := fakeQuery("admin.$cmd", bson.D{{Name: "isMaster", Value: 1}})
+	ensure.Nil(t, c.Proxy(h, [][]byte{h.ToWire(), body}, &clientOut, &server, rewriter))
+	ensure.DeepEqual(t, atomic.LoadInt32(&rewriter.calls), int32(1))
+	ensure.True(t, clientOut.Len() > 0)
+}
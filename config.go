@@ -0,0 +1,214 @@
+package dvara
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// redacted replaces secrets in EffectiveConfig.
+const redacted = "REDACTED"
+
+// EffectiveConfig is a snapshot of the configuration in force, with defaults
+// applied and secrets redacted. Durations are formatted as strings.
+type EffectiveConfig struct {
+	Name  string   `json:"name"`
+	Addrs []string `json:"addrs"`
+
+	PortStart       int  `json:"portStart"`
+	PortEnd         int  `json:"portEnd"`
+	MaxListeners    int  `json:"maxListeners"`
+	LazyListeners   bool `json:"lazyListeners"`
+	CollapseAliases bool `json:"collapseAliases"`
+
+	MaxConnections          uint  `json:"maxConnections"`
+	MaxQueueDepth           uint  `json:"maxQueueDepth"`
+	MinIdleConnections      uint  `json:"minIdleConnections"`
+	PrewarmConnections      uint  `json:"prewarmConnections"`
+	ServerClosePoolSize     uint  `json:"serverClosePoolSize"`
+	MaxPerClientConnections uint  `json:"maxPerClientConnections"`
+	MaxGlobalConnections    uint  `json:"maxGlobalConnections"`
+	MaxConcurrentDials      uint  `json:"maxConcurrentDials"`
+	ClientBandwidth         uint  `json:"clientBandwidth"`
+	ClientBandwidthBurst    uint  `json:"clientBandwidthBurst"`
+	ClientByteQuota         uint  `json:"clientByteQuota"`
+	MaxNamespaces           uint  `json:"maxNamespaces"`
+	MaxBatchSize            int32 `json:"maxBatchSize"`
+	MaxReplyBatch           int   `json:"maxReplyBatch"`
+	MaxHeldReplyBytes       int64 `json:"maxHeldReplyBytes"`
+	TCPDelay                bool  `json:"tcpDelay"`
+	WriteBufferSize         int   `json:"writeBufferSize"`
+
+	ServerIdleTimeout       string            `json:"serverIdleTimeout"`
+	ServerIdleStatsInterval string            `json:"serverIdleStatsInterval"`
+	ClientIdleTimeout       string            `json:"clientIdleTimeout"`
+	ClientHeaderTimeout     string            `json:"clientHeaderTimeout"`
+	ClientWriteTimeout      string            `json:"clientWriteTimeout"`
+	SASLReplayWindow        string            `json:"saslReplayWindow"`
+	GetLastErrorTimeout     string            `json:"getLastErrorTimeout"`
+	ConnectTimeout          string            `json:"connectTimeout"`
+	MessageTimeout          string            `json:"messageTimeout"`
+	CommandTimeouts         map[string]string `json:"commandTimeouts"`
+	AwaitDataTimeout        string            `json:"awaitDataTimeout"`
+	DatabasePools           map[string]uint   `json:"databasePools"`
+	QueryMaxTime            string            `json:"queryMaxTime"`
+	MemberGracePeriod       string            `json:"memberGracePeriod"`
+	StartupTimeout          string            `json:"startupTimeout"`
+	DNSCacheTTL             string            `json:"dnsCacheTTL"`
+
+	InstabilityThreshold uint   `json:"instabilityThreshold"`
+	InstabilityWindow    string `json:"instabilityWindow"`
+	InstabilityMaxQueued uint   `json:"instabilityMaxQueued"`
+
+	LocalCommands        bool                         `json:"localCommands"`
+	Introspection        bool                         `json:"introspection"`
+	AllowShutdown        []string                     `json:"allowShutdown"`
+	AllowProfile         bool                         `json:"allowProfile"`
+	AllowedParameters    []string                     `json:"allowedParameters"`
+	AllowedDatabases     []string                     `json:"allowedDatabases"`
+	AllowedAdminCommands []string                     `json:"allowedAdminCommands"`
+	ListenerOverrides    map[string]*ListenerOverride `json:"listenerOverrides"`
+	PinPrimaryClients    []string                     `json:"pinPrimaryClients"`
+	PinPrimaryAppNames   []string                     `json:"pinPrimaryAppNames"`
+	RederiveClientRoles  bool                         `json:"rederiveClientRoles"`
+	QuietClients         []string                     `json:"quietClients"`
+	CloseReasonMessages  map[CloseReason]string       `json:"closeReasonMessages"`
+
+	ShadowAddr string  `json:"shadowAddr"`
+	ShadowRate float64 `json:"shadowRate"`
+
+	Tracing          bool `json:"tracing"`
+	Audit            bool `json:"audit"`
+	AuditAllCommands bool `json:"auditAllCommands"`
+}
+
+// EffectiveConfig returns a snapshot of the configuration in force. Seed
+// addresses carrying credentials have them redacted.
+func (r *ReplicaSet) EffectiveConfig() EffectiveConfig {
+	c := EffectiveConfig{
+		Name:                    r.Name,
+		PortStart:               r.PortStart,
+		PortEnd:                 r.PortEnd,
+		MaxListeners:            r.MaxListeners,
+		LazyListeners:           r.LazyListeners,
+		CollapseAliases:         r.CollapseAliases,
+		MaxConnections:          r.MaxConnections,
+		MaxQueueDepth:           r.MaxQueueDepth,
+		MinIdleConnections:      r.MinIdleConnections,
+		PrewarmConnections:      r.PrewarmConnections,
+		ServerClosePoolSize:     r.ServerClosePoolSize,
+		MaxPerClientConnections: r.MaxPerClientConnections,
+		ClientBandwidth:         r.ClientBandwidth,
+		ClientBandwidthBurst:    r.ClientBandwidthBurst,
+		ClientByteQuota:         r.ClientByteQuota,
+		MaxNamespaces:           r.MaxNamespaces,
+		TCPDelay:                r.TCPDelay,
+		WriteBufferSize:         r.WriteBufferSize,
+		ServerIdleTimeout:       r.ServerIdleTimeout.String(),
+		ServerIdleStatsInterval: r.ServerIdleStatsInterval.String(),
+		ClientIdleTimeout:       r.ClientIdleTimeout.String(),
+		ClientHeaderTimeout:     r.ClientHeaderTimeout.String(),
+		ClientWriteTimeout:      r.ClientWriteTimeout.String(),
+		SASLReplayWindow:        r.SASLReplayWindow.String(),
+		GetLastErrorTimeout:     r.GetLastErrorTimeout.String(),
+		ConnectTimeout:          r.ConnectTimeout.String(),
+		MessageTimeout:          r.MessageTimeout.String(),
+		CommandTimeouts:         make(map[string]string, len(r.CommandTimeouts)),
+		AwaitDataTimeout:        r.AwaitDataTimeout.String(),
+		DatabasePools:           r.DatabasePools,
+		MemberGracePeriod:       r.MemberGracePeriod.String(),
+		StartupTimeout:          r.StartupTimeout.String(),
+		QueryMaxTime:            time.Duration(0).String(),
+		DNSCacheTTL:             time.Duration(0).String(),
+		InstabilityThreshold:    r.InstabilityThreshold,
+		InstabilityWindow:       r.InstabilityWindow.String(),
+		InstabilityMaxQueued:    r.InstabilityMaxQueued,
+		LocalCommands:           r.LocalCommands,
+		Introspection:           r.Introspection,
+		AllowShutdown:           r.AllowShutdown,
+		AllowProfile:            r.AllowProfile,
+		AllowedParameters:       r.AllowedParameters,
+		AllowedDatabases:        r.AllowedDatabases,
+		AllowedAdminCommands:    r.AllowedAdminCommands,
+		ListenerOverrides:       r.ListenerOverrides,
+		RederiveClientRoles:     r.RederiveClientRoles,
+		QuietClients:            r.QuietClients,
+		CloseReasonMessages:     make(map[CloseReason]string, len(DefaultCloseReasonMessages)),
+		Tracing:                 r.Tracer != nil,
+		Audit:                   r.AuditSink != nil,
+		AuditAllCommands:        r.AuditAllCommands,
+	}
+	if r.Addrs != "" {
+		for _, addr := range strings.Split(r.Addrs, ",") {
+			c.Addrs = append(c.Addrs, redactAddr(addr))
+		}
+	}
+	for command, timeout := range r.CommandTimeouts {
+		c.CommandTimeouts[command] = timeout.String()
+	}
+	if c.AllowedAdminCommands == nil {
+		c.AllowedAdminCommands = DefaultAllowedAdminCommands
+	}
+	for reason, msg := range DefaultCloseReasonMessages {
+		c.CloseReasonMessages[reason] = msg
+	}
+	for reason, msg := range r.CloseReasonMessages {
+		c.CloseReasonMessages[reason] = msg
+	}
+	if r.ConnectionLimiter != nil {
+		c.MaxGlobalConnections = r.ConnectionLimiter.Max
+	}
+	if r.DialLimiter != nil {
+		c.MaxConcurrentDials = r.DialLimiter.Max
+	}
+	if r.DNSCache != nil {
+		c.DNSCacheTTL = r.DNSCache.TTL.String()
+	}
+	if r.PrimaryPin != nil {
+		c.PinPrimaryClients = r.PrimaryPin.Clients
+		c.PinPrimaryAppNames = r.PrimaryPin.AppNames
+	}
+	if r.Shadow != nil {
+		c.ShadowAddr = r.Shadow.Addr
+		c.ShadowRate = r.Shadow.Rate
+	}
+	if r.ProxyMsg != nil {
+		if r.ProxyMsg.MaxTimeMSRewriter != nil {
+			c.QueryMaxTime = r.ProxyMsg.MaxTimeMSRewriter.Max.String()
+		}
+		if r.ProxyMsg.BatchSizeRewriter != nil {
+			c.MaxBatchSize = r.ProxyMsg.BatchSizeRewriter.Max
+		}
+		if r.ProxyMsg.ReplyBatchLimiter != nil {
+			c.MaxReplyBatch = r.ProxyMsg.ReplyBatchLimiter.Max
+			c.MaxHeldReplyBytes = r.ProxyMsg.ReplyBatchLimiter.maxHeldBytes()
+		}
+	}
+	return c
+}
+
+// redactAddr redacts the credentials of an address in the user:password@host
+// form.
+func redactAddr(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i != -1 {
+		return redacted + addr[i:]
+	}
+	return addr
+}
+
+// ConfigHandler serves the effective configuration of a ReplicaSet as JSON
+// over HTTP.
+type ConfigHandler struct {
+	ReplicaSet *ReplicaSet
+}
+
+func (h *ConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(h.ReplicaSet.EffectiveConfig(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,62 @@
+package dvara
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		Name:            "rs",
+		Addrs:           "a:1,admin:secret@b:2",
+		MaxConnections:  5,
+		MessageTimeout:  time.Minute,
+		CommandTimeouts: map[string]time.Duration{"aggregate": time.Hour},
+		CloseReasonMessages: map[CloseReason]string{
+			CloseReasonShutdown: "bye",
+		},
+		ConnectionLimiter: &ConnectionLimiter{Max: 100},
+		ProxyMsg: &ProxyMsg{
+			MaxTimeMSRewriter: &MaxTimeMSRewriter{Max: time.Second},
+			BatchSizeRewriter: &BatchSizeRewriter{Max: 10},
+			ReplyBatchLimiter: &ReplyBatchLimiter{Max: 20},
+		},
+	}
+	c := r.EffectiveConfig()
+	ensure.DeepEqual(t, c.Name, "rs")
+	ensure.DeepEqual(t, c.Addrs, []string{"a:1", "REDACTED@b:2"})
+	ensure.DeepEqual(t, c.MaxConnections, uint(5))
+	ensure.DeepEqual(t, c.MaxGlobalConnections, uint(100))
+	ensure.DeepEqual(t, c.MessageTimeout, "1m0s")
+	ensure.DeepEqual(t, c.ConnectTimeout, "0s")
+	ensure.DeepEqual(t, c.CommandTimeouts, map[string]string{"aggregate": "1h0m0s"})
+	ensure.DeepEqual(t, c.QueryMaxTime, "1s")
+	ensure.DeepEqual(t, c.MaxBatchSize, int32(10))
+	ensure.DeepEqual(t, c.MaxReplyBatch, 20)
+	ensure.DeepEqual(t, c.MaxHeldReplyBytes, int64(DefaultMaxHeldBytes))
+	ensure.DeepEqual(t, c.AllowedAdminCommands, DefaultAllowedAdminCommands)
+	ensure.DeepEqual(t, c.CloseReasonMessages[CloseReasonShutdown], "bye")
+	ensure.DeepEqual(t, c.CloseReasonMessages[CloseReasonServerBusy], DefaultCloseReasonMessages[CloseReasonServerBusy])
+	ensure.False(t, c.Tracing)
+}
+
+func TestConfigHandler(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{Addrs: "admin:secret@a:1", MessageTimeout: time.Second}
+	w := httptest.NewRecorder()
+	(&ConfigHandler{ReplicaSet: r}).ServeHTTP(w, httptest.NewRequest("GET", "/config", nil))
+	ensure.DeepEqual(t, w.Code, http.StatusOK)
+	ensure.False(t, strings.Contains(w.Body.String(), "secret"))
+
+	var c EffectiveConfig
+	ensure.Nil(t, json.Unmarshal(w.Body.Bytes(), &c))
+	ensure.DeepEqual(t, c.Addrs, []string{"REDACTED@a:1"})
+	ensure.DeepEqual(t, c.MessageTimeout, "1s")
+}
@@ -0,0 +1,117 @@
+package dvara
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	connectionStringScheme = "mongodb://"
+	defaultMongoPort       = "27017"
+)
+
+// ApplyConnectionString configures the ReplicaSet from a standard mongodb://
+// connection string. The hosts become the seed Addrs and the supported options
+// are mapped to the corresponding fields:
+//
+//	replicaSet       Name
+//	connectTimeoutMS ConnectTimeout
+//	socketTimeoutMS  MessageTimeout
+//	maxPoolSize      MaxConnections
+//
+// Options dvara cannot honor, like credentials, authSource or enabling TLS,
+// result in an error since clients authenticate through the proxy and dvara
+// speaks plain TCP to the servers.
+func (r *ReplicaSet) ApplyConnectionString(uri string) error {
+	if !strings.HasPrefix(uri, connectionStringScheme) {
+		return fmt.Errorf("dvara: connection string must start with %s: %s", connectionStringScheme, uri)
+	}
+	rest := uri[len(connectionStringScheme):]
+
+	var rawQuery string
+	if i := strings.Index(rest, "?"); i != -1 {
+		rest, rawQuery = rest[:i], rest[i+1:]
+	}
+	if i := strings.Index(rest, "/"); i != -1 {
+		rest = rest[:i]
+	}
+	if strings.Contains(rest, "@") {
+		return fmt.Errorf("dvara: connection string credentials are not supported, clients authenticate through the proxy")
+	}
+	if rest == "" {
+		return fmt.Errorf("dvara: connection string without hosts: %s", uri)
+	}
+
+	var addrs []string
+	for _, host := range strings.Split(rest, ",") {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			// IPv6 hosts are bracketed, JoinHostPort adds its own brackets.
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			host = net.JoinHostPort(host, defaultMongoPort)
+		}
+		addrs = append(addrs, host)
+	}
+
+	options, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return fmt.Errorf("dvara: invalid connection string options: %s", err)
+	}
+	// The options are only applied once all of them are known to be valid, so
+	// an error leaves the ReplicaSet as it was.
+	name := r.Name
+	connectTimeout := r.ConnectTimeout
+	messageTimeout := r.MessageTimeout
+	maxConnections := r.MaxConnections
+	for option, values := range options {
+		value := values[len(values)-1]
+		switch strings.ToLower(option) {
+		default:
+			return fmt.Errorf("dvara: unsupported connection string option %s", option)
+		case "replicaset":
+			name = value
+		case "connecttimeoutms":
+			if connectTimeout, err = parseMS(option, value); err != nil {
+				return err
+			}
+		case "sockettimeoutms":
+			if messageTimeout, err = parseMS(option, value); err != nil {
+				return err
+			}
+		case "maxpoolsize":
+			n, err := strconv.ParseUint(value, 10, 0)
+			if err != nil || n == 0 {
+				return fmt.Errorf("dvara: invalid connection string option %s=%s", option, value)
+			}
+			maxConnections = uint(n)
+		case "ssl", "tls":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("dvara: invalid connection string option %s=%s", option, value)
+			}
+			if enabled {
+				return fmt.Errorf("dvara: connection string option %s=%s is not supported", option, value)
+			}
+		case "authsource", "authmechanism":
+			return fmt.Errorf("dvara: connection string option %s is not supported, clients authenticate through the proxy", option)
+		}
+	}
+
+	r.Addrs = strings.Join(addrs, ",")
+	r.Name = name
+	r.ConnectTimeout = connectTimeout
+	r.MessageTimeout = messageTimeout
+	r.MaxConnections = maxConnections
+	return nil
+}
+
+func parseMS(name, value string) (time.Duration, error) {
+	ms, err := strconv.ParseUint(value, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("dvara: invalid connection string option %s=%s", name, value)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
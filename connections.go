@@ -0,0 +1,148 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientConnState is the state of a client connection.
+type ClientConnState int32
+
+const (
+	// ClientConnIdle is a client waiting to send its next request.
+	ClientConnIdle ClientConnState = iota
+
+	// ClientConnInFlight is a client with a request being proxied.
+	ClientConnInFlight
+)
+
+// String returns a human readable representation of the state.
+func (s ClientConnState) String() string {
+	switch s {
+	default:
+		return "unknown"
+	case ClientConnIdle:
+		return "idle"
+	case ClientConnInFlight:
+		return "in flight"
+	}
+}
+
+// ClientConn is a snapshot of a client connection.
+type ClientConn struct {
+	RemoteAddr string          // Address of the client
+	ProxyAddr  string          // Address of the proxy the client connected to
+	Backend    string          // Address of the mongo server its requests go to
+	AppName    string          // Application name from the handshake
+	Driver     string          // Driver name and version from the handshake
+	Opened     time.Time       // When the connection was accepted
+	Duration   time.Duration   // How long the connection has been open
+	State      ClientConnState // Whether a request is in flight
+}
+
+// clientConn tracks a client connection, for Connections and to apply the
+// restrictions which depend on the connection.
+type clientConn struct {
+	remoteAddr string
+	opened     time.Time
+	state      int32 // ClientConnState, accessed atomically
+
+	mutex    sync.Mutex
+	backend  string
+	metadata clientMetadata
+
+	// Only used by the goroutine serving the client.
+	override   *ListenerOverride
+	namespaces map[string]struct{}
+}
+
+func (cc *clientConn) setState(s ClientConnState) {
+	atomic.StoreInt32(&cc.state, int32(s))
+}
+
+func (cc *clientConn) setBackend(backend string, metadata clientMetadata) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.backend = backend
+	cc.metadata = metadata
+}
+
+// trackClient starts tracking a newly accepted client connection.
+func (p *Proxy) trackClient(c net.Conn) *clientConn {
+	cc := &clientConn{remoteAddr: c.RemoteAddr().String(), opened: time.Now()}
+	p.clientConnsMutex.Lock()
+	defer p.clientConnsMutex.Unlock()
+	if p.clientConns == nil {
+		p.clientConns = make(map[*clientConn]struct{})
+	}
+	p.clientConns[cc] = struct{}{}
+	return cc
+}
+
+// untrackClient stops tracking a closed client connection.
+func (p *Proxy) untrackClient(cc *clientConn) {
+	p.clientConnsMutex.Lock()
+	defer p.clientConnsMutex.Unlock()
+	delete(p.clientConns, cc)
+}
+
+// connections returns a snapshot of the client connections of the proxy.
+func (p *Proxy) connections(now time.Time) []ClientConn {
+	p.clientConnsMutex.Lock()
+	tracked := make([]*clientConn, 0, len(p.clientConns))
+	for cc := range p.clientConns {
+		tracked = append(tracked, cc)
+	}
+	p.clientConnsMutex.Unlock()
+
+	conns := make([]ClientConn, 0, len(tracked))
+	for _, cc := range tracked {
+		cc.mutex.Lock()
+		backend, metadata := cc.backend, cc.metadata
+		cc.mutex.Unlock()
+		conns = append(conns, ClientConn{
+			RemoteAddr: cc.remoteAddr,
+			ProxyAddr:  p.ProxyAddr,
+			Backend:    backend,
+			AppName:    metadata.AppName,
+			Driver:     metadata.Driver,
+			Opened:     cc.opened,
+			Duration:   now.Sub(cc.opened),
+			State:      ClientConnState(atomic.LoadInt32(&cc.state)),
+		})
+	}
+	return conns
+}
+
+// Connections returns a snapshot of the client connections of all the
+// proxies, oldest first.
+func (r *ReplicaSet) Connections() []ClientConn {
+	now := time.Now()
+	r.mappingMutex.RLock()
+	var conns []ClientConn
+	for _, p := range r.proxies {
+		conns = append(conns, p.connections(now)...)
+	}
+	r.mappingMutex.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Opened.Before(conns[j].Opened) })
+	return conns
+}
+
+// readHandshake reads the client metadata from the first message of a client.
+// If the message expects a response its body is read, and the returned
+// net.Conn replays it.
+func readHandshake(h *messageHeader, c net.Conn) (clientMetadata, net.Conn, error) {
+	if !h.OpCode.HasResponse() {
+		return clientMetadata{}, c, nil
+	}
+	body := make([]byte, h.MessageLength-headerLen)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return clientMetadata{}, nil, err
+	}
+	c = newBufferedConn(c, body)
+	return handshakeMetadata(h, body), c, nil
+}
@@ -0,0 +1,103 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestConnections(t *testing.T) {
+	t.Parallel()
+	const blockedRequestID = 2
+	unblock := make(chan struct{})
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		if h.RequestID == blockedRequestID {
+			<-unblock
+		}
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	rs := &ReplicaSet{}
+	p := newFakeProxy(t, mongo.Addr(), rs)
+	defer p.Stop()
+	rs.proxies = map[string]*Proxy{p.ProxyAddr: p}
+
+	// The metadata is read from the first command, which is a ping rather than
+	// an isMaster to not need a replica set state for the rewriter.
+	handshake := func(c net.Conn, appName string) {
+		h, body := fakeQuery("admin.$cmd", bson.D{
+			{Name: "ping", Value: 1},
+			{Name: "client", Value: bson.D{
+				{Name: "application", Value: bson.D{{Name: "name", Value: appName}}},
+				{Name: "driver", Value: bson.D{
+					{Name: "name", Value: "mgo"},
+					{Name: "version", Value: "2"},
+				}},
+			}},
+		})
+		h.RequestID = 1
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+		ensure.Nil(t, err)
+	}
+
+	idle, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer idle.Close()
+	handshake(idle, "idle")
+
+	busy, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer busy.Close()
+	handshake(busy, "busy")
+	h, body := fakeQuery("test.foo", bson.D{})
+	h.RequestID = blockedRequestID
+	_, err = busy.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	var conns []ClientConn
+	for {
+		conns = rs.Connections()
+		if len(conns) == 2 && conns[1].State == ClientConnInFlight {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected connections: %+v", conns)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(unblock)
+
+	for i, c := range []struct {
+		Conn    net.Conn
+		AppName string
+		State   ClientConnState
+	}{
+		{Conn: idle, AppName: "idle", State: ClientConnIdle},
+		{Conn: busy, AppName: "busy", State: ClientConnInFlight},
+	} {
+		ensure.DeepEqual(t, conns[i].RemoteAddr, c.Conn.LocalAddr().String())
+		ensure.DeepEqual(t, conns[i].ProxyAddr, p.ProxyAddr)
+		ensure.DeepEqual(t, conns[i].Backend, mongo.Addr())
+		ensure.DeepEqual(t, conns[i].AppName, c.AppName)
+		ensure.DeepEqual(t, conns[i].Driver, "mgo 2")
+		ensure.DeepEqual(t, conns[i].State, c.State)
+		ensure.True(t, conns[i].Duration > 0)
+	}
+}
+
+func TestClientConnStateString(t *testing.T) {
+	t.Parallel()
+	ensure.DeepEqual(t, ClientConnIdle.String(), "idle")
+	ensure.DeepEqual(t, ClientConnInFlight.String(), "in flight")
+	ensure.DeepEqual(t, ClientConnState(42).String(), "unknown")
+}
@@ -0,0 +1,109 @@
+package dvara
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/facebookgo/rpool"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// startDatabasePools creates the pools of the databases in DatabasePools.
+// They share the settings of the main pool, except for their size.
+func (p *Proxy) startDatabasePools() {
+	p.databasePools = make(map[string]*rpool.Pool, len(p.ReplicaSet.DatabasePools))
+	for database, max := range p.ReplicaSet.DatabasePools {
+		pool := &rpool.Pool{
+			CloseErrorHandler: p.serverCloseErrorHandler,
+			Max:               max,
+			IdleTimeout:       p.ReplicaSet.ServerIdleTimeout,
+			ClosePoolSize:     p.ReplicaSet.ServerClosePoolSize,
+		}
+		pool.New = func() (io.Closer, error) {
+			c, err := p.newServerConn()
+			if pc, ok := c.(*pooledServerConn); ok {
+				pc.pool = pool
+			}
+			return c, err
+		}
+		if p.ReplicaSet.Stats != nil {
+			pool.Stats = stats.PrefixClient(
+				[]string{fmt.Sprintf("mongoproxy.database.%s.server.pool.", database)},
+				p.ReplicaSet.Stats,
+			)
+		}
+		p.databasePools[database] = pool
+	}
+}
+
+// poolOf returns the pool a server connection was acquired from.
+func (p *Proxy) poolOf(c net.Conn) *rpool.Pool {
+	if pc, ok := c.(*pooledServerConn); ok && pc.pool != nil {
+		return pc.pool
+	}
+	return &p.serverPool
+}
+
+// peekDatabase peeks at a message to find the database it is for, when some
+// databases have their own pool. It is empty for messages which are not for a
+// database, like OpKillCursors. The returned connection replays what was
+// peeked.
+func (p *Proxy) peekDatabase(h *messageHeader, c net.Conn) (net.Conn, string, error) {
+	if len(p.ReplicaSet.DatabasePools) == 0 || h.MessageLength-headerLen < 4 {
+		return c, "", nil
+	}
+
+	var length int
+	switch h.OpCode {
+	default:
+		return c, "", nil
+	case OpQuery, OpGetMore, OpInsert, OpUpdate, OpDelete:
+		// An int32 followed by the full collection name.
+		length = maxCommandPeekLength
+	case OpMsg:
+		// The flags, then the body section first. Only its document is read.
+		length = 4 + 1 + 4
+	}
+	if remaining := int(h.MessageLength - headerLen); length > remaining {
+		length = remaining
+	}
+	prefix := make([]byte, length)
+	c.SetReadDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	if _, err := io.ReadFull(c, prefix); err != nil {
+		return nil, "", err
+	}
+
+	if h.OpCode != OpMsg {
+		replay := newBufferedConn(c, prefix)
+		end := bytes.IndexByte(prefix[4:], 0)
+		if end < 0 {
+			return replay, "", nil
+		}
+		return replay, databaseOf(string(prefix[4 : 4+end])), nil
+	}
+
+	if len(prefix) < 9 || prefix[4] != msgSectionBody {
+		return newBufferedConn(c, prefix), "", nil
+	}
+	docLen := int(getInt32(prefix, 5))
+	if docLen < 5 || 4+1+docLen > int(h.MessageLength-headerLen) {
+		return newBufferedConn(c, prefix), "", nil
+	}
+	body := make([]byte, 4+1+docLen)
+	copy(body, prefix)
+	if _, err := io.ReadFull(c, body[len(prefix):]); err != nil {
+		return nil, "", err
+	}
+	replay := newBufferedConn(c, body)
+	var doc struct {
+		DB string `bson:"$db"`
+	}
+	if err := bson.Unmarshal(body[5:], &doc); err != nil {
+		return replay, "", nil
+	}
+	return replay, doc.DB, nil
+}
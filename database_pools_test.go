@@ -0,0 +1,57 @@
+package dvara
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// acceptCounter counts the connections accepted by a listener.
+type acceptCounter struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *acceptCounter) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func TestDatabasePools(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Pools    map[string]uint
+		Accepted int32
+	}{
+		{Name: "shared", Accepted: 1},
+		{Name: "own pool", Pools: map[string]uint{"a": 1}, Accepted: 2},
+	}
+	for _, c := range cases {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		ensure.Nil(t, err)
+		counter := &acceptCounter{Listener: l}
+		mongo := &fakeMongo{Listener: counter, Handler: okReply}
+		go mongo.acceptLoop()
+		p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{DatabasePools: c.Pools})
+
+		conn, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		for _, database := range []string{"a", "b", "a", "b"} {
+			h, body := fakeQuery(database+".foo", bson.D{})
+			ensure.Nil(t, proxyRoundTrip(conn, h, body), c.Name)
+			h, body = fakeOpMsg(0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: database}})
+			ensure.Nil(t, proxyRoundTrip(conn, h, body), c.Name)
+		}
+		conn.Close()
+		p.Stop()
+		mongo.Stop()
+		ensure.DeepEqual(t, atomic.LoadInt32(&counter.accepted), c.Accepted, c.Name)
+	}
+}
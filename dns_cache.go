@@ -0,0 +1,183 @@
+package dvara
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver resolves a host name to a list of addresses.
+type Resolver interface {
+	LookupHost(host string) ([]string, error)
+}
+
+type netResolver struct{}
+
+func (netResolver) LookupHost(host string) ([]string, error) {
+	return net.LookupHost(host)
+}
+
+type dnsCacheEntry struct {
+	addrs    []string
+	resolved time.Time
+}
+
+// DNSCache caches the resolution of mongo server host names used when dialing
+// them. Resolutions are used for up to TTL and refreshed in the background, so
+// transient DNS failures fall back to the last good resolution.
+type DNSCache struct {
+	Log Logger `inject:""`
+
+	// Resolver is used to resolve host names. If nil the system resolver is
+	// used.
+	Resolver Resolver
+
+	// TTL is how long a resolution is used for. Zero disables caching and
+	// every dial resolves the host name.
+	TTL time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*dnsCacheEntry
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Start starts refreshing the cached resolutions in the background.
+func (c *DNSCache) Start() error {
+	if c.TTL == 0 {
+		return nil
+	}
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+	go c.refreshLoop()
+	return nil
+}
+
+// Stop stops refreshing the cached resolutions.
+func (c *DNSCache) Stop() error {
+	if c.stop == nil {
+		return nil
+	}
+	close(c.stop)
+	<-c.stopped
+	return nil
+}
+
+// Dial connects to the given address using a cached resolution of the host.
+func (c *DNSCache) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	if c.TTL == 0 {
+		return net.DialTimeout(network, addr, timeout)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return net.DialTimeout(network, addr, timeout)
+	}
+
+	addrs, err := c.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var conn net.Conn
+		conn, err = net.DialTimeout(network, net.JoinHostPort(a, port), timeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// canonical returns the address with its host name replaced by the lowest of
+// the addresses it resolves to, to tell whether different host names are the
+// same server. The address is returned as is if it cannot be resolved. A nil
+// DNSCache uses the system resolver.
+func (c *DNSCache) canonical(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	var addrs []string
+	switch {
+	case net.ParseIP(host) != nil:
+		addrs = []string{net.ParseIP(host).String()}
+	case c == nil:
+		addrs, err = netResolver{}.LookupHost(host)
+	default:
+		addrs, err = c.lookup(host)
+	}
+	if err != nil || len(addrs) == 0 {
+		return addr
+	}
+	lowest := addrs[0]
+	for _, a := range addrs[1:] {
+		if a < lowest {
+			lowest = a
+		}
+	}
+	return net.JoinHostPort(lowest, port)
+}
+
+// lookup returns the cached resolution if it is within the TTL, otherwise it
+// resolves the host.
+func (c *DNSCache) lookup(host string) ([]string, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[host]
+	c.mutex.Unlock()
+	if ok && time.Since(entry.resolved) < c.TTL {
+		return entry.addrs, nil
+	}
+	return c.resolve(host)
+}
+
+// resolve resolves the host and caches the result.
+func (c *DNSCache) resolve(host string) ([]string, error) {
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = netResolver{}
+	}
+	addrs, err := resolver.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*dnsCacheEntry)
+	}
+	c.entries[host] = &dnsCacheEntry{addrs: addrs, resolved: time.Now()}
+	return addrs, nil
+}
+
+// refresh resolves all the cached hosts again. Failures leave the last good
+// resolution in place until it expires.
+func (c *DNSCache) refresh() {
+	c.mutex.Lock()
+	hosts := make([]string, 0, len(c.entries))
+	for host := range c.entries {
+		hosts = append(hosts, host)
+	}
+	c.mutex.Unlock()
+
+	for _, host := range hosts {
+		if _, err := c.resolve(host); err != nil {
+			c.Log.Warnf("failed to refresh resolution for %s: %s", host, err)
+		}
+	}
+}
+
+func (c *DNSCache) refreshLoop() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.TTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.refresh()
+		}
+	}
+}
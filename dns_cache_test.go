@@ -0,0 +1,97 @@
+package dvara
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+var errFakeResolver = errors.New("fake resolver failure")
+
+// fakeResolver succeeds for the first lookup and fails after.
+type fakeResolver struct {
+	mutex   sync.Mutex
+	addrs   []string
+	lookups int
+}
+
+func (r *fakeResolver) LookupHost(host string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lookups++
+	if r.lookups > 1 {
+		return nil, errFakeResolver
+	}
+	return r.addrs, nil
+}
+
+func TestDNSCacheFallsBackToCachedResolution(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	ensure.Nil(t, err)
+	addr := net.JoinHostPort("mongo.example.com", port)
+
+	resolver := &fakeResolver{addrs: []string{"127.0.0.1"}}
+	c := &DNSCache{
+		Log:      &tLogger{TB: t},
+		Resolver: resolver,
+		TTL:      time.Minute,
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := c.Dial("tcp", addr, time.Second)
+		ensure.Nil(t, err)
+		conn.Close()
+	}
+	ensure.DeepEqual(t, resolver.lookups, 1)
+
+	// A failed refresh keeps the last good resolution.
+	c.refresh()
+	ensure.DeepEqual(t, resolver.lookups, 2)
+	conn, err := c.Dial("tcp", addr, time.Second)
+	ensure.Nil(t, err)
+	conn.Close()
+
+	// Once expired the resolution is no longer used.
+	c.entries["mongo.example.com"].resolved = time.Now().Add(-2 * time.Minute)
+	_, err = c.Dial("tcp", addr, time.Second)
+	ensure.DeepEqual(t, err, errFakeResolver)
+}
+
+func TestDNSCacheDisabled(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer l.Close()
+	resolver := &fakeResolver{}
+	c := &DNSCache{Resolver: resolver}
+	ensure.Nil(t, c.Start())
+	conn, err := c.Dial("tcp", l.Addr().String(), time.Second)
+	ensure.Nil(t, err)
+	conn.Close()
+	ensure.Nil(t, c.Stop())
+	ensure.DeepEqual(t, resolver.lookups, 0)
+}
+
+func TestDNSCacheStartStop(t *testing.T) {
+	t.Parallel()
+	c := &DNSCache{Log: &tLogger{TB: t}, TTL: time.Millisecond}
+	ensure.Nil(t, c.Start())
+	ensure.Nil(t, c.Stop())
+}
@@ -0,0 +1,170 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRSChanged is returned when a response indicates the replica set
+// configuration has changed since the proxies were started.
+var ErrRSChanged = errors.New("dvara: replset config changed")
+
+// UnexpectedOpCodeError is returned when a message has an OpCode other than
+// the one expected.
+type UnexpectedOpCodeError struct {
+	Expected OpCode
+	Got      OpCode
+}
+
+func (e *UnexpectedOpCodeError) Error() string {
+	return fmt.Sprintf("dvara: expected op %s, got %s", e.Expected, e.Got)
+}
+
+// MultiDocumentReplyError is returned when a reply expected to contain a
+// single document contains some other number of documents.
+type MultiDocumentReplyError struct {
+	NumberReturned int32
+}
+
+func (e *MultiDocumentReplyError) Error() string {
+	return fmt.Sprintf(
+		"dvara: can only handle 1 result document, got: %d",
+		e.NumberReturned,
+	)
+}
+
+// MessageLengthError is returned when a message header specifies a length
+// larger than mongo allows.
+type MessageLengthError struct {
+	Length int32
+}
+
+func (e *MessageLengthError) Error() string {
+	return fmt.Sprintf("dvara: invalid message length %d", e.Length)
+}
+
+// DocumentLengthError is returned when the length prefix of a BSON document
+// is inconsistent with the length of the message containing it.
+type DocumentLengthError struct {
+	Length    int32
+	Remaining int32
+}
+
+func (e *DocumentLengthError) Error() string {
+	return fmt.Sprintf(
+		"dvara: document length %d inconsistent with the %d bytes left in the message",
+		e.Length,
+		e.Remaining,
+	)
+}
+
+// ProtocolError is returned when the first message from a client shows it is
+// not speaking a version of the mongo wire protocol we understand, for example
+// an HTTP request or a port scanner probe.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("dvara: unrecognized client protocol: %s", e.Reason)
+}
+
+// ProxyMappingError is returned when the members and their proxies are not
+// mapped one to one, which would advertise an ambiguous topology to clients.
+type ProxyMappingError struct {
+	ProxyAddr string
+	MongoAddr string
+	Reason    string
+}
+
+func (e *ProxyMappingError) Error() string {
+	return fmt.Sprintf(
+		"dvara: invalid mapping of proxy %s to mongo %s: %s",
+		e.ProxyAddr,
+		e.MongoAddr,
+		e.Reason,
+	)
+}
+
+// ReplyMismatchError is returned when a reply does not correspond to the
+// request it was expected to answer.
+type ReplyMismatchError struct {
+	RequestID  int32
+	ResponseTo int32
+}
+
+func (e *ReplyMismatchError) Error() string {
+	return fmt.Sprintf(
+		"dvara: got reply to request %d while expecting reply to request %d",
+		e.ResponseTo,
+		e.RequestID,
+	)
+}
+
+// TruncatedReplyError is returned when a server closes its connection before
+// sending the whole reply announced by the MessageLength of its header.
+type TruncatedReplyError struct {
+	ResponseTo    int32
+	MessageLength int32
+}
+
+func (e *TruncatedReplyError) Error() string {
+	return fmt.Sprintf(
+		"dvara: truncated backend reply to request %d of %d bytes",
+		e.ResponseTo,
+		e.MessageLength,
+	)
+}
+
+// ServerUnavailableError is returned when a connection to a mongo server
+// could not be established, or the server is a suspect member.
+type ServerUnavailableError struct {
+	Addr    string
+	Suspect bool
+}
+
+func (e *ServerUnavailableError) Error() string {
+	if e.Suspect {
+		return fmt.Sprintf("dvara: mongo %s is suspect", e.Addr)
+	}
+	return fmt.Sprintf("dvara: could not connect to %s", e.Addr)
+}
+
+// ServerOverloadedError is returned instead of waiting for a connection to a
+// mongo server when MaxQueueDepth requests are already waiting for one.
+type ServerOverloadedError struct {
+	Addr   string
+	Queued int64
+}
+
+func (e *ServerOverloadedError) Error() string {
+	return fmt.Sprintf("dvara: mongo %s is overloaded with %d queued requests", e.Addr, e.Queued)
+}
+
+// ClientStalledError is returned when writing to a client which stopped
+// reading for longer than ClientWriteTimeout. It is a timeout.
+type ClientStalledError struct {
+	Addr  string
+	After time.Duration
+}
+
+func (e *ClientStalledError) Error() string {
+	return fmt.Sprintf("dvara: client %s stopped reading for %s", e.Addr, e.After)
+}
+
+// Timeout is true, the write timed out.
+func (e *ClientStalledError) Timeout() bool { return true }
+
+// Temporary is false, the connection is closed.
+func (e *ClientStalledError) Temporary() bool { return false }
+
+// UnknownMemberError is returned when mapping a mongo address which is not a
+// member of the ReplicaSet.
+type UnknownMemberError struct {
+	RealHost string
+}
+
+func (e *UnknownMemberError) Error() string {
+	return fmt.Sprintf("dvara: mongo %s is not in ReplicaSet", e.RealHost)
+}
@@ -0,0 +1,64 @@
+package dvara
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestTypedErrors(t *testing.T) {
+	t.Parallel()
+	var rw ReplyRW
+	rw.Log = &tLogger{TB: t}
+
+	_, _, _, err := rw.ReadOne(bytes.NewReader((messageHeader{OpCode: OpDelete}).ToWire()), nil)
+	var opErr *UnexpectedOpCodeError
+	if !errors.As(err, &opErr) || opErr.Expected != OpReply || opErr.Got != OpDelete {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var prefix replyPrefix
+	setInt32(prefix[:], 16, 2)
+	reply := append((messageHeader{OpCode: OpReply}).ToWire(), prefix[:]...)
+	_, _, _, err = rw.ReadOne(bytes.NewReader(reply), nil)
+	var docsErr *MultiDocumentReplyError
+	if !errors.As(err, &docsErr) || docsErr.NumberReturned != 2 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	_, err = readHeader(bytes.NewReader((messageHeader{MessageLength: maxMessageLength + 1}).ToWire()))
+	var lengthErr *MessageLengthError
+	if !errors.As(err, &lengthErr) || lengthErr.Length != maxMessageLength+1 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	_, err = copyReply(ioutil.Discard, bytes.NewReader(fakeReplyWithFlags(0, 0)), &messageHeader{RequestID: 7})
+	var mismatchErr *ReplyMismatchError
+	if !errors.As(err, &mismatchErr) || mismatchErr.RequestID != 7 || mismatchErr.ResponseTo != 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	overrun := fakeReplyWithFlags(0, 0)
+	setInt32(overrun, headerLen+len(emptyPrefix), int32(len(overrun)))
+	_, _, _, err = rw.ReadOne(bytes.NewReader(append(overrun, make([]byte, 64)...)), nil)
+	var docErr *DocumentLengthError
+	if !errors.As(err, &docErr) || int(docErr.Length) != len(overrun) ||
+		int(docErr.Remaining) != len(overrun)-headerLen-len(emptyPrefix) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	truncated := fakeReplyWithFlags(0, 0)
+	_, err = copyReply(ioutil.Discard, bytes.NewReader(truncated[:len(truncated)-1]), &messageHeader{})
+	var truncatedErr *TruncatedReplyError
+	if !errors.As(err, &truncatedErr) || int(truncatedErr.MessageLength) != len(truncated) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	r := ReplicaSet{realToProxy: map[string]string{}}
+	_, err = r.Proxy("a:1")
+	var memberErr *UnknownMemberError
+	if !errors.As(err, &memberErr) || memberErr.RealHost != "a:1" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
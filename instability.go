@@ -0,0 +1,92 @@
+package dvara
+
+import (
+	"sync"
+	"time"
+)
+
+// admissionPollInterval is how often a new client held while the replica set
+// is unstable checks if it has settled.
+const admissionPollInterval = 20 * time.Millisecond
+
+// instability tracks the recent changes of the replica set state and the new
+// clients held until it settles.
+type instability struct {
+	mutex   sync.Mutex
+	changes []time.Time
+	queued  uint
+}
+
+// noteChange records a change of the replica set, such as a restart of the
+// proxies following an election or a failed check of the members.
+func (r *ReplicaSet) noteChange(now time.Time) {
+	if r.InstabilityThreshold == 0 {
+		return
+	}
+	r.instability.mutex.Lock()
+	defer r.instability.mutex.Unlock()
+	r.instability.changes = append(r.pruneChanges(now), now)
+}
+
+// pruneChanges drops the changes older than InstabilityWindow. The mutex must
+// be held.
+func (r *ReplicaSet) pruneChanges(now time.Time) []time.Time {
+	changes := r.instability.changes
+	for len(changes) > 0 && now.Sub(changes[0]) > r.InstabilityWindow {
+		changes = changes[1:]
+	}
+	return changes
+}
+
+// unstable checks if the replica set changed more than InstabilityThreshold
+// times within InstabilityWindow.
+func (r *ReplicaSet) unstable(now time.Time) bool {
+	if r.InstabilityThreshold == 0 {
+		return false
+	}
+	r.instability.mutex.Lock()
+	defer r.instability.mutex.Unlock()
+	r.instability.changes = r.pruneChanges(now)
+	return uint(len(r.instability.changes)) > r.InstabilityThreshold
+}
+
+// admitClient holds a new client while the replica set is unstable, for up to
+// InstabilityWindow or until closed is closed. It returns false without
+// waiting if InstabilityMaxQueued clients are already held, and whether the
+// client was held otherwise.
+func (r *ReplicaSet) admitClient(closed <-chan struct{}) (held bool, ok bool) {
+	start := time.Now()
+	if !r.unstable(start) {
+		return false, true
+	}
+
+	r.instability.mutex.Lock()
+	if r.InstabilityMaxQueued != 0 && r.instability.queued >= r.InstabilityMaxQueued {
+		r.instability.mutex.Unlock()
+		return false, false
+	}
+	r.instability.queued++
+	r.instability.mutex.Unlock()
+	defer func() {
+		r.instability.mutex.Lock()
+		r.instability.queued--
+		r.instability.mutex.Unlock()
+	}()
+
+	deadline := start.Add(r.InstabilityWindow)
+	for now := start; now.Before(deadline) && r.unstable(now); now = time.Now() {
+		select {
+		case <-closed:
+			return true, true
+		case <-time.After(admissionPollInterval):
+		}
+	}
+	return true, true
+}
+
+// queuedClients returns the number of new clients being held.
+func (r *ReplicaSet) queuedClients() uint {
+	r.instability.mutex.Lock()
+	defer r.instability.mutex.Unlock()
+	return r.instability.queued
+}
@@ -0,0 +1,85 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestUnstable(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{InstabilityThreshold: 2, InstabilityWindow: time.Minute}
+	now := time.Now()
+	r.noteChange(now.Add(-2 * time.Minute))
+	r.noteChange(now.Add(-time.Second))
+	r.noteChange(now)
+	ensure.False(t, r.unstable(now))
+	r.noteChange(now)
+	ensure.True(t, r.unstable(now))
+
+	// Changes outside the window no longer count.
+	ensure.False(t, r.unstable(now.Add(time.Minute)))
+	ensure.False(t, (&ReplicaSet{}).unstable(now))
+}
+
+func TestAdmissionWhileUnstable(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	const window = 300 * time.Millisecond
+	rs := &ReplicaSet{
+		InstabilityThreshold: 2,
+		InstabilityWindow:    window,
+		InstabilityMaxQueued: 1,
+	}
+	p := newFakeProxy(t, mongo.Addr(), rs)
+	defer p.Stop()
+
+	ping := func(c net.Conn) bson.M {
+		h, body := fakeOpMsg(0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		b := make([]byte, reply.MessageLength-headerLen)
+		_, err = io.ReadFull(c, b)
+		ensure.Nil(t, err)
+		var doc bson.M
+		ensure.Nil(t, bson.Unmarshal(b[5:], &doc))
+		return doc
+	}
+
+	// A stable replica set admits clients right away.
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, ping(c), bson.M{"ok": 1})
+	ensure.Nil(t, c.Close())
+
+	// Rapid changes make it unstable.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		rs.noteChange(time.Now())
+	}
+
+	held, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer held.Close()
+	for rs.queuedClients() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// With the queue full further clients are told to retry.
+	rejected, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer rejected.Close()
+	doc := ping(rejected)
+	ensure.DeepEqual(t, doc["errmsg"], DefaultCloseReasonMessages[CloseReasonServerBusy])
+
+	// The held client is served once the changes fall out of the window.
+	ensure.DeepEqual(t, ping(held), bson.M{"ok": 1})
+	ensure.True(t, time.Since(start) >= window)
+}
@@ -0,0 +1,69 @@
+package dvara
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// IntrospectionDatabase is the reserved database answered by the proxy itself
+// when ReplicaSet.Introspection is set, for example:
+//
+//	db.getSiblingDB("dvara").runCommand({status: 1})
+const IntrospectionDatabase = "dvara"
+
+type introspectionMember struct {
+	Mongo   string `bson:"mongo"`
+	Proxy   string `bson:"proxy"`
+	Clients int64  `bson:"clients"`
+	Idle    int64  `bson:"idleServers"`
+	Suspect bool   `bson:"suspect"`
+	Latency int64  `bson:"latencyMicros"`
+}
+
+type introspectionIgnored struct {
+	Mongo string       `bson:"mongo"`
+	State ReplicaState `bson:"state"`
+}
+
+// introspect describes the current state of the ReplicaSet.
+func (r *ReplicaSet) introspect() bson.D {
+	r.mappingMutex.RLock()
+	members := make([]introspectionMember, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		members = append(members, introspectionMember{
+			Mongo:   p.MongoAddr,
+			Proxy:   p.ProxyAddr,
+			Clients: p.clientCount(),
+			Idle:    p.idleServerConnCount(),
+			Suspect: r.isSuspect(p.MongoAddr),
+			Latency: int64(p.latency.value() / time.Microsecond),
+		})
+	}
+	pending := make([]string, 0, len(r.pendingReal))
+	for addr := range r.pendingReal {
+		pending = append(pending, addr)
+	}
+	r.mappingMutex.RUnlock()
+	sort.Slice(members, func(i, j int) bool { return members[i].Mongo < members[j].Mongo })
+	sort.Strings(pending)
+
+	ignored := make([]introspectionIgnored, 0, len(r.ignoredReal))
+	for addr, state := range r.ignoredReal {
+		ignored = append(ignored, introspectionIgnored{Mongo: addr, State: state})
+	}
+	sort.Slice(ignored, func(i, j int) bool { return ignored[i].Mongo < ignored[j].Mongo })
+
+	return bson.D{
+		{Name: "replicaSet", Value: r.Name},
+		{Name: "state", Value: r.State().String()},
+		{Name: "members", Value: members},
+		{Name: "pending", Value: pending},
+		{Name: "ignored", Value: ignored},
+		{Name: "clients", Value: int64(r.ConnectionLimiter.Count())},
+		{Name: "clientsByRole", Value: r.ClientsByRole()},
+		{Name: "rejectedClients", Value: int64(r.ConnectionLimiter.Rejected())},
+		{Name: "ok", Value: 1},
+	}
+}
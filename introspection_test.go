@@ -0,0 +1,105 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIntrospection(t *testing.T) {
+	t.Parallel()
+	var accepted int32
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	mongo := &fakeMongo{
+		Listener: &countingListener{Listener: l, accepted: &accepted},
+		Handler:  okReply,
+	}
+	go mongo.acceptLoop()
+	defer mongo.Stop()
+
+	rs := &ReplicaSet{Name: "rs0", Introspection: true}
+	p := newFakeProxy(t, mongo.Addr(), rs)
+	defer p.Stop()
+	rs.mappingMutex.Lock()
+	rs.proxies = map[string]*Proxy{p.ProxyAddr: p}
+	rs.pendingReal = map[string]struct{}{"b:1": {}}
+	rs.ignoredReal = map[string]ReplicaState{"c:1": ReplicaStateArbiter}
+	rs.mappingMutex.Unlock()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	for _, msg := range []bool{false, true} {
+		var h *messageHeader
+		var body []byte
+		if msg {
+			h, body = fakeOpMsg(0, bson.D{{Name: "status", Value: 1}, {Name: "$db", Value: IntrospectionDatabase}})
+		} else {
+			h, body = fakeQuery(IntrospectionDatabase+".$cmd", bson.D{{Name: "status", Value: 1}})
+		}
+		_, err = c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		b := make([]byte, reply.MessageLength-headerLen)
+		_, err = io.ReadFull(c, b)
+		ensure.Nil(t, err)
+		if msg {
+			b = b[5:]
+		} else {
+			b = b[len(emptyPrefix):]
+		}
+
+		var doc struct {
+			ReplicaSet string                 `bson:"replicaSet"`
+			State      string                 `bson:"state"`
+			Members    []introspectionMember  `bson:"members"`
+			Pending    []string               `bson:"pending"`
+			Ignored    []introspectionIgnored `bson:"ignored"`
+			Clients    int64                  `bson:"clients"`
+			OK         int                    `bson:"ok"`
+		}
+		ensure.Nil(t, bson.Unmarshal(b, &doc))
+		ensure.DeepEqual(t, doc.ReplicaSet, "rs0")
+		ensure.DeepEqual(t, doc.State, "stopped")
+		ensure.DeepEqual(t, doc.Members, []introspectionMember{
+			{Mongo: mongo.Addr(), Proxy: p.ProxyAddr, Clients: 1},
+		})
+		ensure.DeepEqual(t, doc.Pending, []string{"b:1"})
+		ensure.DeepEqual(t, doc.Ignored, []introspectionIgnored{{Mongo: "c:1", State: ReplicaStateArbiter}})
+		ensure.DeepEqual(t, doc.Clients, int64(1))
+		ensure.DeepEqual(t, doc.OK, 1)
+	}
+	ensure.DeepEqual(t, atomic.LoadInt32(&accepted), int32(0))
+}
+
+func TestIntrospectionDisabled(t *testing.T) {
+	t.Parallel()
+	var accepted int32
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	mongo := &fakeMongo{
+		Listener: &countingListener{Listener: l, accepted: &accepted},
+		Handler:  okReply,
+	}
+	go mongo.acceptLoop()
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{LocalCommands: true})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	h, body := fakeQuery(IntrospectionDatabase+".$cmd", bson.D{{Name: "status", Value: 1}})
+	_, err = c.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+	_, err = readHeader(c)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&accepted), int32(1))
+}
@@ -0,0 +1,57 @@
+package dvara
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyWeight is the weight of a new sample in the latency moving average.
+const latencyWeight = 0.2
+
+// latencyEWMA is an exponentially weighted moving average of the time taken
+// to proxy a message to a server and back.
+type latencyEWMA struct {
+	mutex   sync.Mutex
+	average float64 // nanoseconds
+	set     bool
+}
+
+// observe adds a sample to the average. The first sample is taken as is.
+func (l *latencyEWMA) observe(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.set {
+		l.average, l.set = float64(d), true
+		return
+	}
+	l.average += latencyWeight * (float64(d) - l.average)
+}
+
+// value returns the average, or zero if there is no sample yet.
+func (l *latencyEWMA) value() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return time.Duration(l.average)
+}
+
+// BackendLatency is the moving average of the round trip time of the messages
+// proxied to a mongo server.
+type BackendLatency struct {
+	Mongo   string        // Address of the mongo server
+	Latency time.Duration // Zero if no message has been proxied yet
+}
+
+// Latencies returns the moving average of the round trip time of the messages
+// proxied to each member, sorted by address. Slow or degraded members stand
+// out before they fail outright.
+func (r *ReplicaSet) Latencies() []BackendLatency {
+	r.mappingMutex.RLock()
+	latencies := make([]BackendLatency, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		latencies = append(latencies, BackendLatency{Mongo: p.MongoAddr, Latency: p.latency.value()})
+	}
+	r.mappingMutex.RUnlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i].Mongo < latencies[j].Mongo })
+	return latencies
+}
@@ -0,0 +1,65 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLatencyEWMA(t *testing.T) {
+	t.Parallel()
+	var l latencyEWMA
+	ensure.DeepEqual(t, l.value(), time.Duration(0))
+	l.observe(10 * time.Millisecond)
+	ensure.DeepEqual(t, l.value(), 10*time.Millisecond)
+	l.observe(20 * time.Millisecond)
+	ensure.DeepEqual(t, l.value(), 12*time.Millisecond)
+}
+
+func TestLatencies(t *testing.T) {
+	t.Parallel()
+	fast := newFakeMongo(t, okReply)
+	defer fast.Stop()
+	slow := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		time.Sleep(20 * time.Millisecond)
+		return okReply(h, body)
+	})
+	defer slow.Stop()
+
+	rs := &ReplicaSet{}
+	fastProxy := newFakeProxy(t, fast.Addr(), rs)
+	defer fastProxy.Stop()
+	slowProxy := newFakeProxy(t, slow.Addr(), rs)
+	defer slowProxy.Stop()
+	rs.mappingMutex.Lock()
+	rs.proxies = map[string]*Proxy{fastProxy.ProxyAddr: fastProxy, slowProxy.ProxyAddr: slowProxy}
+	rs.mappingMutex.Unlock()
+
+	for _, p := range []*Proxy{fastProxy, slowProxy} {
+		c, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		for i := 0; i < 3; i++ {
+			h, body := fakeQuery("test.foo", bson.D{})
+			_, err = c.Write(append(h.ToWire(), body...))
+			ensure.Nil(t, err)
+			reply, err := readHeader(c)
+			ensure.Nil(t, err)
+			_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+			ensure.Nil(t, err)
+		}
+		ensure.Nil(t, c.Close())
+	}
+
+	latency := make(map[string]time.Duration)
+	for _, l := range rs.Latencies() {
+		latency[l.Mongo] = l.Latency
+	}
+	ensure.DeepEqual(t, len(latency), 2)
+	ensure.True(t, latency[slow.Addr()] >= 20*time.Millisecond, latency)
+	ensure.True(t, latency[fast.Addr()] < latency[slow.Addr()], latency)
+}
@@ -0,0 +1,154 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	errNotRunning     = errors.New("dvara: ReplicaSet is not running")
+	errAlreadyStarted = errors.New("dvara: ReplicaSet is already started")
+)
+
+// LifecycleState is the lifecycle state of a ReplicaSet.
+type LifecycleState int32
+
+const (
+	// LifecycleStopped is the state before Start and after Stop.
+	LifecycleStopped LifecycleState = iota
+
+	// LifecycleStarting is the state while the proxies are being started,
+	// including during a Restart.
+	LifecycleStarting
+
+	// LifecycleRunning is the state while the proxies are accepting and
+	// serving clients.
+	LifecycleRunning
+
+	// LifecycleDraining is the state after Drain. Existing and new clients are
+	// still served but the health endpoint reports the ReplicaSet unavailable so
+	// load balancers stop sending new clients.
+	LifecycleDraining
+)
+
+// String returns a human readable representation of the state.
+func (s LifecycleState) String() string {
+	switch s {
+	default:
+		return "unknown"
+	case LifecycleStopped:
+		return "stopped"
+	case LifecycleStarting:
+		return "starting"
+	case LifecycleRunning:
+		return "running"
+	case LifecycleDraining:
+		return "draining"
+	}
+}
+
+// State returns the current lifecycle state.
+func (r *ReplicaSet) State() LifecycleState {
+	return LifecycleState(atomic.LoadInt32(&r.state))
+}
+
+func (r *ReplicaSet) setState(s LifecycleState) {
+	old := LifecycleState(atomic.SwapInt32(&r.state, int32(s)))
+	if old != s {
+		r.Log.Infof("replica set %s => %s", old, s)
+	}
+}
+
+// transition moves the ReplicaSet from one state to another, and returns
+// false if it was not in the former. Unlike setState it leaves logging the
+// transition to the caller.
+func (r *ReplicaSet) transition(from, to LifecycleState) bool {
+	return atomic.CompareAndSwapInt32(&r.state, int32(from), int32(to))
+}
+
+// Drain moves a running ReplicaSet to the draining state in preparation of
+// stopping it. The proxies keep serving clients until Stop is called.
+func (r *ReplicaSet) Drain() error {
+	if !r.transition(LifecycleRunning, LifecycleDraining) {
+		return errNotRunning
+	}
+	r.Log.Infof("replica set %s => %s", LifecycleRunning, LifecycleDraining)
+	return nil
+}
+
+// drainPollInterval is how often a draining ReplicaSet checks if all clients
+// have disconnected.
+const drainPollInterval = 100 * time.Millisecond
+
+// DrainOnSignal blocks until the process receives SIGTERM or SIGINT, then
+// drains the ReplicaSet for up to drainPeriod before returning so the caller
+// can stop it. The drain ends early once no clients are left, or if another
+// signal is received. A zero drainPeriod returns right after the signal.
+// Library users handling signals themselves can use Drain directly.
+func (r *ReplicaSet) DrainOnSignal(drainPeriod time.Duration) error {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(ch)
+	return r.drainOnSignal(ch, drainPeriod)
+}
+
+func (r *ReplicaSet) drainOnSignal(ch <-chan os.Signal, drainPeriod time.Duration) error {
+	sig := <-ch
+	r.Log.Infof("received %s, shutting down", sig)
+	if drainPeriod <= 0 {
+		return nil
+	}
+	if err := r.Drain(); err != nil {
+		return err
+	}
+
+	deadline := time.After(drainPeriod)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline:
+			r.Log.Infof("drain period over with %d clients left", r.clientCount())
+			return nil
+		case sig := <-ch:
+			r.Log.Warnf("received %s while draining, shutting down now", sig)
+			return nil
+		case <-ticker.C:
+			if r.clientCount() == 0 {
+				r.Log.Info("drained all clients")
+				return nil
+			}
+		}
+	}
+}
+
+// clientCount returns the number of clients connected to the proxies.
+func (r *ReplicaSet) clientCount() int64 {
+	r.mappingMutex.RLock()
+	defer r.mappingMutex.RUnlock()
+	var count int64
+	for _, p := range r.proxies {
+		count += p.clientCount()
+	}
+	return count
+}
+
+// HealthHandler reports the lifecycle state of a ReplicaSet over HTTP. It
+// responds with 200 while running and 503 otherwise.
+type HealthHandler struct {
+	ReplicaSet *ReplicaSet
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := h.ReplicaSet.State()
+	if state != LifecycleRunning {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, state)
+}
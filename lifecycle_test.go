@@ -0,0 +1,178 @@
+package dvara
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestLifecycleStartFailure(t *testing.T) {
+	t.Parallel()
+	r := ReplicaSet{Log: &tLogger{TB: t}}
+	ensure.DeepEqual(t, r.State(), LifecycleStopped)
+	ensure.DeepEqual(t, r.Start(), errNoAddrsGiven)
+	ensure.DeepEqual(t, r.State(), LifecycleStopped)
+}
+
+func TestLifecycleStartTwice(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		return standaloneReply(t, h, body)
+	})
+	defer mongo.Stop()
+	r := newStartupReplicaSet(t, mongo.Addr(), 0)
+
+	// Concurrent calls start the replica set once.
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- r.Start() }()
+	}
+	first, second := <-errs, <-errs
+	if first != nil {
+		first, second = second, first
+	}
+	ensure.Nil(t, first)
+	ensure.DeepEqual(t, second, errAlreadyStarted)
+	ensure.DeepEqual(t, r.State(), LifecycleRunning)
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 1)
+
+	ensure.DeepEqual(t, r.Start(), errAlreadyStarted)
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 1)
+
+	ensure.Nil(t, r.Stop())
+	ensure.DeepEqual(t, r.State(), LifecycleStopped)
+	ensure.Nil(t, r.Stop())
+
+	// And it can be started again once stopped.
+	ensure.Nil(t, r.Start())
+	ensure.DeepEqual(t, r.State(), LifecycleRunning)
+	ensure.Nil(t, r.Stop())
+}
+
+func TestLifecycleStopWithoutStart(t *testing.T) {
+	t.Parallel()
+	r := ReplicaSet{Log: &tLogger{TB: t}}
+	ensure.Nil(t, r.Stop())
+	ensure.DeepEqual(t, r.State(), LifecycleStopped)
+}
+
+func TestLifecycleDrain(t *testing.T) {
+	t.Parallel()
+	r := ReplicaSet{Log: &tLogger{TB: t}}
+	ensure.DeepEqual(t, r.Drain(), errNotRunning)
+	ensure.DeepEqual(t, r.State(), LifecycleStopped)
+
+	r.setState(LifecycleRunning)
+	ensure.Nil(t, r.Drain())
+	ensure.DeepEqual(t, r.State(), LifecycleDraining)
+	ensure.DeepEqual(t, r.Drain(), errNotRunning)
+
+	ensure.Nil(t, r.Stop())
+	ensure.DeepEqual(t, r.State(), LifecycleStopped)
+}
+
+func TestHealthHandler(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		State LifecycleState
+		Code  int
+	}{
+		{State: LifecycleStopped, Code: http.StatusServiceUnavailable},
+		{State: LifecycleStarting, Code: http.StatusServiceUnavailable},
+		{State: LifecycleRunning, Code: http.StatusOK},
+		{State: LifecycleDraining, Code: http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		r := ReplicaSet{Log: &tLogger{TB: t}}
+		r.setState(c.State)
+		w := httptest.NewRecorder()
+		(&HealthHandler{ReplicaSet: &r}).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		ensure.DeepEqual(t, w.Code, c.Code)
+		ensure.DeepEqual(t, strings.TrimSpace(w.Body.String()), c.State.String())
+	}
+}
+
+func TestDrainOnSignal(t *testing.T) {
+	t.Parallel()
+	r := ReplicaSet{Log: &tLogger{TB: t}}
+	r.setState(LifecycleRunning)
+	p := &Proxy{ReplicaSet: &r, ProxyAddr: "p:1", MongoAddr: "a:1", clients: 1}
+	r.proxies = map[string]*Proxy{p.ProxyAddr: p}
+
+	ch := make(chan os.Signal, 2)
+	done := make(chan error)
+	go func() { done <- r.drainOnSignal(ch, time.Minute) }()
+	ch <- syscall.SIGTERM
+
+	// Draining waits for the remaining client.
+	for r.State() != LifecycleDraining {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("drain returned with a client left")
+	case <-time.After(2 * drainPollInterval):
+	}
+	atomic.AddInt64(&p.clients, -1)
+	ensure.Nil(t, <-done)
+}
+
+func TestDrainOnSignalCutShort(t *testing.T) {
+	t.Parallel()
+	r := ReplicaSet{Log: &tLogger{TB: t}}
+	r.setState(LifecycleRunning)
+	p := &Proxy{ReplicaSet: &r, ProxyAddr: "p:1", MongoAddr: "a:1", clients: 1}
+	r.proxies = map[string]*Proxy{p.ProxyAddr: p}
+
+	// A second signal stops the drain right away.
+	ch := make(chan os.Signal, 2)
+	ch <- syscall.SIGTERM
+	ch <- syscall.SIGINT
+	ensure.Nil(t, r.drainOnSignal(ch, time.Minute))
+	ensure.DeepEqual(t, r.State(), LifecycleDraining)
+
+	// Without a drain period the ReplicaSet is not drained at all.
+	r.setState(LifecycleRunning)
+	ch <- syscall.SIGTERM
+	ensure.Nil(t, r.drainOnSignal(ch, 0))
+	ensure.DeepEqual(t, r.State(), LifecycleRunning)
+
+	// The drain period bounds how long clients are waited for.
+	ch <- syscall.SIGTERM
+	start := time.Now()
+	ensure.Nil(t, r.drainOnSignal(ch, 10*time.Millisecond))
+	ensure.True(t, time.Since(start) < time.Minute)
+}
+
+func TestDrainOnSignalProcess(t *testing.T) {
+	// Keep the signal from terminating the test binary before the handler is
+	// installed.
+	guard := make(chan os.Signal, 10)
+	signal.Notify(guard, syscall.SIGINT)
+	defer signal.Stop(guard)
+
+	r := ReplicaSet{Log: &tLogger{TB: t}}
+	r.setState(LifecycleRunning)
+	done := make(chan error)
+	go func() { done <- r.DrainOnSignal(time.Minute) }()
+
+	// The handler is installed asynchronously, keep signalling until it runs.
+	for {
+		ensure.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGINT))
+		select {
+		case err := <-done:
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, r.State(), LifecycleDraining)
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+var errMaxListeners = errors.New("dvara: reached the maximum number of listeners")
+
+// eagerAddrs returns the members whose listeners are bound on Start. The
+// primary comes first so it is proxied regardless of MaxListeners, and is the
+// only one when using LazyListeners.
+func (r *ReplicaSet) eagerAddrs(healthy []string) []string {
+	var primary string
+	if r.lastState.lastIM != nil {
+		primary = r.lastState.lastIM.Primary
+	}
+	addrs := make([]string, 0, len(healthy))
+	for _, addr := range healthy {
+		if addr == primary {
+			addrs = append([]string{addr}, addrs...)
+		} else {
+			addrs = append(addrs, addr)
+		}
+	}
+	if r.LazyListeners && len(addrs) > 1 {
+		return addrs[:1]
+	}
+	return addrs
+}
+
+// newProxy binds a listener for the given member and adds its proxy, without
+// starting it. The mappingMutex must be held.
+func (r *ReplicaSet) newProxy(addr string) (*Proxy, error) {
+	if r.MaxListeners != 0 && len(r.proxies) >= r.MaxListeners {
+		return nil, errMaxListeners
+	}
+	listener, err := r.newListener()
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		Log:            r.Log,
+		ReplicaSet:     r,
+		ClientListener: listener,
+		ProxyAddr:      r.proxyAddr(listener),
+		MongoAddr:      addr,
+	}
+	if err := r.add(p); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	delete(r.pendingReal, addr)
+	return p, nil
+}
+
+// proxyList returns the started proxies. The mappingMutex must be held.
+func (r *ReplicaSet) proxyList() []*Proxy {
+	proxies := make([]*Proxy, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		proxies = append(proxies, p)
+	}
+	return proxies
+}
+
+// bindPending binds and starts the proxy for a healthy member on first need,
+// that is when it is about to be advertised to a client. Members which cannot
+// get a listener are reported like ignored members so they are not
+// advertised. Host names are resolved and the proxy started without holding
+// the mappingMutex, so other members keep being mapped meanwhile.
+func (r *ReplicaSet) bindPending(h string) (string, error) {
+	canonical := r.resolveAliases(h)
+
+	r.mappingMutex.Lock()
+	if proxyAddr, ok := r.realToProxy[h]; ok {
+		r.mappingMutex.Unlock()
+		return proxyAddr, nil
+	}
+	if real, ok := r.aliasReal[h]; ok {
+		r.mappingMutex.Unlock()
+		return r.realToProxy[real], nil
+	}
+	if _, ok := r.pendingReal[h]; !ok || !r.LazyListeners {
+		r.mappingMutex.Unlock()
+		return "", &ProxyMapperError{RealHost: h, State: r.memberState(h)}
+	}
+	if r.bindAlias(h, canonical) {
+		proxyAddr := r.realToProxy[r.aliasReal[h]]
+		r.mappingMutex.Unlock()
+		return proxyAddr, nil
+	}
+
+	p, err := r.newProxy(h)
+	if err == errMaxListeners {
+		r.Log.Warnf("not proxying %s, reached %d listeners", h, r.MaxListeners)
+		r.mappingMutex.Unlock()
+		return "", &ProxyMapperError{RealHost: h, State: r.memberState(h)}
+	}
+	if err != nil {
+		r.mappingMutex.Unlock()
+		return "", err
+	}
+	if err := r.validateMapping(); err != nil {
+		r.Log.Errorf("refusing to proxy %s: %s", h, err)
+		r.remove(p)
+		r.mappingMutex.Unlock()
+		p.ClientListener.Close()
+		return "", err
+	}
+	r.binding.Add(1)
+	r.mappingMutex.Unlock()
+	defer r.binding.Done()
+
+	// Clients given the address before the proxy is started wait in the
+	// listen backlog.
+	if err := p.Start(); err != nil {
+		r.mappingMutex.Lock()
+		r.remove(p)
+		r.mappingMutex.Unlock()
+		p.ClientListener.Close()
+		return "", err
+	}
+	return p.ProxyAddr, nil
+}
+
+// remove a proxy/mongo mapping, putting the member back as pending. The
+// mappingMutex must be held.
+func (r *ReplicaSet) remove(p *Proxy) {
+	delete(r.proxyToReal, p.ProxyAddr)
+	delete(r.realToProxy, p.MongoAddr)
+	delete(r.proxies, p.ProxyAddr)
+	// No member is pending once stopping.
+	if r.pendingReal != nil {
+		r.pendingReal[p.MongoAddr] = struct{}{}
+	}
+	r.removeAliases(p.MongoAddr)
+}
+
+// validateMapping checks the members and their proxies are mapped one to one,
+// and that the proxies are within the port range. The mappingMutex must be
+// held.
+func (r *ReplicaSet) validateMapping() error {
+	for proxyAddr, p := range r.proxies {
+		if p.ProxyAddr != proxyAddr ||
+			r.proxyToReal[proxyAddr] != p.MongoAddr ||
+			r.realToProxy[p.MongoAddr] != proxyAddr {
+			return &ProxyMappingError{
+				ProxyAddr: proxyAddr,
+				MongoAddr: p.MongoAddr,
+				Reason:    "proxy is not mapped one to one",
+			}
+		}
+		if r.PortEnd == 0 {
+			continue
+		}
+		_, port, err := net.SplitHostPort(proxyAddr)
+		if err != nil {
+			return err
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < r.PortStart || n > r.PortEnd {
+			return &ProxyMappingError{
+				ProxyAddr: proxyAddr,
+				MongoAddr: p.MongoAddr,
+				Reason:    fmt.Sprintf("port outside of range %d-%d", r.PortStart, r.PortEnd),
+			}
+		}
+	}
+	if len(r.proxyToReal) != len(r.proxies) || len(r.realToProxy) != len(r.proxies) {
+		for mongoAddr, proxyAddr := range r.realToProxy {
+			if _, ok := r.proxies[proxyAddr]; !ok || r.proxyToReal[proxyAddr] != mongoAddr {
+				return &ProxyMappingError{
+					ProxyAddr: proxyAddr,
+					MongoAddr: mongoAddr,
+					Reason:    "proxy is not mapped one to one",
+				}
+			}
+		}
+		return &ProxyMappingError{Reason: "stale proxy mapping"}
+	}
+	return nil
+}
+
+// memberState returns the last known state of the member.
+func (r *ReplicaSet) memberState(h string) ReplicaState {
+	if r.lastState != nil && r.lastState.lastRS != nil {
+		for _, m := range r.lastState.lastRS.Members {
+			if m.Name == h {
+				return m.State
+			}
+		}
+	}
+	return ""
+}
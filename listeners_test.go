@@ -0,0 +1,263 @@
+package dvara
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func newPendingReplicaSet(t *testing.T, lazy bool, max int) *ReplicaSet {
+	return &ReplicaSet{
+		Log:                     &tLogger{TB: t},
+		LazyListeners:           lazy,
+		MaxListeners:            max,
+		MaxConnections:          1,
+		MaxPerClientConnections: 1,
+		proxyToReal:             make(map[string]string),
+		realToProxy:             make(map[string]string),
+		proxies:                 make(map[string]*Proxy),
+		pendingReal: map[string]struct{}{
+			"a:1": {},
+			"b:1": {},
+			"c:1": {},
+		},
+		lastState: &ReplicaSetState{
+			lastRS: &replSetGetStatusResponse{
+				Members: []statusMember{
+					{Name: "a:1", State: ReplicaStatePrimary},
+					{Name: "b:1", State: ReplicaStateSecondary},
+					{Name: "c:1", State: ReplicaStateSecondary},
+				},
+			},
+			lastIM: &isMasterResponse{Primary: "b:1"},
+		},
+	}
+}
+
+func TestEagerAddrs(t *testing.T) {
+	t.Parallel()
+	healthy := []string{"a:1", "b:1", "c:1"}
+	r := newPendingReplicaSet(t, false, 0)
+	ensure.DeepEqual(t, r.eagerAddrs(healthy), []string{"b:1", "a:1", "c:1"})
+	r.LazyListeners = true
+	ensure.DeepEqual(t, r.eagerAddrs(healthy), []string{"b:1"})
+}
+
+func TestLazyListeners(t *testing.T) {
+	t.Parallel()
+	r := newPendingReplicaSet(t, true, 2)
+
+	a, err := r.Proxy("a:1")
+	ensure.Nil(t, err)
+	again, err := r.Proxy("a:1")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, again, a)
+	b, err := r.Proxy("b:1")
+	ensure.Nil(t, err)
+	ensure.NotDeepEqual(t, b, a)
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 2)
+
+	// The third member is over the limit and is not advertised.
+	_, err = r.Proxy("c:1")
+	ensure.DeepEqual(t, err, &ProxyMapperError{RealHost: "c:1", State: ReplicaStateSecondary})
+
+	// Stop closes the bound listeners and binds no more.
+	ensure.Nil(t, r.Stop())
+	for _, addr := range []string{a, b} {
+		_, port, err := net.SplitHostPort(addr)
+		ensure.Nil(t, err)
+		_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		ensure.NotNil(t, err)
+	}
+	_, err = r.Proxy("c:1")
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 2)
+}
+
+func TestPendingWithoutLazyListeners(t *testing.T) {
+	t.Parallel()
+	r := newPendingReplicaSet(t, false, 1)
+	_, err := r.Proxy("a:1")
+	ensure.DeepEqual(t, err, &ProxyMapperError{RealHost: "a:1", State: ReplicaStatePrimary})
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 0)
+}
+
+func TestValidateMapping(t *testing.T) {
+	t.Parallel()
+	r := newPendingReplicaSet(t, true, 0)
+	ensure.Nil(t, r.validateMapping())
+	a, err := r.Proxy("a:1")
+	ensure.Nil(t, err)
+	ensure.Nil(t, r.validateMapping())
+
+	// Port range is enforced when one is configured.
+	r.PortStart, r.PortEnd = 1, 2
+	ensure.DeepEqual(t, r.validateMapping(), &ProxyMappingError{
+		ProxyAddr: a,
+		MongoAddr: "a:1",
+		Reason:    "port outside of range 1-2",
+	})
+	r.PortStart, r.PortEnd = 0, 0
+
+	// A second member mapped to the same proxy is a collision.
+	r.realToProxy["x:1"] = a
+	ensure.DeepEqual(t, r.validateMapping(), &ProxyMappingError{
+		ProxyAddr: a,
+		MongoAddr: "x:1",
+		Reason:    "proxy is not mapped one to one",
+	})
+	ensure.Nil(t, r.Stop())
+}
+
+func TestBindPendingRefusesCollision(t *testing.T) {
+	t.Parallel()
+	r := newPendingReplicaSet(t, true, 0)
+	a, err := r.Proxy("a:1")
+	ensure.Nil(t, err)
+
+	// Corrupt the mapping so binding another member would collide with a.
+	r.mappingMutex.Lock()
+	r.proxyToReal[a] = "b:1"
+	r.mappingMutex.Unlock()
+
+	_, err = r.Proxy("c:1")
+	_, ok := err.(*ProxyMappingError)
+	ensure.True(t, ok)
+	r.mappingMutex.RLock()
+	_, bound := r.realToProxy["c:1"]
+	_, pending := r.pendingReal["c:1"]
+	r.mappingMutex.RUnlock()
+	ensure.False(t, bound)
+	ensure.True(t, pending)
+	ensure.Nil(t, r.Stop())
+}
+
+func TestBindPendingStartsWithoutLock(t *testing.T) {
+	t.Parallel()
+	mongo, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer mongo.Close()
+	r := newPendingReplicaSet(t, true, 0)
+	r.pendingReal[mongo.Addr().String()] = struct{}{}
+	r.PrewarmConnections = 1
+	r.DialLimiter = &DialLimiter{Max: 1}
+	r.DNSCache = &DNSCache{}
+
+	// Prewarming waits for the dial held here, meanwhile the mapping is not
+	// locked.
+	r.DialLimiter.acquire()
+	bound := make(chan string)
+	go func() {
+		proxyAddr, err := r.Proxy(mongo.Addr().String())
+		if err != nil {
+			t.Error(err)
+		}
+		bound <- proxyAddr
+	}()
+	members := make(chan int)
+	go func() {
+		for {
+			if n := len(r.ProxyMembers()); n != 0 {
+				members <- n
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case n := <-members:
+		ensure.DeepEqual(t, n, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("mapping locked while starting the proxy")
+	}
+	r.DialLimiter.release()
+	proxyAddr := <-bound
+	ensure.DeepEqual(t, r.ProxyMembers(), []string{proxyAddr})
+	ensure.Nil(t, r.Stop())
+}
+
+func TestListenerProxy(t *testing.T) {
+	t.Parallel()
+	r := newPendingReplicaSet(t, true, 0)
+	a, err := r.Proxy("a:1")
+	ensure.Nil(t, err)
+	b, err := r.Proxy("b:1")
+	ensure.Nil(t, err)
+	defer r.Stop()
+
+	// Clients see the address of the interface they connected through, only
+	// the port identifies the listener.
+	for _, addr := range []string{a, b} {
+		_, port, err := net.SplitHostPort(addr)
+		ensure.Nil(t, err)
+		local, err := net.ResolveTCPAddr("tcp", net.JoinHostPort("10.0.0.1", port))
+		ensure.Nil(t, err)
+		proxy, err := r.ListenerProxy(local)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, proxy, addr)
+	}
+
+	_, err = r.ListenerProxy(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1})
+	ensure.NotNil(t, err)
+}
+
+// hostsResolver resolves host names from a fixed table.
+type hostsResolver map[string][]string
+
+func (r hostsResolver) LookupHost(host string) ([]string, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host}
+}
+
+func TestCollapseAliases(t *testing.T) {
+	t.Parallel()
+	r := newPendingReplicaSet(t, true, 0)
+	r.CollapseAliases = true
+	r.DNSCache = &DNSCache{Resolver: hostsResolver{
+		"a": {"10.0.0.2", "10.0.0.1"},
+		"b": {"10.0.0.1"},
+		"c": {"10.0.0.3"},
+	}}
+
+	a, err := r.Proxy("a:1")
+	ensure.Nil(t, err)
+	b, err := r.Proxy("b:1")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, b, a)
+	c, err := r.Proxy("c:1")
+	ensure.Nil(t, err)
+	ensure.NotDeepEqual(t, c, a)
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 2)
+	ensure.Nil(t, r.validateMapping())
+
+	// Clients see the shared proxy once.
+	hosts, err := proxyHosts(r.Log, r, []string{"a:1", "b:1", "c:1"})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, hosts, []string{a, c})
+
+	// Removing the proxy puts its aliases back as pending.
+	r.mappingMutex.Lock()
+	p := r.proxies[a]
+	r.remove(p)
+	_, pending := r.pendingReal["b:1"]
+	r.mappingMutex.Unlock()
+	ensure.True(t, pending)
+	ensure.Nil(t, p.Stop())
+	ensure.Nil(t, r.Stop())
+}
+
+func TestCollapseAliasesDisabled(t *testing.T) {
+	t.Parallel()
+	r := newPendingReplicaSet(t, true, 0)
+	r.DNSCache = &DNSCache{Resolver: hostsResolver{"a": {"10.0.0.1"}, "b": {"10.0.0.1"}}}
+	a, err := r.Proxy("a:1")
+	ensure.Nil(t, err)
+	b, err := r.Proxy("b:1")
+	ensure.Nil(t, err)
+	ensure.NotDeepEqual(t, b, a)
+	ensure.Nil(t, r.Stop())
+}
@@ -0,0 +1,69 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxLocalCommandLength is the largest message body inspected for commands
+// answered locally. Anything larger is proxied without being inspected.
+const maxLocalCommandLength = 16 * 1024
+
+// answerLocally replies to ping and whatsmyuri commands when LocalCommands is
+// set, and to anything against the IntrospectionDatabase when Introspection is
+// set, without involving a server. Small OpQuery and OpMsg bodies are read to
+// find the command. The returned net.Conn should be used to proxy the message
+// if it was not answered, it replays the body if it was read.
+func (p *Proxy) answerLocally(h *messageHeader, c net.Conn) (net.Conn, bool, error) {
+	if !p.ReplicaSet.LocalCommands && !p.ReplicaSet.Introspection ||
+		h.OpCode != OpQuery && h.OpCode != OpMsg ||
+		h.MessageLength-headerLen > maxLocalCommandLength {
+		return c, false, nil
+	}
+
+	body := make([]byte, h.MessageLength-headerLen)
+	c.SetReadDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, false, err
+	}
+	replay := newBufferedConn(c, body)
+	if h.OpCode == OpMsg && len(body) >= 4 && uint32(getInt32(body, 0))&msgFlagMoreToCome != 0 {
+		return replay, false, nil
+	}
+
+	op := TracedOperation{OpCode: h.OpCode}
+	op.describe(body, p.ReplicaSet.CommandClassifier)
+	var doc bson.D
+	switch {
+	default:
+		return replay, false, nil
+	case p.ReplicaSet.Introspection && databaseOf(op.Namespace) == IntrospectionDatabase:
+		doc = p.ReplicaSet.introspect()
+	case !p.ReplicaSet.LocalCommands:
+		return replay, false, nil
+	case strings.EqualFold(op.Command, "ping"):
+		doc = bson.D{{Name: "ok", Value: 1}}
+	case strings.EqualFold(op.Command, "whatsmyuri"):
+		doc = bson.D{
+			{Name: "you", Value: c.RemoteAddr().String()},
+			{Name: "ok", Value: 1},
+		}
+	}
+
+	reply, err := newReply(h, 0, doc)
+	if err != nil {
+		return nil, false, err
+	}
+	c.SetWriteDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	if _, err := c.Write(reply); err != nil {
+		return nil, false, err
+	}
+	p.Log.Debugf("answered %s on %s from %s locally", op.Command, op.Namespace, c.RemoteAddr())
+	stats.BumpSum(p.stats, "message.local.reply", 1)
+	return c, true, nil
+}
@@ -0,0 +1,115 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLocalCommands(t *testing.T) {
+	t.Parallel()
+	var accepted int32
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	mongo := &fakeMongo{
+		Listener: &countingListener{Listener: l, accepted: &accepted},
+		Handler:  okReply,
+	}
+	go mongo.acceptLoop()
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{LocalCommands: true})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	roundTrip := func(h *messageHeader, body []byte) (*messageHeader, bson.M) {
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		b := make([]byte, reply.MessageLength-headerLen)
+		_, err = io.ReadFull(c, b)
+		ensure.Nil(t, err)
+		if reply.OpCode == OpMsg {
+			b = b[5:]
+		} else {
+			b = b[len(emptyPrefix):]
+		}
+		var doc bson.M
+		ensure.Nil(t, bson.Unmarshal(b, &doc))
+		return reply, doc
+	}
+
+	cases := []struct {
+		Name     string
+		Msg      bool
+		Command  bson.D
+		Expected bson.M
+	}{
+		{
+			Name:     "query ping",
+			Command:  bson.D{{Name: "ping", Value: 1}},
+			Expected: bson.M{"ok": 1},
+		},
+		{
+			Name:     "msg ping",
+			Msg:      true,
+			Command:  bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}},
+			Expected: bson.M{"ok": 1},
+		},
+		{
+			Name:     "query whatsmyuri",
+			Command:  bson.D{{Name: "whatsmyuri", Value: 1}},
+			Expected: bson.M{"you": c.LocalAddr().String(), "ok": 1},
+		},
+		{
+			Name:     "msg whatsmyuri",
+			Msg:      true,
+			Command:  bson.D{{Name: "whatsmyuri", Value: 1}, {Name: "$db", Value: "admin"}},
+			Expected: bson.M{"you": c.LocalAddr().String(), "ok": 1},
+		},
+	}
+	for i, tc := range cases {
+		var h *messageHeader
+		var body []byte
+		if tc.Msg {
+			h, body = fakeOpMsg(0, tc.Command)
+		} else {
+			h, body = fakeQuery("admin.$cmd", tc.Command)
+		}
+		h.RequestID = int32(i + 1)
+		reply, doc := roundTrip(h, body)
+		ensure.DeepEqual(t, reply.ResponseTo, h.RequestID, tc.Name)
+		if tc.Msg {
+			ensure.DeepEqual(t, reply.OpCode, OpMsg, tc.Name)
+		} else {
+			ensure.DeepEqual(t, reply.OpCode, OpReply, tc.Name)
+		}
+		ensure.DeepEqual(t, doc, tc.Expected, tc.Name)
+	}
+	ensure.DeepEqual(t, atomic.LoadInt32(&accepted), int32(0))
+
+	// Anything else still goes to the server.
+	_, doc := roundTrip(fakeQuery("admin.$cmd", bson.D{{Name: "buildInfo", Value: 1}}))
+	ensure.DeepEqual(t, doc, bson.M{"ok": 1})
+	ensure.DeepEqual(t, atomic.LoadInt32(&accepted), int32(1))
+}
+
+type countingListener struct {
+	net.Listener
+	accepted *int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.accepted, 1)
+	}
+	return c, err
+}
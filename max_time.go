@@ -0,0 +1,142 @@
+package dvara
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxTimeMSCommands are the commands which accept a maxTimeMS argument and
+// will be subject to the ceiling.
+var maxTimeMSCommands = []string{
+	"aggregate",
+	"count",
+	"distinct",
+	"find",
+	"geoNear",
+	"geoSearch",
+	"group",
+	"mapReduce",
+	"parallelCollectionScan",
+	"text",
+}
+
+// MaxTimeMSRewriter enforces a ceiling on how long queries and commands are
+// allowed to run on the server. Operations without a time limit get the
+// ceiling injected, and those with a larger one are clamped to it.
+type MaxTimeMSRewriter struct {
+	// Max is the ceiling. Zero disables enforcement.
+	Max time.Duration
+}
+
+// Enabled returns true if a ceiling has been configured.
+func (r *MaxTimeMSRewriter) Enabled() bool {
+	return r != nil && r.Max > 0
+}
+
+func (r *MaxTimeMSRewriter) maxMS() int64 {
+	ms := int64(r.Max / time.Millisecond)
+	if ms == 0 {
+		ms = 1
+	}
+	return ms
+}
+
+// RewriteQuery enforces the ceiling on a non command OpQuery document. It
+// returns the new document and true if it was modified. An unwrapped query is
+// wrapped in $query in order to specify $maxTimeMS.
+func (r *MaxTimeMSRewriter) RewriteQuery(q bson.D) (bson.D, bool) {
+	if !r.Enabled() {
+		return q, false
+	}
+	if !isWrappedQuery(q) {
+		q = bson.D{{Name: "$query", Value: q}}
+	}
+	return r.clamp(q, "$maxTimeMS")
+}
+
+// RewriteCommand enforces the ceiling on a command document. Commands wrapped
+// in $query, as sent by some drivers along with $readPreference, are
+// rewritten within the wrapper. It returns the new document and true if it
+// was modified.
+func (r *MaxTimeMSRewriter) RewriteCommand(cmd bson.D) (bson.D, bool) {
+	if !r.Enabled() || len(cmd) == 0 {
+		return cmd, false
+	}
+	if isWrappedQuery(cmd) {
+		for i, e := range cmd {
+			if e.Name != "$query" {
+				continue
+			}
+			inner, ok := e.Value.(bson.D)
+			if !ok {
+				return cmd, false
+			}
+			newInner, ok := r.RewriteCommand(inner)
+			if !ok {
+				return cmd, false
+			}
+			newCmd := append(bson.D(nil), cmd...)
+			newCmd[i].Value = newInner
+			return newCmd, true
+		}
+		return cmd, false
+	}
+	if !isMaxTimeMSCommand(cmd[0].Name) {
+		return cmd, false
+	}
+	return r.clamp(cmd, "maxTimeMS")
+}
+
+// clamp sets the named field to the ceiling if it is missing, not a positive
+// number or larger than the ceiling.
+func (r *MaxTimeMSRewriter) clamp(d bson.D, field string) (bson.D, bool) {
+	max := r.maxMS()
+	for i, e := range d {
+		if e.Name != field {
+			continue
+		}
+		if current, ok := int64Value(e.Value); ok && current > 0 && current <= max {
+			return d, false
+		}
+		newD := append(bson.D(nil), d...)
+		newD[i].Value = max
+		return newD, true
+	}
+	return append(d, bson.DocElem{Name: field, Value: max}), true
+}
+
+// isWrappedQuery checks if the query is using the $query wrapper form.
+func isWrappedQuery(q bson.D) bool {
+	for _, e := range q {
+		if e.Name == "$query" {
+			return true
+		}
+	}
+	return false
+}
+
+func isMaxTimeMSCommand(name string) bool {
+	for _, c := range maxTimeMSCommands {
+		if strings.EqualFold(name, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// int64Value converts the various numeric BSON types to an int64.
+func int64Value(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,155 @@
+package dvara
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMaxTimeMSRewriteCommand(t *testing.T) {
+	t.Parallel()
+	r := &MaxTimeMSRewriter{Max: time.Second}
+	cases := []struct {
+		Name      string
+		In        bson.D
+		Out       bson.D
+		Rewritten bool
+	}{
+		{
+			Name:      "injected when absent",
+			In:        bson.D{{Name: "find", Value: "foo"}},
+			Out:       bson.D{{Name: "find", Value: "foo"}, {Name: "maxTimeMS", Value: int64(1000)}},
+			Rewritten: true,
+		},
+		{
+			Name:      "clamped when too large",
+			In:        bson.D{{Name: "count", Value: "foo"}, {Name: "maxTimeMS", Value: 5000}},
+			Out:       bson.D{{Name: "count", Value: "foo"}, {Name: "maxTimeMS", Value: int64(1000)}},
+			Rewritten: true,
+		},
+		{
+			Name:      "clamped when unlimited",
+			In:        bson.D{{Name: "count", Value: "foo"}, {Name: "maxTimeMS", Value: int32(0)}},
+			Out:       bson.D{{Name: "count", Value: "foo"}, {Name: "maxTimeMS", Value: int64(1000)}},
+			Rewritten: true,
+		},
+		{
+			Name:      "within the ceiling",
+			In:        bson.D{{Name: "aggregate", Value: "foo"}, {Name: "maxTimeMS", Value: 500.0}},
+			Out:       bson.D{{Name: "aggregate", Value: "foo"}, {Name: "maxTimeMS", Value: 500.0}},
+			Rewritten: false,
+		},
+		{
+			Name:      "unsupported command",
+			In:        bson.D{{Name: "insert", Value: "foo"}},
+			Out:       bson.D{{Name: "insert", Value: "foo"}},
+			Rewritten: false,
+		},
+		{
+			Name: "wrapped command",
+			In: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "count", Value: "foo"}}},
+				{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondary"}}},
+			},
+			Out: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "count", Value: "foo"}, {Name: "maxTimeMS", Value: int64(1000)}}},
+				{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondary"}}},
+			},
+			Rewritten: true,
+		},
+	}
+
+	for _, c := range cases {
+		out, rewritten := r.RewriteCommand(c.In)
+		if rewritten != c.Rewritten {
+			t.Fatalf("for case %s expected rewritten %v got %v", c.Name, c.Rewritten, rewritten)
+		}
+		if !reflect.DeepEqual(out, c.Out) {
+			t.Fatalf("for case %s expected %v got %v", c.Name, c.Out, out)
+		}
+	}
+}
+
+func TestMaxTimeMSRewriteQuery(t *testing.T) {
+	t.Parallel()
+	r := &MaxTimeMSRewriter{Max: time.Second}
+	cases := []struct {
+		Name      string
+		In        bson.D
+		Out       bson.D
+		Rewritten bool
+	}{
+		{
+			Name: "injected when absent",
+			In:   bson.D{{Name: "a", Value: 1}},
+			Out: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+				{Name: "$maxTimeMS", Value: int64(1000)},
+			},
+			Rewritten: true,
+		},
+		{
+			Name: "clamped when too large",
+			In: bson.D{
+				{Name: "$query", Value: bson.D{}},
+				{Name: "$maxTimeMS", Value: int64(2000)},
+			},
+			Out: bson.D{
+				{Name: "$query", Value: bson.D{}},
+				{Name: "$maxTimeMS", Value: int64(1000)},
+			},
+			Rewritten: true,
+		},
+		{
+			Name: "within the ceiling",
+			In: bson.D{
+				{Name: "$query", Value: bson.D{}},
+				{Name: "$maxTimeMS", Value: 10},
+			},
+			Out: bson.D{
+				{Name: "$query", Value: bson.D{}},
+				{Name: "$maxTimeMS", Value: 10},
+			},
+			Rewritten: false,
+		},
+	}
+
+	for _, c := range cases {
+		out, rewritten := r.RewriteQuery(c.In)
+		if rewritten != c.Rewritten {
+			t.Fatalf("for case %s expected rewritten %v got %v", c.Name, c.Rewritten, rewritten)
+		}
+		if !reflect.DeepEqual(out, c.Out) {
+			t.Fatalf("for case %s expected %v got %v", c.Name, c.Out, out)
+		}
+	}
+}
+
+func TestMaxTimeMSDisabled(t *testing.T) {
+	t.Parallel()
+	var r MaxTimeMSRewriter
+	in := bson.D{{Name: "find", Value: "foo"}}
+	if _, rewritten := r.RewriteCommand(in); rewritten {
+		t.Fatal("was not expecting a rewrite")
+	}
+	if _, rewritten := r.RewriteQuery(in); rewritten {
+		t.Fatal("was not expecting a rewrite")
+	}
+}
+
+func TestMaxTimeMSNil(t *testing.T) {
+	t.Parallel()
+	var r *MaxTimeMSRewriter
+	if r.Enabled() {
+		t.Fatal("was not expecting a nil rewriter to be enabled")
+	}
+	in := bson.D{{Name: "find", Value: "foo"}}
+	if _, rewritten := r.RewriteCommand(in); rewritten {
+		t.Fatal("was not expecting a rewrite")
+	}
+	if _, rewritten := r.RewriteQuery(in); rewritten {
+		t.Fatal("was not expecting a rewrite")
+	}
+}
@@ -0,0 +1,286 @@
+package dvara
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OpMsg flag bits:
+// https://github.com/mongodb/specifications/blob/master/source/message/OP_MSG.rst#flag-bits
+const (
+	msgFlagChecksumPresent = uint32(1 << 0)
+	msgFlagMoreToCome      = uint32(1 << 1)
+	msgFlagExhaustAllowed  = uint32(1 << 16)
+)
+
+// OpMsg section kinds.
+const (
+	msgSectionBody     = byte(0)
+	msgSectionSequence = byte(1)
+)
+
+var (
+	errMsgTooShort      = errors.New("dvara: OP_MSG too short")
+	errMsgNoBody        = errors.New("dvara: OP_MSG without a body section")
+	errMsgUnknownKind   = errors.New("dvara: OP_MSG with unknown section kind")
+	errMsgSectionLength = errors.New("dvara: OP_MSG section exceeds message length")
+
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// opMsg is a fully buffered OP_MSG. The body section is kept as a raw BSON
+// document, document sequences are kept as is including their kind byte.
+type opMsg struct {
+	Flags     uint32
+	Body      []byte
+	Sequences [][]byte
+}
+
+// readOpMsg reads the rest of an OP_MSG described by the given header.
+func readOpMsg(h *messageHeader, r io.Reader) (*opMsg, error) {
+	if h.MessageLength < headerLen+4 {
+		return nil, errMsgTooShort
+	}
+	b := make([]byte, h.MessageLength-headerLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	m := opMsg{Flags: uint32(getInt32(b, 0))}
+	end := len(b)
+	if m.Flags&msgFlagChecksumPresent != 0 {
+		end -= 4
+	}
+	for pos := 4; pos < end; {
+		kind := b[pos]
+		if pos+5 > end {
+			return nil, errMsgSectionLength
+		}
+		size := int(getInt32(b, pos+1))
+		if size < 4 || pos+1+size > end {
+			return nil, errMsgSectionLength
+		}
+		switch kind {
+		default:
+			return nil, errMsgUnknownKind
+		case msgSectionBody:
+			m.Body = b[pos+1 : pos+1+size]
+		case msgSectionSequence:
+			m.Sequences = append(m.Sequences, b[pos:pos+1+size])
+		}
+		pos += 1 + size
+	}
+	if m.Body == nil {
+		return nil, errMsgNoBody
+	}
+	return &m, nil
+}
+
+// Command unmarshals the body section.
+func (m *opMsg) Command() (bson.D, error) {
+	var cmd bson.D
+	if err := bson.Unmarshal(m.Body, &cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// SetCommand replaces the body section.
+func (m *opMsg) SetCommand(cmd bson.D) error {
+	body, err := bson.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	m.Body = body
+	return nil
+}
+
+// ToWire converts the message to the wire protocol. The MessageLength of the
+// header is updated and the checksum recalculated if one was present.
+func (m *opMsg) ToWire(h *messageHeader) []byte {
+	length := headerLen + 4 + 1 + len(m.Body)
+	for _, s := range m.Sequences {
+		length += len(s)
+	}
+	if m.Flags&msgFlagChecksumPresent != 0 {
+		length += 4
+	}
+	h.MessageLength = int32(length)
+
+	b := make([]byte, 0, length)
+	b = append(b, h.ToWire()...)
+	var flags [4]byte
+	setInt32(flags[:], 0, int32(m.Flags))
+	b = append(b, flags[:]...)
+	b = append(b, msgSectionBody)
+	b = append(b, m.Body...)
+	for _, s := range m.Sequences {
+		b = append(b, s...)
+	}
+	if m.Flags&msgFlagChecksumPresent != 0 {
+		var sum [4]byte
+		setInt32(sum[:], 0, int32(crc32.Checksum(b, castagnoliTable)))
+		b = append(b, sum[:]...)
+	}
+	return b
+}
+
+// ProxyMsg proxies an OpMsg and a corresponding response.
+type ProxyMsg struct {
+	Log               Logger             `inject:""`
+	MaxTimeMSRewriter *MaxTimeMSRewriter `inject:""`
+	BatchSizeRewriter *BatchSizeRewriter `inject:""`
+	ReplyBatchLimiter *ReplyBatchLimiter `inject:""`
+}
+
+// Proxy proxies an OpMsg and a corresponding response. Requests with the
+// moreToCome flag set are unacknowledged and get no response. The documents
+// held back by the ReplyBatchLimiter for the client connection are in held.
+func (p *ProxyMsg) Proxy(
+	h *messageHeader,
+	client io.ReadWriter,
+	server io.ReadWriter,
+	held *HeldBatches,
+) error {
+
+	if !p.MaxTimeMSRewriter.Enabled() && !p.BatchSizeRewriter.Enabled() && !p.ReplyBatchLimiter.Enabled() {
+		flags, err := p.forwardRequest(h, client, server)
+		if err != nil {
+			return err
+		}
+		return p.copyResponse(flags, client, server, h)
+	}
+
+	m, cmd, err := p.rewriteRequest(h, client)
+	if err != nil {
+		return err
+	}
+	reply, ok, err := p.ReplyBatchLimiter.heldReply(h, cmd, held)
+	if err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	if ok {
+		_, err := client.Write(reply)
+		return err
+	}
+	p.ReplyBatchLimiter.forgetKilled(cmd, held)
+	if _, err := server.Write(m.ToWire(h)); err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	if m.Flags&msgFlagMoreToCome == 0 && p.ReplyBatchLimiter.limits(m.Flags, cmd) {
+		if err := p.ReplyBatchLimiter.copyReply(client, server, h, held); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		return nil
+	}
+	return p.copyResponse(m.Flags, client, server, h)
+}
+
+// copyResponse copies the replies to a request with the given flags, unless it
+// has the moreToCome flag set.
+func (p *ProxyMsg) copyResponse(flags uint32, client io.Writer, server io.Reader, h *messageHeader) error {
+	if flags&msgFlagMoreToCome != 0 {
+		return nil
+	}
+	if err := p.copyReplies(client, server, h); err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// forwardRequest forwards the request to the server as is and returns its
+// flags.
+func (p *ProxyMsg) forwardRequest(h *messageHeader, client io.Reader, server io.Writer) (uint32, error) {
+	if h.MessageLength < headerLen+4 {
+		return 0, errMsgTooShort
+	}
+	var flags [4]byte
+	if _, err := io.ReadFull(client, flags[:]); err != nil {
+		p.Log.Error(err)
+		return 0, err
+	}
+	if _, err := server.Write(append(h.ToWire(), flags[:]...)); err != nil {
+		p.Log.Error(err)
+		return 0, err
+	}
+	if err := copyBody(server, client, int64(h.MessageLength-headerLen-4)); err != nil {
+		p.Log.Error(err)
+		return 0, err
+	}
+	return uint32(getInt32(flags[:], 0)), nil
+}
+
+// rewriteRequest buffers the request and applies the request rewriters. It
+// returns the request to forward and its command.
+func (p *ProxyMsg) rewriteRequest(h *messageHeader, client io.Reader) (*opMsg, bson.D, error) {
+	m, err := readOpMsg(h, client)
+	if err != nil {
+		p.Log.Error(err)
+		return nil, nil, err
+	}
+
+	cmd, err := m.Command()
+	if err != nil {
+		p.Log.Error(err)
+		return nil, nil, err
+	}
+
+	rewritten := false
+	if newCmd, ok := p.MaxTimeMSRewriter.RewriteCommand(cmd); ok {
+		cmd, rewritten = newCmd, true
+	}
+	if newCmd, ok := p.BatchSizeRewriter.RewriteCommand(cmd); ok {
+		cmd, rewritten = newCmd, true
+	}
+	if rewritten {
+		if err := m.SetCommand(cmd); err != nil {
+			p.Log.Error(err)
+			return nil, nil, err
+		}
+	}
+	return m, cmd, nil
+}
+
+// copyReplies copies the reply to the request. A reply with the moreToCome
+// flag set, as sent for exhaust cursors, is followed by another reply in
+// response to it, so replies are copied until one without the flag.
+func (p *ProxyMsg) copyReplies(client io.Writer, server io.Reader, req *messageHeader) error {
+	for {
+		h, err := readHeader(server)
+		if err != nil {
+			return err
+		}
+		if h.ResponseTo != req.RequestID {
+			return &ReplyMismatchError{RequestID: req.RequestID, ResponseTo: h.ResponseTo}
+		}
+		if err := h.WriteTo(client); err != nil {
+			return err
+		}
+		pending := int64(h.MessageLength - headerLen)
+		if h.OpCode != OpMsg || pending < 4 {
+			return truncatedReply(h, copyBody(client, server, pending))
+		}
+
+		var flags [4]byte
+		if _, err := io.ReadFull(server, flags[:]); err != nil {
+			return truncatedReply(h, err)
+		}
+		if _, err := client.Write(flags[:]); err != nil {
+			return err
+		}
+		if err := copyBody(client, server, pending-4); err != nil {
+			return truncatedReply(h, err)
+		}
+		if uint32(getInt32(flags[:], 0))&msgFlagMoreToCome == 0 {
+			return nil
+		}
+		req = h
+	}
+}
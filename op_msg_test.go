@@ -0,0 +1,303 @@
+package dvara
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func fakeOpMsg(flags uint32, cmd interface{}, sequences ...[]byte) (*messageHeader, []byte) {
+	body, err := bson.Marshal(cmd)
+	if err != nil {
+		panic(err)
+	}
+	m := opMsg{Flags: flags, Body: body, Sequences: sequences}
+	h := &messageHeader{OpCode: OpMsg}
+	b := m.ToWire(h)
+	return h, b[headerLen:]
+}
+
+func fakeDocSequence(identifier string, docs ...interface{}) []byte {
+	var b []byte
+	b = append(b, msgSectionSequence, 0, 0, 0, 0)
+	b = append(b, identifier...)
+	b = append(b, 0)
+	for _, d := range docs {
+		raw, err := bson.Marshal(d)
+		if err != nil {
+			panic(err)
+		}
+		b = append(b, raw...)
+	}
+	setInt32(b, 1, int32(len(b)-1))
+	return b
+}
+
+func TestOpMsgRoundTrip(t *testing.T) {
+	t.Parallel()
+	seq := fakeDocSequence("documents", bson.M{"a": 1}, bson.M{"b": 2})
+	cmd := bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}}
+	h, body := fakeOpMsg(0, cmd, seq)
+	if int(h.MessageLength) != headerLen+len(body) {
+		t.Fatalf("unexpected message length %d", h.MessageLength)
+	}
+	m, err := readOpMsg(h, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := m.Command()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cmd, actual) {
+		t.Fatalf("expected %v got %v", cmd, actual)
+	}
+	if len(m.Sequences) != 1 || !bytes.Equal(m.Sequences[0], seq) {
+		t.Fatal("did not get expected document sequence")
+	}
+	if !bytes.Equal(m.ToWire(h), append(h.ToWire(), body...)) {
+		t.Fatal("did not get back the same bytes")
+	}
+}
+
+func TestOpMsgChecksum(t *testing.T) {
+	t.Parallel()
+	h, body := fakeOpMsg(msgFlagChecksumPresent, bson.D{{Name: "ping", Value: 1}})
+	m, err := readOpMsg(h, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetCommand(bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	b := m.ToWire(h)
+	if int(h.MessageLength) != len(b) {
+		t.Fatalf("expected length %d got %d", len(b), h.MessageLength)
+	}
+	expected := crc32.Checksum(b[:len(b)-4], castagnoliTable)
+	if actual := uint32(getInt32(b, len(b)-4)); actual != expected {
+		t.Fatalf("expected checksum %d got %d", expected, actual)
+	}
+}
+
+func TestReadOpMsgErrors(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name   string
+		Length int32
+		Body   []byte
+		Error  error
+	}{
+		{
+			Name:   "too short",
+			Length: headerLen + 2,
+			Error:  errMsgTooShort,
+		},
+		{
+			Name:   "no body",
+			Length: headerLen + 4,
+			Body:   []byte{0, 0, 0, 0},
+			Error:  errMsgNoBody,
+		},
+		{
+			Name:   "unknown kind",
+			Length: headerLen + 9,
+			Body:   []byte{0, 0, 0, 0, 7, 4, 0, 0, 0},
+			Error:  errMsgUnknownKind,
+		},
+		{
+			Name:   "section overruns message",
+			Length: headerLen + 9,
+			Body:   []byte{0, 0, 0, 0, 0, 9, 0, 0, 0},
+			Error:  errMsgSectionLength,
+		},
+	}
+	for _, c := range cases {
+		h := &messageHeader{OpCode: OpMsg, MessageLength: c.Length}
+		if _, err := readOpMsg(h, bytes.NewReader(c.Body)); err != c.Error {
+			t.Fatalf("for case %s expected %s got %v", c.Name, c.Error, err)
+		}
+	}
+}
+
+func TestProxyMsg(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Max      time.Duration
+		In       bson.D
+		Expected bson.D
+	}{
+		{
+			Name:     "disabled",
+			In:       bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}},
+			Expected: bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}},
+		},
+		{
+			Name: "injected",
+			Max:  time.Minute,
+			In:   bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}},
+			Expected: bson.D{
+				{Name: "find", Value: "foo"},
+				{Name: "$db", Value: "test"},
+				{Name: "maxTimeMS", Value: int64(60000)},
+			},
+		},
+		{
+			Name: "clamped",
+			Max:  time.Minute,
+			In: bson.D{
+				{Name: "find", Value: "foo"},
+				{Name: "maxTimeMS", Value: int64(120000)},
+				{Name: "$db", Value: "test"},
+			},
+			Expected: bson.D{
+				{Name: "find", Value: "foo"},
+				{Name: "maxTimeMS", Value: int64(60000)},
+				{Name: "$db", Value: "test"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		p := &ProxyMsg{
+			Log:               &tLogger{TB: t},
+			MaxTimeMSRewriter: &MaxTimeMSRewriter{Max: c.Max},
+		}
+		h, body := fakeOpMsg(0, c.In)
+		reply := bson.D{{Name: "ok", Value: 1}}
+		var clientOut, serverIn bytes.Buffer
+		client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+		server := fakeReadWriter{Reader: fakeSingleDocReply(reply), Writer: &serverIn}
+		if err := p.Proxy(h, client, server, &HeldBatches{}); err != nil {
+			t.Fatalf("unexpected error for case %s: %s", c.Name, err)
+		}
+
+		sh, err := readHeader(&serverIn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(sh.MessageLength) != headerLen+serverIn.Len() {
+			t.Fatalf("incorrect message length for case %s", c.Name)
+		}
+		m, err := readOpMsg(sh, &serverIn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := m.Command()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, c.Expected) {
+			t.Fatalf("for case %s expected %v got %v", c.Name, c.Expected, actual)
+		}
+		if clientOut.Len() == 0 {
+			t.Fatalf("reply was not forwarded for case %s", c.Name)
+		}
+	}
+}
+
+func TestProxyMsgMoreToCome(t *testing.T) {
+	t.Parallel()
+	for _, max := range []time.Duration{0, time.Minute} {
+		p := &ProxyMsg{
+			Log:               &tLogger{TB: t},
+			MaxTimeMSRewriter: &MaxTimeMSRewriter{Max: max},
+		}
+		h, body := fakeOpMsg(msgFlagMoreToCome, bson.D{
+			{Name: "insert", Value: "foo"},
+			{Name: "$db", Value: "test"},
+		})
+		var clientOut, serverIn bytes.Buffer
+		client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+		// The server does not reply, reading from it would fail.
+		server := fakeReadWriter{Reader: bytes.NewReader(nil), Writer: &serverIn}
+		ensure.Nil(t, p.Proxy(h, client, server, &HeldBatches{}))
+		ensure.DeepEqual(t, serverIn.Len(), int(h.MessageLength))
+		ensure.DeepEqual(t, clientOut.Len(), 0)
+	}
+}
+
+func TestProxyMsgExhaustReplies(t *testing.T) {
+	t.Parallel()
+	p := &ProxyMsg{
+		Log:               &tLogger{TB: t},
+		MaxTimeMSRewriter: &MaxTimeMSRewriter{},
+	}
+	reply := func(flags uint32, requestID, responseTo int32) []byte {
+		h, body := fakeOpMsg(flags, bson.D{{Name: "ok", Value: 1}})
+		h.RequestID = requestID
+		h.ResponseTo = responseTo
+		return append(h.ToWire(), body...)
+	}
+
+	h, body := fakeOpMsg(0, bson.D{{Name: "getMore", Value: int64(1)}, {Name: "$db", Value: "test"}})
+	h.RequestID = 1
+	var replies []byte
+	replies = append(replies, reply(msgFlagMoreToCome, 10, 1)...)
+	replies = append(replies, reply(msgFlagMoreToCome, 11, 10)...)
+	replies = append(replies, reply(0, 12, 11)...)
+	stray := reply(0, 13, 1)
+
+	var clientOut, serverIn bytes.Buffer
+	serverOut := bytes.NewReader(append(replies, stray...))
+	client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+	server := fakeReadWriter{Reader: serverOut, Writer: &serverIn}
+	ensure.Nil(t, p.Proxy(h, client, server, &HeldBatches{}))
+	ensure.DeepEqual(t, clientOut.Bytes(), replies)
+	ensure.DeepEqual(t, serverOut.Len(), len(stray))
+
+	// A follow up reply must be in response to the previous reply.
+	client = fakeReadWriter{Reader: bytes.NewReader(body), Writer: ioutil.Discard}
+	server = fakeReadWriter{
+		Reader: bytes.NewReader(append(reply(msgFlagMoreToCome, 10, 1), reply(0, 11, 1)...)),
+		Writer: ioutil.Discard,
+	}
+	ensure.DeepEqual(t, p.Proxy(h, client, server, &HeldBatches{}), &ReplyMismatchError{RequestID: 10, ResponseTo: 1})
+}
+
+func TestUnacknowledgedOpMsgDoesNotHang(t *testing.T) {
+	t.Parallel()
+	var unacknowledged int32
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		if h.OpCode == OpMsg && uint32(getInt32(body, 0))&msgFlagMoreToCome != 0 {
+			atomic.AddInt32(&unacknowledged, 1)
+			return nil
+		}
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	ensure.Nil(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+
+	h, body := fakeOpMsg(msgFlagMoreToCome, bson.D{
+		{Name: "insert", Value: "foo"},
+		{Name: "$db", Value: "test"},
+	})
+	h.RequestID = 1
+	_, err = c.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+
+	h, body = fakeOpMsg(0, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+	h.RequestID = 2
+	_, err = c.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+
+	reply, err := readHeader(c)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, reply.ResponseTo, int32(2))
+	ensure.DeepEqual(t, atomic.LoadInt32(&unacknowledged), int32(1))
+}
@@ -0,0 +1,62 @@
+package dvara
+
+import (
+	"io"
+	"net"
+
+	"github.com/facebookgo/stats"
+)
+
+// ListenerOverride overrides parts of the ReplicaSet configuration for the
+// clients of some listeners, for example to make the listeners fronting
+// secondaries read only.
+type ListenerOverride struct {
+	// ReadOnly if true rejects writes with an Unauthorized error.
+	ReadOnly bool
+
+	// AllowedDatabases if not nil replaces ReplicaSet.AllowedDatabases.
+	AllowedDatabases []string
+
+	// MaxClients if non zero limits the number of clients connected to each
+	// listener.
+	MaxClients uint
+}
+
+// restricts checks if the override requires the operations to be inspected.
+func (o *ListenerOverride) restricts() bool {
+	return o != nil && (o.ReadOnly || o.AllowedDatabases != nil)
+}
+
+// full checks if a listener with the given number of clients, including a
+// new one, is over MaxClients.
+func (o *ListenerOverride) full(clients int64) bool {
+	return o != nil && o.MaxClients != 0 && clients > int64(o.MaxClients)
+}
+
+// listenerOverride returns the override for new clients of the proxy, or nil
+// if there is none. An override for the port of the listener takes precedence
+// over one for the current role of its member.
+func (p *Proxy) listenerOverride() *ListenerOverride {
+	overrides := p.ReplicaSet.ListenerOverrides
+	if len(overrides) == 0 {
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(p.ProxyAddr); err == nil {
+		if o, ok := overrides[port]; ok {
+			return o
+		}
+	}
+	return overrides[string(p.ReplicaSet.memberRole(p.MongoAddr))]
+}
+
+// writeAllowed checks if the operation is allowed by the override.
+func (o *ListenerOverride) writeAllowed(op *TracedOperation) bool {
+	return o == nil || !o.ReadOnly || !op.OpCode.IsMutation() && !op.Write
+}
+
+// rejectWrite rejects a write on a ReadOnly listener.
+func (p *Proxy) rejectWrite(h *messageHeader, client io.ReadWriter, lastError *LastError) error {
+	p.Log.Debugf("rejecting write %s on read only listener", h)
+	stats.BumpSum(p.stats, "client.rejected.read.only", 1)
+	return p.rejectUnauthorized(h, client, "dvara: writes are not allowed on this listener", lastError)
+}
@@ -0,0 +1,161 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestListenerOverrideLookup(t *testing.T) {
+	t.Parallel()
+	port := &ListenerOverride{MaxClients: 1}
+	secondary := &ListenerOverride{ReadOnly: true}
+	rs := &ReplicaSet{
+		ListenerOverrides: map[string]*ListenerOverride{
+			"6001":      port,
+			"SECONDARY": secondary,
+		},
+		lastState: &ReplicaSetState{lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: "a:1", State: ReplicaStatePrimary},
+				{Name: "b:2", State: ReplicaStateSecondary},
+				{Name: "c:3", State: ReplicaStateSecondary},
+			},
+		}},
+	}
+	cases := []struct {
+		Name     string
+		Proxy    *Proxy
+		Override *ListenerOverride
+	}{
+		{
+			Name:  "primary",
+			Proxy: &Proxy{ProxyAddr: "proxy:6000", MongoAddr: "a:1"},
+		},
+		{
+			Name:     "secondary",
+			Proxy:    &Proxy{ProxyAddr: "proxy:6002", MongoAddr: "c:3"},
+			Override: secondary,
+		},
+		{
+			Name:     "port over role",
+			Proxy:    &Proxy{ProxyAddr: "proxy:6001", MongoAddr: "b:2"},
+			Override: port,
+		},
+	}
+	for _, c := range cases {
+		c.Proxy.ReplicaSet = rs
+		ensure.True(t, c.Proxy.listenerOverride() == c.Override, c.Name)
+	}
+	ensure.True(t, (&Proxy{ReplicaSet: &ReplicaSet{}}).listenerOverride() == nil)
+}
+
+func TestReadOnlyListener(t *testing.T) {
+	t.Parallel()
+	primaryMongo := newFakeMongo(t, okReply)
+	defer primaryMongo.Stop()
+	secondaryMongo := newFakeMongo(t, okReply)
+	defer secondaryMongo.Stop()
+	rs := &ReplicaSet{
+		ListenerOverrides: map[string]*ListenerOverride{
+			string(ReplicaStateSecondary): {ReadOnly: true},
+		},
+		lastState: &ReplicaSetState{lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: primaryMongo.Addr(), State: ReplicaStatePrimary},
+				{Name: secondaryMongo.Addr(), State: ReplicaStateSecondary},
+			},
+		}},
+	}
+	primary := newFakeProxy(t, primaryMongo.Addr(), rs)
+	defer primary.Stop()
+	secondary := newFakeProxy(t, secondaryMongo.Addr(), rs)
+	defer secondary.Stop()
+
+	roundTrip := func(p *Proxy, cmd bson.D) bson.M {
+		c, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		defer c.Close()
+		h, body := fakeOpMsg(0, cmd)
+		_, err = c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		b := make([]byte, reply.MessageLength-headerLen)
+		_, err = io.ReadFull(c, b)
+		ensure.Nil(t, err)
+		var doc bson.M
+		ensure.Nil(t, bson.Unmarshal(b[5:], &doc))
+		return doc
+	}
+
+	insert := bson.D{
+		{Name: "insert", Value: "foo"},
+		{Name: "documents", Value: []bson.D{{{Name: "a", Value: 1}}}},
+		{Name: "$db", Value: "test"},
+	}
+	find := bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "$db", Value: "test"},
+	}
+	ensure.DeepEqual(t, roundTrip(primary, insert), bson.M{"ok": 1})
+	ensure.DeepEqual(t, roundTrip(primary, find), bson.M{"ok": 1})
+	ensure.DeepEqual(t, roundTrip(secondary, insert)["code"], unauthorizedCode)
+	ensure.DeepEqual(t, roundTrip(secondary, find), bson.M{"ok": 1})
+}
+
+func TestListenerMaxClients(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	rs := &ReplicaSet{
+		ListenerOverrides: map[string]*ListenerOverride{
+			string(ReplicaStatePrimary): {MaxClients: 1},
+		},
+		lastState: &ReplicaSetState{lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{{Name: mongo.Addr(), State: ReplicaStatePrimary}},
+		}},
+	}
+	p := newFakeProxy(t, mongo.Addr(), rs)
+	defer p.Stop()
+
+	query := func(c net.Conn) responseFlags {
+		h, body := fakeQuery("test.foo", bson.D{})
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		var prefix replyPrefix
+		_, err = io.ReadFull(c, prefix[:])
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen-int32(len(prefix))))
+		ensure.Nil(t, err)
+		return prefix.Flags()
+	}
+
+	first, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	ensure.False(t, query(first).QueryFailure())
+
+	second, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer second.Close()
+	ensure.True(t, query(second).QueryFailure())
+	_, err = second.Read(make([]byte, 1))
+	ensure.DeepEqual(t, err, io.EOF)
+
+	first.Close()
+	for p.clientCount() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	third, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer third.Close()
+	ensure.False(t, query(third).QueryFailure())
+}
@@ -0,0 +1,162 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PrimaryPin routes every operation of matching clients to the primary,
+// regardless of which member they connected to. This is meant for legacy
+// clients which set slaveOk but require read-your-writes consistency. The
+// decision is made once per client connection.
+type PrimaryPin struct {
+	// Clients are the IP addresses or CIDR ranges of pinned clients.
+	Clients []string
+
+	// AppNames are the application names of pinned clients, as sent by drivers
+	// in the connection handshake, usually from the appName connection string
+	// option.
+	AppNames []string
+}
+
+// Enabled checks if any clients are pinned.
+func (pp *PrimaryPin) Enabled() bool {
+	return len(pp.Clients) != 0 || len(pp.AppNames) != 0
+}
+
+// MatchClient checks if the client IP is pinned.
+func (pp *PrimaryPin) MatchClient(ip net.IP) bool {
+	return matchIP(pp.Clients, ip)
+}
+
+// matchIP checks if the IP is one of the given IP addresses or CIDR ranges.
+func matchIP(addrs []string, ip net.IP) bool {
+	for _, a := range addrs {
+		if _, n, err := net.ParseCIDR(a); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if other := net.ParseIP(a); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchAppName checks if the application name is pinned.
+func (pp *PrimaryPin) MatchAppName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, n := range pp.AppNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// clientMetadata is the client metadata sent by drivers in the isMaster or
+// hello handshake.
+type clientMetadata struct {
+	AppName string
+	Driver  string
+}
+
+// handshakeMetadata extracts the client metadata of an isMaster or hello
+// handshake. The zero value is returned for any other message.
+func handshakeMetadata(h *messageHeader, body []byte) clientMetadata {
+	var doc []byte
+	switch h.OpCode {
+	default:
+		return clientMetadata{}
+	case OpQuery:
+		// flags, fullCollectionName, numberToSkip, numberToReturn, query
+		if len(body) < 4 {
+			return clientMetadata{}
+		}
+		end := bytes.IndexByte(body[4:], 0)
+		if end < 0 || len(body) < 4+end+1+8 {
+			return clientMetadata{}
+		}
+		if !strings.HasSuffix(string(body[4:4+end]), ".$cmd") {
+			return clientMetadata{}
+		}
+		doc = body[4+end+1+8:]
+	case OpMsg:
+		m, err := readOpMsg(h, bytes.NewReader(body))
+		if err != nil {
+			return clientMetadata{}
+		}
+		doc = m.Body
+	}
+
+	var handshake struct {
+		Client struct {
+			Application struct {
+				Name string `bson:"name"`
+			} `bson:"application"`
+			Driver struct {
+				Name    string `bson:"name"`
+				Version string `bson:"version"`
+			} `bson:"driver"`
+		} `bson:"client"`
+	}
+	if err := bson.Unmarshal(doc, &handshake); err != nil {
+		return clientMetadata{}
+	}
+	return clientMetadata{
+		AppName: handshake.Client.Application.Name,
+		Driver:  strings.TrimSpace(handshake.Client.Driver.Name + " " + handshake.Client.Driver.Version),
+	}
+}
+
+// primaryProxy returns the proxy for the current primary, or nil if it is not
+// known.
+func (r *ReplicaSet) primaryProxy() *Proxy {
+	if r.lastState == nil || r.lastState.lastIM == nil {
+		return nil
+	}
+	r.mappingMutex.RLock()
+	defer r.mappingMutex.RUnlock()
+	proxyAddr, ok := r.realToProxy[r.lastState.lastIM.Primary]
+	if !ok {
+		return nil
+	}
+	return r.proxies[proxyAddr]
+}
+
+// clientBackend decides which proxy's server connections are used for a new
+// client, given the metadata of its handshake. Clients matching the PrimaryPin
+// get the primary's, everyone else gets this proxy's.
+func (p *Proxy) clientBackend(c net.Conn, ip net.IP, metadata clientMetadata) *Proxy {
+	pin := p.ReplicaSet.PrimaryPin
+	if !pin.Enabled() {
+		return p
+	}
+
+	reason := ""
+	if pin.MatchClient(ip) {
+		reason = "client " + ip.String()
+	} else if pin.MatchAppName(metadata.AppName) {
+		reason = "app name " + metadata.AppName
+	}
+	if reason == "" {
+		return p
+	}
+
+	primary := p.ReplicaSet.primaryProxy()
+	if primary == nil {
+		p.Log.Warnf("not pinning client %s matching %s, primary is unknown", c.RemoteAddr(), reason)
+		return p
+	}
+	p.Log.Infof("pinning client %s matching %s to %s", c.RemoteAddr(), reason, primary)
+	stats.BumpSum(p.stats, "client.pinned.primary", 1)
+	return primary
+}
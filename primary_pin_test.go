@@ -0,0 +1,165 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPrimaryPinMatchClient(t *testing.T) {
+	t.Parallel()
+	pin := &PrimaryPin{Clients: []string{"10.0.0.1", "192.168.0.0/16", "bogus"}}
+	cases := []struct {
+		IP    string
+		Match bool
+	}{
+		{IP: "10.0.0.1", Match: true},
+		{IP: "10.0.0.2"},
+		{IP: "192.168.4.2", Match: true},
+		{IP: "172.16.0.1"},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, pin.MatchClient(net.ParseIP(c.IP)), c.Match, c.IP)
+	}
+}
+
+func TestPrimaryPinMatchAppName(t *testing.T) {
+	t.Parallel()
+	pin := &PrimaryPin{AppNames: []string{"legacy"}}
+	ensure.True(t, pin.MatchAppName("legacy"))
+	ensure.False(t, pin.MatchAppName("modern"))
+	ensure.False(t, pin.MatchAppName(""))
+	ensure.False(t, (&PrimaryPin{}).Enabled())
+	ensure.True(t, pin.Enabled())
+}
+
+func TestHandshakeMetadata(t *testing.T) {
+	t.Parallel()
+	client := bson.D{
+		{Name: "application", Value: bson.D{{Name: "name", Value: "legacy"}}},
+		{Name: "driver", Value: bson.D{
+			{Name: "name", Value: "mongo-go-driver"},
+			{Name: "version", Value: "v1.2.3"},
+		}},
+	}
+	cases := []struct {
+		Name     string
+		Header   *messageHeader
+		Body     []byte
+		Metadata clientMetadata
+	}{
+		{
+			Name:     "query",
+			Metadata: clientMetadata{AppName: "legacy", Driver: "mongo-go-driver v1.2.3"},
+		},
+		{
+			Name:     "op msg",
+			Metadata: clientMetadata{AppName: "legacy", Driver: "mongo-go-driver v1.2.3"},
+		},
+		{
+			Name: "not a command",
+		},
+	}
+	cases[0].Header, cases[0].Body = fakeQuery("admin.$cmd", bson.D{
+		{Name: "isMaster", Value: 1},
+		{Name: "client", Value: client},
+	})
+	cases[1].Header, cases[1].Body = fakeOpMsg(0, bson.D{
+		{Name: "hello", Value: 1},
+		{Name: "client", Value: client},
+		{Name: "$db", Value: "admin"},
+	})
+	cases[2].Header, cases[2].Body = fakeQuery("db.foo", bson.D{
+		{Name: "client", Value: client},
+	})
+	for _, c := range cases {
+		ensure.DeepEqual(t, handshakeMetadata(c.Header, c.Body), c.Metadata, c.Name)
+	}
+}
+
+func TestPrimaryPin(t *testing.T) {
+	t.Parallel()
+	handshake := func(name string) bson.D {
+		return bson.D{
+			{Name: "hello", Value: 1},
+			{Name: "client", Value: bson.D{
+				{Name: "application", Value: bson.D{{Name: "name", Value: name}}},
+			}},
+			{Name: "$db", Value: "admin"},
+		}
+	}
+	cases := []struct {
+		Name   string
+		Pin    *PrimaryPin
+		App    string
+		Pinned bool
+	}{
+		{
+			Name: "not pinned",
+			Pin:  &PrimaryPin{AppNames: []string{"legacy"}},
+			App:  "modern",
+		},
+		{
+			Name:   "pinned by app name",
+			Pin:    &PrimaryPin{AppNames: []string{"legacy"}},
+			App:    "legacy",
+			Pinned: true,
+		},
+		{
+			Name:   "pinned by client",
+			Pin:    &PrimaryPin{Clients: []string{"127.0.0.0/8"}},
+			App:    "modern",
+			Pinned: true,
+		},
+	}
+	for _, c := range cases {
+		var primaryCount, secondaryCount int32
+		primaryMongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+			atomic.AddInt32(&primaryCount, 1)
+			return okReply(h, body)
+		})
+		secondaryMongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+			atomic.AddInt32(&secondaryCount, 1)
+			return okReply(h, body)
+		})
+
+		rs := &ReplicaSet{PrimaryPin: c.Pin}
+		primary := newFakeProxy(t, primaryMongo.Addr(), rs)
+		rs.lastState = &ReplicaSetState{lastIM: &isMasterResponse{Primary: primaryMongo.Addr()}}
+		rs.realToProxy = map[string]string{primaryMongo.Addr(): primary.ProxyAddr}
+		rs.proxies = map[string]*Proxy{primary.ProxyAddr: primary}
+		secondary := newFakeProxy(t, secondaryMongo.Addr(), rs)
+
+		conn, err := net.Dial("tcp", secondary.ProxyAddr)
+		ensure.Nil(t, err)
+		find := bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "db"}}
+		for _, cmd := range []bson.D{handshake(c.App), find} {
+			h, body := fakeOpMsg(0, cmd)
+			_, err = conn.Write(append(h.ToWire(), body...))
+			ensure.Nil(t, err)
+			rh, err := readHeader(conn)
+			ensure.Nil(t, err)
+			_, err = io.CopyN(ioutil.Discard, conn, int64(rh.MessageLength-headerLen))
+			ensure.Nil(t, err)
+		}
+		conn.Close()
+
+		if c.Pinned {
+			ensure.DeepEqual(t, atomic.LoadInt32(&primaryCount), int32(2), c.Name)
+			ensure.DeepEqual(t, atomic.LoadInt32(&secondaryCount), int32(0), c.Name)
+		} else {
+			ensure.DeepEqual(t, atomic.LoadInt32(&primaryCount), int32(0), c.Name)
+			ensure.DeepEqual(t, atomic.LoadInt32(&secondaryCount), int32(2), c.Name)
+		}
+
+		secondary.Stop()
+		primary.Stop()
+		secondaryMongo.Stop()
+		primaryMongo.Stop()
+	}
+}
@@ -4,12 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"sync"
 )
 
 var (
 	errWrite = errors.New("incorrect number of bytes written")
 )
 
+// maxMessageLength is the maximum message size accepted by mongo, including
+// the header.
+const maxMessageLength = 48000000
+
 // Look at http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/ for the protocol.
 
 // OpCode allow identifying the type of operation:
@@ -40,6 +46,8 @@ func (c OpCode) String() string {
 		return "DELETE"
 	case OpKillCursors:
 		return "KILL_CURSORS"
+	case OpMsg:
+		return "MSG"
 	}
 }
 
@@ -49,9 +57,18 @@ func (c OpCode) IsMutation() bool {
 	return c == OpInsert || c == OpUpdate || c == OpDelete
 }
 
+// IsRequest tells us if the operation is one a client may send.
+func (c OpCode) IsRequest() bool {
+	switch c {
+	case OpUpdate, OpInsert, OpQuery, OpGetMore, OpDelete, OpKillCursors, OpMsg:
+		return true
+	}
+	return false
+}
+
 // HasResponse tells us if the operation will have a response from the server.
 func (c OpCode) HasResponse() bool {
-	return c == OpQuery || c == OpGetMore
+	return c == OpQuery || c == OpGetMore || c == OpMsg
 }
 
 // The full set of known request op codes:
@@ -66,6 +83,7 @@ const (
 	OpGetMore     = OpCode(2005)
 	OpDelete      = OpCode(2006)
 	OpKillCursors = OpCode(2007)
+	OpMsg         = OpCode(2013)
 )
 
 // messageHeader is the mongo MessageHeader
@@ -131,6 +149,9 @@ func readHeader(r io.Reader) (*messageHeader, error) {
 	}
 	h := messageHeader{}
 	h.FromWire(b)
+	if h.MessageLength > maxMessageLength {
+		return nil, &MessageLengthError{Length: h.MessageLength}
+	}
 	return &h, nil
 }
 
@@ -143,18 +164,120 @@ func copyMessage(w io.Writer, r io.Reader) error {
 	if err := h.WriteTo(w); err != nil {
 		return err
 	}
-	_, err = io.CopyN(w, r, int64(h.MessageLength-headerLen))
+	return copyBody(w, r, int64(h.MessageLength-headerLen))
+}
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// copyBody copies exactly n bytes from r to w, returning io.EOF if fewer were
+// available. When both sides are TCP connections the copy is left to the
+// kernel (splice(2) on Linux) so the bytes never pass through user space.
+// Otherwise a pooled buffer is used. What was read ahead of a bufferedConn is
+// copied first, the rest may then come straight from the connection under it.
+func copyBody(w io.Writer, r io.Reader, n int64) error {
+	var written int64
+	var err error
+	if ahead := readAhead(r); ahead > 0 {
+		if ahead > n {
+			ahead = n
+		}
+		written, err = copyBuffered(w, r, ahead)
+		if err == nil && written < ahead {
+			err = io.EOF
+		}
+		if err != nil || written == n {
+			return err
+		}
+	}
+
+	wc, wCounted := unwrapConn(w)
+	rc, rCounted := unwrapConn(r)
+	wt, wok := wc.(*net.TCPConn)
+	rt, rok := rc.(*net.TCPConn)
+	if wok && rok {
+		var spliced int64
+		spliced, err = wt.ReadFrom(&io.LimitedReader{R: rt, N: n - written})
+		for _, c := range append(wCounted, rCounted...) {
+			c.add(spliced)
+		}
+		written += spliced
+	} else {
+		var copied int64
+		copied, err = copyBuffered(w, r, n-written)
+		written += copied
+	}
+	if err == nil && written < n {
+		err = io.EOF
+	}
 	return err
 }
 
+// copyBuffered copies up to n bytes from r to w using a pooled buffer.
+func copyBuffered(w io.Writer, r io.Reader, n int64) (int64, error) {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return io.CopyBuffer(w, &io.LimitedReader{R: r, N: n}, *buf)
+}
+
+// readAhead returns how many bytes bufferedConns hold for r.
+func readAhead(r interface{}) int64 {
+	var ahead int64
+	for {
+		switch c := r.(type) {
+		case *pooledServerConn:
+			r = c.Conn
+		case *countingConn:
+			r = c.Conn
+		case *bufferedConn:
+			ahead += int64(c.buffered.Len())
+			r = c.Conn
+		default:
+			return ahead
+		}
+	}
+}
+
+// unwrapConn returns the connection under the wrappers which do not need to
+// see the bytes relayed by copyBody, along with the countingConns to credit
+// with them. A bufferedConn is only unwrapped once it has nothing read ahead.
+func unwrapConn(c interface{}) (interface{}, []*countingConn) {
+	var counted []*countingConn
+	for {
+		switch conn := c.(type) {
+		case *pooledServerConn:
+			c = conn.Conn
+		case *countingConn:
+			counted = append(counted, conn)
+			c = conn.Conn
+		case *bufferedConn:
+			if conn.buffered.Len() != 0 {
+				return c, counted
+			}
+			c = conn.Conn
+		default:
+			return c, counted
+		}
+	}
+}
+
 // readDocument read an entire BSON document. This document can be used with
-// bson.Unmarshal.
-func readDocument(r io.Reader) ([]byte, error) {
+// bson.Unmarshal. The document may be at most max bytes long, which is what
+// is left of the message it is part of, so a bad length prefix is caught
+// rather than reading into the next message.
+func readDocument(r io.Reader, max int32) ([]byte, error) {
 	var sizeRaw [4]byte
 	if _, err := io.ReadFull(r, sizeRaw[:]); err != nil {
 		return nil, err
 	}
 	size := getInt32(sizeRaw[:], 0)
+	if size < 5 || size > max {
+		return nil, &DocumentLengthError{Length: size, Remaining: max}
+	}
 	doc := make([]byte, size)
 	setInt32(doc, 0, size)
 	if _, err := io.ReadFull(r, doc[4:]); err != nil {
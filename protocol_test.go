@@ -4,7 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
 	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type testReader struct {
@@ -35,6 +41,7 @@ func TestOpStrings(t *testing.T) {
 		{OpGetMore, "GET_MORE"},
 		{OpDelete, "DELETE"},
 		{OpKillCursors, "KILL_CURSORS"},
+		{OpMsg, "MSG"},
 	}
 	for _, c := range cases {
 		if c.OpCode.String() != c.String {
@@ -43,6 +50,21 @@ func TestOpStrings(t *testing.T) {
 	}
 }
 
+func TestOpIsRequest(t *testing.T) {
+	t.Parallel()
+	requests := []OpCode{OpUpdate, OpInsert, OpQuery, OpGetMore, OpDelete, OpKillCursors, OpMsg}
+	for _, c := range requests {
+		if !c.IsRequest() {
+			t.Fatalf("expected %s to be a request", c)
+		}
+	}
+	for _, c := range []OpCode{OpCode(0), OpReply, OpMessage, Reserved, OpCode(542393671)} {
+		if c.IsRequest() {
+			t.Fatalf("expected %s (%d) not to be a request", c, c)
+		}
+	}
+}
+
 func TestMsgHeaderString(t *testing.T) {
 	t.Parallel()
 	m := &messageHeader{
@@ -115,7 +137,7 @@ func TestCopyMessageFromWriteLengthError(t *testing.T) {
 
 func TestReadDocumentEmpty(t *testing.T) {
 	t.Parallel()
-	doc, err := readDocument(bytes.NewReader([]byte{}))
+	doc, err := readDocument(bytes.NewReader([]byte{}), maxMessageLength)
 	if err != io.EOF {
 		t.Fatal("did not find expected error")
 	}
@@ -137,7 +159,7 @@ func TestReadDocumentPartial(t *testing.T) {
 			return 0, io.EOF
 		},
 	}
-	doc, err := readDocument(r)
+	doc, err := readDocument(r, maxMessageLength)
 	if err != io.EOF {
 		t.Fatalf("did not find expected error, instead got %s %v", err, doc)
 	}
@@ -146,6 +168,38 @@ func TestReadDocumentPartial(t *testing.T) {
 	}
 }
 
+func TestReadDocumentLength(t *testing.T) {
+	t.Parallel()
+	doc, err := bson.Marshal(bson.M{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := append(append([]byte(nil), doc...), doc...)
+	cases := []struct {
+		Name  string
+		Data  []byte
+		Max   int32
+		Error bool
+	}{
+		{Name: "fits", Data: doc, Max: int32(len(doc))},
+		{Name: "overruns the message", Data: next, Max: int32(len(doc) - 1), Error: true},
+		{Name: "too short", Data: []byte{4, 0, 0, 0, 0}, Max: maxMessageLength, Error: true},
+		{Name: "negative", Data: []byte{0xff, 0xff, 0xff, 0xff, 0}, Max: maxMessageLength, Error: true},
+	}
+	for _, c := range cases {
+		actual, err := readDocument(bytes.NewReader(c.Data), c.Max)
+		if c.Error {
+			if _, ok := err.(*DocumentLengthError); !ok {
+				t.Fatalf("expected DocumentLengthError for %s got %v", c.Name, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(actual, doc) {
+			t.Fatalf("unexpected result for %s: %v %v", c.Name, actual, err)
+		}
+	}
+}
+
 func TestReadCString(t *testing.T) {
 	t.Parallel()
 	cases := []struct {
@@ -169,3 +223,177 @@ func TestReadCString(t *testing.T) {
 		}
 	}
 }
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*net.TCPConn), (<-accepted).(*net.TCPConn)
+}
+
+// relayPair returns the two TCP connections between which bytes will be
+// relayed, along with the outer ends for writing into and reading from them.
+func relayPair(t testing.TB) (in, src, dst, out *net.TCPConn) {
+	in, src = tcpPair(t)
+	dst, out = tcpPair(t)
+	return
+}
+
+// hideTCP hides the concrete connection type forcing the buffered path.
+type hideTCP struct {
+	io.ReadWriter
+}
+
+func TestCopyBodyPreservesFraming(t *testing.T) {
+	t.Parallel()
+	body := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1<<18)
+	next := []byte("next message")
+	for _, hide := range []bool{false, true} {
+		in, src, dst, out := relayPair(t)
+		go func() {
+			in.Write(body)
+			in.Write(next)
+			in.Close()
+		}()
+		var r io.Reader = src
+		var w io.Writer = dst
+		if hide {
+			r = hideTCP{ReadWriter: src}
+			w = hideTCP{ReadWriter: dst}
+		}
+		if err := copyBody(w, r, int64(len(body))); err != nil {
+			t.Fatal(err)
+		}
+		dst.Close()
+		relayed, err := ioutil.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(relayed, body) {
+			t.Fatalf("did not get expected bytes with hide=%v", hide)
+		}
+		rest, err := ioutil.ReadAll(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, next) {
+			t.Fatalf("next message was consumed with hide=%v", hide)
+		}
+		src.Close()
+		out.Close()
+	}
+}
+
+func TestCopyBodySplicesClientConn(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name   string
+		RS     *ReplicaSet
+		Splice bool
+	}{
+		{Name: "default", RS: &ReplicaSet{}, Splice: true},
+		{Name: "quota", RS: &ReplicaSet{ClientByteQuota: 1 << 30}, Splice: true},
+		{Name: "bandwidth", RS: &ReplicaSet{ClientBandwidth: 1 << 30, ClientBandwidthBurst: 1 << 30}},
+	}
+	sequence := fakeDocSequence("documents", bson.D{{Name: "a", Value: bytes.Repeat([]byte{1}, 1<<20)}})
+	h, body := fakeOpMsg(0, bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}}, sequence)
+	message := append(h.ToWire(), body...)
+	for _, c := range cases {
+		in, src, dst, out := relayPair(t)
+		go func() {
+			in.Write(message)
+			in.Close()
+		}()
+		c.RS.MessageTimeout = time.Minute
+		p := &Proxy{Log: &tLogger{TB: t}, ReplicaSet: c.RS}
+		conn, counted := p.wrapClientConn(src)
+		rh, err := readHeader(conn)
+		ensure.Nil(t, err, c.Name)
+		client, command, rejected, err := p.rejectCommand(rh, conn, p)
+		ensure.Nil(t, err, c.Name)
+		ensure.False(t, rejected, c.Name)
+		ensure.DeepEqual(t, command, "insert", c.Name)
+
+		// The body section was read ahead, the document sequence is relayed
+		// from the connection.
+		server := &pooledServerConn{Conn: dst}
+		ensure.Nil(t, rh.WriteTo(server), c.Name)
+		ensure.DeepEqual(t, readAhead(client), int64(len(body)-len(sequence)), c.Name)
+		ensure.Nil(t, copyBody(server, client, int64(len(body))), c.Name)
+		rc, _ := unwrapConn(client)
+		_, spliced := rc.(*net.TCPConn)
+		ensure.DeepEqual(t, spliced, c.Splice, c.Name)
+		if counted != nil {
+			ensure.DeepEqual(t, counted.transferred(), uint64(len(message)), c.Name)
+		}
+
+		dst.Close()
+		relayed, err := ioutil.ReadAll(out)
+		ensure.Nil(t, err, c.Name)
+		ensure.DeepEqual(t, relayed, message, c.Name)
+		src.Close()
+		out.Close()
+	}
+}
+
+func TestCopyBodyShort(t *testing.T) {
+	t.Parallel()
+	var w bytes.Buffer
+	if err := copyBody(&w, bytes.NewReader([]byte{1, 2}), 3); err != io.EOF {
+		t.Fatalf("did not get expected error, instead got: %v", err)
+	}
+}
+
+func benchmarkCopyBody(b *testing.B, hide bool) {
+	const size = 8 << 20
+	in, src, dst, out := relayPair(b)
+	defer in.Close()
+	defer src.Close()
+	defer dst.Close()
+	defer out.Close()
+	go io.Copy(ioutil.Discard, out)
+	go func() {
+		chunk := make([]byte, 1<<20)
+		for i := 0; i < b.N*(size/len(chunk)); i++ {
+			if _, err := in.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	var r io.Reader = src
+	var w io.Writer = dst
+	if hide {
+		r = hideTCP{ReadWriter: src}
+		w = hideTCP{ReadWriter: dst}
+	}
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := copyBody(w, r, size); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyBodySplice(b *testing.B) {
+	benchmarkCopyBody(b, false)
+}
+
+func BenchmarkCopyBodyBuffered(b *testing.B) {
+	benchmarkCopyBody(b, true)
+}
@@ -1,13 +1,16 @@
 package dvara
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/facebookgo/rpool"
@@ -21,10 +24,108 @@ var (
 	errZeroMaxPerClientConnections = errors.New("dvara: MaxPerClientConnections cannot be 0")
 	errNormalClose                 = errors.New("dvara: normal close")
 	errClientReadTimeout           = errors.New("dvara: client read timeout")
+	errClientHeaderTimeout         = errors.New("dvara: client header read timeout")
 
 	timeInPast = time.Now()
 )
 
+// CloseReason identifies why dvara closed a client connection while it had a
+// pending request.
+type CloseReason int
+
+const (
+	// CloseReasonShutdown indicates the proxy is stopping or restarting.
+	CloseReasonShutdown CloseReason = iota
+
+	// CloseReasonReplicaSetChanged indicates the replica set configuration
+	// changed and the client must reconnect.
+	CloseReasonReplicaSetChanged
+
+	// CloseReasonServerUnavailable indicates a connection to the mongo server
+	// could not be established.
+	CloseReasonServerUnavailable
+
+	// CloseReasonServerBusy indicates the global connection limit was reached.
+	CloseReasonServerBusy
+
+	// CloseReasonQuotaExceeded indicates the client connection transferred
+	// more than ClientByteQuota bytes.
+	CloseReasonQuotaExceeded
+
+	// CloseReasonServerOverloaded indicates MaxQueueDepth requests were
+	// already waiting for a connection to the mongo server.
+	CloseReasonServerOverloaded
+
+	// CloseReasonReplayedNonce indicates a saslStart reused the client nonce of
+	// a recent one, see ReplicaSet.SASLReplayWindow.
+	CloseReasonReplayedNonce
+)
+
+// DefaultCloseReasonMessages are the messages sent to clients for each
+// CloseReason, unless overridden via ReplicaSet.CloseReasonMessages.
+var DefaultCloseReasonMessages = map[CloseReason]string{
+	CloseReasonShutdown:          "dvara: draining for maintenance",
+	CloseReasonReplicaSetChanged: "dvara: replica set configuration changed",
+	CloseReasonServerUnavailable: "dvara: mongo server unavailable",
+	CloseReasonServerBusy:        "dvara: server busy, too many connections",
+	CloseReasonQuotaExceeded:     "dvara: connection byte quota exceeded",
+	CloseReasonServerOverloaded:  "dvara: mongo server overloaded, too many queued requests",
+	CloseReasonReplayedNonce:     "dvara: authentication nonce replayed",
+}
+
+// Error labels understood by drivers as a hint to retry the operation.
+const (
+	labelRetryableWrite  = "RetryableWriteError"
+	labelRetryable       = "RetryableError"
+	labelSystemOverload  = "SystemOverloadedError"
+	hostUnreachableCode  = 6
+	shutdownCode         = 91
+	ingressRateLimitCode = 462
+	operationFailedCode  = 96
+	authFailedCode       = 18
+)
+
+// closeReasonError is the error code and labels sent along with a CloseReason
+// message.
+type closeReasonError struct {
+	Code   int32
+	Labels []string
+}
+
+// closeReasonErrors maps each CloseReason to the error sent to clients. All
+// of them but CloseReasonQuotaExceeded and CloseReasonReplayedNonce are
+// transient, the labels tell drivers to retry, and in the case of
+// CloseReasonServerBusy and CloseReasonServerOverloaded to back off before
+// doing so.
+var closeReasonErrors = map[CloseReason]closeReasonError{
+	CloseReasonShutdown: {
+		Code:   shutdownCode,
+		Labels: []string{labelRetryableWrite},
+	},
+	CloseReasonReplicaSetChanged: {
+		Code:   hostUnreachableCode,
+		Labels: []string{labelRetryableWrite},
+	},
+	CloseReasonServerUnavailable: {
+		Code:   hostUnreachableCode,
+		Labels: []string{labelRetryableWrite},
+	},
+	CloseReasonServerBusy: {
+		Code:   ingressRateLimitCode,
+		Labels: []string{labelRetryable, labelSystemOverload},
+	},
+	CloseReasonQuotaExceeded: {
+		Code: operationFailedCode,
+	},
+	CloseReasonServerOverloaded: {
+		Code:   ingressRateLimitCode,
+		Labels: []string{labelRetryable, labelSystemOverload},
+	},
+	CloseReasonReplayedNonce: {
+		Code: authFailedCode,
+	},
+}
+
 // Proxy sends stuff from clients to mongo servers.
 type Proxy struct {
 	Log            Logger
@@ -36,8 +137,16 @@ type Proxy struct {
 	wg                      sync.WaitGroup
 	closed                  chan struct{}
 	serverPool              rpool.Pool
+	databasePools           map[string]*rpool.Pool
 	stats                   stats.Client
 	maxPerClientConnections *maxPerClientConnections
+	clients                 int64 // accessed atomically
+	idleServerConns         int64 // accessed atomically
+	serverDemand            int64 // requests holding or waiting for a server connection, accessed atomically
+	prewarming              int32 // accessed atomically
+	clientConnsMutex        sync.Mutex
+	clientConns             map[*clientConn]struct{}
+	latency                 latencyEWMA
 }
 
 // String representation for debugging.
@@ -45,6 +154,11 @@ func (p *Proxy) String() string {
 	return fmt.Sprintf("proxy %s => mongo %s", p.ProxyAddr, p.MongoAddr)
 }
 
+// clientCount returns the number of connected clients.
+func (p *Proxy) clientCount() int64 {
+	return atomic.LoadInt64(&p.clients)
+}
+
 // Start the proxy.
 func (p *Proxy) Start() error {
 	if p.ReplicaSet.MaxConnections == 0 {
@@ -64,6 +178,7 @@ func (p *Proxy) Start() error {
 		IdleTimeout:       p.ReplicaSet.ServerIdleTimeout,
 		ClosePoolSize:     p.ReplicaSet.ServerClosePoolSize,
 	}
+	p.startDatabasePools()
 
 	// plug stats if we can
 	if p.ReplicaSet.Stats != nil {
@@ -88,6 +203,10 @@ func (p *Proxy) Start() error {
 		)
 	}
 
+	if p.ReplicaSet.ServerIdleStatsInterval != 0 {
+		go p.idleStatsLoop(p.ReplicaSet.ServerIdleStatsInterval)
+	}
+	p.prewarm()
 	go p.clientAcceptLoop()
 
 	return nil
@@ -99,6 +218,15 @@ func (p *Proxy) Stop() error {
 }
 
 func (p *Proxy) stop(hard bool) error {
+	if p.closed == nil {
+		// Never started, only the listener is open.
+		return p.ClientListener.Close()
+	}
+	select {
+	case <-p.closed:
+		return nil
+	default:
+	}
 	if err := p.ClientListener.Close(); err != nil {
 		return err
 	}
@@ -107,6 +235,9 @@ func (p *Proxy) stop(hard bool) error {
 		p.wg.Wait()
 	}
 	p.serverPool.Close()
+	for _, pool := range p.databasePools {
+		pool.Close()
+	}
 	return nil
 }
 
@@ -115,11 +246,12 @@ func (p *Proxy) checkRSChanged() bool {
 	r, err := p.ReplicaSet.ReplicaSetStateCreator.FromAddrs(addrs, p.ReplicaSet.Name)
 	if err != nil {
 		p.Log.Errorf("all nodes possibly down?: %s", err)
+		p.ReplicaSet.noteChange(time.Now())
 		return true
 	}
 
-	if err := r.AssertEqual(p.ReplicaSet.lastState); err != nil {
-		p.Log.Error(err)
+	if !p.ReplicaSet.SameIM(r.lastIM) || !p.ReplicaSet.SameRS(r.lastRS) {
+		p.Log.Error(r.AssertEqual(p.ReplicaSet.lastState))
 		go p.ReplicaSet.Restart()
 		return true
 	}
@@ -133,10 +265,15 @@ func (p *Proxy) checkRSChanged() bool {
 func (p *Proxy) newServerConn() (io.Closer, error) {
 	retrySleep := 50 * time.Millisecond
 	for retryCount := 7; retryCount > 0; retryCount-- {
-		c, err := net.Dial("tcp", p.MongoAddr)
+		c, err := p.dialServer()
 		if err == nil {
 			return c, nil
 		}
+
+		// Prewarming is best effort, it makes a single attempt.
+		if atomic.LoadInt32(&p.prewarming) != 0 {
+			return nil, err
+		}
 		p.Log.Error(err)
 
 		// abort if rs changed
@@ -146,33 +283,94 @@ func (p *Proxy) newServerConn() (io.Closer, error) {
 		time.Sleep(retrySleep)
 		retrySleep = retrySleep * 2
 	}
-	return nil, fmt.Errorf("could not connect to %s", p.MongoAddr)
+	return nil, &ServerUnavailableError{Addr: p.MongoAddr}
 }
 
-// getServerConn gets a server connection from the pool.
-func (p *Proxy) getServerConn() (net.Conn, error) {
-	c, err := p.serverPool.Acquire()
+// dialServer makes a single attempt at connecting to the server, bounded by
+// the ConnectTimeout.
+func (p *Proxy) dialServer() (*pooledServerConn, error) {
+	p.ReplicaSet.DialLimiter.acquire()
+	c, err := p.ReplicaSet.DNSCache.Dial("tcp", p.MongoAddr, p.ReplicaSet.ConnectTimeout)
+	p.ReplicaSet.DialLimiter.release()
 	if err != nil {
 		return nil, err
 	}
-	return c.(net.Conn), nil
+	p.ReplicaSet.tuneConn(c)
+	return &pooledServerConn{Conn: c, proxy: p}, nil
+}
+
+// getServerConn gets a server connection for the given database from its pool
+// if it has one, otherwise from the main pool.
+func (p *Proxy) getServerConn(database string) (net.Conn, error) {
+	if p.ReplicaSet.isSuspect(p.MongoAddr) {
+		return nil, &ServerUnavailableError{Addr: p.MongoAddr, Suspect: true}
+	}
+	if pool := p.databasePools[database]; pool != nil {
+		return p.acquireServerConn(pool)
+	}
+	demand := atomic.AddInt64(&p.serverDemand, 1)
+	if max := p.ReplicaSet.MaxQueueDepth; max != 0 && demand > int64(p.ReplicaSet.MaxConnections+max) {
+		atomic.AddInt64(&p.serverDemand, -1)
+		stats.BumpSum(p.stats, "server.conn.overloaded", 1)
+		return nil, &ServerOverloadedError{Addr: p.MongoAddr, Queued: demand - 1 - int64(p.ReplicaSet.MaxConnections)}
+	}
+	c, err := p.acquireServerConn(&p.serverPool)
+	if err != nil {
+		atomic.AddInt64(&p.serverDemand, -1)
+	}
+	return c, err
+}
+
+// acquireServerConn gets a server connection from the pool. Connections idle
+// for a while which the server has closed in the meantime are discarded, so
+// the request is sent on a live or newly established connection rather than
+// failing.
+func (p *Proxy) acquireServerConn(pool *rpool.Pool) (net.Conn, error) {
+	for {
+		c, err := pool.Acquire()
+		if err != nil {
+			return nil, err
+		}
+		pc, ok := c.(*pooledServerConn)
+		if !ok || pc.acquired() < staleCheckIdle || !pc.stale() {
+			return c.(net.Conn), nil
+		}
+		p.Log.Debugf("discarding server connection closed by %s while idle", p.MongoAddr)
+		stats.BumpSum(p.stats, "server.conn.stale", 1)
+		pool.Discard(c)
+	}
 }
 
 func (p *Proxy) serverCloseErrorHandler(err error) {
 	p.Log.Error(err)
 }
 
+// commandTimeout returns the timeout for proxying the named command, which is
+// MessageTimeout unless overridden in CommandTimeouts.
+func (r *ReplicaSet) commandTimeout(command string) time.Duration {
+	if command != "" {
+		for name, timeout := range r.CommandTimeouts {
+			if strings.EqualFold(name, command) {
+				return timeout
+			}
+		}
+	}
+	return r.MessageTimeout
+}
+
 // proxyMessage proxies a message, possibly it's response, and possibly a
-// follow up call.
+// follow up call, within the given timeout.
 func (p *Proxy) proxyMessage(
 	h *messageHeader,
 	client net.Conn,
 	server net.Conn,
 	lastError *LastError,
+	held *HeldBatches,
+	timeout time.Duration,
 ) error {
 
 	p.Log.Debugf("proxying message %s from %s for %s", h, client.RemoteAddr(), p)
-	deadline := time.Now().Add(p.ReplicaSet.MessageTimeout)
+	deadline := time.Now().Add(timeout)
 	server.SetDeadline(deadline)
 	client.SetDeadline(deadline)
 
@@ -185,29 +383,52 @@ func (p *Proxy) proxyMessage(
 
 	// Anything besides a getlasterror call (which requires an OpQuery) resets
 	// the lastError.
+	lastError.noteOperation(h.OpCode.IsMutation())
 	if lastError.Exists() {
 		p.Log.Debug("reset getLastError cache")
 		lastError.Reset()
 	}
 
-	// For other Ops we proxy the header & raw body over.
-	if err := h.WriteTo(server); err != nil {
-		p.Log.Error(err)
-		return err
+	// OpMsg may need to be transformed before being sent to the server.
+	if h.OpCode == OpMsg {
+		stats.BumpSum(p.stats, "message.with.response", 1)
+		return p.ReplicaSet.ProxyMsg.Proxy(h, client, server, held)
 	}
 
-	if _, err := io.CopyN(server, client, int64(h.MessageLength-headerLen)); err != nil {
-		p.Log.Error(err)
-		return err
+	// For other Ops we proxy the header & raw body over, except for the
+	// numberToReturn of OpGetMore which may need to be clamped.
+	if h.OpCode == OpGetMore && p.ReplicaSet.ProxyQuery != nil && p.ReplicaSet.ProxyQuery.BatchSizeRewriter.Enabled() {
+		if err := p.ReplicaSet.ProxyQuery.BatchSizeRewriter.forwardGetMore(h, client, server); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+	} else {
+		if err := h.WriteTo(server); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+
+		if err := copyBody(server, client, int64(h.MessageLength-headerLen)); err != nil {
+			p.Log.Error(err)
+			return err
+		}
 	}
 
 	// For Ops with responses we proxy the raw response message over.
 	if h.OpCode.HasResponse() {
 		stats.BumpSum(p.stats, "message.with.response", 1)
-		if err := copyMessage(client, server); err != nil {
+		flags, err := copyReply(client, server, h)
+		if err != nil {
 			p.Log.Error(err)
 			return err
 		}
+		if flags.CursorNotFound() {
+			p.Log.Debugf("cursor not found for %s from %s", h, client.RemoteAddr())
+			stats.BumpSum(p.stats, "reply.cursor.not.found", 1)
+		}
+		if flags.QueryFailure() {
+			stats.BumpSum(p.stats, "reply.query.failure", 1)
+		}
 	}
 
 	return nil
@@ -239,60 +460,182 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 	// enforce per-client max connection limit
 	if p.maxPerClientConnections.inc(remoteIP) {
 		c.Close()
+		p.wg.Done()
 		stats.BumpSum(p.stats, "client.rejected.max.connections", 1)
 		p.Log.Errorf("rejecting client connection due to max connections limit: %s", remoteIP)
 		return
 	}
 
+	// hold new clients while the replica set is unstable
+	held, ok := p.ReplicaSet.admitClient(p.closed)
+	if !ok {
+		stats.BumpSum(p.stats, "client.rejected.unstable", 1)
+		p.Log.Errorf("rejecting client connection while the replica set is unstable: %s", remoteIP)
+		p.rejectBusy(c)
+		c.Close()
+		p.maxPerClientConnections.dec(remoteIP)
+		p.wg.Done()
+		return
+	}
+	if held {
+		stats.BumpSum(p.stats, "client.held.unstable", 1)
+	}
+
+	// enforce global max connection limit
+	count, ok := p.ReplicaSet.ConnectionLimiter.acquire()
+	if !ok {
+		stats.BumpSum(p.stats, "client.rejected.global.max.connections", 1)
+		p.Log.Errorf("rejecting client connection due to global max connections limit: %s", remoteIP)
+		p.rejectBusy(c)
+		c.Close()
+		p.maxPerClientConnections.dec(remoteIP)
+		p.wg.Done()
+		return
+	}
+	stats.BumpAvg(p.stats, "client.global.connections", float64(count))
+
+	// enforce the listener max connection limit
+	override := p.listenerOverride()
+	if override.full(atomic.AddInt64(&p.clients, 1)) {
+		atomic.AddInt64(&p.clients, -1)
+		stats.BumpSum(p.stats, "client.rejected.listener.max.connections", 1)
+		p.Log.Errorf("rejecting client connection due to listener max connections limit: %s", remoteIP)
+		p.rejectBusy(c)
+		c.Close()
+		p.ReplicaSet.ConnectionLimiter.release()
+		p.maxPerClientConnections.dec(remoteIP)
+		p.wg.Done()
+		return
+	}
+
 	// turn on TCP keep-alive and set it to the recommended period of 2 minutes
 	// http://docs.mongodb.org/manual/faq/diagnostics/#faq-keepalive
 	if conn, ok := c.(*net.TCPConn); ok {
 		conn.SetKeepAlivePeriod(2 * time.Minute)
 		conn.SetKeepAlive(true)
 	}
+	p.ReplicaSet.tuneConn(c)
 
-	c = teeIf(fmt.Sprintf("client %s <=> %s", c.RemoteAddr(), p), c)
-	p.Log.Infof("client %s connected to %s", c.RemoteAddr(), p)
+	c, counted := p.wrapClientConn(c)
+	quiet := matchIP(p.ReplicaSet.QuietClients, net.ParseIP(remoteIP))
+	if !quiet {
+		p.Log.Infof("client %s connected to %s", c.RemoteAddr(), p)
+	}
 	stats.BumpSum(p.stats, "client.connected", 1)
+	role := p.openClientRole()
+	conn := p.trackClient(c)
+	conn.override = override
 	defer func() {
-		p.Log.Infof("client %s disconnected from %s", c.RemoteAddr(), p)
+		p.untrackClient(conn)
+		p.closeClientRole(role)
+		atomic.AddInt64(&p.clients, -1)
+		if !quiet {
+			p.Log.Infof("client %s disconnected from %s", c.RemoteAddr(), p)
+		}
 		p.wg.Done()
 		if err := c.Close(); err != nil {
 			p.Log.Error(err)
 		}
 		p.maxPerClientConnections.dec(remoteIP)
+		p.ReplicaSet.ConnectionLimiter.release()
 	}()
 
+	// The cached getLastError response and the documents held back from
+	// cursors belong to this client connection alone and are dropped when it
+	// closes.
 	var lastError LastError
+	defer lastError.Reset()
+	var heldBatches HeldBatches
+	defer heldBatches.Reset()
+	tailing := make(tailingCursors)
+
+	// The backend is decided on the first message and is this proxy unless the
+	// client is pinned to the primary.
+	var backend *Proxy
+	observe := p.ReplicaSet.observeMessages() || override.restricts()
 	for {
+		conn.setState(ClientConnIdle)
 		h, err := p.idleClientReadHeader(c)
+		if backend == nil {
+			err = checkFirstHeader(h, err)
+		}
 		if err != nil {
-			if err != errNormalClose {
+			if _, ok := err.(*ProtocolError); ok {
+				stats.BumpSum(p.stats, "client.rejected.protocol", 1)
+				p.Log.Errorf("closing client %s: %s", c.RemoteAddr(), err)
+			} else if err != errNormalClose {
+				p.Log.Error(err)
+			}
+			return
+		}
+		conn.setState(ClientConnInFlight)
+
+		if backend == nil {
+			var metadata clientMetadata
+			if metadata, c, err = readHandshake(h, c); err != nil {
 				p.Log.Error(err)
+				return
 			}
+			backend = p.clientBackend(c, net.ParseIP(remoteIP), metadata)
+			conn.setBackend(backend.MongoAddr, metadata)
+		}
+
+		m, ok := p.screenMessage(h, c, counted, backend, tailing)
+		if !ok {
 			return
 		}
+		if m == nil {
+			continue
+		}
+		client, awaitData, timeout := m.client, m.awaitData, m.timeout
 
 		mpt := stats.BumpTime(p.stats, "message.proxy.time")
-		serverConn, err := p.getServerConn()
+		serverConn, err := backend.getServerConn(m.database)
 		if err != nil {
 			if err != errNormalClose {
 				p.Log.Error(err)
 			}
+			reason := CloseReasonServerUnavailable
+			if err == errNormalClose {
+				reason = CloseReasonReplicaSetChanged
+			} else if _, ok := err.(*ServerOverloadedError); ok {
+				reason = CloseReasonServerOverloaded
+			}
+			select {
+			case <-p.closed:
+				reason = CloseReasonShutdown
+			default:
+			}
+			p.sendCloseReason(h, client, reason)
 			return
 		}
 
 		scht := stats.BumpTime(p.stats, "server.conn.held.time")
 		for {
-			err := p.proxyMessage(h, c, serverConn, &lastError)
+			var err error
+			start := time.Now()
+			if !observe {
+				err = backend.proxyMessage(h, client, serverConn, &lastError, &heldBatches, timeout)
+			} else {
+				err = backend.proxyObservedMessage(h, client, serverConn, &lastError, &heldBatches, timeout, conn)
+			}
 			if err != nil {
-				p.serverPool.Discard(serverConn)
-				p.Log.Error(err)
+				backend.discardServerConn(serverConn)
+				if _, ok := err.(*TruncatedReplyError); ok {
+					p.Log.Errorf("closing client %s: %s", c.RemoteAddr(), err)
+					stats.BumpSum(p.stats, "message.proxy.truncated", 1)
+				} else if _, ok := err.(*ClientStalledError); ok {
+					p.Log.Warnf("closing client: %s", err)
+					stats.BumpSum(p.stats, "client.stalled", 1)
+				} else {
+					p.Log.Error(err)
+				}
 				stats.BumpSum(p.stats, "message.proxy.error", 1)
 				if ne, ok := err.(net.Error); ok && ne.Timeout() {
 					stats.BumpSum(p.stats, "message.proxy.timeout", 1)
 				}
-				if err == errRSChanged {
+				if err == ErrRSChanged {
+					stats.BumpSum(p.stats, "client.dropped.rs.changed", 1)
 					go p.ReplicaSet.Restart()
 				}
 				return
@@ -300,6 +643,10 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 
 			// One message was proxied, stop it's timer.
 			mpt.End()
+			if !awaitData {
+				// Waiting for data is not latency.
+				backend.latency.observe(time.Since(start))
+			}
 
 			if !h.OpCode.IsMutation() {
 				break
@@ -323,19 +670,233 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 				}
 				// We need to return our server to the pool (it's still good as far
 				// as we know).
-				p.serverPool.Release(serverConn)
+				backend.releaseServerConn(serverConn)
 				return
 			}
 
-			// Successfully read message when waiting for the getLastError call.
+			// Successfully read message when waiting for the getLastError call,
+			// it goes through the same checks as any other.
+			m, ok := p.screenMessage(h, c, counted, backend, tailing)
+			if !ok {
+				backend.releaseServerConn(serverConn)
+				return
+			}
+			if m == nil {
+				break
+			}
+			client, awaitData, timeout = m.client, m.awaitData, m.timeout
 			mpt = stats.BumpTime(p.stats, "message.proxy.time")
 		}
-		p.serverPool.Release(serverConn)
+		backend.releaseServerConn(serverConn)
 		scht.End()
 		stats.BumpSum(p.stats, "message.proxy.success", 1)
 	}
 }
 
+// wrapClientConn wraps a client connection as configured. The returned
+// countingConn is nil unless there is a ClientByteQuota. Without any of those
+// options the connection is returned as is, which lets copyBody splice.
+func (p *Proxy) wrapClientConn(c net.Conn) (net.Conn, *countingConn) {
+	c = teeIf(fmt.Sprintf("client %s <=> %s", c.RemoteAddr(), p), c)
+	c = newStallConn(c, p.ReplicaSet.ClientWriteTimeout)
+	c = newThrottledConn(c, p.ReplicaSet.ClientBandwidth, p.ReplicaSet.ClientBandwidthBurst)
+	if p.ReplicaSet.ClientByteQuota == 0 {
+		return c, nil
+	}
+	// copyBody credits the countingConn with the bytes it splices past it.
+	counted := &countingConn{Conn: c}
+	return counted, counted
+}
+
+// screenedMessage is a message from a client which passed the checks made
+// before proxying it.
+type screenedMessage struct {
+	client    net.Conn // replays what the checks read of the message
+	database  string
+	awaitData bool
+	timeout   time.Duration
+}
+
+// screenMessage makes the checks on a message from a client before it is
+// proxied: the byte quota, commands answered locally or rejected, and
+// replayed authentication nonces. It returns false if the client connection
+// should be closed, and a nil screenedMessage if the message was handled and
+// the next one should be read.
+func (p *Proxy) screenMessage(
+	h *messageHeader,
+	c net.Conn,
+	counted *countingConn,
+	backend *Proxy,
+	tailing tailingCursors,
+) (*screenedMessage, bool) {
+
+	// The quota is only enforced between messages, so the client is told why
+	// it is closed rather than seeing a truncated reply.
+	if counted.exceeds(p.ReplicaSet.ClientByteQuota) {
+		stats.BumpSum(p.stats, "client.rejected.quota", 1)
+		p.Log.Errorf("closing client %s: transferred %d bytes, over the quota of %d", c.RemoteAddr(), counted.transferred(), p.ReplicaSet.ClientByteQuota)
+		p.sendCloseReason(h, c, CloseReasonQuotaExceeded)
+		return nil, false
+	}
+
+	client, answered, err := p.answerLocally(h, c)
+	if err != nil {
+		p.Log.Error(err)
+		return nil, false
+	}
+	if answered {
+		return nil, true
+	}
+	client, command, rejected, err := p.rejectCommand(h, client, backend)
+	if err != nil {
+		p.Log.Error(err)
+		return nil, false
+	}
+	if rejected {
+		return nil, true
+	}
+	client, replayed, err := p.replayedNonce(h, client, command)
+	if err != nil {
+		p.Log.Error(err)
+		return nil, false
+	}
+	if replayed {
+		p.sendCloseReason(h, client, CloseReasonReplayedNonce)
+		return nil, false
+	}
+	client, awaitData, err := p.awaitsData(h, client, tailing)
+	if err != nil {
+		p.Log.Error(err)
+		return nil, false
+	}
+	client, database, err := p.peekDatabase(h, client)
+	if err != nil {
+		p.Log.Error(err)
+		return nil, false
+	}
+
+	m := &screenedMessage{
+		client:    client,
+		database:  database,
+		awaitData: awaitData,
+		timeout:   p.ReplicaSet.commandTimeout(command),
+	}
+	if awaitData {
+		stats.BumpSum(p.stats, "message.await.data", 1)
+		m.timeout = p.ReplicaSet.AwaitDataTimeout
+	}
+	return m, true
+}
+
+// tuneConn applies the TCPDelay and WriteBufferSize options to a client or
+// server connection.
+func (r *ReplicaSet) tuneConn(c net.Conn) {
+	conn, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := conn.SetNoDelay(!r.TCPDelay); err != nil {
+		r.Log.Error(err)
+	}
+	if r.WriteBufferSize != 0 {
+		if err := conn.SetWriteBuffer(r.WriteBufferSize); err != nil {
+			r.Log.Error(err)
+		}
+	}
+}
+
+// checkFirstHeader validates the header of the first message from a client,
+// or the error reading it, to reject clients not speaking the mongo wire
+// protocol before anything is sent to a server.
+//
+// A client attempting TLS is called out, since dvara listens in plain TCP and
+// the handshake would otherwise be reported as a nonsensical message.
+func checkFirstHeader(h *messageHeader, err error) error {
+	if le, ok := err.(*MessageLengthError); ok {
+		if isTLSHandshake(le.Length) {
+			return &ProtocolError{Reason: tlsHandshakeReason}
+		}
+		return &ProtocolError{Reason: fmt.Sprintf("message length %d", le.Length)}
+	}
+	if err != nil {
+		return err
+	}
+	if h.MessageLength < headerLen {
+		return &ProtocolError{Reason: fmt.Sprintf("message length %d", h.MessageLength)}
+	}
+	if !h.OpCode.IsRequest() {
+		if isTLSHandshake(h.MessageLength) {
+			return &ProtocolError{Reason: tlsHandshakeReason}
+		}
+		return &ProtocolError{Reason: fmt.Sprintf("op code %d", int32(h.OpCode))}
+	}
+	return nil
+}
+
+const tlsHandshakeReason = "TLS handshake, the listener does not terminate TLS"
+
+// isTLSHandshake checks if the message length read from a client is the start
+// of a TLS handshake record, that is the handshake content type followed by a
+// 3.x record version.
+func isTLSHandshake(length int32) bool {
+	b := uint32(length)
+	return b&0xff == 0x16 && b>>8&0xff == 0x03 && b>>16&0xff <= 0x04
+}
+
+// sendCloseReason consumes the pending request and, if the client expects a
+// response, sends an error reply explaining why the connection is being
+// closed. An OpMsg with the moreToCome flag set expects none. This is best
+// effort as the connection is closed right after.
+func (p *Proxy) sendCloseReason(h *messageHeader, client io.ReadWriter, reason CloseReason) {
+	if !h.OpCode.HasResponse() {
+		return
+	}
+	remaining := int64(h.MessageLength - headerLen)
+	var flags [4]byte
+	if h.OpCode == OpMsg && remaining >= 4 {
+		if _, err := io.ReadFull(client, flags[:]); err != nil {
+			p.Log.Error(err)
+			return
+		}
+		remaining -= 4
+	}
+	if _, err := io.CopyN(ioutil.Discard, client, remaining); err != nil {
+		p.Log.Error(err)
+		return
+	}
+	if uint32(getInt32(flags[:], 0))&msgFlagMoreToCome != 0 {
+		return
+	}
+
+	msg, ok := p.ReplicaSet.CloseReasonMessages[reason]
+	if !ok {
+		msg = DefaultCloseReasonMessages[reason]
+	}
+	e := closeReasonErrors[reason]
+	reply, err := newErrorReply(h, e.Code, msg, e.Labels...)
+	if err != nil {
+		p.Log.Error(err)
+		return
+	}
+	if _, err := client.Write(reply); err != nil {
+		p.Log.Error(err)
+		return
+	}
+	stats.BumpSum(p.stats, "client.close.reason.sent", 1)
+}
+
+// rejectBusy waits for the first request from a client being rejected due to
+// the global connection limit in order to tell it why it is being closed.
+func (p *Proxy) rejectBusy(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	h, err := readHeader(c)
+	if err != nil {
+		return
+	}
+	c.SetDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	p.sendCloseReason(h, c, CloseReasonServerBusy)
+}
+
 // We wait for upto ClientIdleTimeout in MessageTimeout increments and keep
 // checking if we're waiting to be closed. This ensures that at worse we
 // wait for MessageTimeout when closing even when we're idling.
@@ -365,7 +926,7 @@ func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHea
 
 	c.SetReadDeadline(time.Now().Add(timeout))
 	go func() {
-		h, err := readHeader(c)
+		h, err := p.readClientHeader(c)
 		resChan <- headerError{header: h, error: err}
 	}()
 
@@ -393,6 +954,16 @@ func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHea
 		return nil, errNormalClose
 	}
 
+	// The client started a header but did not finish it in time.
+	if response.error == errClientHeaderTimeout {
+		if closed {
+			stats.BumpSum(p.stats, "client.clean.disconnect", 1)
+			return nil, errNormalClose
+		}
+		stats.BumpSum(p.stats, "client.header.timeout", 1)
+		return nil, errClientHeaderTimeout
+	}
+
 	// We hit our ReadDeadline.
 	if ne, ok := response.error.(net.Error); ok && ne.Timeout() {
 		if closed {
@@ -402,12 +973,35 @@ func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHea
 		return nil, errClientReadTimeout
 	}
 
-	// Some other unknown error.
+	// Some other unknown error. Garbage headers are left to the caller to
+	// report.
 	stats.BumpSum(p.stats, "client.error.disconnect", 1)
-	p.Log.Error(response.error)
+	if _, ok := response.error.(*MessageLengthError); !ok {
+		p.Log.Error(response.error)
+	}
 	return nil, response.error
 }
 
+// readClientHeader reads a message header from the client. Once the first
+// byte has arrived the rest of the header must arrive within the
+// ClientHeaderTimeout, so clients trickling in headers are dropped quickly.
+func (p *Proxy) readClientHeader(c net.Conn) (*messageHeader, error) {
+	timeout := p.ReplicaSet.ClientHeaderTimeout
+	if timeout == 0 {
+		return readHeader(c)
+	}
+	var first [1]byte
+	if _, err := io.ReadFull(c, first[:]); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	h, err := readHeader(io.MultiReader(bytes.NewReader(first[:]), c))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, errClientHeaderTimeout
+	}
+	return h, err
+}
+
 var teeIfEnable = os.Getenv("MONGOPROXY_TEE") == "1"
 
 type teeConn struct {
@@ -477,3 +1071,78 @@ func (m *maxPerClientConnections) dec(remoteIP string) {
 		m.counts[remoteIP] = current - 1
 	}
 }
+
+// ConnectionLimiter limits the number of client connections across all the
+// proxies sharing it, which by default is every ReplicaSet in the graph.
+type ConnectionLimiter struct {
+	// Max is the maximum number of client connections. Zero means no limit.
+	Max uint
+
+	mutex    sync.Mutex
+	count    uint
+	rejected uint64
+}
+
+// acquire reserves a connection and returns the new count, or false if the
+// limit has been reached.
+func (l *ConnectionLimiter) acquire() (uint, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.Max != 0 && l.count >= l.Max {
+		l.rejected++
+		return l.count, false
+	}
+	l.count++
+	return l.count, true
+}
+
+// release releases a connection reserved by acquire.
+func (l *ConnectionLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.count--
+}
+
+// Count returns the current number of client connections.
+func (l *ConnectionLimiter) Count() uint {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.count
+}
+
+// Rejected returns the number of client connections rejected so far.
+func (l *ConnectionLimiter) Rejected() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rejected
+}
+
+// DialLimiter limits the number of server connections being established at
+// once across all the proxies sharing it. Unlike the connection limits it does
+// not bound how many connections are open, only how many are dialed
+// concurrently, so a burst of new clients queues up rather than flooding the
+// servers with connection attempts.
+type DialLimiter struct {
+	// Max is the maximum number of concurrent dials. Zero means no limit.
+	Max uint
+
+	once   sync.Once
+	tokens chan struct{}
+}
+
+// acquire blocks until a dial may proceed.
+func (l *DialLimiter) acquire() {
+	if l.Max == 0 {
+		return
+	}
+	l.once.Do(func() { l.tokens = make(chan struct{}, l.Max) })
+	l.tokens <- struct{}{}
+}
+
+// release releases a dial reserved by acquire.
+func (l *DialLimiter) release() {
+	if l.Max == 0 {
+		return
+	}
+	<-l.tokens
+}
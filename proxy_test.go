@@ -1,9 +1,18 @@
 package dvara
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/facebookgo/ensure"
 	"github.com/facebookgo/inject"
@@ -385,3 +394,1025 @@ func BenchmarkInsertReadDirect(b *testing.B) {
 	p := NewSingleHarness(b)
 	benchmarkInsertRead(b, p.RealSession())
 }
+
+func benchmarkSmallRoundTrip(b *testing.B, rs *ReplicaSet) {
+	mongo := newFakeMongo(b, okReply)
+	defer mongo.Stop()
+	p := newFakeProxy(b, mongo.Addr(), rs)
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(b, err)
+	defer c.Close()
+	h, body := fakeQuery("db.foo", bson.D{{Name: "a", Value: 1}})
+	request := append(h.ToWire(), body...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(request); err != nil {
+			b.Fatal(err)
+		}
+		reply, err := readHeader(c)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSmallRoundTripNoDelay(b *testing.B) {
+	benchmarkSmallRoundTrip(b, &ReplicaSet{})
+}
+
+func BenchmarkSmallRoundTripDelay(b *testing.B) {
+	benchmarkSmallRoundTrip(b, &ReplicaSet{TCPDelay: true})
+}
+
+func TestSendCloseReason(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Header   messageHeader
+		Messages map[CloseReason]string
+		Expected string
+	}{
+		{
+			Name:     "default message",
+			Header:   messageHeader{OpCode: OpQuery, MessageLength: headerLen + 3},
+			Expected: DefaultCloseReasonMessages[CloseReasonShutdown],
+		},
+		{
+			Name:     "configured message",
+			Header:   messageHeader{OpCode: OpQuery, MessageLength: headerLen + 3},
+			Messages: map[CloseReason]string{CloseReasonShutdown: "go away"},
+			Expected: "go away",
+		},
+		{
+			Name:   "no response expected",
+			Header: messageHeader{OpCode: OpInsert, MessageLength: headerLen + 3},
+		},
+	}
+
+	for _, c := range cases {
+		p := &Proxy{
+			Log:        &tLogger{TB: t},
+			ReplicaSet: &ReplicaSet{CloseReasonMessages: c.Messages},
+		}
+		var clientOut bytes.Buffer
+		client := fakeReadWriter{
+			Reader: bytes.NewReader([]byte{1, 2, 3}),
+			Writer: &clientOut,
+		}
+		p.sendCloseReason(&c.Header, client, CloseReasonShutdown)
+		if c.Expected == "" {
+			if clientOut.Len() != 0 {
+				t.Fatalf("was not expecting a reply for case %s", c.Name)
+			}
+			continue
+		}
+		var doc bson.M
+		r := &ReplyRW{Log: &tLogger{TB: t}}
+		if _, _, _, err := r.ReadOne(&clientOut, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc["errmsg"] != c.Expected {
+			t.Fatalf("for case %s expected %s got %v", c.Name, c.Expected, doc["errmsg"])
+		}
+	}
+}
+
+func TestSendCloseReasonOpMsg(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name  string
+		Flags uint32
+		Reply bool
+	}{
+		{Name: "acknowledged", Reply: true},
+		{Name: "moreToCome", Flags: msgFlagMoreToCome},
+	}
+	for _, c := range cases {
+		p := &Proxy{
+			Log:        &tLogger{TB: t},
+			ReplicaSet: &ReplicaSet{},
+		}
+		h, body := fakeOpMsg(c.Flags, bson.D{{Name: "insert", Value: "foo"}})
+		request := bytes.NewReader(body)
+		var clientOut bytes.Buffer
+		client := fakeReadWriter{Reader: request, Writer: &clientOut}
+		p.sendCloseReason(h, client, CloseReasonShutdown)
+		ensure.DeepEqual(t, request.Len(), 0, c.Name)
+		ensure.DeepEqual(t, clientOut.Len() != 0, c.Reply, c.Name)
+	}
+}
+
+func TestSendCloseReasonErrorLabels(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Reason CloseReason
+		Code   int32
+		Labels []string
+	}{
+		{
+			Reason: CloseReasonShutdown,
+			Code:   91,
+			Labels: []string{"RetryableWriteError"},
+		},
+		{
+			Reason: CloseReasonReplicaSetChanged,
+			Code:   6,
+			Labels: []string{"RetryableWriteError"},
+		},
+		{
+			Reason: CloseReasonServerUnavailable,
+			Code:   6,
+			Labels: []string{"RetryableWriteError"},
+		},
+		{
+			Reason: CloseReasonServerBusy,
+			Code:   462,
+			Labels: []string{"RetryableError", "SystemOverloadedError"},
+		},
+		{
+			Reason: CloseReasonQuotaExceeded,
+			Code:   96,
+		},
+		{
+			Reason: CloseReasonServerOverloaded,
+			Code:   462,
+			Labels: []string{"RetryableError", "SystemOverloadedError"},
+		},
+	}
+	for _, c := range cases {
+		p := &Proxy{
+			Log:        &tLogger{TB: t},
+			ReplicaSet: &ReplicaSet{},
+		}
+		var clientOut bytes.Buffer
+		client := fakeReadWriter{
+			Reader: bytes.NewReader([]byte{1, 2, 3}),
+			Writer: &clientOut,
+		}
+		h := messageHeader{OpCode: OpQuery, MessageLength: headerLen + 3}
+		p.sendCloseReason(&h, client, c.Reason)
+		var doc struct {
+			Code        int32    `bson:"code"`
+			ErrorLabels []string `bson:"errorLabels"`
+		}
+		r := &ReplyRW{Log: &tLogger{TB: t}}
+		if _, _, _, err := r.ReadOne(&clientOut, &doc); err != nil {
+			t.Fatal(err)
+		}
+		ensure.DeepEqual(t, doc.Code, c.Code)
+		ensure.DeepEqual(t, doc.ErrorLabels, c.Labels)
+	}
+}
+
+func TestCheckFirstHeader(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name   string
+		Header *messageHeader
+		Err    error
+		Error  string
+	}{
+		{
+			Name:   "valid",
+			Header: &messageHeader{OpCode: OpMsg, MessageLength: headerLen + 10},
+		},
+		{
+			Name:  "read error",
+			Err:   errNormalClose,
+			Error: errNormalClose.Error(),
+		},
+		{
+			Name:  "length too large",
+			Err:   &MessageLengthError{Length: 542393671},
+			Error: "dvara: unrecognized client protocol: message length 542393671",
+		},
+		{
+			Name:   "length too small",
+			Header: &messageHeader{OpCode: OpQuery, MessageLength: 3},
+			Error:  "dvara: unrecognized client protocol: message length 3",
+		},
+		{
+			Name:   "reply",
+			Header: &messageHeader{OpCode: OpReply, MessageLength: headerLen},
+			Error:  "dvara: unrecognized client protocol: op code 1",
+		},
+		{
+			Name:   "unknown op code",
+			Header: &messageHeader{OpCode: OpCode(4242), MessageLength: headerLen},
+			Error:  "dvara: unrecognized client protocol: op code 4242",
+		},
+		{
+			Name:   "tls handshake",
+			Header: &messageHeader{OpCode: OpCode(0x03030000), MessageLength: 0x00010316},
+			Error:  "dvara: unrecognized client protocol: " + tlsHandshakeReason,
+		},
+		{
+			Name:  "large tls handshake",
+			Err:   &MessageLengthError{Length: 0x7f010316},
+			Error: "dvara: unrecognized client protocol: " + tlsHandshakeReason,
+		},
+		{
+			Name:   "tls like length of a request",
+			Header: &messageHeader{OpCode: OpMsg, MessageLength: 0x00010316},
+		},
+	}
+	for _, c := range cases {
+		err := checkFirstHeader(c.Header, c.Err)
+		if c.Error == "" {
+			ensure.Nil(t, err, c.Name)
+			continue
+		}
+		ensure.NotNil(t, err, c.Name)
+		ensure.DeepEqual(t, err.Error(), c.Error, c.Name)
+	}
+}
+
+func TestProxyRejectsUnrecognizedProtocol(t *testing.T) {
+	t.Parallel()
+	random := make([]byte, 64)
+	rand.New(rand.NewSource(42)).Read(random)
+	cases := []struct {
+		Name string
+		Data []byte
+	}{
+		{Name: "http", Data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")},
+		{Name: "random", Data: random},
+		{Name: "reply", Data: fakeReplyWithFlags(0, 0)},
+	}
+
+	var received int32
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		atomic.AddInt32(&received, 1)
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{})
+	defer p.Stop()
+
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err, c.Name)
+		_, err = conn.Write(c.Data)
+		ensure.Nil(t, err, c.Name)
+
+		// The proxy closes the connection without replying, possibly resetting
+		// it since the rest of the data is never read.
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		reply, err := ioutil.ReadAll(conn)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("connection was not closed for case %s", c.Name)
+		}
+		ensure.DeepEqual(t, len(reply), 0, c.Name)
+		conn.Close()
+	}
+	ensure.DeepEqual(t, atomic.LoadInt32(&received), int32(0))
+}
+
+func TestProxyRejectsTLSClient(t *testing.T) {
+	t.Parallel()
+	var received int32
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		atomic.AddInt32(&received, 1)
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	var rejected int32
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "mongoproxy.client.rejected.protocol" {
+					atomic.AddInt32(&rejected, int32(val))
+				}
+			},
+		},
+	})
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	err = tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection was not closed")
+	}
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&rejected), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&received), int32(0))
+}
+
+func TestProxyMessageReplyFlagStats(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Flags responseFlags
+		Stat  string
+	}{
+		{Flags: replyFlagCursorNotFound, Stat: "reply.cursor.not.found"},
+		{Flags: replyFlagQueryFailure, Stat: "reply.query.failure"},
+	}
+	for _, c := range cases {
+		bumped := make(map[string]float64)
+		p := &Proxy{
+			Log:        &tLogger{TB: t},
+			ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute},
+			stats: &stats.HookClient{
+				BumpSumHook: func(key string, val float64) { bumped[key] += val },
+			},
+		}
+		clientProxy, client := net.Pipe()
+		serverProxy, server := net.Pipe()
+		body := make([]byte, 20)
+		h := &messageHeader{
+			OpCode:        OpGetMore,
+			MessageLength: int32(headerLen + len(body)),
+		}
+		go func() {
+			client.Write(body)
+			ioutil.ReadAll(client)
+		}()
+		go func() {
+			io.ReadFull(server, make([]byte, h.MessageLength))
+			server.Write(fakeReplyWithFlags(c.Flags, 0))
+		}()
+		var lastError LastError
+		if err := p.proxyMessage(h, clientProxy, serverProxy, &lastError, &HeldBatches{}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		clientProxy.Close()
+		serverProxy.Close()
+		if bumped[c.Stat] != 1 {
+			t.Fatalf("expected %s to be bumped, got %v", c.Stat, bumped)
+		}
+	}
+}
+
+// fakeMongo is a fake mongo server which replies to every request using
+// Handler. A nil reply sends nothing back.
+type fakeMongo struct {
+	Listener net.Listener
+	Handler  func(h *messageHeader, body []byte) []byte
+}
+
+func newFakeMongo(t testing.TB, handler func(h *messageHeader, body []byte) []byte) *fakeMongo {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	f := &fakeMongo{Listener: l, Handler: handler}
+	go f.acceptLoop()
+	return f
+}
+
+func (f *fakeMongo) acceptLoop() {
+	for {
+		c, err := f.Listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.serve(c)
+	}
+}
+
+func (f *fakeMongo) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		h, err := readHeader(c)
+		if err != nil {
+			return
+		}
+		body := make([]byte, h.MessageLength-headerLen)
+		if _, err := io.ReadFull(c, body); err != nil {
+			return
+		}
+		if reply := f.Handler(h, body); reply != nil {
+			if _, err := c.Write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *fakeMongo) Addr() string {
+	return f.Listener.Addr().String()
+}
+
+func (f *fakeMongo) Stop() {
+	f.Listener.Close()
+}
+
+// okReply is a fakeMongo handler replying {ok: 1} to requests expecting a
+// response.
+func okReply(h *messageHeader, body []byte) []byte {
+	if !h.OpCode.HasResponse() {
+		return nil
+	}
+	b, err := newReply(h, 0, bson.D{{Name: "ok", Value: 1}})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// newFakeProxy starts a Proxy in front of the given mongo address. Unset
+// limits and timeouts in the given ReplicaSet get usable defaults.
+func newFakeProxy(t testing.TB, mongoAddr string, rs *ReplicaSet) *Proxy {
+	if rs.MaxConnections == 0 {
+		rs.MaxConnections = 5
+	}
+	if rs.MaxPerClientConnections == 0 {
+		rs.MaxPerClientConnections = 5
+	}
+	if rs.MessageTimeout == 0 {
+		rs.MessageTimeout = time.Minute
+	}
+	if rs.ClientIdleTimeout == 0 {
+		rs.ClientIdleTimeout = time.Minute
+	}
+	if rs.GetLastErrorTimeout == 0 {
+		rs.GetLastErrorTimeout = time.Minute
+	}
+	log := tLogger{TB: t}
+	var graph inject.Graph
+	err := graph.Provide(
+		&inject.Object{Value: &log},
+		&inject.Object{Value: rs},
+		&inject.Object{Value: &stats.HookClient{}},
+	)
+	ensure.Nil(t, err)
+	ensure.Nil(t, graph.Populate())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		Log:            rs.Log,
+		ReplicaSet:     rs,
+		ClientListener: l,
+		ProxyAddr:      l.Addr().String(),
+		MongoAddr:      mongoAddr,
+	}
+	ensure.Nil(t, p.Start())
+	return p
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	// Send all requests before reading any replies.
+	var pipelined []byte
+	for i := 1; i <= 3; i++ {
+		h, body := fakeQuery("test.foo", bson.D{{Name: "a", Value: i}})
+		h.RequestID = int32(i)
+		pipelined = append(pipelined, h.ToWire()...)
+		pipelined = append(pipelined, body...)
+	}
+	_, err = c.Write(pipelined)
+	ensure.Nil(t, err)
+
+	for i := 1; i <= 3; i++ {
+		h, err := readHeader(c)
+		ensure.Nil(t, err)
+		if h.ResponseTo != int32(i) {
+			t.Fatalf("expected reply to %d got reply to %d", i, h.ResponseTo)
+		}
+		_, err = io.CopyN(ioutil.Discard, c, int64(h.MessageLength-headerLen))
+		ensure.Nil(t, err)
+	}
+}
+
+func TestHalfClosedClientGetsReplies(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		time.Sleep(50 * time.Millisecond)
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	var pipelined []byte
+	for i := 1; i <= 3; i++ {
+		h, body := fakeQuery("test.foo", bson.D{{Name: "a", Value: i}})
+		h.RequestID = int32(i)
+		pipelined = append(pipelined, h.ToWire()...)
+		pipelined = append(pipelined, body...)
+	}
+	_, err = c.Write(pipelined)
+	ensure.Nil(t, err)
+
+	// The client is done sending but still expects its replies.
+	ensure.Nil(t, c.(*net.TCPConn).CloseWrite())
+
+	for i := 1; i <= 3; i++ {
+		h, err := readHeader(c)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, h.ResponseTo, int32(i))
+		_, err = io.CopyN(ioutil.Discard, c, int64(h.MessageLength-headerLen))
+		ensure.Nil(t, err)
+	}
+
+	// Once the replies are flushed the proxy closes the connection.
+	_, err = readHeader(c)
+	ensure.DeepEqual(t, err, io.EOF)
+}
+
+func TestMismatchedReplyClosesClient(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		b, err := newReply(&messageHeader{RequestID: h.RequestID + 1}, 0, bson.M{})
+		if err != nil {
+			panic(err)
+		}
+		return b
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	h, body := fakeQuery("test.foo", bson.M{})
+	h.RequestID = 7
+	_, err = c.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+	if _, err := readHeader(c); err != io.EOF {
+		t.Fatalf("was expecting the connection to be closed, got %v", err)
+	}
+}
+
+func TestClientHeaderTimeout(t *testing.T) {
+	t.Parallel()
+	var timeouts int32
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	const timeout = 100 * time.Millisecond
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{
+		ClientHeaderTimeout: timeout,
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "mongoproxy.client.header.timeout" {
+					atomic.AddInt32(&timeouts, 1)
+				}
+			},
+		},
+	})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	// Idle clients are not affected by the header timeout.
+	time.Sleep(2 * timeout)
+
+	// Trickle in the header a byte at a time, it would take 16 times the
+	// timeout to complete.
+	h, _ := fakeQuery("test.foo", bson.D{})
+	header := h.ToWire()
+	start := time.Now()
+	closed := make(chan time.Time)
+	go func() {
+		c.Read(make([]byte, 1))
+		closed <- time.Now()
+	}()
+	for _, b := range header {
+		c.Write([]byte{b})
+		select {
+		case <-time.After(timeout):
+		case end := <-closed:
+			if elapsed := end.Sub(start); elapsed > 5*timeout {
+				t.Fatalf("connection was dropped after %s", elapsed)
+			}
+			ensure.DeepEqual(t, atomic.LoadInt32(&timeouts), int32(1))
+			return
+		}
+	}
+	t.Fatal("connection was not dropped")
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	t.Parallel()
+	l := ConnectionLimiter{Max: 2}
+	for i := uint(1); i <= 2; i++ {
+		count, ok := l.acquire()
+		ensure.True(t, ok)
+		ensure.DeepEqual(t, count, i)
+	}
+	_, ok := l.acquire()
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, l.Rejected(), uint64(1))
+	l.release()
+	ensure.DeepEqual(t, l.Count(), uint(1))
+	_, ok = l.acquire()
+	ensure.True(t, ok)
+
+	var unlimited ConnectionLimiter
+	for i := 0; i < 10; i++ {
+		_, ok := unlimited.acquire()
+		ensure.True(t, ok)
+	}
+}
+
+func TestGlobalConnectionLimit(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	limiter := &ConnectionLimiter{Max: 1}
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{ConnectionLimiter: limiter})
+	defer p.Stop()
+
+	query := func(c net.Conn) responseFlags {
+		h, body := fakeQuery("test.foo", bson.D{})
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		var prefix replyPrefix
+		_, err = io.ReadFull(c, prefix[:])
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen-int32(len(prefix))))
+		ensure.Nil(t, err)
+		return prefix.Flags()
+	}
+
+	first, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	ensure.False(t, query(first).QueryFailure())
+
+	second, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer second.Close()
+	ensure.True(t, query(second).QueryFailure())
+	_, err = second.Read(make([]byte, 1))
+	ensure.DeepEqual(t, err, io.EOF)
+	ensure.DeepEqual(t, limiter.Rejected(), uint64(1))
+
+	first.Close()
+	for limiter.Count() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	third, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer third.Close()
+	ensure.False(t, query(third).QueryFailure())
+}
+
+func TestDialLimiter(t *testing.T) {
+	t.Parallel()
+	l := DialLimiter{Max: 2}
+	var current, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.acquire()
+			defer l.release()
+			n := atomic.AddInt32(&current, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&current, -1)
+		}()
+	}
+	wg.Wait()
+	ensure.DeepEqual(t, atomic.LoadInt32(&peak), int32(2))
+
+	var unlimited DialLimiter
+	for i := 0; i < 10; i++ {
+		unlimited.acquire()
+	}
+}
+
+// slowResolver resolves every host to the loopback address after a delay, and
+// tracks how many lookups are in progress at once.
+type slowResolver struct {
+	current, peak int32
+}
+
+func (r *slowResolver) LookupHost(host string) ([]string, error) {
+	n := atomic.AddInt32(&r.current, 1)
+	defer atomic.AddInt32(&r.current, -1)
+	for {
+		p := atomic.LoadInt32(&r.peak)
+		if n <= p || atomic.CompareAndSwapInt32(&r.peak, p, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return []string{"127.0.0.1"}, nil
+}
+
+func TestConcurrentDialLimit(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	_, port, err := net.SplitHostPort(mongo.Addr())
+	ensure.Nil(t, err)
+
+	// Every dial resolves the host name, so the resolver sees as many
+	// concurrent lookups as there are concurrent dials.
+	resolver := &slowResolver{}
+	const clients = 10
+	p := newFakeProxy(t, net.JoinHostPort("mongo.test", port), &ReplicaSet{
+		MaxConnections:          clients,
+		MaxPerClientConnections: clients,
+		DialLimiter:             &DialLimiter{Max: 2},
+		DNSCache:                &DNSCache{TTL: time.Nanosecond, Resolver: resolver},
+	})
+	defer p.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := net.Dial("tcp", p.ProxyAddr)
+			ensure.Nil(t, err)
+			defer c.Close()
+			h, body := fakeQuery("test.foo", bson.D{})
+			_, err = c.Write(append(h.ToWire(), body...))
+			ensure.Nil(t, err)
+			reply, err := readHeader(c)
+			ensure.Nil(t, err)
+			_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+			ensure.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	ensure.DeepEqual(t, atomic.LoadInt32(&resolver.peak), int32(2))
+}
+
+func TestLastErrorNotSharedAcrossConnections(t *testing.T) {
+	t.Parallel()
+	var gleMutex sync.Mutex
+	var gleCount int
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		if bytes.Contains(body, []byte("getLastError")) {
+			gleMutex.Lock()
+			gleCount++
+			gleMutex.Unlock()
+		}
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{MaxConnections: 1})
+	defer p.Stop()
+
+	insert := append([]byte{0, 0, 0, 0}, "test.foo\000"...)
+	doc, err := bson.Marshal(bson.D{{Name: "a", Value: 1}})
+	ensure.Nil(t, err)
+	insert = append(insert, doc...)
+	insertH := messageHeader{OpCode: OpInsert, MessageLength: int32(headerLen + len(insert))}
+	gleH, gle := fakeQuery("admin.$cmd", bson.D{{Name: "getLastError", Value: 1}})
+
+	// The first client disconnects right after its getLastError is cached.
+	first, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	var pipelined []byte
+	pipelined = append(pipelined, insertH.ToWire()...)
+	pipelined = append(pipelined, insert...)
+	pipelined = append(pipelined, gleH.ToWire()...)
+	pipelined = append(pipelined, gle...)
+	_, err = first.Write(pipelined)
+	ensure.Nil(t, err)
+	first.Close()
+
+	// The second client using the same server connection must get its own
+	// getLastError response.
+	second, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer second.Close()
+	_, err = second.Write(pipelined)
+	ensure.Nil(t, err)
+	reply, err := readHeader(second)
+	ensure.Nil(t, err)
+	_, err = io.CopyN(ioutil.Discard, second, int64(reply.MessageLength-headerLen))
+	ensure.Nil(t, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gleMutex.Lock()
+		count := gleCount
+		gleMutex.Unlock()
+		if count == 2 {
+			break
+		}
+		if count > 2 || time.Now().After(deadline) {
+			t.Fatalf("unexpected getLastError count %d", count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// recordingLogger records the info messages it logs.
+type recordingLogger struct {
+	tLogger
+	mutex sync.Mutex
+	infos []string
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Infos() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.infos...)
+}
+
+func TestQuietClientsAreNotLogged(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name   string
+		Quiet  []string
+		Logged int
+	}{
+		{Name: "not quiet", Logged: 2},
+		{Name: "quiet address", Quiet: []string{"127.0.0.1"}},
+		{Name: "quiet range", Quiet: []string{"10.0.0.0/8", "127.0.0.0/8"}},
+	}
+	for _, c := range cases {
+		var mutex sync.Mutex
+		var connected float64
+		log := &recordingLogger{tLogger: tLogger{TB: t}}
+		mongo := newFakeMongo(t, okReply)
+		p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{
+			Log:          log,
+			QuietClients: c.Quiet,
+			Stats: &stats.HookClient{
+				BumpSumHook: func(key string, val float64) {
+					if key == "mongoproxy.client.connected" {
+						mutex.Lock()
+						defer mutex.Unlock()
+						connected += val
+					}
+				},
+			},
+		})
+
+		// Like a health check, connect and disconnect right away.
+		conn, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		ensure.Nil(t, conn.Close())
+		deadline := time.Now().Add(5 * time.Second)
+		for p.clientCount() != 0 || func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return connected != 1
+		}() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: client was not counted", c.Name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		ensure.Nil(t, p.Stop())
+		mongo.Stop()
+
+		var logged int
+		for _, l := range log.Infos() {
+			if strings.HasPrefix(l, "client ") {
+				logged++
+			}
+		}
+		if logged != c.Logged {
+			t.Fatalf("%s: expected %d client log lines but got %v", c.Name, c.Logged, log.Infos())
+		}
+	}
+}
+
+func TestTruncatedBackendReply(t *testing.T) {
+	t.Parallel()
+	// The backend announces a large reply, sends only its beginning and closes
+	// the connection.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				h, err := readHeader(c)
+				if err != nil {
+					return
+				}
+				if _, err := io.CopyN(ioutil.Discard, c, int64(h.MessageLength-headerLen)); err != nil {
+					return
+				}
+				reply := okReply(h, nil)
+				setInt32(reply, 0, int32(len(reply)+1024))
+				c.Write(reply)
+			}(c)
+		}
+	}()
+	p := newFakeProxy(t, l.Addr().String(), &ReplicaSet{})
+	defer p.Stop()
+
+	requests := []struct {
+		Name   string
+		Header *messageHeader
+		Body   []byte
+	}{
+		{Name: "op query"},
+		{Name: "op msg"},
+	}
+	requests[0].Header, requests[0].Body = fakeQuery("test.foo", bson.D{})
+	requests[1].Header, requests[1].Body = fakeOpMsg(0, bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "$db", Value: "test"},
+	})
+	for _, r := range requests {
+		c, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		_, err = c.Write(append(r.Header.ToWire(), r.Body...))
+		ensure.Nil(t, err)
+
+		// The client gets what the backend sent and is then disconnected,
+		// rather than waiting for the rest until the MessageTimeout.
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = ioutil.ReadAll(c)
+		ensure.Nil(t, err, r.Name)
+		ensure.Nil(t, c.Close())
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		MessageTimeout:  time.Minute,
+		CommandTimeouts: map[string]time.Duration{"aggregate": time.Hour, "isMaster": time.Second},
+	}
+	ensure.DeepEqual(t, r.commandTimeout("aggregate"), time.Hour)
+	ensure.DeepEqual(t, r.commandTimeout("ismaster"), time.Second)
+	ensure.DeepEqual(t, r.commandTimeout("find"), time.Minute)
+	ensure.DeepEqual(t, r.commandTimeout(""), time.Minute)
+}
+
+func TestCommandTimeoutApplied(t *testing.T) {
+	t.Parallel()
+	// Every command takes a while, except ping.
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		if peekCommand(h, body) != "ping" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{
+		MessageTimeout: 100 * time.Millisecond,
+		CommandTimeouts: map[string]time.Duration{
+			"aggregate": time.Minute,
+			"ping":      time.Minute,
+		},
+	})
+	defer p.Stop()
+
+	roundTrip := func(command string) error {
+		c, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		defer c.Close()
+		h, body := fakeOpMsg(0, bson.D{{Name: command, Value: "foo"}, {Name: "$db", Value: "test"}})
+		_, err = c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+		return err
+	}
+
+	// The slow aggregate has more time than the MessageTimeout, while find
+	// falls back to it and times out.
+	ensure.Nil(t, roundTrip("aggregate"))
+	ensure.NotNil(t, roundTrip("find"))
+	ensure.Nil(t, roundTrip("ping"))
+}
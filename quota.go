@@ -0,0 +1,41 @@
+package dvara
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// countingConn is a net.Conn which counts the bytes read from and written to
+// it, for ReplicaSet.ClientByteQuota.
+type countingConn struct {
+	net.Conn
+	bytes uint64 // accessed atomically
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.bytes, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.bytes, uint64(n))
+	return n, err
+}
+
+// add counts n bytes relayed past the connection, see copyBody.
+func (c *countingConn) add(n int64) {
+	atomic.AddUint64(&c.bytes, uint64(n))
+}
+
+// transferred returns the number of bytes read and written so far.
+func (c *countingConn) transferred() uint64 {
+	return atomic.LoadUint64(&c.bytes)
+}
+
+// exceeds checks if more than quota bytes were transferred. A zero quota, or
+// a nil countingConn as used without a quota, is never exceeded.
+func (c *countingConn) exceeds(quota uint) bool {
+	return c != nil && quota != 0 && c.transferred() > uint64(quota)
+}
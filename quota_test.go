@@ -0,0 +1,49 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestClientByteQuota(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	h, body := fakeQuery("test.foo", bson.D{})
+	query := append(h.ToWire(), body...)
+	reply := okReply(h, body)
+	roundTrip := len(query) + len(reply)
+
+	// Two round trips fit in the quota, reading the header of the third
+	// message goes over it.
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{ClientByteQuota: uint(2 * roundTrip)})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		_, err := c.Write(query)
+		ensure.Nil(t, err)
+		rh, err := readHeader(c)
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(rh.MessageLength-headerLen))
+		ensure.Nil(t, err)
+	}
+
+	// The third message is answered with an error and the connection closed.
+	_, err = c.Write(query)
+	ensure.Nil(t, err)
+	var doc bson.M
+	r := &ReplyRW{Log: &tLogger{TB: t}}
+	_, _, _, err = r.ReadOne(c, &doc)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, doc["errmsg"], DefaultCloseReasonMessages[CloseReasonQuotaExceeded])
+	_, err = c.Read(make([]byte, 1))
+	ensure.DeepEqual(t, err, io.EOF)
+}
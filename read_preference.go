@@ -0,0 +1,68 @@
+package dvara
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OpQuery flags.
+const (
+	// queryFlagTailable leaves the cursor open after the last result, for
+	// more to be read as it is inserted into a capped collection.
+	queryFlagTailable = 1 << 1
+
+	// queryFlagSlaveOK allows the query to run on a secondary.
+	queryFlagSlaveOK = 1 << 2
+
+	// queryFlagAwaitData makes the server hold a getMore on a tailable cursor
+	// for a while when there is no more data, rather than reply at once.
+	queryFlagAwaitData = 1 << 5
+
+	// queryFlagExhaust makes the server stream all the results as replies
+	// without waiting for getMore requests.
+	queryFlagExhaust = 1 << 6
+
+	// queryFlagPartial allows mongos to return partial results when some
+	// shards are down. It is meaningless for a replica set and ignored, the
+	// flag is forwarded as is.
+	queryFlagPartial = 1 << 7
+)
+
+// Read preference modes.
+const (
+	readPreferencePrimary            = "primary"
+	readPreferenceSecondaryPreferred = "secondaryPreferred"
+)
+
+// readPreferenceMode returns the mode of the $readPreference field of a
+// command or wrapped query, or an empty string if there is none.
+func readPreferenceMode(doc bson.D) string {
+	for _, e := range doc {
+		if e.Name != "$readPreference" {
+			continue
+		}
+		pref, _ := e.Value.(bson.D)
+		for _, f := range pref {
+			if f.Name == "mode" {
+				mode, _ := f.Value.(string)
+				return mode
+			}
+		}
+	}
+	return ""
+}
+
+// resolveReadPreference resolves the read preference of an operation from the
+// mode of its $readPreference, if any, and the slaveOk flag. An explicit
+// $readPreference takes precedence. Without one slaveOk means
+// secondaryPreferred, as it does for mongos, and an empty string is returned
+// if neither is present. The returned bool is true if both are present and
+// disagree about reading from secondaries.
+func resolveReadPreference(mode string, slaveOK bool) (string, bool) {
+	if mode == "" {
+		if slaveOK {
+			return readPreferenceSecondaryPreferred, false
+		}
+		return "", false
+	}
+	return mode, slaveOK == (mode == readPreferencePrimary)
+}
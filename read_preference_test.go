@@ -0,0 +1,31 @@
+package dvara
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestResolveReadPreference(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Mode     string
+		SlaveOK  bool
+		Resolved string
+		Conflict bool
+	}{
+		{Name: "neither"},
+		{Name: "slaveOk only", SlaveOK: true, Resolved: "secondaryPreferred"},
+		{Name: "primary only", Mode: "primary", Resolved: "primary"},
+		{Name: "secondary with slaveOk", Mode: "secondary", SlaveOK: true, Resolved: "secondary"},
+		{Name: "nearest with slaveOk", Mode: "nearest", SlaveOK: true, Resolved: "nearest"},
+		{Name: "primary with slaveOk", Mode: "primary", SlaveOK: true, Resolved: "primary", Conflict: true},
+		{Name: "secondary without slaveOk", Mode: "secondary", Resolved: "secondary", Conflict: true},
+	}
+	for _, c := range cases {
+		resolved, conflict := resolveReadPreference(c.Mode, c.SlaveOK)
+		ensure.DeepEqual(t, resolved, c.Resolved, c.Name)
+		ensure.DeepEqual(t, conflict, c.Conflict, c.Name)
+	}
+}
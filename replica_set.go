@@ -32,6 +32,10 @@ type Logger interface {
 	Debugf(format string, args ...interface{})
 }
 
+// startupRetryInterval is how long Start waits between attempts to discover
+// the replica set when StartupTimeout is set.
+const startupRetryInterval = time.Second
+
 var errNoAddrsGiven = errors.New("dvara: no seed addresses given for ReplicaSet")
 
 // ReplicaSet manages the real => proxy address mapping.
@@ -43,6 +47,13 @@ type ReplicaSet struct {
 	Log                    Logger                  `inject:""`
 	ReplicaSetStateCreator *ReplicaSetStateCreator `inject:""`
 	ProxyQuery             *ProxyQuery             `inject:""`
+	ProxyMsg               *ProxyMsg               `inject:""`
+	ConnectionLimiter      *ConnectionLimiter      `inject:""`
+	DialLimiter            *DialLimiter            `inject:""`
+	DNSCache               *DNSCache               `inject:""`
+	PrimaryPin             *PrimaryPin             `inject:""`
+	Shadow                 *Shadow                 `inject:""`
+	CommandClassifier      *CommandClassifier      `inject:""`
 
 	// Stats if provided will be used to record interesting stats.
 	Stats stats.Client `inject:""`
@@ -58,17 +69,52 @@ type ReplicaSet struct {
 	PortStart int
 	PortEnd   int
 
+	// MaxListeners if non zero limits the number of proxies listening. Members
+	// without a proxy are not advertised to clients. The primary is always
+	// proxied.
+	MaxListeners int
+
+	// LazyListeners if true only binds the primary's listener on Start. The
+	// listeners for other members are bound the first time they are advertised
+	// to a client.
+	LazyListeners bool
+
+	// CollapseAliases if true proxies members whose host names resolve to the
+	// same address through a single listener, rather than one per member name.
+	CollapseAliases bool
+
 	// Maximum number of connections that will be established to each mongo node.
 	MaxConnections uint
 
+	// MaxQueueDepth if non zero is the most requests waiting for a connection to
+	// a mongo node once all MaxConnections are in use. Further requests fail
+	// right away with a retryable error, bounding the latency of an
+	// overloaded node.
+	MaxQueueDepth uint
+
+	// DatabasePools gives the named databases a pool of their own of at most
+	// the given number of connections to each mongo node, so they neither
+	// starve nor are starved by the others. Other databases share the pool of
+	// MaxConnections, to which MaxQueueDepth applies.
+	DatabasePools map[string]uint
+
 	// MinIdleConnections is the number of idle server connections we'll keep
 	// around.
 	MinIdleConnections uint
 
+	// PrewarmConnections is the number of server connections established to
+	// each member when its proxy starts, including after a topology change, so
+	// the first clients do not pay for the dials. Failures are only logged.
+	PrewarmConnections uint
+
 	// ServerIdleTimeout is the duration after which a server connection will be
 	// considered idle.
 	ServerIdleTimeout time.Duration
 
+	// ServerIdleStatsInterval if non zero is how often the number of idle
+	// server connections of each proxy is reported.
+	ServerIdleStatsInterval time.Duration
+
 	// ServerClosePoolSize is the number of goroutines that will handle closing
 	// server connections.
 	ServerClosePoolSize uint
@@ -77,6 +123,24 @@ type ReplicaSet struct {
 	// idle and disconnect and release it's resources.
 	ClientIdleTimeout time.Duration
 
+	// ClientHeaderTimeout if non zero is how long a client has to send the rest
+	// of a message header once it started sending it. This protects against
+	// clients tying up connections by trickling in headers.
+	ClientHeaderTimeout time.Duration
+
+	// ClientWriteTimeout if non zero is how long a client may stop reading a
+	// reply before its connection is closed, rather than holding a server
+	// connection until MessageTimeout. Slow clients which keep reading are not
+	// affected.
+	ClientWriteTimeout time.Duration
+
+	// SASLReplayWindow if non zero is how long the client nonces of SCRAM
+	// saslStart commands are remembered. A saslStart reusing a nonce within the
+	// window is rejected and its connection closed, as it is likely a captured
+	// conversation being replayed. Nonces are shared by all the proxies of the
+	// ReplicaSet, since a replay usually comes on a new connection.
+	SASLReplayWindow time.Duration
+
 	// MaxPerClientConnections is how many client connections are allowed from a
 	// single client.
 	MaxPerClientConnections uint
@@ -85,29 +149,242 @@ type ReplicaSet struct {
 	// connection expecting a possibly getLastError call.
 	GetLastErrorTimeout time.Duration
 
+	// ConnectTimeout is the timeout for establishing a connection to a mongo
+	// server. Zero means no timeout.
+	ConnectTimeout time.Duration
+
+	// TCPDelay if true enables Nagle's algorithm on client and server
+	// connections. By default TCP_NODELAY is set so small messages are sent
+	// right away.
+	TCPDelay bool
+
+	// WriteBufferSize if non zero sets the size of the operating system write
+	// buffer of client and server connections.
+	WriteBufferSize int
+
 	// MessageTimeout is used to determine the timeout for a single message to be
 	// proxied.
 	MessageTimeout time.Duration
 
+	// CommandTimeouts override MessageTimeout for the named commands, for
+	// example to give long running aggregations more time while keeping the
+	// handshake commands snappy. Command names are matched case insensitively.
+	CommandTimeouts map[string]time.Duration
+
+	// AwaitDataTimeout if non zero overrides MessageTimeout for getMore on
+	// tailable cursors opened with AwaitData and on change streams, which the
+	// server holds until new data arrives.
+	AwaitDataTimeout time.Duration
+
+	// ClientBandwidth if non zero limits the rate at which replies are written
+	// to each client connection, in bytes per second. Throttled clients slow
+	// down reading the reply from the server rather than buffering it.
+	ClientBandwidth uint
+
+	// ClientBandwidthBurst is the number of bytes a client connection may be
+	// sent at once when ClientBandwidth is set.
+	ClientBandwidthBurst uint
+
+	// ClientByteQuota if non zero is the most bytes, read and written, a client
+	// connection may transfer. Once over it the connection is closed before its
+	// next message, with an error reply explaining why.
+	ClientByteQuota uint
+
+	// LocalCommands if true answers ping and whatsmyuri commands in the proxy
+	// without a server round trip.
+	LocalCommands bool
+
+	// AllowShutdown are the addresses of the mongo servers to which the
+	// shutdown command is forwarded. Clients issuing it against any other
+	// member get an error, so a server is not shut down through the proxy by
+	// mistake.
+	AllowShutdown []string
+
+	// AllowProfile if true forwards profile commands changing the profiling
+	// level. They are rejected by default since the level applies to all the
+	// clients of a server. Reading the level is always allowed.
+	AllowProfile bool
+
+	// AllowedParameters are the server parameters clients may change with
+	// setParameter. Other setParameter commands are rejected since they apply
+	// to all the clients of a server.
+	AllowedParameters []string
+
+	// Introspection if true answers operations against the
+	// IntrospectionDatabase with the state of the proxy. It exposes the member
+	// addresses to any client and is disabled by default.
+	Introspection bool
+
+	// CloseReasonMessages overrides the messages sent to clients with a pending
+	// request when their connection is closed. Reasons not specified here use
+	// DefaultCloseReasonMessages.
+	CloseReasonMessages map[CloseReason]string
+
+	// Tracer if set is used to start a span for each proxied operation.
+	Tracer Tracer
+
+	// AuditSink if set receives an AuditEvent for each proxied mutation.
+	AuditSink AuditSink
+
+	// AuditAllCommands if true audits every proxied operation rather than just
+	// mutations.
+	AuditAllCommands bool
+
+	// AllowedDatabases if non empty restricts clients to these databases.
+	// Operations against other databases get an Unauthorized error.
+	AllowedDatabases []string
+
+	// AllowedAdminCommands are the commands against the admin database allowed
+	// when AllowedDatabases is set. If nil DefaultAllowedAdminCommands is used.
+	AllowedAdminCommands []string
+
+	// MaxNamespaces if non zero limits the number of distinct collections a
+	// client connection may use. Operations on further ones get an error. This
+	// guards against a buggy client scanning the whole cluster.
+	MaxNamespaces uint
+
+	// ListenerOverrides override parts of the configuration for the clients of
+	// some listeners. They are keyed by the port of a listener, or by the role
+	// of the member it fronts such as SECONDARY. An override for a port takes
+	// precedence over one for a role. The role is the one when a client
+	// connects.
+	ListenerOverrides map[string]*ListenerOverride
+
+	// MemberGracePeriod is how long a member that stops being healthy is kept
+	// in the mapping as a suspect before the proxies are restarted to drop it.
+	// New client requests to a suspect are rejected. Zero drops it immediately.
+	MemberGracePeriod time.Duration
+
+	// RederiveClientRoles if true attributes client connections to the current
+	// role of their member in ClientsByRole, rather than the role it had when
+	// they were opened.
+	RederiveClientRoles bool
+
+	// InstabilityThreshold if non zero is the number of changes of the replica
+	// set within InstabilityWindow, such as restarts of the proxies during an
+	// election, above which it is unstable. New clients are then held until it
+	// settles, for up to InstabilityWindow, rather than reconnecting en masse.
+	InstabilityThreshold uint
+
+	// InstabilityWindow is the window over which changes of the replica set are
+	// counted, and the longest a new client is held.
+	InstabilityWindow time.Duration
+
+	// InstabilityMaxQueued if non zero is the most new clients held while the
+	// replica set is unstable. Further ones are told the server is busy so they
+	// retry later.
+	InstabilityMaxQueued uint
+
+	// QuietClients are the IP addresses or CIDR ranges of clients, such as load
+	// balancer health checks, whose connections are not logged. They are still
+	// counted in the stats.
+	QuietClients []string
+
+	// StartupTimeout if non zero makes Start retry discovering the replica set
+	// until it succeeds, giving up with an error after this long. No client
+	// connection is accepted before discovery succeeds. Zero means Start fails
+	// if the first attempt does.
+	StartupTimeout time.Duration
+
 	// Name is the name of the replica set to connect to. Nodes that are not part
 	// of this replica set will be ignored. If this is empty, the first replica set
 	// will be used
 	Name string
 
-	proxyToReal map[string]string
-	realToProxy map[string]string
-	ignoredReal map[string]ReplicaState
-	proxies     map[string]*Proxy
-	restarter   *sync.Once
-	lastState   *ReplicaSetState
+	mappingMutex sync.RWMutex
+	proxyToReal  map[string]string
+	realToProxy  map[string]string
+	pendingReal  map[string]struct{} // healthy members without a listener yet
+	ignoredReal  map[string]ReplicaState
+	aliasReal    map[string]string // members proxied through the proxy of another member
+	proxies      map[string]*Proxy
+	binding      sync.WaitGroup // proxies bound by bindPending and being started
+	restarter    *sync.Once
+	lastState    *ReplicaSetState
+
+	topologyMutex sync.Mutex
+	topology      *Topology
+
+	suspectsMutex sync.Mutex
+	suspects      map[string]time.Time
+
+	rolesMutex  sync.Mutex
+	clientRoles map[ReplicaState]int64 // client connections by role when opened
+
+	instability instability
+	nonces      nonceCache
+
+	state int32 // LifecycleState, accessed atomically
 }
 
-// Start starts proxies to support this ReplicaSet.
+// Start starts proxies to support this ReplicaSet. It fails with an error if
+// the ReplicaSet is already started, or starting.
 func (r *ReplicaSet) Start() error {
+	if !r.transition(LifecycleStopped, LifecycleStarting) {
+		return errAlreadyStarted
+	}
+	// The proxies log while handling clients, so the Logger is wrapped to keep
+	// a misbehaving one from stalling or crashing them, if it was not provided
+	// wrapped already.
+	r.Log = NewSafeLogger(r.Log, r.Stats)
+	r.Log.Infof("replica set %s => %s", LifecycleStopped, LifecycleStarting)
+	if err := r.start(); err != nil {
+		r.setState(LifecycleStopped)
+		return err
+	}
+	r.setState(LifecycleRunning)
+	return nil
+}
+
+// discover discovers the replica set from the seed addresses. With a
+// StartupTimeout failed attempts are retried until it expires, and an attempt
+// stalled on a slow server is abandoned when it does.
+func (r *ReplicaSet) discover(addrs []string) (*ReplicaSetState, error) {
+	if r.StartupTimeout == 0 {
+		return r.ReplicaSetStateCreator.FromAddrs(addrs, r.Name)
+	}
+
+	type discovery struct {
+		state *ReplicaSetState
+		err   error
+	}
+	timeout := time.NewTimer(r.StartupTimeout)
+	defer timeout.Stop()
+	lastErr := errors.New("no attempt completed")
+	for {
+		// Buffered so an abandoned attempt does not leak its goroutine.
+		done := make(chan discovery, 1)
+		go func() {
+			state, err := r.ReplicaSetStateCreator.FromAddrs(addrs, r.Name)
+			done <- discovery{state: state, err: err}
+		}()
+		select {
+		case d := <-done:
+			if d.err == nil {
+				return d.state, nil
+			}
+			lastErr = d.err
+			r.Log.Warnf("retrying replica set discovery: %s", lastErr)
+		case <-timeout.C:
+			return nil, fmt.Errorf("dvara: replica set not discovered within %s: %s", r.StartupTimeout, lastErr)
+		}
+		select {
+		case <-time.After(startupRetryInterval):
+		case <-timeout.C:
+			return nil, fmt.Errorf("dvara: replica set not discovered within %s: %s", r.StartupTimeout, lastErr)
+		}
+	}
+}
+
+func (r *ReplicaSet) start() error {
 	r.proxyToReal = make(map[string]string)
 	r.realToProxy = make(map[string]string)
 	r.ignoredReal = make(map[string]ReplicaState)
+	r.aliasReal = make(map[string]string)
 	r.proxies = make(map[string]*Proxy)
+	r.suspectsMutex.Lock()
+	r.suspects = make(map[string]time.Time)
+	r.suspectsMutex.Unlock()
 
 	if r.Addrs == "" {
 		return errNoAddrsGiven
@@ -115,10 +392,11 @@ func (r *ReplicaSet) Start() error {
 
 	rawAddrs := strings.Split(r.Addrs, ",")
 	var err error
-	r.lastState, err = r.ReplicaSetStateCreator.FromAddrs(rawAddrs, r.Name)
+	r.lastState, err = r.discover(rawAddrs)
 	if err != nil {
 		return err
 	}
+	r.setTopology(r.lastState)
 
 	healthyAddrs := r.lastState.Addrs()
 
@@ -134,37 +412,48 @@ func (r *ReplicaSet) Start() error {
 
 	r.restarter = new(sync.Once)
 
+	r.mappingMutex.Lock()
+	r.pendingReal = make(map[string]struct{}, len(healthyAddrs))
 	for _, addr := range healthyAddrs {
-		listener, err := r.newListener()
-		if err != nil {
-			return err
-		}
-
-		p := &Proxy{
-			Log:            r.Log,
-			ReplicaSet:     r,
-			ClientListener: listener,
-			ProxyAddr:      r.proxyAddr(listener),
-			MongoAddr:      addr,
+		r.pendingReal[addr] = struct{}{}
+	}
+	for _, addr := range r.eagerAddrs(healthyAddrs) {
+		if r.bindAlias(addr, r.DNSCache.canonical) {
+			continue
 		}
-		if err := r.add(p); err != nil {
+		if _, err := r.newProxy(addr); err != nil {
+			if err == errMaxListeners {
+				r.Log.Warnf("not proxying %s, reached %d listeners", addr, r.MaxListeners)
+				continue
+			}
+			r.mappingMutex.Unlock()
 			return err
 		}
 	}
+	if err := r.validateMapping(); err != nil {
+		for _, p := range r.proxyList() {
+			p.ClientListener.Close()
+		}
+		r.mappingMutex.Unlock()
+		return err
+	}
+	proxies := r.proxyList()
+	r.mappingMutex.Unlock()
 
 	// add the ignored hosts, unless lastRS is nil (single node mode)
 	if r.lastState.lastRS != nil {
 		for _, member := range r.lastState.lastRS.Members {
-			if _, ok := r.realToProxy[member.Name]; !ok {
+			_, alias := r.aliasReal[member.Name]
+			if _, ok := r.realToProxy[member.Name]; !ok && !alias {
 				r.ignoredReal[member.Name] = member.State
 			}
 		}
 	}
 
 	var wg sync.WaitGroup
-	wg.Add(len(r.proxies))
-	errch := make(chan error, len(r.proxies))
-	for _, p := range r.proxies {
+	wg.Add(len(proxies))
+	errch := make(chan error, len(proxies))
+	for _, p := range proxies {
 		go func(p *Proxy) {
 			defer wg.Done()
 			if err := p.Start(); err != nil {
@@ -182,16 +471,29 @@ func (r *ReplicaSet) Start() error {
 	}
 }
 
-// Stop stops all the associated proxies for this ReplicaSet.
+// Stop stops all the associated proxies for this ReplicaSet. Proxies already
+// stopped are left alone, so stopping twice or without starting does nothing.
 func (r *ReplicaSet) Stop() error {
 	return r.stop(false)
 }
 
 func (r *ReplicaSet) stop(hard bool) error {
+	defer r.setState(LifecycleStopped)
+
+	// Only bound listeners have a proxy to stop, and no more are bound once
+	// stopping. Those bound by bindPending are waited for to be started.
+	r.mappingMutex.Lock()
+	r.pendingReal = nil
+	r.mappingMutex.Unlock()
+	r.binding.Wait()
+	r.mappingMutex.RLock()
+	proxies := r.proxyList()
+	r.mappingMutex.RUnlock()
+
 	var wg sync.WaitGroup
-	wg.Add(len(r.proxies))
-	errch := make(chan error, len(r.proxies))
-	for _, p := range r.proxies {
+	wg.Add(len(proxies))
+	errch := make(chan error, len(proxies))
+	for _, p := range proxies {
 		go func(p *Proxy) {
 			defer wg.Done()
 			if err := p.stop(hard); err != nil {
@@ -214,6 +516,8 @@ func (r *ReplicaSet) stop(hard bool) error {
 func (r *ReplicaSet) Restart() {
 	r.restarter.Do(func() {
 		r.Log.Info("restart triggered")
+		r.noteChange(time.Now())
+		draining := r.State() == LifecycleDraining
 		if err := r.stop(*hardRestart); err != nil {
 			// We log and ignore this hoping for a successful start anyways.
 			r.Log.Errorf("stop failed for restart: %s", err)
@@ -226,6 +530,9 @@ func (r *ReplicaSet) Restart() {
 			// fucked.
 			panic(fmt.Errorf("start failed for restart: %s", err))
 		}
+		if draining {
+			r.Drain()
+		}
 
 		r.Log.Info("successfully restarted")
 	})
@@ -290,7 +597,8 @@ func (r *ReplicaSet) newListener() (net.Listener, error) {
 	)
 }
 
-// add a proxy/mongo mapping.
+// add a proxy/mongo mapping. The mappingMutex must be held if the ReplicaSet
+// has been started.
 func (r *ReplicaSet) add(p *Proxy) error {
 	if _, ok := r.proxyToReal[p.ProxyAddr]; ok {
 		return fmt.Errorf("proxy %s already used in ReplicaSet", p.ProxyAddr)
@@ -308,7 +616,17 @@ func (r *ReplicaSet) add(p *Proxy) error {
 // Proxy returns the corresponding proxy address for the given real mongo
 // address.
 func (r *ReplicaSet) Proxy(h string) (string, error) {
-	p, ok := r.realToProxy[h]
+	r.mappingMutex.RLock()
+	real, alias := r.aliasReal[h]
+	if !alias {
+		real = h
+	}
+	p, ok := r.realToProxy[real]
+	_, pending := r.pendingReal[h]
+	r.mappingMutex.RUnlock()
+	if !ok && pending {
+		return r.bindPending(h)
+	}
 	if !ok {
 		if s, ok := r.ignoredReal[h]; ok {
 			return "", &ProxyMapperError{
@@ -316,13 +634,33 @@ func (r *ReplicaSet) Proxy(h string) (string, error) {
 				State:    s,
 			}
 		}
-		return "", fmt.Errorf("mongo %s is not in ReplicaSet", h)
+		return "", &UnknownMemberError{RealHost: h}
 	}
 	return p, nil
 }
 
+// ListenerProxy returns the proxy address of the listener a client connected
+// to, given the local address of its connection. Listeners are told apart by
+// their port, since they may be bound to any address.
+func (r *ReplicaSet) ListenerProxy(localAddr net.Addr) (string, error) {
+	_, port, err := net.SplitHostPort(localAddr.String())
+	if err != nil {
+		return "", err
+	}
+	r.mappingMutex.RLock()
+	defer r.mappingMutex.RUnlock()
+	for _, p := range r.proxies {
+		if _, lport, err := net.SplitHostPort(p.ClientListener.Addr().String()); err == nil && lport == port {
+			return p.ProxyAddr, nil
+		}
+	}
+	return "", fmt.Errorf("dvara: no listener for %s", localAddr)
+}
+
 // ProxyMembers returns the list of proxy members in this ReplicaSet.
 func (r *ReplicaSet) ProxyMembers() []string {
+	r.mappingMutex.RLock()
+	defer r.mappingMutex.RUnlock()
 	members := make([]string, 0, len(r.proxyToReal))
 	for r := range r.proxyToReal {
 		members = append(members, r)
@@ -331,9 +669,76 @@ func (r *ReplicaSet) ProxyMembers() []string {
 }
 
 // SameRS checks if the given replSetGetStatusResponse is the same as the last
-// state.
+// state. Members that recently stopped being healthy are tolerated as
+// suspects until MemberGracePeriod elapses.
 func (r *ReplicaSet) SameRS(o *replSetGetStatusResponse) bool {
-	return r.lastState.SameRS(o)
+	if r.lastState.SameRS(o) {
+		r.suspectsMutex.Lock()
+		r.suspects = make(map[string]time.Time)
+		r.suspectsMutex.Unlock()
+		return true
+	}
+	return r.tolerateSuspects(o)
+}
+
+// tolerateSuspects checks if the only difference from the last state is
+// members that went from healthy to unhealthy within the grace period.
+func (r *ReplicaSet) tolerateSuspects(o *replSetGetStatusResponse) bool {
+	if r.MemberGracePeriod == 0 || r.lastState.lastRS == nil || o == nil {
+		return false
+	}
+	last := r.lastState.lastRS.Members
+	if len(last) != len(o.Members) {
+		return false
+	}
+	current := make(map[string]ReplicaState, len(o.Members))
+	for _, m := range o.Members {
+		current[m.Name] = m.State
+	}
+
+	var suspects []string
+	for _, m := range last {
+		state, ok := current[m.Name]
+		if !ok {
+			return false
+		}
+		if state == m.State {
+			continue
+		}
+		wasHealthy := m.State == ReplicaStatePrimary || m.State == ReplicaStateSecondary
+		isHealthy := state == ReplicaStatePrimary || state == ReplicaStateSecondary
+		if !wasHealthy || isHealthy {
+			return false
+		}
+		suspects = append(suspects, m.Name)
+	}
+
+	now := time.Now()
+	r.suspectsMutex.Lock()
+	defer r.suspectsMutex.Unlock()
+	newSuspects := make(map[string]time.Time, len(suspects))
+	for _, name := range suspects {
+		since, ok := r.suspects[name]
+		if !ok {
+			r.Log.Warnf("member %s is suspect, will be dropped in %s", name, r.MemberGracePeriod)
+			since = now
+		}
+		if now.Sub(since) > r.MemberGracePeriod {
+			r.Log.Errorf("member %s is still unhealthy after %s", name, r.MemberGracePeriod)
+			return false
+		}
+		newSuspects[name] = since
+	}
+	r.suspects = newSuspects
+	return true
+}
+
+// isSuspect checks if the given real mongo address is a suspect member.
+func (r *ReplicaSet) isSuspect(addr string) bool {
+	r.suspectsMutex.Lock()
+	defer r.suspectsMutex.Unlock()
+	_, ok := r.suspects[addr]
+	return ok
 }
 
 // SameIM checks if the given isMasterResponse is the same as the last state.
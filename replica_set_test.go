@@ -1,9 +1,15 @@
 package dvara
 
 import (
+	"bytes"
 	"fmt"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/inject"
+	"github.com/facebookgo/stats"
 	"github.com/facebookgo/subset"
 
 	"gopkg.in/mgo.v2"
@@ -66,7 +72,7 @@ func TestProxyNotInReplicaSet(t *testing.T) {
 	h := NewSingleHarness(t)
 	defer h.Stop()
 	addr := "127.0.0.1:666"
-	expected := fmt.Sprintf("mongo %s is not in ReplicaSet", addr)
+	expected := fmt.Sprintf("dvara: mongo %s is not in ReplicaSet", addr)
 	_, err := h.ReplicaSet.Proxy(addr)
 	if err == nil || err.Error() != expected {
 		t.Fatalf("did not get expected error, got: %s", err)
@@ -140,3 +146,203 @@ func TestNewListenerError(t *testing.T) {
 		t.Fatalf("did not get expected error, got: %s", err)
 	}
 }
+
+func newGraceReplicaSet(t *testing.T, grace time.Duration) *ReplicaSet {
+	return &ReplicaSet{
+		Log:               &tLogger{TB: t},
+		MemberGracePeriod: grace,
+		suspects:          make(map[string]time.Time),
+		lastState: &ReplicaSetState{
+			lastRS: &replSetGetStatusResponse{
+				Members: []statusMember{
+					{Name: "a", State: ReplicaStatePrimary},
+					{Name: "b", State: ReplicaStateSecondary},
+				},
+			},
+		},
+	}
+}
+
+func TestMemberGracePeriod(t *testing.T) {
+	t.Parallel()
+	unreachable := &replSetGetStatusResponse{
+		Members: []statusMember{
+			{Name: "a", State: ReplicaStatePrimary},
+			{Name: "b", State: "(not reachable/healthy)"},
+		},
+	}
+
+	r := newGraceReplicaSet(t, time.Minute)
+	if !r.SameRS(unreachable) {
+		t.Fatal("expected unreachable member to be tolerated")
+	}
+	if !r.isSuspect("b") {
+		t.Fatal("expected member to be suspect")
+	}
+	if r.isSuspect("a") {
+		t.Fatal("did not expect healthy member to be suspect")
+	}
+
+	r.suspects["b"] = time.Now().Add(-2 * time.Minute)
+	if r.SameRS(unreachable) {
+		t.Fatal("expected member to be dropped after the grace period")
+	}
+
+	if !r.SameRS(r.lastState.lastRS) {
+		t.Fatal("expected same state")
+	}
+	if r.isSuspect("b") {
+		t.Fatal("expected recovered member to no longer be suspect")
+	}
+}
+
+func TestMemberGracePeriodNotTolerated(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name  string
+		Grace time.Duration
+		RS    *replSetGetStatusResponse
+	}{
+		{
+			Name:  "no grace period",
+			Grace: 0,
+			RS: &replSetGetStatusResponse{
+				Members: []statusMember{
+					{Name: "a", State: ReplicaStatePrimary},
+					{Name: "b", State: "(not reachable/healthy)"},
+				},
+			},
+		},
+		{
+			Name:  "primary changed",
+			Grace: time.Minute,
+			RS: &replSetGetStatusResponse{
+				Members: []statusMember{
+					{Name: "a", State: ReplicaStateSecondary},
+					{Name: "b", State: ReplicaStatePrimary},
+				},
+			},
+		},
+		{
+			Name:  "member added",
+			Grace: time.Minute,
+			RS: &replSetGetStatusResponse{
+				Members: []statusMember{
+					{Name: "a", State: ReplicaStatePrimary},
+					{Name: "b", State: ReplicaStateSecondary},
+					{Name: "c", State: ReplicaStateSecondary},
+				},
+			},
+		},
+		{
+			Name:  "member replaced",
+			Grace: time.Minute,
+			RS: &replSetGetStatusResponse{
+				Members: []statusMember{
+					{Name: "a", State: ReplicaStatePrimary},
+					{Name: "c", State: "(not reachable/healthy)"},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		r := newGraceReplicaSet(t, c.Grace)
+		if r.SameRS(c.RS) {
+			t.Fatalf("failed %s", c.Name)
+		}
+	}
+}
+
+// newStartupReplicaSet returns a ReplicaSet seeded with the given address,
+// ready to be started.
+func newStartupReplicaSet(t *testing.T, addr string, timeout time.Duration) *ReplicaSet {
+	r := &ReplicaSet{
+		Addrs:                   addr,
+		StartupTimeout:          timeout,
+		MaxConnections:          5,
+		ServerIdleTimeout:       time.Minute,
+		ServerClosePoolSize:     1,
+		ClientIdleTimeout:       time.Minute,
+		MaxPerClientConnections: 5,
+		GetLastErrorTimeout:     time.Minute,
+		MessageTimeout:          time.Minute,
+	}
+	var graph inject.Graph
+	ensure.Nil(t, graph.Provide(
+		&inject.Object{Value: &tLogger{TB: t}},
+		&inject.Object{Value: r},
+		&inject.Object{Value: &stats.HookClient{}},
+	))
+	ensure.Nil(t, graph.Populate())
+	return r
+}
+
+// standaloneReply answers the commands sent during discovery as a standalone
+// mongod would.
+func standaloneReply(t *testing.T, h *messageHeader, body []byte) []byte {
+	doc := bson.D{
+		{Name: "ismaster", Value: true},
+		{Name: "maxWireVersion", Value: 6},
+		{Name: "ok", Value: 1},
+	}
+	switch {
+	case bytes.Contains(body, []byte("getnonce")):
+		doc = bson.D{{Name: "nonce", Value: "2375531c32080ae8"}, {Name: "ok", Value: 1}}
+	case bytes.Contains(body, []byte("replSetGetStatus")):
+		doc = bson.D{{Name: "ok", Value: 0}, {Name: "errmsg", Value: errNotReplSet}}
+	}
+	b, err := newReply(h, 0, doc)
+	ensure.Nil(t, err)
+	return b
+}
+
+func TestStartupTimeoutHoldsUntilDiscovered(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		<-release
+		return standaloneReply(t, h, body)
+	})
+	defer mongo.Stop()
+	r := newStartupReplicaSet(t, mongo.Addr(), time.Minute)
+
+	started := make(chan error, 1)
+	go func() { started <- r.Start() }()
+
+	// Nothing is proxied while the server is slow to respond.
+	time.Sleep(100 * time.Millisecond)
+	ensure.DeepEqual(t, r.State(), LifecycleStarting)
+	select {
+	case err := <-started:
+		t.Fatalf("Start returned before discovery: %v", err)
+	default:
+	}
+
+	close(release)
+	ensure.Nil(t, <-started)
+	defer r.Stop()
+	ensure.DeepEqual(t, r.State(), LifecycleRunning)
+	proxies := r.ProxyMembers()
+	ensure.DeepEqual(t, len(proxies), 1)
+	c, err := net.Dial("tcp", proxies[0])
+	ensure.Nil(t, err)
+	c.Close()
+}
+
+func TestStartupTimeoutExpires(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		return nil
+	})
+	defer mongo.Stop()
+	r := newStartupReplicaSet(t, mongo.Addr(), 100*time.Millisecond)
+
+	begin := time.Now()
+	err := r.Start()
+	ensure.NotNil(t, err)
+	ensure.StringContains(t, err.Error(), "replica set not discovered within 100ms")
+	ensure.True(t, time.Since(begin) < 5*time.Second)
+	ensure.DeepEqual(t, r.State(), LifecycleStopped)
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 0)
+}
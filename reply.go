@@ -0,0 +1,208 @@
+package dvara
+
+import (
+	"io"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// responseFlags are the OpReply response flags:
+// http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/#op-reply
+type responseFlags int32
+
+const (
+	replyFlagCursorNotFound   = responseFlags(1 << 0)
+	replyFlagQueryFailure     = responseFlags(1 << 1)
+	replyFlagShardConfigStale = responseFlags(1 << 2)
+	replyFlagAwaitCapable     = responseFlags(1 << 3)
+)
+
+// CursorNotFound is set when a getMore referenced an unknown cursor.
+func (f responseFlags) CursorNotFound() bool {
+	return f&replyFlagCursorNotFound != 0
+}
+
+// QueryFailure is set when the query failed, the single document in the reply
+// will contain the $err field.
+func (f responseFlags) QueryFailure() bool {
+	return f&replyFlagQueryFailure != 0
+}
+
+// ShardConfigStale is set by mongos when the shard config is stale.
+func (f responseFlags) ShardConfigStale() bool {
+	return f&replyFlagShardConfigStale != 0
+}
+
+// AwaitCapable is set when the server supports the AwaitData query option.
+func (f responseFlags) AwaitCapable() bool {
+	return f&replyFlagAwaitCapable != 0
+}
+
+// Flags returns the response flags in the reply prefix.
+func (p replyPrefix) Flags() responseFlags {
+	return responseFlags(getInt32(p[:], 0))
+}
+
+// CursorID returns the cursor ID in the reply prefix.
+func (p replyPrefix) CursorID() int64 {
+	return int64(uint32(getInt32(p[:], 4))) | int64(getInt32(p[:], 8))<<32
+}
+
+// copyReply copies an entire reply to the given request like copyMessage. If
+// the reply is an OpReply its response flags are returned. Since a connection
+// replies to requests in order, a reply to a different request indicates the
+// connection is out of sync and is treated as an error.
+func copyReply(w io.Writer, r io.Reader, req *messageHeader) (responseFlags, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	if h.ResponseTo != req.RequestID {
+		return 0, &ReplyMismatchError{RequestID: req.RequestID, ResponseTo: h.ResponseTo}
+	}
+	if err := h.WriteTo(w); err != nil {
+		return 0, err
+	}
+	pending := int64(h.MessageLength - headerLen)
+	if h.OpCode != OpReply || pending < 4 {
+		return 0, truncatedReply(h, copyBody(w, r, pending))
+	}
+
+	var flags [4]byte
+	if _, err := io.ReadFull(r, flags[:]); err != nil {
+		return 0, truncatedReply(h, err)
+	}
+	if _, err := w.Write(flags[:]); err != nil {
+		return 0, err
+	}
+	return responseFlags(getInt32(flags[:], 0)), truncatedReply(h, copyBody(w, r, pending-4))
+}
+
+// truncatedReply returns a TruncatedReplyError if the error of reading the
+// body of the reply with the given header shows the server closed the
+// connection before sending all of it. Other errors are returned as is.
+func truncatedReply(h *messageHeader, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &TruncatedReplyError{ResponseTo: h.ResponseTo, MessageLength: h.MessageLength}
+	}
+	return err
+}
+
+// newReply synthesizes a reply to the given request containing the single
+// document v. OpMsg requests get an OpMsg reply, everything else gets an
+// OpReply with the given flags.
+func newReply(req *messageHeader, flags responseFlags, v interface{}) ([]byte, error) {
+	doc, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	h := messageHeader{ResponseTo: req.RequestID}
+	if req.OpCode == OpMsg {
+		h.OpCode = OpMsg
+		m := opMsg{Body: doc}
+		return m.ToWire(&h), nil
+	}
+
+	h.OpCode = OpReply
+	h.MessageLength = int32(headerLen + len(emptyPrefix) + len(doc))
+	var prefix replyPrefix
+	setInt32(prefix[:], 0, int32(flags))
+	setInt32(prefix[:], 16, 1) // numberReturned
+	b := make([]byte, 0, h.MessageLength)
+	b = append(b, h.ToWire()...)
+	b = append(b, prefix[:]...)
+	b = append(b, doc...)
+	return b, nil
+}
+
+// newErrorReply synthesizes an error reply to the given request. The document
+// is understood both as a failed query and a failed command. The optional
+// labels are sent as errorLabels, which drivers use to decide whether to retry.
+func newErrorReply(req *messageHeader, code int32, errmsg string, labels ...string) ([]byte, error) {
+	doc := bson.D{
+		{Name: "$err", Value: errmsg},
+		{Name: "errmsg", Value: errmsg},
+		{Name: "code", Value: code},
+		{Name: "ok", Value: 0},
+	}
+	if len(labels) > 0 {
+		doc = append(doc, bson.DocElem{Name: "errorLabels", Value: labels})
+	}
+	return newReply(req, replyFlagQueryFailure, doc)
+}
+
+// replyStatus is the outcome of a command as reported by the first document of
+// its reply, with the code and codeName of the error preserved as sent by the
+// server.
+type replyStatus struct {
+	Ok         bool
+	Code       int32
+	CodeName   string
+	ErrMsg     string
+	WriteError string // errmsg of the first write error of a successful write
+}
+
+// parseReplyStatus parses the status from the beginning of an OpReply or
+// OpMsg. Replies without an ok field, like query results, are successful. It
+// returns false if the reply is truncated or cannot be understood.
+func parseReplyStatus(b []byte) (replyStatus, bool) {
+	if len(b) < headerLen {
+		return replyStatus{}, false
+	}
+	var h messageHeader
+	h.FromWire(b)
+
+	var doc []byte
+	switch h.OpCode {
+	default:
+		return replyStatus{}, false
+	case OpReply:
+		if len(b) < headerLen+len(emptyPrefix) {
+			return replyStatus{}, false
+		}
+		doc = b[headerLen+len(emptyPrefix):]
+	case OpMsg:
+		if len(b) < headerLen+5 || b[headerLen+4] != msgSectionBody {
+			return replyStatus{}, false
+		}
+		doc = b[headerLen+5:]
+	}
+	if len(doc) < 5 {
+		return replyStatus{}, false
+	}
+	if n := int(getInt32(doc, 0)); n >= 5 && n <= len(doc) {
+		doc = doc[:n]
+	} else {
+		return replyStatus{}, false
+	}
+
+	var r struct {
+		Err         string      `bson:"$err"`
+		Ok          interface{} `bson:"ok"`
+		Code        interface{} `bson:"code"`
+		CodeName    string      `bson:"codeName"`
+		ErrMsg      string      `bson:"errmsg"`
+		WriteErrors []struct {
+			ErrMsg string `bson:"errmsg"`
+		} `bson:"writeErrors"`
+	}
+	if err := bson.Unmarshal(doc, &r); err != nil {
+		return replyStatus{}, false
+	}
+	s := replyStatus{Ok: true, CodeName: r.CodeName, ErrMsg: r.ErrMsg}
+	if code, isNumber := int64Value(r.Code); isNumber {
+		s.Code = int32(code)
+	}
+	if r.Err != "" {
+		s.Ok = false
+		s.ErrMsg = r.Err
+	}
+	if ok, isNumber := int64Value(r.Ok); isNumber && ok == 0 {
+		s.Ok = false
+	}
+	if s.Ok && len(r.WriteErrors) > 0 {
+		s.WriteError = r.WriteErrors[0].ErrMsg
+	}
+	return s, true
+}
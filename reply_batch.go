@@ -0,0 +1,370 @@
+package dvara
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	cursorNotFoundCode      = 43
+	exceededMemoryLimitCode = 146
+
+	// DefaultMaxHeldBytes is the MaxHeldBytes used if none is configured.
+	DefaultMaxHeldBytes = 64 << 20
+
+	// heldBatchTimeout is how long the documents held back from a cursor are
+	// kept without a getMore, like the server times out idle cursors.
+	heldBatchTimeout = 10 * time.Minute
+)
+
+// ReplyBatchLimiter limits the number of documents relayed in a single cursor
+// batch of an OpMsg reply, for clients which request unbounded batches. The
+// documents past the limit are held back for the client connection and
+// returned to its next getMore on the cursor before the server is asked for
+// more, so it still sees all of them in order. If the server already closed
+// the cursor, the reply carries a cursor id made up by the proxy for the
+// client to fetch them with.
+//
+// The held documents are only returned to the connection they were held for,
+// which sends all its messages to the same backend, and are dropped when it
+// closes. A getMore on the cursor from another connection is answered with a
+// CursorNotFound error rather than skipping them. A batch which would take the
+// documents held for all the connections over MaxHeldBytes is answered with
+// an error instead, and the server cursor is left to time out.
+//
+// Single batch finds, change streams, whose resume token would point past the
+// documents held back, and exhaust cursors, which are not continued with
+// getMore, are relayed as is.
+type ReplyBatchLimiter struct {
+	// Max is the most documents relayed in a batch. Zero disables the limit.
+	Max int
+
+	// MaxHeldBytes is the most bytes of documents held back at once for all
+	// the client connections. Zero means DefaultMaxHeldBytes.
+	MaxHeldBytes int64
+
+	heldBytes int64 // accessed atomically
+
+	mutex  sync.Mutex
+	owners map[heldCursor]*HeldBatches // the connections holding server cursors
+}
+
+// HeldBatches are the documents held back by the ReplyBatchLimiter from the
+// cursors of a client connection. Reset drops them, it must be called when the
+// connection closes.
+type HeldBatches struct {
+	limiter *ReplyBatchLimiter
+	cursors map[heldCursor]*heldBatch
+}
+
+// heldCursor identifies a cursor with documents held back.
+type heldCursor struct {
+	Namespace string
+	ID        int64
+}
+
+// heldBatch are the documents held back from a cursor.
+type heldBatch struct {
+	docs     []bson.Raw
+	size     int64 // bytes of docs
+	serverID int64 // the cursor on the server, zero if it is closed
+	at       time.Time
+}
+
+// Enabled returns true if a limit has been configured.
+func (l *ReplyBatchLimiter) Enabled() bool {
+	return l != nil && l.Max > 0
+}
+
+func (l *ReplyBatchLimiter) maxHeldBytes() int64 {
+	if l.MaxHeldBytes == 0 {
+		return DefaultMaxHeldBytes
+	}
+	return l.MaxHeldBytes
+}
+
+// limits checks if the reply to the command with the given OpMsg flags is
+// limited.
+func (l *ReplyBatchLimiter) limits(flags uint32, cmd bson.D) bool {
+	if !l.Enabled() || flags&msgFlagExhaustAllowed != 0 || len(cmd) == 0 {
+		return false
+	}
+	switch name := cmd[0].Name; {
+	case strings.EqualFold(name, "find"):
+		return !isSingleBatch(cmd)
+	case strings.EqualFold(name, "getMore"):
+		return true
+	case strings.EqualFold(name, "aggregate"):
+		return !opensChangeStream(cmd)
+	default:
+		return containsFold(cursorCommands, name)
+	}
+}
+
+// copyReply copies the reply to the request, limiting its batch and holding
+// back the rest of it for the connection.
+func (l *ReplyBatchLimiter) copyReply(client io.Writer, server io.Reader, req *messageHeader, held *HeldBatches) error {
+	h, err := readHeader(server)
+	if err != nil {
+		return err
+	}
+	if h.ResponseTo != req.RequestID {
+		return &ReplyMismatchError{RequestID: req.RequestID, ResponseTo: h.ResponseTo}
+	}
+	if h.OpCode != OpMsg {
+		if err := h.WriteTo(client); err != nil {
+			return err
+		}
+		return truncatedReply(h, copyBody(client, server, int64(h.MessageLength-headerLen)))
+	}
+	m, err := readOpMsg(h, server)
+	if err != nil {
+		return truncatedReply(h, err)
+	}
+	body, ok, err := l.limitBatch(m.Body, held, time.Now())
+	if err != nil {
+		reply, err := newErrorReply(req, exceededMemoryLimitCode, err.Error())
+		if err != nil {
+			return err
+		}
+		_, err = client.Write(reply)
+		return err
+	}
+	if ok {
+		m.Body = body
+	}
+	_, err = client.Write(m.ToWire(h))
+	return err
+}
+
+// limitBatch holds back the documents past the limit from the batch in the
+// cursor document of a reply. It returns the new reply document and true if
+// it was modified, or an error if the documents cannot be held.
+func (l *ReplyBatchLimiter) limitBatch(body []byte, held *HeldBatches, now time.Time) ([]byte, bool, error) {
+	var reply bson.RawD
+	if err := bson.Unmarshal(body, &reply); err != nil {
+		return body, false, nil
+	}
+	for i, e := range reply {
+		if e.Name != "cursor" {
+			continue
+		}
+		var cursor bson.RawD
+		if err := e.Value.Unmarshal(&cursor); err != nil {
+			return body, false, nil
+		}
+		var batch []bson.Raw
+		var id int64
+		var ns string
+		batchAt, idAt := -1, -1
+		for j, ce := range cursor {
+			switch ce.Name {
+			case "firstBatch", "nextBatch":
+				if err := ce.Value.Unmarshal(&batch); err != nil {
+					return body, false, nil
+				}
+				batchAt = j
+			case "id":
+				if err := ce.Value.Unmarshal(&id); err != nil {
+					return body, false, nil
+				}
+				idAt = j
+			case "ns":
+				ce.Value.Unmarshal(&ns)
+			case "postBatchResumeToken":
+				// A change stream, the token would resume past the documents
+				// held back.
+				return body, false, nil
+			}
+		}
+		if batchAt < 0 || idAt < 0 || len(batch) <= l.Max {
+			return body, false, nil
+		}
+
+		clientID, err := held.hold(l, ns, id, batch[l.Max:], now)
+		if err != nil {
+			return body, false, err
+		}
+		newCursor := rawToD(cursor)
+		newCursor[batchAt].Value = batch[:l.Max]
+		newCursor[idAt].Value = clientID
+		newReply := rawToD(reply)
+		newReply[i].Value = newCursor
+		newBody, err := bson.Marshal(newReply)
+		if err != nil {
+			held.drop(heldCursor{Namespace: ns, ID: clientID})
+			return body, false, nil
+		}
+		return newBody, true, nil
+	}
+	return body, false, nil
+}
+
+// hold keeps the documents for the next getMore on the cursor from the
+// connection, and returns the cursor id to give to the client. Documents held
+// for too long are dropped.
+func (b *HeldBatches) hold(l *ReplyBatchLimiter, ns string, serverID int64, docs []bson.Raw, now time.Time) (int64, error) {
+	var size int64
+	for _, d := range docs {
+		size += int64(len(d.Data))
+	}
+	if atomic.AddInt64(&l.heldBytes, size) > l.maxHeldBytes() {
+		atomic.AddInt64(&l.heldBytes, -size)
+		return 0, fmt.Errorf("dvara: batch of more than %d documents exceeds the memory held back for cursors", l.Max)
+	}
+
+	b.limiter = l
+	if b.cursors == nil {
+		b.cursors = make(map[heldCursor]*heldBatch)
+	}
+	for c, hb := range b.cursors {
+		if now.Sub(hb.at) > heldBatchTimeout {
+			b.drop(c)
+		}
+	}
+	id := serverID
+	for id == 0 || serverID == 0 && b.cursors[heldCursor{Namespace: ns, ID: id}] != nil {
+		id = rand.Int63()
+	}
+	c := heldCursor{Namespace: ns, ID: id}
+	b.cursors[c] = &heldBatch{docs: docs, size: size, serverID: serverID, at: now}
+	if serverID != 0 {
+		l.mutex.Lock()
+		if l.owners == nil {
+			l.owners = make(map[heldCursor]*HeldBatches)
+		}
+		l.owners[c] = b
+		l.mutex.Unlock()
+	}
+	return id, nil
+}
+
+// drop drops the documents held back from the cursor.
+func (b *HeldBatches) drop(c heldCursor) {
+	hb, ok := b.cursors[c]
+	if !ok {
+		return
+	}
+	delete(b.cursors, c)
+	atomic.AddInt64(&b.limiter.heldBytes, -hb.size)
+	if hb.serverID != 0 {
+		b.limiter.mutex.Lock()
+		if b.limiter.owners[c] == b {
+			delete(b.limiter.owners, c)
+		}
+		b.limiter.mutex.Unlock()
+	}
+}
+
+// Reset drops all the documents held back.
+func (b *HeldBatches) Reset() {
+	for c := range b.cursors {
+		b.drop(c)
+	}
+}
+
+// heldReply answers a getMore from the documents held back from its cursor
+// for the connection. It returns false if there are none and the getMore
+// should go to the server.
+func (l *ReplyBatchLimiter) heldReply(req *messageHeader, cmd bson.D, held *HeldBatches) ([]byte, bool, error) {
+	if !l.Enabled() || len(cmd) == 0 || !strings.EqualFold(cmd[0].Name, "getMore") {
+		return nil, false, nil
+	}
+	id, _ := int64Value(cmd[0].Value)
+	var db, collection string
+	var batchSize int64
+	for _, e := range cmd[1:] {
+		switch e.Name {
+		case "$db":
+			db, _ = e.Value.(string)
+		case "collection":
+			collection, _ = e.Value.(string)
+		case "batchSize":
+			batchSize, _ = int64Value(e.Value)
+		}
+	}
+	c := heldCursor{Namespace: db + "." + collection, ID: id}
+
+	b, ok := held.cursors[c]
+	if !ok {
+		l.mutex.Lock()
+		owner := l.owners[c]
+		l.mutex.Unlock()
+		if owner == nil {
+			return nil, false, nil
+		}
+		reply, err := newErrorReply(req, cursorNotFoundCode, fmt.Sprintf("dvara: cursor id %d not found", id))
+		return reply, err == nil, err
+	}
+	n := l.Max
+	if batchSize > 0 && batchSize < int64(n) {
+		n = int(batchSize)
+	}
+	if n > len(b.docs) {
+		n = len(b.docs)
+	}
+	docs := b.docs[:n]
+	if n == len(b.docs) {
+		held.drop(c)
+		id = b.serverID
+	} else {
+		var size int64
+		for _, d := range docs {
+			size += int64(len(d.Data))
+		}
+		b.docs = b.docs[n:]
+		b.size -= size
+		b.at = time.Now()
+		atomic.AddInt64(&l.heldBytes, -size)
+	}
+
+	reply, err := newReply(req, 0, bson.D{
+		{Name: "cursor", Value: bson.D{
+			{Name: "nextBatch", Value: docs},
+			{Name: "id", Value: id},
+			{Name: "ns", Value: c.Namespace},
+		}},
+		{Name: "ok", Value: 1.0},
+	})
+	return reply, err == nil, err
+}
+
+// forgetKilled drops the documents held back for the connection from the
+// cursors killed by a killCursors command.
+func (l *ReplyBatchLimiter) forgetKilled(cmd bson.D, held *HeldBatches) {
+	if !l.Enabled() || len(cmd) == 0 || !strings.EqualFold(cmd[0].Name, "killCursors") {
+		return
+	}
+	collection, _ := cmd[0].Value.(string)
+	var db string
+	var cursors []interface{}
+	for _, e := range cmd[1:] {
+		switch e.Name {
+		case "$db":
+			db, _ = e.Value.(string)
+		case "cursors":
+			cursors, _ = e.Value.([]interface{})
+		}
+	}
+	for _, v := range cursors {
+		if id, ok := int64Value(v); ok {
+			held.drop(heldCursor{Namespace: db + "." + collection, ID: id})
+		}
+	}
+}
+
+// rawToD converts a bson.RawD to a bson.D keeping the values raw.
+func rawToD(raw bson.RawD) bson.D {
+	d := make(bson.D, len(raw))
+	for i, e := range raw {
+		d[i] = bson.DocElem{Name: e.Name, Value: e.Value}
+	}
+	return d
+}
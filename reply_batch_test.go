@@ -0,0 +1,246 @@
+package dvara
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeCursorReply returns an OpMsg reply with a batch of documents numbered
+// from first.
+func fakeCursorReply(batch string, id int64, first, count int, extra ...bson.DocElem) []byte {
+	docs := make([]bson.D, count)
+	for i := range docs {
+		docs[i] = bson.D{{Name: "_id", Value: first + i}}
+	}
+	cursor := bson.D{
+		{Name: batch, Value: docs},
+		{Name: "id", Value: id},
+		{Name: "ns", Value: "test.foo"},
+	}
+	h, body := fakeOpMsg(0, bson.D{
+		{Name: "cursor", Value: append(cursor, extra...)},
+		{Name: "ok", Value: 1.0},
+	})
+	return append(h.ToWire(), body...)
+}
+
+type limitedCursor struct {
+	IDs []int
+	ID  int64
+}
+
+type cursorReply struct {
+	Cursor struct {
+		FirstBatch []struct {
+			ID int `bson:"_id"`
+		} `bson:"firstBatch"`
+		NextBatch []struct {
+			ID int `bson:"_id"`
+		} `bson:"nextBatch"`
+		ID int64  `bson:"id"`
+		NS string `bson:"ns"`
+	} `bson:"cursor"`
+	OK   float64 `bson:"ok"`
+	Code int     `bson:"code"`
+}
+
+// proxyCommand proxies the command through p for the connection with the
+// documents held, with the server replying as given, or not at all if reply
+// is nil. It returns the reply relayed to the client and whether the server
+// was asked.
+func proxyCommand(t *testing.T, p *ProxyMsg, held *HeldBatches, cmd bson.D, reply []byte) (cursorReply, bool) {
+	h, body := fakeOpMsg(0, cmd)
+	var clientOut, serverIn bytes.Buffer
+	client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+	server := fakeReadWriter{Reader: bytes.NewReader(reply), Writer: &serverIn}
+	ensure.Nil(t, p.Proxy(h, client, server, held))
+
+	rh, err := readHeader(&clientOut)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, int(rh.MessageLength), headerLen+clientOut.Len())
+	m, err := readOpMsg(rh, &clientOut)
+	ensure.Nil(t, err)
+	var doc cursorReply
+	ensure.Nil(t, bson.Unmarshal(m.Body, &doc))
+	return doc, serverIn.Len() != 0
+}
+
+// proxyCursorCommand is proxyCommand for a command returning a cursor.
+func proxyCursorCommand(t *testing.T, p *ProxyMsg, held *HeldBatches, cmd bson.D, reply []byte) (limitedCursor, bool) {
+	doc, asked := proxyCommand(t, p, held, cmd, reply)
+	ensure.DeepEqual(t, doc.OK, 1.0)
+	ensure.DeepEqual(t, doc.Cursor.NS, "test.foo")
+	var c limitedCursor
+	for _, d := range append(doc.Cursor.FirstBatch, doc.Cursor.NextBatch...) {
+		c.IDs = append(c.IDs, d.ID)
+	}
+	c.ID = doc.Cursor.ID
+	return c, asked
+}
+
+func getMore(id int64) bson.D {
+	return bson.D{
+		{Name: "getMore", Value: id},
+		{Name: "collection", Value: "foo"},
+		{Name: "$db", Value: "test"},
+	}
+}
+
+var findFoo = bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}}
+
+func TestReplyBatchLimiterContinuesCursor(t *testing.T) {
+	t.Parallel()
+	p := &ProxyMsg{Log: &tLogger{TB: t}, ReplyBatchLimiter: &ReplyBatchLimiter{Max: 2}}
+	var held HeldBatches
+
+	// The batch is truncated, the rest is returned to the following getMores
+	// without asking the server.
+	c, asked := proxyCursorCommand(t, p, &held, findFoo, fakeCursorReply("firstBatch", 42, 0, 5))
+	ensure.True(t, asked)
+	ensure.DeepEqual(t, c, limitedCursor{IDs: []int{0, 1}, ID: 42})
+	ensure.True(t, p.ReplyBatchLimiter.heldBytes > 0)
+	c, asked = proxyCursorCommand(t, p, &held, getMore(42), nil)
+	ensure.False(t, asked)
+	ensure.DeepEqual(t, c, limitedCursor{IDs: []int{2, 3}, ID: 42})
+	c, asked = proxyCursorCommand(t, p, &held, getMore(42), nil)
+	ensure.False(t, asked)
+	ensure.DeepEqual(t, c, limitedCursor{IDs: []int{4}, ID: 42})
+	ensure.DeepEqual(t, p.ReplyBatchLimiter.heldBytes, int64(0))
+
+	// Once nothing is held back the cursor continues on the server.
+	c, asked = proxyCursorCommand(t, p, &held, getMore(42), fakeCursorReply("nextBatch", 0, 5, 1))
+	ensure.True(t, asked)
+	ensure.DeepEqual(t, c, limitedCursor{IDs: []int{5}})
+}
+
+func TestReplyBatchLimiterClosedCursor(t *testing.T) {
+	t.Parallel()
+	p := &ProxyMsg{Log: &tLogger{TB: t}, ReplyBatchLimiter: &ReplyBatchLimiter{Max: 2}}
+	var held HeldBatches
+	aggregate := bson.D{
+		{Name: "aggregate", Value: "foo"},
+		{Name: "pipeline", Value: []bson.D{}},
+		{Name: "cursor", Value: bson.D{}},
+		{Name: "$db", Value: "test"},
+	}
+
+	// The server closed the cursor, the client is given one to fetch the rest.
+	c, _ := proxyCursorCommand(t, p, &held, aggregate, fakeCursorReply("firstBatch", 0, 0, 3))
+	ensure.DeepEqual(t, c.IDs, []int{0, 1})
+	ensure.True(t, c.ID != 0)
+	c, asked := proxyCursorCommand(t, p, &held, getMore(c.ID), nil)
+	ensure.False(t, asked)
+	ensure.DeepEqual(t, c, limitedCursor{IDs: []int{2}})
+}
+
+func TestReplyBatchLimiterOtherConnection(t *testing.T) {
+	t.Parallel()
+	p := &ProxyMsg{Log: &tLogger{TB: t}, ReplyBatchLimiter: &ReplyBatchLimiter{Max: 2}}
+	var owner, other HeldBatches
+	proxyCursorCommand(t, p, &owner, findFoo, fakeCursorReply("firstBatch", 42, 0, 5))
+	closed, _ := proxyCursorCommand(t, p, &owner, findFoo, fakeCursorReply("firstBatch", 0, 0, 5))
+
+	// The documents are not returned to another connection, nor skipped by
+	// asking the server.
+	doc, asked := proxyCommand(t, p, &other, getMore(42), nil)
+	ensure.False(t, asked)
+	ensure.DeepEqual(t, doc.Code, cursorNotFoundCode)
+	ensure.DeepEqual(t, len(doc.Cursor.NextBatch), 0)
+
+	// Made up cursor ids are unknown to other connections and the server.
+	_, asked = proxyCommand(t, p, &other, getMore(closed.ID), fakeCursorReply("nextBatch", 0, 0, 0))
+	ensure.True(t, asked)
+
+	// The documents are dropped along with the connection.
+	owner.Reset()
+	ensure.DeepEqual(t, p.ReplyBatchLimiter.heldBytes, int64(0))
+	ensure.DeepEqual(t, len(p.ReplyBatchLimiter.owners), 0)
+	_, asked = proxyCursorCommand(t, p, &other, getMore(42), fakeCursorReply("nextBatch", 0, 5, 1))
+	ensure.True(t, asked)
+}
+
+func TestReplyBatchLimiterMaxHeldBytes(t *testing.T) {
+	t.Parallel()
+	p := &ProxyMsg{
+		Log:               &tLogger{TB: t},
+		ReplyBatchLimiter: &ReplyBatchLimiter{Max: 2, MaxHeldBytes: 50},
+	}
+	var held HeldBatches
+	proxyCursorCommand(t, p, &held, findFoo, fakeCursorReply("firstBatch", 42, 0, 5))
+	size := p.ReplyBatchLimiter.heldBytes
+	ensure.True(t, size > 25 && size <= 50)
+
+	// Holding back as much again would go over the limit.
+	doc, _ := proxyCommand(t, p, &held, findFoo, fakeCursorReply("firstBatch", 43, 0, 5))
+	ensure.DeepEqual(t, doc.Code, exceededMemoryLimitCode)
+	ensure.DeepEqual(t, p.ReplyBatchLimiter.heldBytes, size)
+}
+
+func TestReplyBatchLimiterKillCursors(t *testing.T) {
+	t.Parallel()
+	p := &ProxyMsg{Log: &tLogger{TB: t}, ReplyBatchLimiter: &ReplyBatchLimiter{Max: 2}}
+	var held HeldBatches
+	proxyCursorCommand(t, p, &held, findFoo, fakeCursorReply("firstBatch", 42, 0, 5))
+
+	h, body := fakeOpMsg(0, bson.D{
+		{Name: "killCursors", Value: "foo"},
+		{Name: "cursors", Value: []int64{42}},
+		{Name: "$db", Value: "test"},
+	})
+	var serverIn bytes.Buffer
+	client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &bytes.Buffer{}}
+	server := fakeReadWriter{Reader: fakeSingleDocReply(bson.D{{Name: "ok", Value: 1}}), Writer: &serverIn}
+	ensure.Nil(t, p.Proxy(h, client, server, &held))
+	ensure.True(t, serverIn.Len() != 0)
+	ensure.DeepEqual(t, len(held.cursors), 0)
+	ensure.DeepEqual(t, p.ReplyBatchLimiter.heldBytes, int64(0))
+	ensure.DeepEqual(t, len(p.ReplyBatchLimiter.owners), 0)
+}
+
+func TestReplyBatchLimiterSingleBatch(t *testing.T) {
+	t.Parallel()
+	p := &ProxyMsg{
+		Log:               &tLogger{TB: t},
+		BatchSizeRewriter: &BatchSizeRewriter{Max: 2},
+		ReplyBatchLimiter: &ReplyBatchLimiter{Max: 2},
+	}
+	find := bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "singleBatch", Value: true},
+		{Name: "$db", Value: "test"},
+	}
+	c, _ := proxyCursorCommand(t, p, &HeldBatches{}, find, fakeCursorReply("firstBatch", 0, 0, 5))
+	ensure.DeepEqual(t, c, limitedCursor{IDs: []int{0, 1, 2, 3, 4}})
+}
+
+func TestReplyBatchLimiterChangeStream(t *testing.T) {
+	t.Parallel()
+	p := &ProxyMsg{Log: &tLogger{TB: t}, ReplyBatchLimiter: &ReplyBatchLimiter{Max: 2}}
+	var held HeldBatches
+	token := bson.DocElem{Name: "postBatchResumeToken", Value: bson.D{{Name: "_data", Value: "token"}}}
+	watch := bson.D{
+		{Name: "aggregate", Value: "foo"},
+		{Name: "pipeline", Value: []interface{}{bson.D{{Name: "$changeStream", Value: bson.D{}}}}},
+		{Name: "cursor", Value: bson.D{}},
+		{Name: "$db", Value: "test"},
+	}
+	c, _ := proxyCursorCommand(t, p, &held, watch, fakeCursorReply("firstBatch", 42, 0, 3, token))
+	ensure.DeepEqual(t, c, limitedCursor{IDs: []int{0, 1, 2}, ID: 42})
+	c, _ = proxyCursorCommand(t, p, &held, getMore(42), fakeCursorReply("nextBatch", 42, 3, 3, token))
+	ensure.DeepEqual(t, c, limitedCursor{IDs: []int{3, 4, 5}, ID: 42})
+	ensure.DeepEqual(t, len(held.cursors), 0)
+}
+
+func TestReplyBatchLimiterDisabled(t *testing.T) {
+	t.Parallel()
+	var l *ReplyBatchLimiter
+	ensure.False(t, l.Enabled())
+	ensure.False(t, l.limits(0, bson.D{{Name: "find", Value: "foo"}}))
+	_, held, err := l.heldReply(&messageHeader{OpCode: OpMsg}, getMore(42), &HeldBatches{})
+	ensure.Nil(t, err)
+	ensure.False(t, held)
+	ensure.False(t, (&ReplyBatchLimiter{Max: 2}).limits(msgFlagExhaustAllowed, getMore(42)))
+}
@@ -0,0 +1,268 @@
+package dvara
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNewErrorReplyOpReply(t *testing.T) {
+	t.Parallel()
+	req := &messageHeader{OpCode: OpQuery, RequestID: 42}
+	b, err := newErrorReply(req, 6, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ReplyRW{Log: &tLogger{TB: t}}
+	var doc bson.M
+	h, prefix, _, err := r.ReadOne(bytes.NewReader(b), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(h.MessageLength) != len(b) {
+		t.Fatalf("expected length %d got %d", len(b), h.MessageLength)
+	}
+	if h.ResponseTo != req.RequestID {
+		t.Fatalf("expected response to %d got %d", req.RequestID, h.ResponseTo)
+	}
+	if !prefix.Flags().QueryFailure() {
+		t.Fatal("QueryFailure flag was not set")
+	}
+	expected := bson.M{"$err": "foo", "errmsg": "foo", "code": 6, "ok": 0}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("expected %v got %v", expected, doc)
+	}
+}
+
+func TestNewErrorReplyOpMsg(t *testing.T) {
+	t.Parallel()
+	req := &messageHeader{OpCode: OpMsg, RequestID: 42}
+	b, err := newErrorReply(req, 6, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(b)
+	h, err := readHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.OpCode != OpMsg || h.ResponseTo != req.RequestID || int(h.MessageLength) != len(b) {
+		t.Fatalf("unexpected header %s", h)
+	}
+	m, err := readOpMsg(h, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(m.Body, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["errmsg"] != "foo" || doc["code"] != 6 || doc["ok"] != 0 {
+		t.Fatalf("unexpected document %v", doc)
+	}
+}
+
+func TestNewErrorReplyLabels(t *testing.T) {
+	t.Parallel()
+	for _, op := range []OpCode{OpQuery, OpMsg} {
+		req := &messageHeader{OpCode: op, RequestID: 42}
+		b, err := newErrorReply(req, 91, "foo", labelRetryableWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc struct {
+			Code        int32    `bson:"code"`
+			ErrorLabels []string `bson:"errorLabels"`
+		}
+		if op == OpMsg {
+			err = bson.Unmarshal(b[headerLen+5:], &doc)
+		} else {
+			err = bson.Unmarshal(b[headerLen+len(emptyPrefix):], &doc)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Code != 91 || !reflect.DeepEqual(doc.ErrorLabels, []string{labelRetryableWrite}) {
+			t.Fatalf("unexpected document %+v for %s", doc, op)
+		}
+	}
+}
+
+func fakeReplyWithFlags(flags responseFlags, cursorID int64) []byte {
+	b, err := newReply(&messageHeader{OpCode: OpQuery}, flags, bson.M{})
+	if err != nil {
+		panic(err)
+	}
+	setInt32(b, headerLen+4, int32(cursorID))
+	setInt32(b, headerLen+8, int32(cursorID>>32))
+	return b
+}
+
+func TestResponseFlags(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Flags            responseFlags
+		CursorNotFound   bool
+		QueryFailure     bool
+		ShardConfigStale bool
+		AwaitCapable     bool
+	}{
+		{Flags: 0},
+		{Flags: replyFlagCursorNotFound, CursorNotFound: true},
+		{Flags: replyFlagQueryFailure, QueryFailure: true},
+		{Flags: replyFlagShardConfigStale, ShardConfigStale: true},
+		{Flags: replyFlagAwaitCapable, AwaitCapable: true},
+		{
+			Flags:          replyFlagCursorNotFound | replyFlagQueryFailure,
+			CursorNotFound: true,
+			QueryFailure:   true,
+		},
+	}
+	for _, c := range cases {
+		var prefix replyPrefix
+		copy(prefix[:], fakeReplyWithFlags(c.Flags, 0)[headerLen:])
+		f := prefix.Flags()
+		if f.CursorNotFound() != c.CursorNotFound ||
+			f.QueryFailure() != c.QueryFailure ||
+			f.ShardConfigStale() != c.ShardConfigStale ||
+			f.AwaitCapable() != c.AwaitCapable {
+			t.Fatalf("incorrectly decoded flags %d", c.Flags)
+		}
+	}
+}
+
+func TestReplyPrefixCursorID(t *testing.T) {
+	t.Parallel()
+	const id = int64(0x7badcafe12345678)
+	var prefix replyPrefix
+	copy(prefix[:], fakeReplyWithFlags(0, id)[headerLen:])
+	if prefix.CursorID() != id {
+		t.Fatalf("expected cursor id %d got %d", id, prefix.CursorID())
+	}
+}
+
+func TestCopyReply(t *testing.T) {
+	t.Parallel()
+	reply := fakeReplyWithFlags(replyFlagCursorNotFound, 0)
+	var w bytes.Buffer
+	flags, err := copyReply(&w, bytes.NewReader(reply), &messageHeader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !flags.CursorNotFound() {
+		t.Fatal("did not find CursorNotFound flag")
+	}
+	if !bytes.Equal(w.Bytes(), reply) {
+		t.Fatal("reply was not copied verbatim")
+	}
+
+	// Other ops are copied but have no flags.
+	w.Reset()
+	msg := messageHeader{OpCode: OpMsg, MessageLength: headerLen + 4}
+	in := append(msg.ToWire(), 1, 0, 0, 0)
+	flags, err = copyReply(&w, bytes.NewReader(in), &messageHeader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != 0 {
+		t.Fatalf("was not expecting flags, got %d", flags)
+	}
+	if !bytes.Equal(w.Bytes(), in) {
+		t.Fatal("message was not copied verbatim")
+	}
+}
+
+func TestParseReplyStatus(t *testing.T) {
+	t.Parallel()
+	reply := func(opCode OpCode, flags responseFlags, v interface{}) []byte {
+		b, err := newReply(&messageHeader{OpCode: opCode}, flags, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	notPrimary := bson.D{
+		{Name: "ok", Value: 0.0},
+		{Name: "errmsg", Value: "not primary"},
+		{Name: "code", Value: 10107},
+		{Name: "codeName", Value: "NotWritablePrimary"},
+	}
+	cases := []struct {
+		Name   string
+		Reply  []byte
+		Status replyStatus
+		Parsed bool
+	}{
+		{
+			Name:   "op reply ok",
+			Reply:  reply(OpQuery, 0, bson.D{{Name: "ok", Value: 1.0}}),
+			Status: replyStatus{Ok: true},
+			Parsed: true,
+		},
+		{
+			Name:   "op msg ok",
+			Reply:  reply(OpMsg, 0, bson.D{{Name: "ok", Value: 1}}),
+			Status: replyStatus{Ok: true},
+			Parsed: true,
+		},
+		{
+			Name:   "query results",
+			Reply:  reply(OpQuery, 0, bson.D{{Name: "a", Value: 1}}),
+			Status: replyStatus{Ok: true},
+			Parsed: true,
+		},
+		{
+			Name:  "op reply error",
+			Reply: reply(OpQuery, 0, notPrimary),
+			Status: replyStatus{
+				Code:     10107,
+				CodeName: "NotWritablePrimary",
+				ErrMsg:   "not primary",
+			},
+			Parsed: true,
+		},
+		{
+			Name:  "op msg error",
+			Reply: reply(OpMsg, 0, notPrimary),
+			Status: replyStatus{
+				Code:     10107,
+				CodeName: "NotWritablePrimary",
+				ErrMsg:   "not primary",
+			},
+			Parsed: true,
+		},
+		{
+			Name: "query failure",
+			Reply: reply(OpQuery, replyFlagQueryFailure, bson.D{
+				{Name: "$err", Value: "bad query"},
+				{Name: "code", Value: int64(2)},
+			}),
+			Status: replyStatus{Code: 2, ErrMsg: "bad query"},
+			Parsed: true,
+		},
+		{
+			Name: "write error",
+			Reply: reply(OpMsg, 0, bson.D{
+				{Name: "ok", Value: 1},
+				{Name: "writeErrors", Value: []bson.D{{{Name: "errmsg", Value: "duplicate key"}}}},
+			}),
+			Status: replyStatus{Ok: true, WriteError: "duplicate key"},
+			Parsed: true,
+		},
+		{
+			Name:  "truncated",
+			Reply: reply(OpMsg, 0, notPrimary)[:headerLen+8],
+		},
+		{
+			Name: "empty",
+		},
+	}
+	for _, c := range cases {
+		status, parsed := parseReplyStatus(c.Reply)
+		if parsed != c.Parsed || status != c.Status {
+			t.Fatalf("expected %+v %v for %s got %+v %v", c.Status, c.Parsed, c.Name, status, parsed)
+		}
+	}
+}
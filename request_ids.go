@@ -0,0 +1,82 @@
+package dvara
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+var errRequestIDsExhausted = errors.New("dvara: no backend request id available")
+
+// pendingRequest is a request sent on a shared server connection awaiting its
+// reply.
+type pendingRequest struct {
+	client    *clientConn
+	requestID int32 // RequestID set by the client
+}
+
+// requestIDMap assigns RequestIDs to the requests of several clients sharing a
+// server connection, since the RequestIDs the clients chose may collide. The
+// ResponseTo of replies is mapped back to the client and its own RequestID. A
+// RequestID is reclaimed once the reply to it has been resolved, or when the
+// request is abandoned.
+type requestIDMap struct {
+	mutex   sync.Mutex
+	last    int32
+	pending map[int32]pendingRequest
+}
+
+// assign returns a RequestID for the request of the client which is unique
+// among the requests pending on the server connection. Zero is never
+// assigned, replies to nothing have a zero ResponseTo.
+func (m *requestIDMap) assign(client *clientConn, requestID int32) (int32, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.pending == nil {
+		m.pending = make(map[int32]pendingRequest)
+	}
+	if len(m.pending) >= math.MaxInt32 {
+		return 0, errRequestIDsExhausted
+	}
+	for {
+		m.last++
+		if m.last <= 0 {
+			m.last = 1
+		}
+		if _, used := m.pending[m.last]; !used {
+			m.pending[m.last] = pendingRequest{client: client, requestID: requestID}
+			return m.last, nil
+		}
+	}
+}
+
+// resolve returns the request a reply with the given ResponseTo answers and
+// reclaims its RequestID. It returns false if there is no such request.
+func (m *requestIDMap) resolve(responseTo int32) (pendingRequest, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	r, ok := m.pending[responseTo]
+	if ok {
+		delete(m.pending, responseTo)
+	}
+	return r, ok
+}
+
+// abandon reclaims the RequestIDs of the pending requests of a client which
+// went away. Replies to them will not resolve.
+func (m *requestIDMap) abandon(client *clientConn) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, r := range m.pending {
+		if r.client == client {
+			delete(m.pending, id)
+		}
+	}
+}
+
+// pendingCount returns the number of pending requests.
+func (m *requestIDMap) pendingCount() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.pending)
+}
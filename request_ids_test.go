@@ -0,0 +1,116 @@
+package dvara
+
+import (
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestRequestIDMapCollisions(t *testing.T) {
+	t.Parallel()
+	var m requestIDMap
+	a, b := &clientConn{remoteAddr: "a"}, &clientConn{remoteAddr: "b"}
+
+	// Both clients use RequestID 1.
+	idA, err := m.assign(a, 1)
+	ensure.Nil(t, err)
+	idB, err := m.assign(b, 1)
+	ensure.Nil(t, err)
+	ensure.NotDeepEqual(t, idA, idB)
+	ensure.DeepEqual(t, m.pendingCount(), 2)
+
+	// Replies are attributed back regardless of their order.
+	r, ok := m.resolve(idB)
+	ensure.True(t, ok)
+	ensure.True(t, r.client == b)
+	ensure.DeepEqual(t, r.requestID, int32(1))
+	r, ok = m.resolve(idA)
+	ensure.True(t, ok)
+	ensure.True(t, r.client == a)
+	ensure.DeepEqual(t, r.requestID, int32(1))
+
+	// Resolved RequestIDs are reclaimed.
+	_, ok = m.resolve(idA)
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, m.pendingCount(), 0)
+}
+
+func TestRequestIDMapWrapsAround(t *testing.T) {
+	t.Parallel()
+	m := requestIDMap{last: math.MaxInt32 - 1}
+	c := &clientConn{}
+	first, err := m.assign(c, 10)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, first, int32(math.MaxInt32))
+
+	// Zero is skipped, and so are RequestIDs still pending.
+	m.pending[2] = pendingRequest{client: c, requestID: 11}
+	id, err := m.assign(c, 12)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, id, int32(1))
+	id, err = m.assign(c, 13)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, id, int32(3))
+}
+
+func TestRequestIDMapAbandon(t *testing.T) {
+	t.Parallel()
+	var m requestIDMap
+	gone, staying := &clientConn{}, &clientConn{}
+	goneID, err := m.assign(gone, 1)
+	ensure.Nil(t, err)
+	stayingID, err := m.assign(staying, 1)
+	ensure.Nil(t, err)
+	m.abandon(gone)
+	_, ok := m.resolve(goneID)
+	ensure.False(t, ok)
+	r, ok := m.resolve(stayingID)
+	ensure.True(t, ok)
+	ensure.True(t, r.client == staying)
+}
+
+func TestRequestIDMapConcurrent(t *testing.T) {
+	t.Parallel()
+	const clients, requests = 8, 200
+	var m requestIDMap
+	type assigned struct {
+		id     int32
+		client *clientConn
+		req    int32
+	}
+	var wg sync.WaitGroup
+	results := make(chan assigned, clients*requests)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(c *clientConn) {
+			defer wg.Done()
+			// Every client uses the same RequestIDs.
+			for req := int32(1); req <= requests; req++ {
+				id, err := m.assign(c, req)
+				ensure.Nil(t, err)
+				results <- assigned{id: id, client: c, req: req}
+			}
+		}(&clientConn{})
+	}
+	wg.Wait()
+	close(results)
+
+	seen := make(map[int32]bool)
+	var resolving sync.WaitGroup
+	for a := range results {
+		ensure.False(t, seen[a.id])
+		seen[a.id] = true
+		resolving.Add(1)
+		go func(a assigned) {
+			defer resolving.Done()
+			r, ok := m.resolve(a.id)
+			ensure.True(t, ok)
+			ensure.True(t, r.client == a.client)
+			ensure.DeepEqual(t, r.requestID, a.req)
+		}(a)
+	}
+	resolving.Wait()
+	ensure.DeepEqual(t, m.pendingCount(), 0)
+}
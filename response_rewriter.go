@@ -2,14 +2,16 @@ package dvara
 
 import (
 	"bytes"
-	"errors"
 	"flag"
-	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/facebookgo/stats"
 
 	"gopkg.in/mgo.v2/bson"
 )
@@ -23,14 +25,87 @@ var (
 
 	adminCollectionName = []byte("admin.$cmd\000")
 	cmdCollectionSuffix = []byte(".$cmd\000")
+
+	// legacySystemCollectionSuffixes are the system collections older drivers
+	// query directly to enumerate collections and indexes instead of using the
+	// listCollections and listIndexes commands.
+	legacySystemCollectionSuffixes = [][]byte{
+		[]byte(".system.namespaces\000"),
+		[]byte(".system.indexes\000"),
+	}
 )
 
+// isLegacySystemQuery checks if the full collection name is one of the legacy
+// system collections. Queries against them are plain reads and are forwarded
+// verbatim, they are never treated as commands or rewritten.
+func isLegacySystemQuery(fullCollectionName []byte) bool {
+	for _, suffix := range legacySystemCollectionSuffixes {
+		if bytes.HasSuffix(fullCollectionName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultPassthroughCommands are the internal sharding and replication
+// commands exchanged between mongos, config servers and shards. They are
+// forwarded verbatim and never considered for rewriting.
+var DefaultPassthroughCommands = []string{
+	"_migrateClone",
+	"_recvChunkAbort",
+	"_recvChunkCommit",
+	"_recvChunkStart",
+	"_recvChunkStatus",
+	"_transferMods",
+	"cleanupOrphaned",
+	"getShardVersion",
+	"handshake",
+	"mergeChunks",
+	"moveChunk",
+	"replSetHeartbeat",
+	"replSetUpdatePosition",
+	"setShardVersion",
+	"splitChunk",
+	"splitVector",
+	"unsetSharding",
+	"writeBacksQueued",
+	"writebacklisten",
+}
+
 // ProxyQuery proxies an OpQuery and a corresponding response.
 type ProxyQuery struct {
 	Log                              Logger                            `inject:""`
 	GetLastErrorRewriter             *GetLastErrorRewriter             `inject:""`
 	IsMasterResponseRewriter         *IsMasterResponseRewriter         `inject:""`
 	ReplSetGetStatusResponseRewriter *ReplSetGetStatusResponseRewriter `inject:""`
+	ServerStatusResponseRewriter     *ServerStatusResponseRewriter     `inject:""`
+	BuildInfoResponseRewriter        *BuildInfoResponseRewriter        `inject:""`
+	GetShardMapResponseRewriter      *GetShardMapResponseRewriter      `inject:""`
+	MaxTimeMSRewriter                *MaxTimeMSRewriter                `inject:""`
+	BatchSizeRewriter                *BatchSizeRewriter                `inject:""`
+	IsMasterCoalescer                *IsMasterCoalescer                `inject:""`
+	CommandClassifier                *CommandClassifier                `inject:""`
+
+	// PassthroughCommands are commands that are forwarded verbatim without
+	// being considered for rewriting. If nil DefaultPassthroughCommands is used.
+	PassthroughCommands []string
+}
+
+// isPassthrough checks if the given command should be forwarded verbatim.
+func (p *ProxyQuery) isPassthrough(q bson.D) bool {
+	if len(q) == 0 {
+		return false
+	}
+	commands := p.PassthroughCommands
+	if commands == nil {
+		commands = DefaultPassthroughCommands
+	}
+	for _, c := range commands {
+		if strings.EqualFold(q[0].Name, c) {
+			return true
+		}
+	}
+	return false
 }
 
 // Proxy proxies an OpQuery and a corresponding response.
@@ -62,9 +137,19 @@ func (p *ProxyQuery) Proxy(
 		return err
 	}
 	parts = append(parts, fullCollectionName)
+	if getInt32(flags[:], 0)&queryFlagPartial != 0 {
+		p.Log.Debugf("ignoring partial flag of OpQuery for %s", fullCollectionName[:len(fullCollectionName)-1])
+	}
 
 	var rewriter responseRewriter
-	if *proxyAllQueries || bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
+	var write bool
+	isCommand := bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix)
+	isSystem := isLegacySystemQuery(fullCollectionName)
+	if isSystem {
+		p.Log.Debugf("legacy system OpQuery for %s", fullCollectionName[:len(fullCollectionName)-1])
+	}
+	if isCommand || !isSystem && (*proxyAllQueries || p.MaxTimeMSRewriter.Enabled() ||
+		p.BatchSizeRewriter.Enabled()) {
 		var twoInt32 [8]byte
 		if _, err := io.ReadFull(client, twoInt32[:]); err != nil {
 			p.Log.Error(err)
@@ -72,7 +157,8 @@ func (p *ProxyQuery) Proxy(
 		}
 		parts = append(parts, twoInt32[:])
 
-		queryDoc, err := readDocument(client)
+		remaining := h.MessageLength - headerLen - int32(len(flags)+len(fullCollectionName)+len(twoInt32))
+		queryDoc, err := readDocument(client, remaining)
 		if err != nil {
 			p.Log.Error(err)
 			return err
@@ -85,39 +171,103 @@ func (p *ProxyQuery) Proxy(
 			return err
 		}
 
-		p.Log.Debugf(
-			"buffered OpQuery for %s: %s",
-			fullCollectionName[:len(fullCollectionName)-1],
-			spew.Sdump(q),
-		)
-
-		if hasKey(q, "getLastError") {
-			return p.GetLastErrorRewriter.Rewrite(
-				h,
-				parts,
-				client,
-				server,
-				lastError,
+		write = isCommand && p.CommandClassifier.Classify("", q).Write
+		passthrough := (*proxyAllQueries || isCommand) && p.isPassthrough(q)
+		if passthrough {
+			p.Log.Debugf(
+				"passthrough OpQuery for %s: %s",
+				fullCollectionName[:len(fullCollectionName)-1],
+				q[0].Name,
 			)
-		}
+		} else if *proxyAllQueries || isCommand {
+			p.Log.Debugf(
+				"buffered OpQuery for %s: %s",
+				fullCollectionName[:len(fullCollectionName)-1],
+				spew.Sdump(q),
+			)
+
+			if hasKey(q, "getLastError") {
+				return p.GetLastErrorRewriter.Rewrite(
+					h,
+					parts,
+					client,
+					server,
+					lastError,
+				)
+			}
 
-		if hasKey(q, "isMaster") {
-			rewriter = p.IsMasterResponseRewriter
+			if hasKey(q, "isMaster") || hasKey(q, "hello") {
+				rewriter = p.IsMasterResponseRewriter
+			}
+			if bytes.Equal(adminCollectionName, fullCollectionName) && hasKey(q, "replSetGetStatus") {
+				rewriter = p.ReplSetGetStatusResponseRewriter
+			}
+			if hasKey(q, "serverStatus") {
+				rewriter = p.ServerStatusResponseRewriter
+			}
+			if hasKey(q, "buildInfo") {
+				rewriter = p.BuildInfoResponseRewriter
+			}
+			if bytes.Equal(adminCollectionName, fullCollectionName) && hasKey(q, "getShardMap") {
+				rewriter = p.GetShardMapResponseRewriter
+			}
+
+			if rewriter != nil {
+				// If forShell is specified, we don't want to reset the last error. See
+				// comment above around resetLastError for details.
+				resetLastError = hasKey(q, "forShell")
+			}
 		}
-		if bytes.Equal(adminCollectionName, fullCollectionName) && hasKey(q, "replSetGetStatus") {
-			rewriter = p.ReplSetGetStatusResponseRewriter
+
+		if !passthrough && rewriter == nil {
+			var newQ bson.D
+			var rewritten bool
+			if isCommand {
+				newQ, rewritten = p.MaxTimeMSRewriter.RewriteCommand(q)
+				if batchQ, ok := p.BatchSizeRewriter.RewriteCommand(newQ); ok {
+					newQ, rewritten = batchQ, true
+				}
+			} else {
+				newQ, rewritten = p.MaxTimeMSRewriter.RewriteQuery(q)
+				// twoInt32 is already part of the message, numberToReturn is
+				// rewritten in place.
+				if n, ok := p.BatchSizeRewriter.RewriteNumberToReturn(getInt32(twoInt32[:], 4)); ok {
+					setInt32(twoInt32[:], 4, n)
+				}
+			}
+			if rewritten {
+				newDoc, err := bson.Marshal(newQ)
+				if err != nil {
+					p.Log.Error(err)
+					return err
+				}
+				h.MessageLength += int32(len(newDoc) - len(queryDoc))
+				parts[0] = h.ToWire()
+				parts[len(parts)-1] = newDoc
+			}
 		}
+	}
 
-		if rewriter != nil {
-			// If forShell is specified, we don't want to reset the last error. See
-			// comment above around resetLastError for details.
-			resetLastError = hasKey(q, "forShell")
+	if resetLastError {
+		lastError.noteOperation(write)
+		if lastError.Exists() {
+			p.Log.Debug("reset getLastError cache")
+			lastError.Reset()
 		}
 	}
 
-	if resetLastError && lastError.Exists() {
-		p.Log.Debug("reset getLastError cache")
-		lastError.Reset()
+	if rewriter == p.IsMasterResponseRewriter && p.IsMasterCoalescer.Coalesce {
+		var read int
+		for _, b := range parts {
+			read += len(b)
+		}
+		rest := make([]byte, int(h.MessageLength)-read)
+		if _, err := io.ReadFull(client, rest); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		parts = append(parts, rest)
+		return p.IsMasterCoalescer.Proxy(h, parts, client, server, rewriter)
 	}
 
 	var written int
@@ -131,7 +281,7 @@ func (p *ProxyQuery) Proxy(
 	}
 
 	pending := int64(h.MessageLength) - int64(written)
-	if _, err := io.CopyN(server, client, pending); err != nil {
+	if err := copyBody(server, client, pending); err != nil {
 		p.Log.Error(err)
 		return err
 	}
@@ -143,7 +293,7 @@ func (p *ProxyQuery) Proxy(
 		return nil
 	}
 
-	if err := copyMessage(client, server); err != nil {
+	if _, err := copyReply(client, server, h); err != nil {
 		p.Log.Error(err)
 		return err
 	}
@@ -155,6 +305,10 @@ func (p *ProxyQuery) Proxy(
 type LastError struct {
 	header *messageHeader
 	rest   bytes.Buffer
+
+	// afterWrite is true if the last operation on the connection, other than
+	// getLastError, was a write for getLastError to report on.
+	afterWrite bool
 }
 
 // Exists returns true if this instance contains a cached error.
@@ -168,10 +322,17 @@ func (l *LastError) Reset() {
 	l.rest.Reset()
 }
 
+// noteOperation records whether the last operation on the connection, other
+// than getLastError, was a write.
+func (l *LastError) noteOperation(write bool) {
+	l.afterWrite = write
+}
+
 // GetLastErrorRewriter handles getLastError requests and proxies, caches or
 // sends cached responses as necessary.
 type GetLastErrorRewriter struct {
-	Log Logger `inject:""`
+	Log   Logger       `inject:""`
+	Stats stats.Client `inject:""`
 }
 
 // Rewrite handles getLastError requests.
@@ -184,6 +345,13 @@ func (r *GetLastErrorRewriter) Rewrite(
 ) error {
 
 	if !lastError.Exists() {
+		// The server reports on whatever preceded the getLastError on its
+		// connection, which is only meaningful right after a write on this one.
+		if !lastError.afterWrite {
+			r.Log.Debugf("getLastError without a preceding write")
+			stats.BumpSum(r.Stats, "getlasterror.without.write", 1)
+		}
+
 		// We're going to be performing a real getLastError query and caching the
 		// response.
 		var written int
@@ -204,11 +372,14 @@ func (r *GetLastErrorRewriter) Rewrite(
 
 		var err error
 		if lastError.header, err = readHeader(server); err != nil {
+			lastError.Reset()
 			r.Log.Error(err)
 			return err
 		}
 		pending = int64(lastError.header.MessageLength - headerLen)
 		if _, err = io.CopyN(&lastError.rest, server, pending); err != nil {
+			// Never leave a partially read response cached.
+			lastError.Reset()
 			r.Log.Error(err)
 			return err
 		}
@@ -242,14 +413,25 @@ func (r *GetLastErrorRewriter) Rewrite(
 	return nil
 }
 
-var errRSChanged = errors.New("dvara: replset config changed")
-
 // ProxyMapper maps real mongo addresses to their corresponding proxy
 // addresses.
 type ProxyMapper interface {
 	Proxy(h string) (string, error)
 }
 
+// ListenerMapper is implemented by ProxyMappers which can also tell the proxy
+// address of the listener a client connected to, given the local address of
+// the client connection.
+type ListenerMapper interface {
+	ListenerProxy(localAddr net.Addr) (string, error)
+}
+
+// localAddrer is implemented by client connections, and by the buffers replies
+// are rewritten into on their behalf.
+type localAddrer interface {
+	LocalAddr() net.Addr
+}
+
 // ReplicaStateCompare provides the last ReplicaSetState and allows for
 // checking if it has changed as we rewrite/proxy the isMaster &
 // replSetGetStatus queries.
@@ -258,6 +440,26 @@ type ReplicaStateCompare interface {
 	SameIM(o *isMasterResponse) bool
 }
 
+// rsChanged counts a client connection closed because the response to the
+// command shows the replica set changed, logs the topology before and after,
+// and returns ErrRSChanged.
+func rsChanged(log Logger, s stats.Client, compare ReplicaStateCompare, command string, after *ReplicaSetState) error {
+	stats.BumpSum(s, "rs.changed."+strings.ToLower(command), 1)
+	var before *Topology
+	if t, ok := compare.(interface {
+		Topology() *Topology
+	}); ok {
+		before = t.Topology()
+	}
+	log.Debugf(
+		"closing the connection, %s shows the replica set changed from %s to %s",
+		command,
+		before.summary(),
+		newTopology(after, time.Now()).summary(),
+	)
+	return ErrRSChanged
+}
+
 type responseRewriter interface {
 	Rewrite(client io.Writer, server io.Reader) error
 }
@@ -274,53 +476,99 @@ type ReplyRW struct {
 // ReadOne reads a 1 document response, from the server, unmarshals it into v
 // and returns the various parts.
 func (r *ReplyRW) ReadOne(server io.Reader, v interface{}) (*messageHeader, replyPrefix, int32, error) {
+	h, prefix, docLen, _, err := r.read(server, v, false)
+	return h, prefix, docLen, err
+}
+
+// ReadFirst reads a response with one or more documents from the server,
+// unmarshals the first one into v and returns the various parts. The
+// documents after the first one are returned as is, to be written back by
+// WriteFirst.
+func (r *ReplyRW) ReadFirst(server io.Reader, v interface{}) (*messageHeader, replyPrefix, int32, []byte, error) {
+	return r.read(server, v, true)
+}
+
+func (r *ReplyRW) read(server io.Reader, v interface{}, many bool) (*messageHeader, replyPrefix, int32, []byte, error) {
 	h, err := readHeader(server)
 	if err != nil {
 		r.Log.Error(err)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, 0, nil, err
 	}
 
 	if h.OpCode != OpReply {
-		err := fmt.Errorf("readOneReplyDoc: expected op %s, got %s", OpReply, h.OpCode)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, 0, nil, &UnexpectedOpCodeError{Expected: OpReply, Got: h.OpCode}
 	}
 
 	var prefix replyPrefix
 	if _, err := io.ReadFull(server, prefix[:]); err != nil {
 		r.Log.Error(err)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, 0, nil, err
 	}
 
 	numDocs := getInt32(prefix[:], 16)
-	if numDocs != 1 {
-		err := fmt.Errorf("readOneReplyDoc: can only handle 1 result document, got: %d", numDocs)
-		return nil, emptyPrefix, 0, err
+	if numDocs < 1 || (numDocs > 1 && !many) {
+		return nil, emptyPrefix, 0, nil, &MultiDocumentReplyError{NumberReturned: numDocs}
 	}
 
-	rawDoc, err := readDocument(server)
+	remaining := h.MessageLength - headerLen - int32(len(prefix))
+	rawDoc, err := readDocument(server, remaining)
 	if err != nil {
 		r.Log.Error(err)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, 0, nil, err
+	}
+	if numDocs == 1 && int32(len(rawDoc)) != remaining {
+		err := &DocumentLengthError{Length: int32(len(rawDoc)), Remaining: remaining}
+		r.Log.Error(err)
+		return nil, emptyPrefix, 0, nil, err
 	}
 
 	if err := bson.Unmarshal(rawDoc, v); err != nil {
 		r.Log.Error(err)
-		return nil, emptyPrefix, 0, err
+		return nil, emptyPrefix, 0, nil, err
 	}
 
-	return h, prefix, int32(len(rawDoc)), nil
+	var rest []byte
+	if numDocs > 1 {
+		restLen := int(h.MessageLength) - headerLen - len(prefix) - len(rawDoc)
+		if restLen < 0 {
+			return nil, emptyPrefix, 0, nil, &MessageLengthError{Length: h.MessageLength}
+		}
+		rest = make([]byte, restLen)
+		if _, err := io.ReadFull(server, rest); err != nil {
+			r.Log.Error(err)
+			return nil, emptyPrefix, 0, nil, err
+		}
+	}
+
+	return h, prefix, int32(len(rawDoc)), rest, nil
 }
 
 // WriteOne writes a rewritten response to the client.
 func (r *ReplyRW) WriteOne(client io.Writer, h *messageHeader, prefix replyPrefix, oldDocLen int32, v interface{}) error {
+	return r.WriteFirst(client, h, prefix, oldDocLen, nil, v)
+}
+
+// WriteFirst writes a response with a rewritten first document to the client,
+// followed by the rest of the documents as returned by ReadFirst. The message
+// length accounts for the rewritten document being larger or smaller than the
+// original one, a response which would grow past what clients accept is not
+// written.
+func (r *ReplyRW) WriteFirst(client io.Writer, h *messageHeader, prefix replyPrefix, oldDocLen int32, rest []byte, v interface{}) error {
 	newDoc, err := bson.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	h.MessageLength = h.MessageLength - oldDocLen + int32(len(newDoc))
-	parts := [][]byte{h.ToWire(), prefix[:], newDoc}
+	length := int64(h.MessageLength) - int64(oldDocLen) + int64(len(newDoc))
+	if length > maxMessageLength {
+		return &MessageLengthError{Length: int32(length)}
+	}
+	h.MessageLength = int32(length)
+	parts := [][]byte{h.ToWire(), prefix[:], newDoc, rest}
 	for _, p := range parts {
+		if len(p) == 0 {
+			continue
+		}
 		if _, err := client.Write(p); err != nil {
 			return err
 		}
@@ -329,63 +577,387 @@ func (r *ReplyRW) WriteOne(client io.Writer, h *messageHeader, prefix replyPrefi
 	return nil
 }
 
+// The non standard fields holding the member addresses behind the proxy
+// addresses, when DebugBackendAddrs is set.
+const (
+	debugBackendField  = "_dvaraBackend"
+	debugBackendsField = "_dvaraBackends"
+)
+
 type isMasterResponse struct {
-	Hosts   []string `bson:"hosts,omitempty"`
-	Primary string   `bson:"primary,omitempty"`
-	Me      string   `bson:"me,omitempty"`
-	Extra   bson.M   `bson:",inline"`
+	Hosts    []string `bson:"hosts,omitempty"`
+	Passives []string `bson:"passives,omitempty"`
+	Arbiters []string `bson:"arbiters,omitempty"`
+	Primary  string   `bson:"primary,omitempty"`
+	Me       string   `bson:"me,omitempty"`
+	Extra    bson.M   `bson:",inline"`
 }
 
+// EmptyHostsPolicy is what IsMasterResponseRewriter does when the server
+// reported hosts but none of them could be mapped to a proxy, for example
+// while members are transiently unreachable.
+type EmptyHostsPolicy int
+
+const (
+	// EmptyHostsServe sends the response with an empty hosts list. Drivers may
+	// take it as the replica set being gone.
+	EmptyHostsServe EmptyHostsPolicy = iota
+
+	// EmptyHostsClose fails with ErrRSChanged, closing the client connection
+	// and restarting the replica set so the client reconnects to a clean
+	// mapping.
+	EmptyHostsClose
+
+	// EmptyHostsLastKnown sends the last hosts list which could be mapped.
+	// Until there is one it behaves like EmptyHostsClose.
+	EmptyHostsLastKnown
+)
+
 // IsMasterResponseRewriter rewrites the response for the "isMaster" query.
 type IsMasterResponseRewriter struct {
-	Log                 Logger              `inject:""`
-	ProxyMapper         ProxyMapper         `inject:""`
-	ReplyRW             *ReplyRW            `inject:""`
-	ReplicaStateCompare ReplicaStateCompare `inject:""`
+	Log                 Logger                    `inject:""`
+	Stats               stats.Client              `inject:""`
+	ProxyMapper         ProxyMapper               `inject:""`
+	ReplyRW             *ReplyRW                  `inject:""`
+	ReplicaStateCompare ReplicaStateCompare       `inject:""`
+	VersionOverride     *BuildInfoVersionOverride `inject:""`
+
+	// StripArbiters removes the arbiters array rather than mapping it. Arbiters
+	// are not proxied, so when mapped only the ones with a proxy are kept.
+	StripArbiters bool
+
+	// BlankUnmappedPrimary removes the primary from the response if it cannot
+	// be mapped to a proxy, rather than failing and closing the connection.
+	// Drivers treat a response without a primary like an election in progress
+	// and retry.
+	BlankUnmappedPrimary bool
+
+	// ConnectedMe sets me to the address of the proxy the client connected to,
+	// rather than mapping the one reported by the server. The two differ when
+	// the client is pinned to another member, or when the server reports a
+	// hostname mapping to another proxy. It requires the ProxyMapper to be a
+	// ListenerMapper.
+	ConnectedMe bool
+
+	// DebugBackendAddrs adds a non standard _dvaraBackends array to the
+	// response, listing the member address behind each proxy address in the
+	// hosts, passives and arbiters. Drivers ignore unknown fields, but this is
+	// meant for troubleshooting only.
+	DebugBackendAddrs bool
+
+	// EmptyHosts is what to do when none of the hosts could be mapped.
+	EmptyHosts EmptyHostsPolicy
+
+	lastHostsMutex sync.Mutex
+	lastHosts      []string // last non empty mapped hosts, for EmptyHostsLastKnown
+}
+
+// emptyHosts applies the EmptyHosts policy to a response whose hosts were
+// all dropped, and otherwise remembers the mapped hosts.
+func (r *IsMasterResponseRewriter) emptyHosts(q *isMasterResponse, reported int) error {
+	switch {
+	case r.EmptyHosts == EmptyHostsServe:
+		return nil
+	case len(q.Hosts) != 0:
+		if r.EmptyHosts == EmptyHostsLastKnown {
+			r.lastHostsMutex.Lock()
+			r.lastHosts = q.Hosts
+			r.lastHostsMutex.Unlock()
+		}
+		return nil
+	case reported == 0:
+		return nil
+	}
+	if r.EmptyHosts == EmptyHostsLastKnown {
+		r.lastHostsMutex.Lock()
+		hosts := r.lastHosts
+		r.lastHostsMutex.Unlock()
+		if hosts != nil {
+			r.Log.Warnf("none of the %d hosts could be mapped, using the last known ones", reported)
+			q.Hosts = hosts
+			return nil
+		}
+	}
+	r.Log.Warnf("none of the %d hosts could be mapped, closing the connection", reported)
+	return rsChanged(r.Log, r.Stats, r.ReplicaStateCompare, "isMaster", &ReplicaSetState{lastIM: q})
+}
+
+// connectedProxy returns the address of the proxy the client connected to,
+// or an empty string if it is not known.
+func (r *IsMasterResponseRewriter) connectedProxy(client io.Writer) string {
+	lm, ok := r.ProxyMapper.(ListenerMapper)
+	if !ok {
+		return ""
+	}
+	c, ok := client.(localAddrer)
+	if !ok || c.LocalAddr() == nil {
+		return ""
+	}
+	addr, err := lm.ListenerProxy(c.LocalAddr())
+	if err != nil {
+		r.Log.Warnf("mapping me from the server: %s", err)
+		return ""
+	}
+	return addr
 }
 
 // Rewrite rewrites the response for the "isMaster" query.
 func (r *IsMasterResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
 	var err error
 	var q isMasterResponse
-	h, prefix, docLen, err := r.ReplyRW.ReadOne(server, &q)
+	h, prefix, docLen, rest, err := r.ReplyRW.ReadFirst(server, &q)
 	if err != nil {
 		return err
 	}
 	if !r.ReplicaStateCompare.SameIM(&q) {
-		return errRSChanged
+		return rsChanged(r.Log, r.Stats, r.ReplicaStateCompare, "isMaster", &ReplicaSetState{lastIM: &q})
+	}
+	if r.BlankUnmappedPrimary && q.Primary != "" {
+		if _, err := r.ProxyMapper.Proxy(q.Primary); err != nil {
+			r.Log.Warnf("blanking unmapped primary %s: %s", q.Primary, err)
+			q.Primary = ""
+		}
+	}
+	var me string
+	if r.ConnectedMe && q.Me != "" {
+		if me = r.connectedProxy(client); me != "" {
+			q.Me = ""
+		}
+	}
+	var backends []bson.D
+	if r.DebugBackendAddrs {
+		backends = r.backendAddrs(&q)
+	}
+	reported := len(q.Hosts)
+	if err := proxyIsMasterHosts(r.Log, r.ProxyMapper, &q, r.StripArbiters); err != nil {
+		return err
+	}
+	if err := r.emptyHosts(&q, reported); err != nil {
+		return err
 	}
+	if backends != nil {
+		if q.Extra == nil {
+			q.Extra = bson.M{}
+		}
+		q.Extra[debugBackendsField] = backends
+	}
+	if me != "" {
+		q.Me = me
+	}
+	r.VersionOverride.RewriteIsMaster(&q)
+	return r.ReplyRW.WriteFirst(client, h, prefix, docLen, rest, q)
+}
 
+// backendAddrs pairs the proxy address of each mapped member in the hosts,
+// passives and arbiters with the member address, before they are mapped.
+func (r *IsMasterResponseRewriter) backendAddrs(q *isMasterResponse) []bson.D {
+	members := append(append([]string{}, q.Hosts...), q.Passives...)
+	if !r.StripArbiters {
+		members = append(members, q.Arbiters...)
+	}
+	backends := []bson.D{}
+	for _, m := range members {
+		proxy, err := r.ProxyMapper.Proxy(m)
+		if err != nil {
+			continue
+		}
+		backends = append(backends, bson.D{
+			{Name: "host", Value: proxy},
+			{Name: debugBackendField, Value: m},
+		})
+	}
+	return backends
+}
+
+// proxyIsMasterHosts maps the member addresses in an isMaster style document
+// to their proxy addresses. The arbiters are removed if stripArbiters is set.
+func proxyIsMasterHosts(log Logger, mapper ProxyMapper, q *isMasterResponse, stripArbiters bool) error {
+	var err error
+	if q.Hosts, err = proxyHosts(log, mapper, q.Hosts); err != nil {
+		return err
+	}
+	if q.Passives, err = proxyHosts(log, mapper, q.Passives); err != nil {
+		return err
+	}
+	if stripArbiters {
+		q.Arbiters = nil
+	} else if q.Arbiters, err = proxyHosts(log, mapper, q.Arbiters); err != nil {
+		return err
+	}
+
+	if q.Primary != "" {
+		// failure in mapping the primary is fatal
+		if q.Primary, err = mapper.Proxy(q.Primary); err != nil {
+			return err
+		}
+	}
+	if q.Me != "" {
+		// failure in mapping me is fatal
+		if q.Me, err = mapper.Proxy(q.Me); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proxyHosts maps a list of member addresses to their proxy addresses,
+// dropping the members which are not proxied. Members sharing a proxy, as
+// aliases of the same server, are listed once.
+func proxyHosts(log Logger, mapper ProxyMapper, hosts []string) ([]string, error) {
 	var newHosts []string
-	for _, h := range q.Hosts {
-		newH, err := r.ProxyMapper.Proxy(h)
+	seen := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		newH, err := mapper.Proxy(h)
 		if err != nil {
 			if pme, ok := err.(*ProxyMapperError); ok {
 				if pme.State != ReplicaStateArbiter {
-					r.Log.Errorf("dropping member %s in state %s", h, pme.State)
+					log.Errorf("dropping member %s in state %s", h, pme.State)
 				}
 				continue
 			}
 			// unknown err
-			return err
+			return nil, err
+		}
+		if !seen[newH] {
+			seen[newH] = true
+			newHosts = append(newHosts, newH)
 		}
-		newHosts = append(newHosts, newH)
 	}
-	q.Hosts = newHosts
+	return newHosts, nil
+}
 
-	if q.Primary != "" {
-		// failure in mapping the primary is fatal
-		if q.Primary, err = r.ProxyMapper.Proxy(q.Primary); err != nil {
-			return err
+// ServerStatusResponseRewriter rewrites the member addresses in the "repl"
+// section of the "serverStatus" response. The rest of the response is left
+// untouched and is only re-marshalled if the "repl" section is present.
+type ServerStatusResponseRewriter struct {
+	Log         Logger      `inject:""`
+	ProxyMapper ProxyMapper `inject:""`
+	ReplyRW     *ReplyRW    `inject:""`
+
+	// StripArbiters removes the arbiters array rather than mapping it, see
+	// IsMasterResponseRewriter.
+	StripArbiters bool
+}
+
+// Rewrite rewrites the "serverStatus" response.
+func (r *ServerStatusResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
+	var raw bson.Raw
+	h, prefix, docLen, rest, err := r.ReplyRW.ReadFirst(server, &raw)
+	if err != nil {
+		return err
+	}
+
+	var probe struct {
+		Repl *isMasterResponse `bson:"repl"`
+	}
+	if err := raw.Unmarshal(&probe); err != nil {
+		r.Log.Error(err)
+		return err
+	}
+	if probe.Repl == nil {
+		return r.ReplyRW.WriteFirst(client, h, prefix, docLen, rest, raw)
+	}
+
+	if err := proxyIsMasterHosts(r.Log, r.ProxyMapper, probe.Repl, r.StripArbiters); err != nil {
+		return err
+	}
+	var q bson.D
+	if err := raw.Unmarshal(&q); err != nil {
+		r.Log.Error(err)
+		return err
+	}
+	for i, e := range q {
+		if e.Name == "repl" {
+			q[i].Value = probe.Repl
 		}
 	}
-	if q.Me != "" {
-		// failure in mapping me is fatal
-		if q.Me, err = r.ProxyMapper.Proxy(q.Me); err != nil {
-			return err
+	return r.ReplyRW.WriteFirst(client, h, prefix, docLen, rest, q)
+}
+
+// GetShardMapResponseRewriter rewrites the member addresses in the keys and
+// values of the "map" document of the "getShardMap" response. Both are shard
+// connection strings, "rs/host:port,..." or a list of hosts. Entries of other
+// shards and of the config servers, which are not members of the replica set,
+// are left untouched. Entries keyed by members which are not proxied are
+// dropped, as are the ones keyed by aliases of a listed member.
+type GetShardMapResponseRewriter struct {
+	Log         Logger      `inject:""`
+	ProxyMapper ProxyMapper `inject:""`
+	ReplyRW     *ReplyRW    `inject:""`
+}
+
+// Rewrite rewrites the "getShardMap" response.
+func (r *GetShardMapResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
+	var q bson.D
+	h, prefix, docLen, rest, err := r.ReplyRW.ReadFirst(server, &q)
+	if err != nil {
+		return err
+	}
+	for i, e := range q {
+		if e.Name != "map" {
+			continue
 		}
+		shards, ok := e.Value.(bson.D)
+		if !ok {
+			continue
+		}
+		newShards := make(bson.D, 0, len(shards))
+		seen := make(map[string]bool, len(shards))
+		for _, shard := range shards {
+			name, member, err := r.proxyShard(shard.Name)
+			if err != nil {
+				return err
+			}
+			// Drop the entries of members which are not proxied, and the ones
+			// of aliases already listed.
+			if member && (name == "" || strings.HasSuffix(name, "/")) || seen[name] {
+				continue
+			}
+			seen[name] = true
+			if s, ok := shard.Value.(string); ok {
+				if shard.Value, _, err = r.proxyShard(s); err != nil {
+					return err
+				}
+			}
+			newShards = append(newShards, bson.DocElem{Name: name, Value: shard.Value})
+		}
+		q[i].Value = newShards
 	}
-	return r.ReplyRW.WriteOne(client, h, prefix, docLen, q)
+	return r.ReplyRW.WriteFirst(client, h, prefix, docLen, rest, q)
+}
+
+// proxyShard maps the hosts of a shard connection string which are members,
+// dropping the others like proxyHosts does. It returns false, with the string
+// as is, if none of the hosts is a member of the replica set.
+func (r *GetShardMapResponseRewriter) proxyShard(s string) (string, bool, error) {
+	var setName string
+	hosts := s
+	if i := strings.Index(s, "/"); i != -1 {
+		setName, hosts = s[:i+1], s[i+1:]
+	}
+	var proxied []string
+	seen := make(map[string]bool)
+	member := false
+	for _, h := range strings.Split(hosts, ",") {
+		newHosts, err := proxyHosts(r.Log, r.ProxyMapper, []string{h})
+		if err != nil {
+			if _, ok := err.(*UnknownMemberError); ok {
+				continue
+			}
+			return "", false, err
+		}
+		member = true
+		for _, newH := range newHosts {
+			if !seen[newH] {
+				seen[newH] = true
+				proxied = append(proxied, newH)
+			}
+		}
+	}
+	if !member {
+		return s, false, nil
+	}
+	return setName + strings.Join(proxied, ","), true, nil
 }
 
 type statusMember struct {
@@ -404,21 +976,27 @@ type replSetGetStatusResponse struct {
 // ReplSetGetStatusResponseRewriter rewrites the "replSetGetStatus" response.
 type ReplSetGetStatusResponseRewriter struct {
 	Log                 Logger              `inject:""`
+	Stats               stats.Client        `inject:""`
 	ProxyMapper         ProxyMapper         `inject:""`
 	ReplyRW             *ReplyRW            `inject:""`
 	ReplicaStateCompare ReplicaStateCompare `inject:""`
+
+	// DebugBackendAddrs adds a non standard _dvaraBackend field to each
+	// member, with the member address its proxy address replaced. It is meant
+	// for troubleshooting only.
+	DebugBackendAddrs bool
 }
 
 // Rewrite rewrites the "replSetGetStatus" response.
 func (r *ReplSetGetStatusResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
 	var err error
 	var q replSetGetStatusResponse
-	h, prefix, docLen, err := r.ReplyRW.ReadOne(server, &q)
+	h, prefix, docLen, rest, err := r.ReplyRW.ReadFirst(server, &q)
 	if err != nil {
 		return err
 	}
 	if !r.ReplicaStateCompare.SameRS(&q) {
-		return errRSChanged
+		return rsChanged(r.Log, r.Stats, r.ReplicaStateCompare, "replSetGetStatus", &ReplicaSetState{lastRS: &q})
 	}
 
 	var newMembers []statusMember
@@ -434,11 +1012,17 @@ func (r *ReplSetGetStatusResponseRewriter) Rewrite(client io.Writer, server io.R
 			// unknown err
 			return err
 		}
+		if r.DebugBackendAddrs {
+			if m.Extra == nil {
+				m.Extra = bson.M{}
+			}
+			m.Extra[debugBackendField] = m.Name
+		}
 		m.Name = newH
 		newMembers = append(newMembers, m)
 	}
 	q.Members = newMembers
-	return r.ReplyRW.WriteOne(client, h, prefix, docLen, q)
+	return r.ReplyRW.WriteFirst(client, h, prefix, docLen, rest, q)
 }
 
 // case insensitive check for the specified key name in the top level.
@@ -3,15 +3,20 @@ package dvara
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/facebookgo/ensure"
 	"github.com/facebookgo/inject"
 	"github.com/facebookgo/startstop"
+	"github.com/facebookgo/stats"
 
 	"gopkg.in/mgo.v2/bson"
 )
@@ -27,7 +32,8 @@ func (i invalidBSON) GetBSON() (interface{}, error) {
 var errProxyNotFound = errors.New("proxy not found")
 
 type fakeProxyMapper struct {
-	m map[string]string
+	m       map[string]string
+	ignored map[string]ReplicaState
 }
 
 func (t fakeProxyMapper) Proxy(h string) (string, error) {
@@ -36,6 +42,9 @@ func (t fakeProxyMapper) Proxy(h string) (string, error) {
 			return r, nil
 		}
 	}
+	if s, ok := t.ignored[h]; ok {
+		return "", &ProxyMapperError{RealHost: h, State: s}
+	}
 	return "", errProxyNotFound
 }
 
@@ -74,6 +83,25 @@ func fakeSingleDocReply(v interface{}) io.Reader {
 	return fakeReader(h, b)
 }
 
+// fakeMultiDocReply returns an OpReply with the given documents.
+func fakeMultiDocReply(docs ...interface{}) []byte {
+	var prefix replyPrefix
+	setInt32(prefix[:], 16, int32(len(docs)))
+	b := prefix[:]
+	for _, d := range docs {
+		raw, err := bson.Marshal(d)
+		if err != nil {
+			panic(err)
+		}
+		b = append(b, raw...)
+	}
+	h := messageHeader{
+		OpCode:        OpReply,
+		MessageLength: int32(headerLen + len(b)),
+	}
+	return append(h.ToWire(), b...)
+}
+
 type fakeReadWriter struct {
 	io.Reader
 	io.Writer
@@ -130,7 +158,7 @@ func TestResponseRWReadOne(t *testing.T) {
 		{
 			Name: "corrupted document",
 			Server: fakeReader(
-				messageHeader{OpCode: OpReply},
+				messageHeader{OpCode: OpReply, MessageLength: headerLen + 20 + 5},
 				[]byte{
 					0, 0, 0, 0,
 					0, 0, 0, 0, 0, 0, 0, 0,
@@ -142,6 +170,21 @@ func TestResponseRWReadOne(t *testing.T) {
 			),
 			Error: "Document is corrupted",
 		},
+		{
+			Name: "document overruns message",
+			Server: fakeReader(
+				messageHeader{OpCode: OpReply, MessageLength: headerLen + 20 + 5},
+				[]byte{
+					0, 0, 0, 0,
+					0, 0, 0, 0, 0, 0, 0, 0,
+					0, 0, 0, 0,
+					1, 0, 0, 0,
+					16, 0, 0, 0,
+					1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				},
+			),
+			Error: "document length 16 inconsistent with the 5 bytes left in the message",
+		},
 	}
 
 	for _, c := range cases {
@@ -184,6 +227,12 @@ func TestResponseRWWriteOne(t *testing.T) {
 			},
 			Error: errWrite.Error(),
 		},
+		{
+			Name:   "grows too large",
+			Header: messageHeader{MessageLength: maxMessageLength},
+			Value:  map[string]string{"hosts": "proxy"},
+			Error:  "invalid message length",
+		},
 	}
 
 	for _, c := range cases {
@@ -249,7 +298,7 @@ func TestIsMasterResponseRewriterFailures(t *testing.T) {
 		{
 			Name:                "different im",
 			Server:              fakeSingleDocReply(map[string]interface{}{}),
-			Error:               errRSChanged.Error(),
+			Error:               ErrRSChanged.Error(),
 			ProxyMapper:         nil,
 			ReplicaStateCompare: fakeReplicaStateCompare{sameIM: false, sameRS: true},
 		},
@@ -263,6 +312,7 @@ func TestIsMasterResponseRewriterFailures(t *testing.T) {
 			ReplyRW: &ReplyRW{
 				Log: &tLogger{TB: t},
 			},
+			VersionOverride: &BuildInfoVersionOverride{},
 		}
 		err := r.Rewrite(c.Client, c.Server)
 		if err == nil {
@@ -301,6 +351,7 @@ func TestIsMasterResponseRewriterSuccess(t *testing.T) {
 		ReplyRW: &ReplyRW{
 			Log: &tLogger{TB: t},
 		},
+		VersionOverride: &BuildInfoVersionOverride{},
 	}
 
 	var client bytes.Buffer
@@ -319,6 +370,354 @@ func TestIsMasterResponseRewriterSuccess(t *testing.T) {
 	}
 }
 
+func TestIsMasterResponseRewriterEmptyHosts(t *testing.T) {
+	t.Parallel()
+	mapped := fakeProxyMapper{m: map[string]string{"a": "1", "b": "2"}}
+	dropped := fakeProxyMapper{ignored: map[string]ReplicaState{
+		"a": ReplicaStateSecondary,
+		"b": ReplicaStateSecondary,
+	}}
+	in := bson.M{"hosts": []interface{}{"a", "b"}}
+	cases := []struct {
+		Name     string
+		Policy   EmptyHostsPolicy
+		Warm     bool // whether a response was mapped before
+		Hosts    []interface{}
+		Expected error
+	}{
+		{Name: "serve", Policy: EmptyHostsServe, Warm: true},
+		{Name: "close", Policy: EmptyHostsClose, Warm: true, Expected: ErrRSChanged},
+		{Name: "last known", Policy: EmptyHostsLastKnown, Warm: true, Hosts: []interface{}{"1", "2"}},
+		{Name: "last known without one", Policy: EmptyHostsLastKnown, Expected: ErrRSChanged},
+	}
+	for _, c := range cases {
+		r := &IsMasterResponseRewriter{
+			Log:                 &tLogger{TB: t},
+			ProxyMapper:         mapped,
+			ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+			ReplyRW:             &ReplyRW{Log: &tLogger{TB: t}},
+			VersionOverride:     &BuildInfoVersionOverride{},
+			EmptyHosts:          c.Policy,
+		}
+		if c.Warm {
+			ensure.Nil(t, r.Rewrite(ioutil.Discard, fakeSingleDocReply(in)), c.Name)
+		}
+		r.ProxyMapper = dropped
+		var client bytes.Buffer
+		err := r.Rewrite(&client, fakeSingleDocReply(in))
+		ensure.DeepEqual(t, err, c.Expected, c.Name)
+		if err != nil {
+			continue
+		}
+		out := bson.M{}
+		ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &out), c.Name)
+		if c.Hosts == nil {
+			_, ok := out["hosts"]
+			ensure.False(t, ok, c.Name)
+		} else {
+			ensure.DeepEqual(t, out["hosts"], c.Hosts, c.Name)
+		}
+	}
+}
+
+func TestIsMasterResponseRewriterUnmappedPrimary(t *testing.T) {
+	t.Parallel()
+	// The new primary b is not known yet.
+	in := bson.M{
+		"hosts":   []interface{}{"a"},
+		"me":      "a",
+		"primary": "b",
+	}
+	for _, blank := range []bool{false, true} {
+		r := &IsMasterResponseRewriter{
+			Log:                 &tLogger{TB: t},
+			ProxyMapper:         fakeProxyMapper{m: map[string]string{"a": "1"}},
+			ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+			ReplyRW: &ReplyRW{
+				Log: &tLogger{TB: t},
+			},
+			VersionOverride:      &BuildInfoVersionOverride{},
+			BlankUnmappedPrimary: blank,
+		}
+		var client bytes.Buffer
+		err := r.Rewrite(&client, fakeSingleDocReply(in))
+		if !blank {
+			ensure.DeepEqual(t, err, errProxyNotFound)
+			ensure.DeepEqual(t, client.Len(), 0)
+			continue
+		}
+		ensure.Nil(t, err)
+		actualOut := bson.M{}
+		ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &actualOut))
+		ensure.DeepEqual(t, actualOut, bson.M{
+			"hosts": []interface{}{"1"},
+			"me":    "1",
+		})
+	}
+}
+
+// fakeListenerMapper is a fakeProxyMapper which also maps the local address
+// of client connections to the proxy they connected to.
+type fakeListenerMapper struct {
+	fakeProxyMapper
+	listeners map[string]string
+}
+
+func (f fakeListenerMapper) ListenerProxy(localAddr net.Addr) (string, error) {
+	if p, ok := f.listeners[localAddr.String()]; ok {
+		return p, nil
+	}
+	return "", errProxyNotFound
+}
+
+// fakeClientConn is a client connection with a local address.
+type fakeClientConn struct {
+	bytes.Buffer
+	localAddr net.Addr
+}
+
+func (c *fakeClientConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func TestIsMasterResponseRewriterConnectedMe(t *testing.T) {
+	t.Parallel()
+	// The client is pinned to the primary a through the proxy for b.
+	in := bson.M{
+		"hosts":   []interface{}{"a", "b"},
+		"me":      "a",
+		"primary": "a",
+	}
+	listener := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	mapper := fakeListenerMapper{
+		fakeProxyMapper: fakeProxyMapper{m: map[string]string{"a": "proxy:1", "b": "proxy:2"}},
+		listeners:       map[string]string{listener.String(): "proxy:2"},
+	}
+	cases := []struct {
+		Name        string
+		ConnectedMe bool
+		Mapper      ProxyMapper
+		LocalAddr   net.Addr
+		Me          string
+	}{
+		{
+			Name:      "disabled",
+			Mapper:    mapper,
+			LocalAddr: listener,
+			Me:        "proxy:1",
+		},
+		{
+			Name:        "connected",
+			ConnectedMe: true,
+			Mapper:      mapper,
+			LocalAddr:   listener,
+			Me:          "proxy:2",
+		},
+		{
+			Name:        "unknown listener",
+			ConnectedMe: true,
+			Mapper:      mapper,
+			LocalAddr:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3},
+			Me:          "proxy:1",
+		},
+		{
+			Name:        "not a listener mapper",
+			ConnectedMe: true,
+			Mapper:      mapper.fakeProxyMapper,
+			LocalAddr:   listener,
+			Me:          "proxy:1",
+		},
+	}
+	for _, c := range cases {
+		r := &IsMasterResponseRewriter{
+			Log:                 &tLogger{TB: t},
+			ProxyMapper:         c.Mapper,
+			ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+			ReplyRW: &ReplyRW{
+				Log: &tLogger{TB: t},
+			},
+			VersionOverride: &BuildInfoVersionOverride{},
+			ConnectedMe:     c.ConnectedMe,
+		}
+		client := &fakeClientConn{localAddr: c.LocalAddr}
+		ensure.Nil(t, r.Rewrite(client, fakeSingleDocReply(in)), c.Name)
+		actualOut := bson.M{}
+		ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &actualOut))
+		ensure.DeepEqual(t, actualOut, bson.M{
+			"hosts":   []interface{}{"proxy:1", "proxy:2"},
+			"me":      c.Me,
+			"primary": "proxy:1",
+		}, c.Name)
+	}
+}
+
+func TestIsMasterResponseRewriterMultipleDocuments(t *testing.T) {
+	t.Parallel()
+	r := &IsMasterResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		ProxyMapper:         fakeProxyMapper{m: map[string]string{"a": "1"}},
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+		ReplyRW: &ReplyRW{
+			Log: &tLogger{TB: t},
+		},
+		VersionOverride: &BuildInfoVersionOverride{},
+	}
+	second := bson.M{"hosts": []interface{}{"b"}}
+	third := bson.M{"foo": "bar"}
+	server := fakeMultiDocReply(bson.M{"hosts": []interface{}{"a"}, "primary": "a"}, second, third)
+	expected := fakeMultiDocReply(bson.M{"hosts": []interface{}{"1"}, "primary": "1"}, second, third)
+
+	var client bytes.Buffer
+	ensure.Nil(t, r.Rewrite(&client, bytes.NewReader(server)))
+	h, err := readHeader(&client)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, int(h.MessageLength), headerLen+client.Len())
+
+	// Only the first document is rewritten, the rest is forwarded as is.
+	var prefix replyPrefix
+	_, err = client.Read(prefix[:])
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, getInt32(prefix[:], 16), int32(3))
+	var docs []bson.M
+	for client.Len() != 0 {
+		raw, err := readDocument(&client, int32(client.Len()))
+		ensure.Nil(t, err)
+		var doc bson.M
+		ensure.Nil(t, bson.Unmarshal(raw, &doc))
+		docs = append(docs, doc)
+	}
+	ensure.DeepEqual(t, docs, []bson.M{
+		{"hosts": []interface{}{"1"}, "primary": "1"},
+		second,
+		third,
+	})
+	ensure.DeepEqual(t, len(expected), int(h.MessageLength))
+}
+
+func TestIsMasterResponseRewriterLongerProxyAddrs(t *testing.T) {
+	t.Parallel()
+	long := func(n int) string {
+		return fmt.Sprintf("proxy-%d.%s.example.com:27017", n, strings.Repeat("x", 200))
+	}
+	r := &IsMasterResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		ProxyMapper:         fakeProxyMapper{m: map[string]string{"a": long(1), "b": long(2)}},
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+		ReplyRW: &ReplyRW{
+			Log: &tLogger{TB: t},
+		},
+		VersionOverride: &BuildInfoVersionOverride{},
+	}
+	second := bson.M{"foo": "bar"}
+	server := fakeMultiDocReply(bson.M{"hosts": []interface{}{"a", "b"}, "primary": "a", "me": "b"}, second)
+
+	var client bytes.Buffer
+	ensure.Nil(t, r.Rewrite(&client, bytes.NewReader(server)))
+	ensure.True(t, client.Len() > len(server))
+
+	// The client reads exactly the framed message, nothing is left over or
+	// missing.
+	written := client.Len()
+	var q isMasterResponse
+	rw := &ReplyRW{Log: &tLogger{TB: t}}
+	h, _, _, rest, err := rw.ReadFirst(&client, &q)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, int(h.MessageLength), written)
+	ensure.DeepEqual(t, client.Len(), 0)
+	ensure.DeepEqual(t, q.Hosts, []string{long(1), long(2)})
+	ensure.DeepEqual(t, q.Primary, long(1))
+	ensure.DeepEqual(t, q.Me, long(2))
+	var doc bson.M
+	ensure.Nil(t, bson.Unmarshal(rest, &doc))
+	ensure.DeepEqual(t, doc, second)
+}
+
+func TestIsMasterResponseRewriterPassivesAndArbiters(t *testing.T) {
+	t.Parallel()
+	proxyMapper := fakeProxyMapper{
+		m: map[string]string{
+			"a": "1",
+			"b": "2",
+			"c": "3",
+			"d": "4",
+		},
+		ignored: map[string]ReplicaState{
+			"e": ReplicaStateArbiter,
+		},
+	}
+	in := bson.M{
+		"hosts":    []interface{}{"a", "b"},
+		"passives": []interface{}{"c"},
+		"arbiters": []interface{}{"d", "e"},
+		"primary":  "a",
+	}
+	cases := []struct {
+		Name          string
+		StripArbiters bool
+		Out           bson.M
+	}{
+		{
+			Name: "map arbiters",
+			Out: bson.M{
+				"hosts":    []interface{}{"1", "2"},
+				"passives": []interface{}{"3"},
+				"arbiters": []interface{}{"4"},
+				"primary":  "1",
+			},
+		},
+		{
+			Name:          "strip arbiters",
+			StripArbiters: true,
+			Out: bson.M{
+				"hosts":    []interface{}{"1", "2"},
+				"passives": []interface{}{"3"},
+				"primary":  "1",
+			},
+		},
+	}
+	for _, c := range cases {
+		r := &IsMasterResponseRewriter{
+			Log:                 &tLogger{TB: t},
+			ProxyMapper:         proxyMapper,
+			ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+			ReplyRW: &ReplyRW{
+				Log: &tLogger{TB: t},
+			},
+			VersionOverride: &BuildInfoVersionOverride{},
+			StripArbiters:   c.StripArbiters,
+		}
+		var client bytes.Buffer
+		if err := r.Rewrite(&client, fakeSingleDocReply(in)); err != nil {
+			t.Fatal(err)
+		}
+		actualOut := bson.M{}
+		doc := client.Bytes()[headerLen+len(emptyPrefix):]
+		if err := bson.Unmarshal(doc, &actualOut); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.Out, actualOut) {
+			spew.Dump(c.Out)
+			spew.Dump(actualOut)
+			t.Fatalf("did not get expected output for case %s", c.Name)
+		}
+	}
+}
+
+func TestIsMasterResponseRewriterUnknownPassive(t *testing.T) {
+	t.Parallel()
+	r := &IsMasterResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		ProxyMapper:         fakeProxyMapper{},
+		ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+		ReplyRW: &ReplyRW{
+			Log: &tLogger{TB: t},
+		},
+		VersionOverride: &BuildInfoVersionOverride{},
+	}
+	err := r.Rewrite(ioutil.Discard, fakeSingleDocReply(bson.M{"passives": []string{"foo"}}))
+	ensure.DeepEqual(t, err, errProxyNotFound)
+}
+
 func TestReplSetGetStatusResponseRewriterFailures(t *testing.T) {
 	t.Parallel()
 	cases := []struct {
@@ -352,7 +751,7 @@ func TestReplSetGetStatusResponseRewriterFailures(t *testing.T) {
 		{
 			Name:                "diffferent rs",
 			Server:              fakeSingleDocReply(map[string]interface{}{}),
-			Error:               errRSChanged.Error(),
+			Error:               ErrRSChanged.Error(),
 			ProxyMapper:         nil,
 			ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: false},
 		},
@@ -440,6 +839,213 @@ func TestReplSetGetStatusResponseRewriterSuccess(t *testing.T) {
 	}
 }
 
+func TestDebugBackendAddrs(t *testing.T) {
+	t.Parallel()
+	proxyMapper := fakeProxyMapper{
+		m: map[string]string{
+			"a": "1",
+			"b": "2",
+		},
+	}
+	isMaster := func(debug bool) bson.M {
+		r := &IsMasterResponseRewriter{
+			Log:                 &tLogger{TB: t},
+			ProxyMapper:         proxyMapper,
+			ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+			ReplyRW:             &ReplyRW{Log: &tLogger{TB: t}},
+			VersionOverride:     &BuildInfoVersionOverride{},
+			DebugBackendAddrs:   debug,
+		}
+		var client bytes.Buffer
+		ensure.Nil(t, r.Rewrite(&client, fakeSingleDocReply(bson.M{
+			"hosts": []interface{}{"a", "b"},
+			"me":    "a",
+		})))
+		out := bson.M{}
+		ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &out))
+		return out
+	}
+	replSetGetStatus := func(debug bool) bson.M {
+		r := &ReplSetGetStatusResponseRewriter{
+			Log:                 &tLogger{TB: t},
+			ProxyMapper:         proxyMapper,
+			ReplicaStateCompare: fakeReplicaStateCompare{sameIM: true, sameRS: true},
+			ReplyRW:             &ReplyRW{Log: &tLogger{TB: t}},
+			DebugBackendAddrs:   debug,
+		}
+		var client bytes.Buffer
+		ensure.Nil(t, r.Rewrite(&client, fakeSingleDocReply(bson.M{
+			"members": []interface{}{bson.M{"name": "a"}, bson.M{"name": "b"}},
+		})))
+		out := bson.M{}
+		ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &out))
+		return out
+	}
+
+	ensure.DeepEqual(t, isMaster(false), bson.M{
+		"hosts": []interface{}{"1", "2"},
+		"me":    "1",
+	})
+	ensure.DeepEqual(t, isMaster(true), bson.M{
+		"hosts": []interface{}{"1", "2"},
+		"me":    "1",
+		"_dvaraBackends": []interface{}{
+			bson.M{"host": "1", "_dvaraBackend": "a"},
+			bson.M{"host": "2", "_dvaraBackend": "b"},
+		},
+	})
+	ensure.DeepEqual(t, replSetGetStatus(false), bson.M{
+		"members": []interface{}{bson.M{"name": "1"}, bson.M{"name": "2"}},
+	})
+	ensure.DeepEqual(t, replSetGetStatus(true), bson.M{
+		"members": []interface{}{
+			bson.M{"name": "1", "_dvaraBackend": "a"},
+			bson.M{"name": "2", "_dvaraBackend": "b"},
+		},
+	})
+}
+
+func TestServerStatusResponseRewriter(t *testing.T) {
+	t.Parallel()
+	r := &ServerStatusResponseRewriter{
+		Log: &tLogger{TB: t},
+		ProxyMapper: fakeProxyMapper{
+			m: map[string]string{
+				"a": "1",
+				"b": "2",
+			},
+		},
+		ReplyRW: &ReplyRW{
+			Log: &tLogger{TB: t},
+		},
+	}
+
+	in := bson.D{
+		{Name: "host", Value: "h"},
+		{Name: "repl", Value: bson.D{
+			{Name: "setName", Value: "rs"},
+			{Name: "hosts", Value: []interface{}{"a", "b"}},
+			{Name: "primary", Value: "b"},
+			{Name: "me", Value: "a"},
+		}},
+		{Name: "ok", Value: 1},
+	}
+	var client bytes.Buffer
+	if err := r.Rewrite(&client, fakeSingleDocReply(in)); err != nil {
+		t.Fatal(err)
+	}
+	var actualOut bson.D
+	doc := client.Bytes()[headerLen+len(emptyPrefix):]
+	if err := bson.Unmarshal(doc, &actualOut); err != nil {
+		t.Fatal(err)
+	}
+	if len(actualOut) != 3 || actualOut[0].Name != "host" || actualOut[1].Name != "repl" || actualOut[2].Name != "ok" {
+		t.Fatalf("unexpected fields: %v", actualOut)
+	}
+	repl := actualOut[1].Value.(bson.D).Map()
+	expectedRepl := bson.M{
+		"setName": "rs",
+		"hosts":   []interface{}{"1", "2"},
+		"primary": "2",
+		"me":      "1",
+	}
+	if !reflect.DeepEqual(repl, expectedRepl) {
+		spew.Dump(repl)
+		t.Fatal("did not get expected repl section")
+	}
+}
+
+func TestServerStatusResponseRewriterWithoutRepl(t *testing.T) {
+	t.Parallel()
+	r := &ServerStatusResponseRewriter{
+		Log:         &tLogger{TB: t},
+		ProxyMapper: fakeProxyMapper{},
+		ReplyRW: &ReplyRW{
+			Log: &tLogger{TB: t},
+		},
+	}
+	in := bson.D{
+		{Name: "host", Value: "h"},
+		{Name: "uptime", Value: 1.5},
+		{Name: "ok", Value: 1},
+	}
+	expected, err := ioutil.ReadAll(fakeSingleDocReply(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client bytes.Buffer
+	if err := r.Rewrite(&client, bytes.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(client.Bytes(), expected) {
+		t.Fatal("response was not forwarded verbatim")
+	}
+}
+
+// memberMapper is a fakeProxyMapper which reports the hosts it does not know
+// as not being members of the replica set.
+type memberMapper struct {
+	fakeProxyMapper
+}
+
+func (m memberMapper) Proxy(h string) (string, error) {
+	p, err := m.fakeProxyMapper.Proxy(h)
+	if err == errProxyNotFound {
+		return "", &UnknownMemberError{RealHost: h}
+	}
+	return p, err
+}
+
+func TestGetShardMapResponseRewriter(t *testing.T) {
+	t.Parallel()
+	r := &GetShardMapResponseRewriter{
+		Log: &tLogger{TB: t},
+		ProxyMapper: memberMapper{fakeProxyMapper{
+			m:       map[string]string{"a:1": "p:1", "b:1": "p:2", "alias:1": "p:1"},
+			ignored: map[string]ReplicaState{"c:1": ReplicaStateArbiter},
+		}},
+		ReplyRW: &ReplyRW{Log: &tLogger{TB: t}},
+	}
+
+	// The members are mapped in the keys and the values. Hosts which are not
+	// members, like the one added to the set since the proxies started, are
+	// dropped, as are the entries of the arbiter and the alias.
+	in := bson.D{
+		{Name: "map", Value: bson.D{
+			{Name: "shard01", Value: "shard01/a:1,b:1,c:1"},
+			{Name: "shard01/a:1,b:1,c:1,d:1", Value: "shard01/a:1,b:1,c:1,d:1"},
+			{Name: "a:1", Value: "shard01/a:1,b:1,c:1"},
+			{Name: "b:1", Value: "shard01/a:1,b:1,d:1"},
+			{Name: "c:1", Value: "shard01/a:1,b:1,c:1"},
+			{Name: "alias:1", Value: "shard01/alias:1,b:1"},
+			{Name: "shard02", Value: "shard02/x:1,y:1"},
+			{Name: "shard02/x:1,y:1", Value: "shard02/x:1,y:1"},
+			{Name: "x:1", Value: "shard02/x:1,y:1"},
+			{Name: "config", Value: "configRS/z:1"},
+			{Name: "single", Value: "b:1"},
+		}},
+		{Name: "ok", Value: 1},
+	}
+	var client bytes.Buffer
+	ensure.Nil(t, r.Rewrite(&client, fakeSingleDocReply(in)))
+	var out bson.D
+	ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &out))
+	ensure.DeepEqual(t, out, bson.D{
+		{Name: "map", Value: bson.D{
+			{Name: "shard01", Value: "shard01/p:1,p:2"},
+			{Name: "shard01/p:1,p:2", Value: "shard01/p:1,p:2"},
+			{Name: "p:1", Value: "shard01/p:1,p:2"},
+			{Name: "p:2", Value: "shard01/p:1,p:2"},
+			{Name: "shard02", Value: "shard02/x:1,y:1"},
+			{Name: "shard02/x:1,y:1", Value: "shard02/x:1,y:1"},
+			{Name: "x:1", Value: "shard02/x:1,y:1"},
+			{Name: "config", Value: "configRS/z:1"},
+			{Name: "single", Value: "p:2"},
+		}},
+		{Name: "ok", Value: 1},
+	})
+}
+
 func TestProxyQuery(t *testing.T) {
 	t.Parallel()
 	var p ProxyQuery
@@ -449,6 +1055,7 @@ func TestProxyQuery(t *testing.T) {
 		&inject.Object{Value: &fakeProxyMapper{}},
 		&inject.Object{Value: &fakeReplicaStateCompare{}},
 		&inject.Object{Value: &log},
+		&inject.Object{Value: &stats.HookClient{}},
 		&inject.Object{Value: &p},
 	)
 	ensure.Nil(t, err)
@@ -511,7 +1118,7 @@ func TestProxyQuery(t *testing.T) {
 		},
 		{
 			Name:   "error while unmarshaling query document",
-			Header: &messageHeader{},
+			Header: &messageHeader{MessageLength: int32(headerLen + 4 + len(adminCollectionName) + 8 + 5)},
 			Client: fakeReadWriter{
 				Reader: io.MultiReader(
 					bytes.NewReader([]byte{0, 0, 0, 0}), // flags int32 before collection name
@@ -536,3 +1143,337 @@ func TestProxyQuery(t *testing.T) {
 		}
 	}
 }
+
+func fakeQuery(collection string, v interface{}) (*messageHeader, []byte) {
+	doc, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	var body []byte
+	body = append(body, 0, 0, 0, 0) // flags
+	body = append(body, collection...)
+	body = append(body, 0)
+	body = append(body, 0, 0, 0, 0, 1, 0, 0, 0) // numberToSkip & numberToReturn
+	body = append(body, doc...)
+	h := &messageHeader{
+		OpCode:        OpQuery,
+		MessageLength: int32(headerLen + len(body)),
+	}
+	return h, body
+}
+
+func TestProxyQueryPassthrough(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name                string
+		PassthroughCommands []string
+		Query               bson.D
+	}{
+		{
+			Name:  "default moveChunk",
+			Query: bson.D{{Name: "moveChunk", Value: "test.foo"}},
+		},
+		{
+			Name:  "default replSetHeartbeat",
+			Query: bson.D{{Name: "replSetHeartbeat", Value: "rs"}},
+		},
+		{
+			Name:                "configured isMaster",
+			PassthroughCommands: []string{"ismaster"},
+			Query:               bson.D{{Name: "isMaster", Value: 1}},
+		},
+	}
+
+	for _, c := range cases {
+		// The rewriters are left nil, so any attempt to rewrite would panic.
+		p := &ProxyQuery{
+			Log:                 &tLogger{TB: t},
+			PassthroughCommands: c.PassthroughCommands,
+		}
+		h, body := fakeQuery("admin.$cmd", c.Query)
+		reply := bson.D{{Name: "ok", Value: 1}, {Name: "hosts", Value: []string{"a"}}}
+		var clientOut, serverIn bytes.Buffer
+		client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+		server := fakeReadWriter{Reader: fakeSingleDocReply(reply), Writer: &serverIn}
+		var lastError LastError
+		if err := p.Proxy(h, client, server, &lastError); err != nil {
+			t.Fatalf("unexpected error for case %s: %s", c.Name, err)
+		}
+		if !bytes.Equal(serverIn.Bytes(), append(h.ToWire(), body...)) {
+			t.Fatalf("query was not forwarded verbatim for case %s", c.Name)
+		}
+		expectedReply, _ := ioutil.ReadAll(fakeSingleDocReply(reply))
+		if !bytes.Equal(clientOut.Bytes(), expectedReply) {
+			t.Fatalf("reply was not forwarded verbatim for case %s", c.Name)
+		}
+	}
+}
+
+func TestProxyQueryMaxTimeMS(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name       string
+		Collection string
+		In         bson.D
+		Expected   bson.D
+	}{
+		{
+			Name:       "query",
+			Collection: "test.foo",
+			In:         bson.D{{Name: "a", Value: 1}},
+			Expected: bson.D{
+				{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+				{Name: "$maxTimeMS", Value: int64(1000)},
+			},
+		},
+		{
+			Name:       "command",
+			Collection: "test.$cmd",
+			In:         bson.D{{Name: "count", Value: "foo"}, {Name: "maxTimeMS", Value: 3000}},
+			Expected:   bson.D{{Name: "count", Value: "foo"}, {Name: "maxTimeMS", Value: int64(1000)}},
+		},
+		{
+			Name:       "system.namespaces",
+			Collection: "test.system.namespaces",
+			In:         bson.D{{Name: "name", Value: "test.foo"}},
+			Expected:   bson.D{{Name: "name", Value: "test.foo"}},
+		},
+		{
+			Name:       "system.indexes",
+			Collection: "test.system.indexes",
+			In:         bson.D{{Name: "ns", Value: "test.foo"}},
+			Expected:   bson.D{{Name: "ns", Value: "test.foo"}},
+		},
+	}
+
+	for _, c := range cases {
+		p := &ProxyQuery{
+			Log:               &tLogger{TB: t},
+			MaxTimeMSRewriter: &MaxTimeMSRewriter{Max: time.Second},
+		}
+		h, body := fakeQuery(c.Collection, c.In)
+		var clientOut, serverIn bytes.Buffer
+		client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+		reply := bson.D{{Name: "ok", Value: 1}}
+		server := fakeReadWriter{Reader: fakeSingleDocReply(reply), Writer: &serverIn}
+		var lastError LastError
+		if err := p.Proxy(h, client, server, &lastError); err != nil {
+			t.Fatalf("unexpected error for case %s: %s", c.Name, err)
+		}
+
+		expectedH, expectedBody := fakeQuery(c.Collection, c.Expected)
+		expected := append(expectedH.ToWire(), expectedBody...)
+		if !bytes.Equal(serverIn.Bytes(), expected) {
+			t.Fatalf("did not get expected query for case %s", c.Name)
+		}
+	}
+}
+
+func TestProxyQueryPartial(t *testing.T) {
+	t.Parallel()
+	p := &ProxyQuery{
+		Log:               &tLogger{TB: t},
+		MaxTimeMSRewriter: &MaxTimeMSRewriter{Max: time.Second},
+	}
+	flags := int32(queryFlagPartial | queryFlagSlaveOK)
+	h, body := fakeQuery("test.foo", bson.D{{Name: "a", Value: 1}})
+	setInt32(body, 0, flags)
+	var clientOut, serverIn bytes.Buffer
+	client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+	reply := bson.D{{Name: "ok", Value: 1}}
+	server := fakeReadWriter{Reader: fakeSingleDocReply(reply), Writer: &serverIn}
+	var lastError LastError
+	ensure.Nil(t, p.Proxy(h, client, server, &lastError))
+
+	// The flags are forwarded as is and the query is rewritten as usual.
+	expectedH, expectedBody := fakeQuery("test.foo", bson.D{
+		{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+		{Name: "$maxTimeMS", Value: int64(1000)},
+	})
+	setInt32(expectedBody, 0, flags)
+	ensure.DeepEqual(t, serverIn.Bytes(), append(expectedH.ToWire(), expectedBody...))
+	expectedReply, _ := ioutil.ReadAll(fakeSingleDocReply(reply))
+	ensure.DeepEqual(t, clientOut.Bytes(), expectedReply)
+}
+
+func TestIsLegacySystemQuery(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Collection string
+		Expected   bool
+	}{
+		{Collection: "test.system.namespaces", Expected: true},
+		{Collection: "test.system.indexes", Expected: true},
+		{Collection: "test.system.users", Expected: false},
+		{Collection: "test.$cmd", Expected: false},
+		{Collection: "test.foo", Expected: false},
+		{Collection: "test.mysystem.namespaces.foo", Expected: false},
+	}
+	for _, c := range cases {
+		if actual := isLegacySystemQuery([]byte(c.Collection + "\000")); actual != c.Expected {
+			t.Fatalf("expected %v for %s got %v", c.Expected, c.Collection, actual)
+		}
+	}
+}
+
+func TestGetLastErrorRewriterPartialResponse(t *testing.T) {
+	t.Parallel()
+	r := &GetLastErrorRewriter{Log: &tLogger{TB: t}}
+	h, body := fakeQuery("admin.$cmd", bson.D{{Name: "getLastError", Value: 1}})
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.D{{Name: "ok", Value: 1}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clientOut, serverIn bytes.Buffer
+	client := fakeReadWriter{Reader: bytes.NewReader(nil), Writer: &clientOut}
+	server := fakeReadWriter{Reader: bytes.NewReader(reply[:len(reply)-1]), Writer: &serverIn}
+	var lastError LastError
+	if err := r.Rewrite(h, [][]byte{h.ToWire(), body}, client, server, &lastError); err == nil {
+		t.Fatal("was expecting an error")
+	}
+	if lastError.Exists() {
+		t.Fatal("partial response was cached")
+	}
+	if clientOut.Len() != 0 {
+		t.Fatal("partial response was sent to the client")
+	}
+}
+
+func TestGetLastErrorWithoutWrite(t *testing.T) {
+	t.Parallel()
+	var anomalies float64
+	p := &ProxyQuery{
+		Log: &tLogger{TB: t},
+		GetLastErrorRewriter: &GetLastErrorRewriter{
+			Log: &tLogger{TB: t},
+			Stats: &stats.HookClient{
+				BumpSumHook: func(key string, val float64) {
+					if key == "getlasterror.without.write" {
+						anomalies += val
+					}
+				},
+			},
+		},
+		MaxTimeMSRewriter: &MaxTimeMSRewriter{},
+	}
+	var lastError LastError
+	proxy := func(collection string, q bson.D) {
+		h, body := fakeQuery(collection, q)
+		var clientOut, serverIn bytes.Buffer
+		client := fakeReadWriter{Reader: bytes.NewReader(body), Writer: &clientOut}
+		server := fakeReadWriter{
+			Reader: fakeSingleDocReply(bson.D{{Name: "ok", Value: 1}}),
+			Writer: &serverIn,
+		}
+		ensure.Nil(t, p.Proxy(h, client, server, &lastError))
+	}
+	gle := bson.D{{Name: "getLastError", Value: 1}}
+
+	proxy("admin.$cmd", gle)
+	ensure.DeepEqual(t, anomalies, float64(1))
+
+	// A cached response for a repeated getLastError is not an anomaly.
+	proxy("admin.$cmd", gle)
+	ensure.DeepEqual(t, anomalies, float64(1))
+
+	proxy("test.$cmd", bson.D{{Name: "insert", Value: "foo"}})
+	proxy("test.$cmd", gle)
+	ensure.DeepEqual(t, anomalies, float64(1))
+
+	proxy("test.$cmd", bson.D{{Name: "count", Value: "foo"}})
+	proxy("test.$cmd", gle)
+	ensure.DeepEqual(t, anomalies, float64(2))
+}
+
+func TestGetLastErrorRewriterClientDisconnect(t *testing.T) {
+	t.Parallel()
+	r := &GetLastErrorRewriter{Log: &tLogger{TB: t}}
+	h, body := fakeQuery("admin.$cmd", bson.D{{Name: "getLastError", Value: 1}})
+	reply, err := ioutil.ReadAll(fakeSingleDocReply(bson.D{{Name: "ok", Value: 1}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serverIn bytes.Buffer
+	client := fakeReadWriter{
+		Reader: bytes.NewReader(nil),
+		Writer: testWriter{
+			write: func(b []byte) (int, error) { return 0, io.ErrClosedPipe },
+		},
+	}
+	server := fakeReadWriter{Reader: bytes.NewReader(reply), Writer: &serverIn}
+	var lastError LastError
+	if err := r.Rewrite(h, [][]byte{h.ToWire(), body}, client, server, &lastError); err != io.ErrClosedPipe {
+		t.Fatalf("was expecting %s got %v", io.ErrClosedPipe, err)
+	}
+
+	// The complete response is cached, and is only dropped along with the
+	// connection.
+	if !lastError.Exists() {
+		t.Fatal("response was not cached")
+	}
+	if !bytes.Equal(append(lastError.header.ToWire(), lastError.rest.Bytes()...), reply) {
+		t.Fatal("cached response does not match")
+	}
+	lastError.Reset()
+	if lastError.Exists() || lastError.rest.Len() != 0 {
+		t.Fatal("reset did not clear the cached response")
+	}
+}
+
+func TestRSChangedMidRewriteIsCounted(t *testing.T) {
+	t.Parallel()
+	state := &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Name: "rs",
+			Members: []statusMember{
+				{Name: "a", State: ReplicaStatePrimary},
+				{Name: "b", State: ReplicaStateSecondary},
+			},
+		},
+		lastIM: &isMasterResponse{Hosts: []string{"a", "b"}, Primary: "a"},
+	}
+	rs := &ReplicaSet{lastState: state}
+	rs.setTopology(state)
+
+	bumped := make(map[string]float64)
+	hooks := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) { bumped[key] += val },
+	}
+	proxyMapper := fakeProxyMapper{m: map[string]string{"a": "1", "b": "2"}}
+	im := &IsMasterResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		Stats:               hooks,
+		ProxyMapper:         proxyMapper,
+		ReplicaStateCompare: rs,
+		ReplyRW:             &ReplyRW{Log: &tLogger{TB: t}},
+		VersionOverride:     &BuildInfoVersionOverride{},
+	}
+	status := &ReplSetGetStatusResponseRewriter{
+		Log:                 &tLogger{TB: t},
+		Stats:               hooks,
+		ProxyMapper:         proxyMapper,
+		ReplicaStateCompare: rs,
+		ReplyRW:             &ReplyRW{Log: &tLogger{TB: t}},
+	}
+
+	// The primary stepped down since the proxies were started.
+	var client bytes.Buffer
+	err := im.Rewrite(&client, fakeSingleDocReply(bson.M{
+		"hosts":   []interface{}{"a", "b"},
+		"primary": "b",
+	}))
+	ensure.DeepEqual(t, err, ErrRSChanged)
+	err = status.Rewrite(&client, fakeSingleDocReply(bson.M{
+		"set": "rs",
+		"members": []interface{}{
+			bson.M{"name": "a", "stateStr": "SECONDARY"},
+			bson.M{"name": "b", "stateStr": "PRIMARY"},
+		},
+	}))
+	ensure.DeepEqual(t, err, ErrRSChanged)
+	ensure.DeepEqual(t, client.Len(), 0)
+	ensure.DeepEqual(t, bumped, map[string]float64{
+		"rs.changed.ismaster":         1,
+		"rs.changed.replsetgetstatus": 1,
+	})
+}
@@ -0,0 +1,79 @@
+package dvara
+
+import (
+	"strings"
+
+	"github.com/facebookgo/stats"
+)
+
+// replicaStateUnknown is the role of a member whose state is not known, for
+// example when proxying a single server.
+const replicaStateUnknown = ReplicaState("UNKNOWN")
+
+// memberRole returns the current role of the member.
+func (r *ReplicaSet) memberRole(h string) ReplicaState {
+	if s := r.memberState(h); s != "" {
+		return s
+	}
+	if r.lastState != nil && r.lastState.lastIM != nil && r.lastState.lastIM.Primary == h {
+		return ReplicaStatePrimary
+	}
+	return replicaStateUnknown
+}
+
+// openClientRole records a new client connection of the proxy under the
+// current role of its member, and returns the role to close it with.
+func (p *Proxy) openClientRole() ReplicaState {
+	role := p.ReplicaSet.memberRole(p.MongoAddr)
+	p.ReplicaSet.rolesMutex.Lock()
+	if p.ReplicaSet.clientRoles == nil {
+		p.ReplicaSet.clientRoles = make(map[ReplicaState]int64)
+	}
+	p.ReplicaSet.clientRoles[role]++
+	count := p.ReplicaSet.clientRoles[role]
+	p.ReplicaSet.rolesMutex.Unlock()
+
+	key := strings.ToLower(string(role))
+	stats.BumpSum(p.stats, "client.connected."+key, 1)
+	stats.BumpAvg(p.stats, "client.role.connections."+key, float64(count))
+	return role
+}
+
+// closeClientRole records a client connection opened under the given role was
+// closed.
+func (p *Proxy) closeClientRole(role ReplicaState) {
+	p.ReplicaSet.rolesMutex.Lock()
+	p.ReplicaSet.clientRoles[role]--
+	count := p.ReplicaSet.clientRoles[role]
+	if count == 0 {
+		delete(p.ReplicaSet.clientRoles, role)
+	}
+	p.ReplicaSet.rolesMutex.Unlock()
+
+	stats.BumpAvg(p.stats, "client.role.connections."+strings.ToLower(string(role)), float64(count))
+}
+
+// ClientsByRole returns the number of client connections by the role of the
+// member they are connected to. Connections keep the role their member had
+// when they were opened, unless RederiveClientRoles is set in which case the
+// current role of each member is used.
+func (r *ReplicaSet) ClientsByRole() map[ReplicaState]int64 {
+	counts := make(map[ReplicaState]int64)
+	if r.RederiveClientRoles {
+		r.mappingMutex.RLock()
+		defer r.mappingMutex.RUnlock()
+		for _, p := range r.proxies {
+			if n := p.clientCount(); n != 0 {
+				counts[r.memberRole(p.MongoAddr)] += n
+			}
+		}
+		return counts
+	}
+
+	r.rolesMutex.Lock()
+	defer r.rolesMutex.Unlock()
+	for role, n := range r.clientRoles {
+		counts[role] = n
+	}
+	return counts
+}
@@ -0,0 +1,83 @@
+package dvara
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+// roleState returns a replica set state where a is the primary and b a
+// secondary.
+func roleState(a, b string) *ReplicaSetState {
+	return &ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Members: []statusMember{
+				{Name: a, State: ReplicaStatePrimary},
+				{Name: b, State: ReplicaStateSecondary},
+			},
+		},
+		lastIM: &isMasterResponse{Primary: a},
+	}
+}
+
+func TestClientsByRoleFailover(t *testing.T) {
+	t.Parallel()
+	for _, rederive := range []bool{false, true} {
+		rs := &ReplicaSet{RederiveClientRoles: rederive, lastState: roleState("a:1", "b:1")}
+		a := &Proxy{ReplicaSet: rs, ProxyAddr: "p:1", MongoAddr: "a:1"}
+		b := &Proxy{ReplicaSet: rs, ProxyAddr: "p:2", MongoAddr: "b:1"}
+		rs.proxies = map[string]*Proxy{a.ProxyAddr: a, b.ProxyAddr: b}
+		open := func(p *Proxy) ReplicaState {
+			atomic.AddInt64(&p.clients, 1)
+			return p.openClientRole()
+		}
+
+		aRole := open(a)
+		bRole := open(b)
+		open(b)
+		ensure.DeepEqual(t, aRole, ReplicaStatePrimary)
+		ensure.DeepEqual(t, bRole, ReplicaStateSecondary)
+		ensure.DeepEqual(t, rs.ClientsByRole(), map[ReplicaState]int64{
+			ReplicaStatePrimary:   1,
+			ReplicaStateSecondary: 2,
+		})
+
+		// b takes over as the primary while the clients are connected.
+		rs.lastState = roleState("b:1", "a:1")
+		if rederive {
+			ensure.DeepEqual(t, rs.ClientsByRole(), map[ReplicaState]int64{
+				ReplicaStatePrimary:   2,
+				ReplicaStateSecondary: 1,
+			})
+		} else {
+			ensure.DeepEqual(t, rs.ClientsByRole(), map[ReplicaState]int64{
+				ReplicaStatePrimary:   1,
+				ReplicaStateSecondary: 2,
+			})
+		}
+
+		// New connections get the new role either way.
+		ensure.DeepEqual(t, open(b), ReplicaStatePrimary)
+		atomic.AddInt64(&a.clients, -1)
+		a.closeClientRole(aRole)
+		if rederive {
+			ensure.DeepEqual(t, rs.ClientsByRole(), map[ReplicaState]int64{
+				ReplicaStatePrimary: 3,
+			})
+		} else {
+			ensure.DeepEqual(t, rs.ClientsByRole(), map[ReplicaState]int64{
+				ReplicaStatePrimary:   1,
+				ReplicaStateSecondary: 2,
+			})
+		}
+	}
+}
+
+func TestMemberRoleUnknown(t *testing.T) {
+	t.Parallel()
+	rs := &ReplicaSet{lastState: &ReplicaSetState{singleAddr: "a:1"}}
+	ensure.DeepEqual(t, rs.memberRole("a:1"), replicaStateUnknown)
+	rs.lastState.lastIM = &isMasterResponse{Primary: "a:1"}
+	ensure.DeepEqual(t, rs.memberRole("a:1"), ReplicaStatePrimary)
+}
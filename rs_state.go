@@ -209,26 +209,16 @@ func sameRSMembers(a *replSetGetStatusResponse, b *replSetGetStatusResponse) boo
 	if a == nil || b == nil {
 		return false
 	}
-	l := len(a.Members)
-	if l != len(b.Members) {
-		return false
-	}
-	aMembers := make([]string, 0, l)
-	bMembers := make([]string, 0, l)
-	for i := 0; i < l; i++ {
-		aM := a.Members[i]
-		aMembers = append(aMembers, fmt.Sprintf("%s:%s", aM.Name, aM.State))
-		bM := b.Members[i]
-		bMembers = append(bMembers, fmt.Sprintf("%s:%s", bM.Name, bM.State))
-	}
-	sort.Strings(aMembers)
-	sort.Strings(bMembers)
-	for i := 0; i < l; i++ {
-		if aMembers[i] != bMembers[i] {
-			return false
-		}
+	return sameSet(memberStates(a), memberStates(b))
+}
+
+// memberStates returns the name and state of each member.
+func memberStates(r *replSetGetStatusResponse) []string {
+	members := make([]string, 0, len(r.Members))
+	for _, m := range r.Members {
+		members = append(members, fmt.Sprintf("%s:%s", m.Name, m.State))
 	}
-	return true
+	return members
 }
 
 var emptyIsMasterResponse = isMasterResponse{}
@@ -243,20 +233,22 @@ func sameIMMembers(a *isMasterResponse, b *isMasterResponse) bool {
 	if b == nil {
 		b = &emptyIsMasterResponse
 	}
-	l := len(a.Hosts)
-	if l != len(b.Hosts) {
+	return a.Primary == b.Primary &&
+		sameSet(a.Hosts, b.Hosts) &&
+		sameSet(a.Passives, b.Passives) &&
+		sameSet(a.Arbiters, b.Arbiters)
+}
+
+// sameHosts checks if the two lists have the same hosts, regardless of their
+// order.
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
 		return false
 	}
-	aHosts := make([]string, 0, l+1)
-	bHosts := make([]string, 0, l+1)
-	for i := 0; i < l; i++ {
-		aHosts = append(aHosts, a.Hosts[i])
-		bHosts = append(bHosts, b.Hosts[i])
-	}
+	aHosts := append([]string(nil), a...)
+	bHosts := append([]string(nil), b...)
 	sort.Strings(aHosts)
 	sort.Strings(bHosts)
-	aHosts = append(aHosts, a.Primary)
-	bHosts = append(bHosts, b.Primary)
 	for i := range aHosts {
 		if aHosts[i] != bHosts[i] {
 			return false
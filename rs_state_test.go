@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/facebookgo/mgotest"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestSameRSMembers(t *testing.T) {
@@ -247,6 +248,160 @@ func TestNotSameIMMembers(t *testing.T) {
 	}
 }
 
+// TestReplicaStateTransitions replays a sequence of topologies, checking each
+// one against the last state that was considered a change.
+func TestReplicaStateTransitions(t *testing.T) {
+	t.Parallel()
+	member := func(name string, state ReplicaState) statusMember {
+		return statusMember{Name: name, State: state}
+	}
+	steps := []struct {
+		Name    string
+		RS      *replSetGetStatusResponse
+		IM      *isMasterResponse
+		Changed bool
+	}{
+		{
+			Name: "initial",
+			RS: &replSetGetStatusResponse{Members: []statusMember{
+				member("a", ReplicaStatePrimary),
+				member("b", ReplicaStateSecondary),
+			}},
+			IM: &isMasterResponse{
+				Hosts:   []string{"a", "b"},
+				Primary: "a",
+				Me:      "a",
+			},
+			Changed: true,
+		},
+		{
+			Name: "reordered members",
+			RS: &replSetGetStatusResponse{Members: []statusMember{
+				member("b", ReplicaStateSecondary),
+				member("a", ReplicaStatePrimary),
+			}},
+			IM: &isMasterResponse{
+				Hosts:   []string{"b", "a"},
+				Primary: "a",
+				Me:      "b",
+			},
+		},
+		{
+			Name: "tags changed",
+			RS: &replSetGetStatusResponse{Members: []statusMember{
+				member("a", ReplicaStatePrimary),
+				member("b", ReplicaStateSecondary),
+			}},
+			IM: &isMasterResponse{
+				Hosts:   []string{"a", "b"},
+				Primary: "a",
+				Extra:   bson.M{"tags": bson.M{"dc": "east"}},
+			},
+		},
+		{
+			Name: "member added",
+			RS: &replSetGetStatusResponse{Members: []statusMember{
+				member("a", ReplicaStatePrimary),
+				member("b", ReplicaStateSecondary),
+				member("c", ReplicaStateSecondary),
+			}},
+			IM: &isMasterResponse{
+				Hosts:   []string{"a", "b", "c"},
+				Primary: "a",
+			},
+			Changed: true,
+		},
+		{
+			Name: "role flip",
+			RS: &replSetGetStatusResponse{Members: []statusMember{
+				member("a", ReplicaStateSecondary),
+				member("b", ReplicaStatePrimary),
+				member("c", ReplicaStateSecondary),
+			}},
+			IM: &isMasterResponse{
+				Hosts:   []string{"a", "b", "c"},
+				Primary: "b",
+			},
+			Changed: true,
+		},
+		{
+			Name: "arbiter added",
+			RS: &replSetGetStatusResponse{Members: []statusMember{
+				member("a", ReplicaStateSecondary),
+				member("b", ReplicaStatePrimary),
+				member("c", ReplicaStateSecondary),
+				member("d", ReplicaStateArbiter),
+				member("e", ReplicaStateArbiter),
+			}},
+			IM: &isMasterResponse{
+				Hosts:    []string{"a", "b", "c"},
+				Arbiters: []string{"d", "e"},
+				Primary:  "b",
+			},
+			Changed: true,
+		},
+		{
+			Name: "arbiters reordered",
+			RS: &replSetGetStatusResponse{Members: []statusMember{
+				member("e", ReplicaStateArbiter),
+				member("d", ReplicaStateArbiter),
+				member("c", ReplicaStateSecondary),
+				member("b", ReplicaStatePrimary),
+				member("a", ReplicaStateSecondary),
+			}},
+			IM: &isMasterResponse{
+				Hosts:    []string{"c", "b", "a"},
+				Arbiters: []string{"e", "d"},
+				Primary:  "b",
+			},
+		},
+		{
+			Name: "member removed",
+			RS: &replSetGetStatusResponse{Members: []statusMember{
+				member("b", ReplicaStatePrimary),
+				member("c", ReplicaStateSecondary),
+				member("d", ReplicaStateArbiter),
+				member("e", ReplicaStateArbiter),
+			}},
+			IM: &isMasterResponse{
+				Hosts:    []string{"b", "c"},
+				Arbiters: []string{"d", "e"},
+				Primary:  "b",
+			},
+			Changed: true,
+		},
+		{
+			Name: "primary lost",
+			RS: &replSetGetStatusResponse{Members: []statusMember{
+				member("b", ReplicaStateSecondary),
+				member("c", ReplicaStateSecondary),
+				member("d", ReplicaStateArbiter),
+				member("e", ReplicaStateArbiter),
+			}},
+			IM: &isMasterResponse{
+				Hosts:    []string{"b", "c"},
+				Arbiters: []string{"d", "e"},
+			},
+			Changed: true,
+		},
+	}
+
+	last := &ReplicaSetState{}
+	for _, s := range steps {
+		next := &ReplicaSetState{lastRS: s.RS, lastIM: s.IM}
+		changed := !last.Equal(next)
+		if changed != s.Changed {
+			t.Fatalf("step %q: expected changed %v but got %v", s.Name, s.Changed, changed)
+		}
+		if next.Equal(last) == changed {
+			t.Fatalf("step %q: comparison is not symmetric", s.Name)
+		}
+		if changed {
+			last = next
+		}
+	}
+}
+
 func TestSingleNodeNewReplicaSetState(t *testing.T) {
 	t.Parallel()
 	mgo := mgotest.NewStartedServer(t)
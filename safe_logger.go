@@ -0,0 +1,119 @@
+package dvara
+
+import (
+	"github.com/facebookgo/stats"
+)
+
+// maxPendingLogs is the most Info and Debug calls a safeLogger lets into the
+// wrapped Logger at once. Further ones are dropped until some return.
+const maxPendingLogs = 64
+
+// safeLogger wraps a Logger so it cannot take down the proxy, since logging
+// happens while handling client connections. Panics from the wrapped Logger
+// are recovered. Info and Debug messages are dropped rather than waiting when
+// the wrapped Logger is blocked on too many of them already. Errors and
+// warnings are always logged.
+type safeLogger struct {
+	logger  Logger
+	stats   stats.Client
+	pending chan struct{}
+}
+
+// NewSafeLogger wraps the Logger so a misbehaving one cannot stall or crash
+// the proxies, with panics and dropped messages counted in the stats. Provide
+// it to the inject graph rather than the Logger itself, so the rewriters and
+// other components log through it too. A Logger already wrapped is returned
+// as is.
+func NewSafeLogger(l Logger, s stats.Client) Logger {
+	if _, ok := l.(*safeLogger); ok {
+		return l
+	}
+	return newSafeLogger(l, s)
+}
+
+func newSafeLogger(l Logger, s stats.Client) *safeLogger {
+	return &safeLogger{
+		logger:  l,
+		stats:   s,
+		pending: make(chan struct{}, maxPendingLogs),
+	}
+}
+
+// recover recovers a panic from the wrapped Logger. It must be deferred.
+func (l *safeLogger) recover() {
+	if recover() != nil {
+		stats.BumpSum(l.stats, "mongoproxy.log.panic", 1)
+	}
+}
+
+// acquire checks if an Info or Debug message can be logged, in which case
+// release must be called once it has been.
+func (l *safeLogger) acquire() bool {
+	select {
+	case l.pending <- struct{}{}:
+		return true
+	default:
+		stats.BumpSum(l.stats, "mongoproxy.log.dropped", 1)
+		return false
+	}
+}
+
+func (l *safeLogger) release() {
+	<-l.pending
+}
+
+func (l *safeLogger) Error(args ...interface{}) {
+	defer l.recover()
+	l.logger.Error(args...)
+}
+
+func (l *safeLogger) Errorf(format string, args ...interface{}) {
+	defer l.recover()
+	l.logger.Errorf(format, args...)
+}
+
+func (l *safeLogger) Warn(args ...interface{}) {
+	defer l.recover()
+	l.logger.Warn(args...)
+}
+
+func (l *safeLogger) Warnf(format string, args ...interface{}) {
+	defer l.recover()
+	l.logger.Warnf(format, args...)
+}
+
+func (l *safeLogger) Info(args ...interface{}) {
+	if !l.acquire() {
+		return
+	}
+	defer l.release()
+	defer l.recover()
+	l.logger.Info(args...)
+}
+
+func (l *safeLogger) Infof(format string, args ...interface{}) {
+	if !l.acquire() {
+		return
+	}
+	defer l.release()
+	defer l.recover()
+	l.logger.Infof(format, args...)
+}
+
+func (l *safeLogger) Debug(args ...interface{}) {
+	if !l.acquire() {
+		return
+	}
+	defer l.release()
+	defer l.recover()
+	l.logger.Debug(args...)
+}
+
+func (l *safeLogger) Debugf(format string, args ...interface{}) {
+	if !l.acquire() {
+		return
+	}
+	defer l.release()
+	defer l.recover()
+	l.logger.Debugf(format, args...)
+}
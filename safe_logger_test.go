@@ -0,0 +1,163 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/inject"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// panickingLogger panics on every call.
+type panickingLogger struct{}
+
+func (panickingLogger) Error(args ...interface{})                 { panic("error") }
+func (panickingLogger) Errorf(format string, args ...interface{}) { panic("errorf") }
+func (panickingLogger) Warn(args ...interface{})                  { panic("warn") }
+func (panickingLogger) Warnf(format string, args ...interface{})  { panic("warnf") }
+func (panickingLogger) Info(args ...interface{})                  { panic("info") }
+func (panickingLogger) Infof(format string, args ...interface{})  { panic("infof") }
+func (panickingLogger) Debug(args ...interface{})                 { panic("debug") }
+func (panickingLogger) Debugf(format string, args ...interface{}) { panic("debugf") }
+
+// blockingLogger blocks Debugf calls until unblocked.
+type blockingLogger struct {
+	tLogger
+	unblock chan struct{}
+}
+
+func (l *blockingLogger) Debugf(format string, args ...interface{}) {
+	<-l.unblock
+}
+
+func TestSafeLoggerRecovers(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	sums := make(map[string]float64)
+	l := newSafeLogger(panickingLogger{}, &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			sums[key] += val
+		},
+	})
+	l.Error("a")
+	l.Errorf("%s", "a")
+	l.Warn("a")
+	l.Warnf("%s", "a")
+	l.Info("a")
+	l.Infof("%s", "a")
+	l.Debug("a")
+	l.Debugf("%s", "a")
+	ensure.DeepEqual(t, sums["mongoproxy.log.panic"], float64(8))
+	ensure.DeepEqual(t, len(l.pending), 0)
+}
+
+func TestSafeLoggerDropsWhenBlocked(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	var dropped float64
+	blocking := &blockingLogger{tLogger: tLogger{TB: t}, unblock: make(chan struct{})}
+	l := newSafeLogger(blocking, &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "mongoproxy.log.dropped" {
+				mutex.Lock()
+				defer mutex.Unlock()
+				dropped += val
+			}
+		},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(maxPendingLogs)
+	for i := 0; i < maxPendingLogs; i++ {
+		go func() {
+			defer wg.Done()
+			l.Debugf("blocked")
+		}()
+	}
+	for len(l.pending) != maxPendingLogs {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once the Logger is blocked on enough messages, more are dropped rather
+	// than waiting.
+	l.Debugf("dropped")
+	l.Infof("dropped")
+	mutex.Lock()
+	ensure.DeepEqual(t, dropped, float64(2))
+	mutex.Unlock()
+
+	close(blocking.unblock)
+	wg.Wait()
+	ensure.DeepEqual(t, len(l.pending), 0)
+}
+
+func TestReplicaSetStartWrapsLogger(t *testing.T) {
+	t.Parallel()
+	r := ReplicaSet{Log: panickingLogger{}}
+	ensure.DeepEqual(t, r.Start(), errNoAddrsGiven)
+	_, ok := r.Log.(*safeLogger)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, r.Start(), errNoAddrsGiven)
+	ensure.True(t, r.Log.(*safeLogger).logger == panickingLogger{})
+}
+
+func TestInjectedSafeLogger(t *testing.T) {
+	t.Parallel()
+	var panics float64
+	statsClient := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "mongoproxy.log.panic" {
+				panics += val
+			}
+		},
+	}
+	var r GetLastErrorRewriter
+	var graph inject.Graph
+	ensure.Nil(t, graph.Provide(
+		&inject.Object{Value: NewSafeLogger(panickingLogger{}, statsClient)},
+		&inject.Object{Value: statsClient},
+		&inject.Object{Value: &r},
+	))
+	ensure.Nil(t, graph.Populate())
+
+	// The rewriter logs a getLastError without a preceding write.
+	h, body := fakeQuery("admin.$cmd", bson.D{{Name: "getLastError", Value: 1}})
+	client := fakeReadWriter{Reader: bytes.NewReader(nil), Writer: ioutil.Discard}
+	server := fakeReadWriter{
+		Reader: fakeSingleDocReply(bson.D{{Name: "ok", Value: 1}}),
+		Writer: ioutil.Discard,
+	}
+	var lastError LastError
+	ensure.Nil(t, r.Rewrite(h, [][]byte{h.ToWire(), body}, client, server, &lastError))
+	ensure.True(t, panics > 0)
+}
+
+func TestProxyWithPanickingLogger(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{Log: newSafeLogger(panickingLogger{}, nil)})
+	defer p.Stop()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		h, body := fakeQuery("test.foo", bson.D{})
+		_, err = c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+		ensure.Nil(t, err)
+		ensure.Nil(t, c.Close())
+	}
+}
@@ -0,0 +1,94 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// nonceCache remembers when the client nonces of SCRAM conversations were
+// seen, to detect replayed saslStart commands.
+type nonceCache struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+// replayed records the nonce and reports whether it was already seen within
+// the window. The nonces older than the window are dropped.
+func (c *nonceCache) replayed(nonce string, now time.Time, window time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	for n, at := range c.seen {
+		if now.Sub(at) > window {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return true
+	}
+	c.seen[nonce] = now
+	return false
+}
+
+// scramClientNonce returns the client nonce from the client-first message of a
+// SCRAM saslStart command, such as "n,,n=user,r=nonce".
+func scramClientNonce(cmd bson.D) (string, bool) {
+	var mechanism string
+	var payload []byte
+	for _, e := range cmd {
+		switch e.Name {
+		case "mechanism":
+			mechanism, _ = e.Value.(string)
+		case "payload":
+			switch v := e.Value.(type) {
+			case []byte:
+				payload = v
+			case bson.Binary:
+				payload = v.Data
+			case string:
+				payload = []byte(v)
+			}
+		}
+	}
+	if !strings.HasPrefix(strings.ToUpper(mechanism), "SCRAM-") {
+		return "", false
+	}
+	for _, attr := range strings.Split(string(payload), ",") {
+		if strings.HasPrefix(attr, "r=") && len(attr) > 2 {
+			return attr[2:], true
+		}
+	}
+	return "", false
+}
+
+// replayedNonce checks if a saslStart command reuses a SCRAM client nonce seen
+// within SASLReplayWindow. The command is read whole, and the returned
+// net.Conn replays what was read.
+func (p *Proxy) replayedNonce(h *messageHeader, c net.Conn, command string) (net.Conn, bool, error) {
+	if p.ReplicaSet.SASLReplayWindow == 0 || !strings.EqualFold(command, "saslStart") {
+		return c, false, nil
+	}
+
+	body := make([]byte, h.MessageLength-headerLen)
+	c.SetReadDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, false, err
+	}
+	replay := newBufferedConn(c, body)
+
+	nonce, ok := scramClientNonce(commandDocument(h, body))
+	if !ok || !p.ReplicaSet.nonces.replayed(nonce, time.Now(), p.ReplicaSet.SASLReplayWindow) {
+		return replay, false, nil
+	}
+	p.Log.Warnf("closing client %s: replayed authentication nonce", c.RemoteAddr())
+	stats.BumpSum(p.stats, "client.rejected.sasl.replay", 1)
+	return replay, true, nil
+}
@@ -0,0 +1,100 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func fakeSASLStart(nonce string) (*messageHeader, []byte) {
+	return fakeQuery("admin.$cmd", bson.D{
+		{Name: "saslStart", Value: 1},
+		{Name: "mechanism", Value: "SCRAM-SHA-256"},
+		{Name: "payload", Value: []byte("n,,n=user,r=" + nonce)},
+	})
+}
+
+func TestScramClientNonce(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name  string
+		Cmd   bson.D
+		Nonce string
+		OK    bool
+	}{
+		{
+			Name:  "bytes",
+			Cmd:   bson.D{{Name: "saslStart", Value: 1}, {Name: "mechanism", Value: "SCRAM-SHA-1"}, {Name: "payload", Value: []byte("n,,n=user,r=abc")}},
+			Nonce: "abc",
+			OK:    true,
+		},
+		{
+			Name:  "binary",
+			Cmd:   bson.D{{Name: "saslStart", Value: 1}, {Name: "mechanism", Value: "SCRAM-SHA-256"}, {Name: "payload", Value: bson.Binary{Kind: 0x80, Data: []byte("n,a=admin,n=user,r=def")}}},
+			Nonce: "def",
+			OK:    true,
+		},
+		{
+			Name: "not scram",
+			Cmd:  bson.D{{Name: "saslStart", Value: 1}, {Name: "mechanism", Value: "PLAIN"}, {Name: "payload", Value: []byte("\x00user\x00r=pass")}},
+		},
+		{
+			Name: "no nonce",
+			Cmd:  bson.D{{Name: "saslStart", Value: 1}, {Name: "mechanism", Value: "SCRAM-SHA-1"}, {Name: "payload", Value: []byte("n,,n=user")}},
+		},
+	}
+	for _, c := range cases {
+		nonce, ok := scramClientNonce(c.Cmd)
+		ensure.DeepEqual(t, nonce, c.Nonce, c.Name)
+		ensure.DeepEqual(t, ok, c.OK, c.Name)
+	}
+}
+
+func TestNonceCacheWindow(t *testing.T) {
+	t.Parallel()
+	var c nonceCache
+	now := time.Now()
+	ensure.False(t, c.replayed("a", now, time.Minute))
+	ensure.True(t, c.replayed("a", now.Add(time.Second), time.Minute))
+	ensure.False(t, c.replayed("b", now.Add(time.Second), time.Minute))
+	ensure.False(t, c.replayed("a", now.Add(2*time.Minute), time.Minute))
+	ensure.DeepEqual(t, len(c.seen), 1)
+}
+
+func TestSASLStartReplayRejected(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{SASLReplayWindow: time.Minute})
+	defer p.Stop()
+
+	first, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer first.Close()
+	h, body := fakeSASLStart("abc")
+	ensure.Nil(t, proxyRoundTrip(first, h, body))
+	h, body = fakeSASLStart("def")
+	ensure.Nil(t, proxyRoundTrip(first, h, body))
+
+	// Replaying the first conversation on another connection is rejected and
+	// the connection closed.
+	second, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer second.Close()
+	h, body = fakeSASLStart("abc")
+	ensure.Nil(t, h.WriteTo(second))
+	_, err = second.Write(body)
+	ensure.Nil(t, err)
+	var doc bson.M
+	r := &ReplyRW{Log: &tLogger{TB: t}}
+	_, _, _, err = r.ReadOne(second, &doc)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, doc["errmsg"], DefaultCloseReasonMessages[CloseReasonReplayedNonce])
+	ensure.DeepEqual(t, doc["code"], authFailedCode)
+	_, err = second.Read(make([]byte, 1))
+	ensure.DeepEqual(t, err, io.EOF)
+}
@@ -0,0 +1,177 @@
+package dvara
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// unauthorizedCode is the Unauthorized error code.
+const unauthorizedCode = 13
+
+// DefaultAllowedAdminCommands are the commands against the admin database
+// which are allowed when clients are restricted to AllowedDatabases. They
+// are needed by drivers, including to authenticate against the admin
+// database, and do not target a user database.
+var DefaultAllowedAdminCommands = []string{
+	"authenticate",
+	"buildInfo",
+	"endSessions",
+	"getLastError",
+	"getnonce",
+	"hello",
+	"isMaster",
+	"logout",
+	"ping",
+	"saslContinue",
+	"saslStart",
+	"whatsmyuri",
+}
+
+// databaseOf returns the database of a namespace.
+func databaseOf(ns string) string {
+	if i := strings.Index(ns, "."); i != -1 {
+		return ns[:i]
+	}
+	return ns
+}
+
+// isScoped checks if the operation targets a database and needs to be
+// checked against the AllowedDatabases.
+func isScoped(op *TracedOperation) bool {
+	switch op.OpCode {
+	case OpQuery, OpMsg, OpGetMore:
+		return true
+	}
+	return op.OpCode.IsMutation()
+}
+
+// databaseAllowed checks if the operation is within the AllowedDatabases, or
+// those of the ListenerOverride if it has any.
+func (p *Proxy) databaseAllowed(op *TracedOperation, override *ListenerOverride) bool {
+	databases := p.ReplicaSet.AllowedDatabases
+	if override != nil && override.AllowedDatabases != nil {
+		databases = override.AllowedDatabases
+	}
+	if len(databases) == 0 || !isScoped(op) {
+		return true
+	}
+	db := databaseOf(op.Namespace)
+	for _, allowed := range databases {
+		if db == allowed {
+			return true
+		}
+	}
+	if db == "admin" {
+		commands := p.ReplicaSet.AllowedAdminCommands
+		if commands == nil {
+			commands = DefaultAllowedAdminCommands
+		}
+		for _, c := range commands {
+			if strings.EqualFold(op.Command, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// namespaceAllowed checks if the operation is on a collection the client
+// connection already used, or if it may use another one within the
+// MaxNamespaces. Commands not on a collection are always allowed.
+func (p *Proxy) namespaceAllowed(op *TracedOperation, conn *clientConn) bool {
+	max := p.ReplicaSet.MaxNamespaces
+	if max == 0 || !isScoped(op) || op.Namespace == "" || strings.HasSuffix(op.Namespace, ".$cmd") {
+		return true
+	}
+	if _, ok := conn.namespaces[op.Namespace]; ok {
+		return true
+	}
+	if uint(len(conn.namespaces)) >= max {
+		return false
+	}
+	if conn.namespaces == nil {
+		conn.namespaces = make(map[string]struct{})
+	}
+	conn.namespaces[op.Namespace] = struct{}{}
+	return true
+}
+
+// rejectNamespace rejects an operation on a collection over the
+// MaxNamespaces of the client connection.
+func (p *Proxy) rejectNamespace(h *messageHeader, client io.ReadWriter, lastError *LastError) error {
+	max := p.ReplicaSet.MaxNamespaces
+	p.Log.Debugf("rejecting %s over the limit of %d namespaces", h, max)
+	stats.BumpSum(p.stats, "client.rejected.namespaces", 1)
+	return p.rejectUnauthorized(h, client, fmt.Sprintf("dvara: connection is limited to %d namespaces", max), lastError)
+}
+
+// rejectDatabase rejects a request for a database the client is not allowed
+// to use.
+func (p *Proxy) rejectDatabase(
+	h *messageHeader,
+	client io.ReadWriter,
+	op *TracedOperation,
+	lastError *LastError,
+) error {
+
+	db := databaseOf(op.Namespace)
+	p.Log.Debugf("rejecting %s on database %q outside of allowed databases", h, db)
+	stats.BumpSum(p.stats, "client.rejected.database", 1)
+	return p.rejectUnauthorized(h, client, fmt.Sprintf("dvara: not authorized on %s", db), lastError)
+}
+
+// rejectUnauthorized consumes a request the client is not allowed to make and
+// replies with an Unauthorized error with the given message. Since mutation
+// ops have no response the error is cached to be returned by getLastError.
+func (p *Proxy) rejectUnauthorized(
+	h *messageHeader,
+	client io.ReadWriter,
+	msg string,
+	lastError *LastError,
+) error {
+
+	if _, err := io.CopyN(ioutil.Discard, client, int64(h.MessageLength-headerLen)); err != nil {
+		p.Log.Error(err)
+		return err
+	}
+
+	if h.OpCode.IsMutation() {
+		reply, err := newReply(h, 0, bson.D{
+			{Name: "ok", Value: 1},
+			{Name: "err", Value: msg},
+			{Name: "code", Value: unauthorizedCode},
+			{Name: "n", Value: 0},
+		})
+		if err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		lastError.Reset()
+		if lastError.header, err = readHeader(bytes.NewReader(reply)); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		lastError.rest.Write(reply[headerLen:])
+		return nil
+	}
+
+	if !h.OpCode.HasResponse() {
+		return nil
+	}
+	reply, err := newErrorReply(h, unauthorizedCode, msg)
+	if err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	if _, err := client.Write(reply); err != nil {
+		p.Log.Error(err)
+		return err
+	}
+	return nil
+}
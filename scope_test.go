@@ -0,0 +1,230 @@
+package dvara
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDatabaseOf(t *testing.T) {
+	t.Parallel()
+	ensure.DeepEqual(t, databaseOf("db.foo.bar"), "db")
+	ensure.DeepEqual(t, databaseOf("db.$cmd"), "db")
+	ensure.DeepEqual(t, databaseOf("db"), "db")
+	ensure.DeepEqual(t, databaseOf(""), "")
+}
+
+func TestAllowedDatabases(t *testing.T) {
+	t.Parallel()
+	var seenMutex sync.Mutex
+	var seen []string
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		op := TracedOperation{OpCode: h.OpCode}
+		op.describe(body, nil)
+		seenMutex.Lock()
+		seen = append(seen, databaseOf(op.Namespace))
+		seenMutex.Unlock()
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{AllowedDatabases: []string{"app"}})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	readReply := func() bson.M {
+		h, err := readHeader(c)
+		ensure.Nil(t, err)
+		body := make([]byte, h.MessageLength-headerLen)
+		_, err = io.ReadFull(c, body)
+		ensure.Nil(t, err)
+		var doc []byte
+		if h.OpCode == OpMsg {
+			doc = body[5:]
+		} else {
+			doc = body[len(emptyPrefix):]
+		}
+		var v bson.M
+		ensure.Nil(t, bson.Unmarshal(doc, &v))
+		return v
+	}
+	send := func(h *messageHeader, body []byte) {
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+	}
+
+	cases := []struct {
+		Name       string
+		Collection string
+		Msg        bool
+		Command    bson.D
+		Allowed    bool
+		Database   string
+	}{
+		{
+			Name:       "query",
+			Collection: "app.foo",
+			Command:    bson.D{{Name: "a", Value: 1}},
+			Allowed:    true,
+		},
+		{
+			Name:       "query other database",
+			Collection: "other.foo",
+			Command:    bson.D{{Name: "a", Value: 1}},
+			Database:   "other",
+		},
+		{
+			Name:       "write command",
+			Collection: "app.$cmd",
+			Command:    bson.D{{Name: "insert", Value: "foo"}},
+			Allowed:    true,
+		},
+		{
+			Name:       "write command other database",
+			Collection: "other.$cmd",
+			Command:    bson.D{{Name: "insert", Value: "foo"}},
+			Database:   "other",
+		},
+		{
+			Name:       "allowed admin command",
+			Collection: "admin.$cmd",
+			Command:    bson.D{{Name: "ping", Value: 1}},
+			Allowed:    true,
+		},
+		{
+			Name:       "legacy authentication against admin",
+			Collection: "admin.$cmd",
+			Command:    bson.D{{Name: "authenticate", Value: 1}, {Name: "user", Value: "u"}},
+			Allowed:    true,
+		},
+		{
+			Name:    "authentication against admin",
+			Msg:     true,
+			Command: bson.D{{Name: "saslStart", Value: 1}, {Name: "mechanism", Value: "SCRAM-SHA-256"}, {Name: "$db", Value: "admin"}},
+			Allowed: true,
+		},
+		{
+			Name:    "authentication conversation against admin",
+			Msg:     true,
+			Command: bson.D{{Name: "saslContinue", Value: 1}, {Name: "conversationId", Value: 1}, {Name: "$db", Value: "admin"}},
+			Allowed: true,
+		},
+		{
+			Name:    "end sessions",
+			Msg:     true,
+			Command: bson.D{{Name: "endSessions", Value: []bson.D{}}, {Name: "$db", Value: "admin"}},
+			Allowed: true,
+		},
+		{
+			Name:    "logout",
+			Msg:     true,
+			Command: bson.D{{Name: "logout", Value: 1}, {Name: "$db", Value: "admin"}},
+			Allowed: true,
+		},
+		{
+			Name:       "admin command",
+			Collection: "admin.$cmd",
+			Command:    bson.D{{Name: "listDatabases", Value: 1}},
+			Database:   "admin",
+		},
+		{
+			Name:    "op msg",
+			Msg:     true,
+			Command: bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "app"}},
+			Allowed: true,
+		},
+		{
+			Name:     "op msg other database",
+			Msg:      true,
+			Command:  bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "other"}},
+			Database: "other",
+		},
+	}
+	for _, c := range cases {
+		if c.Msg {
+			send(fakeOpMsg(0, c.Command))
+		} else {
+			send(fakeQuery(c.Collection, c.Command))
+		}
+		reply := readReply()
+		if c.Allowed {
+			ensure.DeepEqual(t, reply["ok"], 1, c.Name)
+			continue
+		}
+		ensure.DeepEqual(t, reply["code"], unauthorizedCode, c.Name)
+		ensure.DeepEqual(t, reply["errmsg"], "dvara: not authorized on "+c.Database, c.Name)
+	}
+
+	// A legacy insert has no response, the error is returned by getLastError.
+	doc, err := bson.Marshal(bson.D{{Name: "a", Value: 1}})
+	ensure.Nil(t, err)
+	insert := append([]byte{0, 0, 0, 0}, "other.foo\000"...)
+	insert = append(insert, doc...)
+	send(&messageHeader{OpCode: OpInsert, MessageLength: int32(headerLen + len(insert))}, insert)
+	send(fakeQuery("admin.$cmd", bson.D{{Name: "getLastError", Value: 1}}))
+	reply := readReply()
+	ensure.DeepEqual(t, reply["err"], "dvara: not authorized on other")
+	ensure.DeepEqual(t, reply["code"], unauthorizedCode)
+
+	seenMutex.Lock()
+	defer seenMutex.Unlock()
+	for _, db := range seen {
+		if db == "other" {
+			t.Fatal("operation on other database reached the server")
+		}
+	}
+}
+
+func TestMaxNamespaces(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{MaxNamespaces: 2})
+	defer p.Stop()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		return c
+	}
+	roundTrip := func(c net.Conn, cmd bson.D) bson.M {
+		h, body := fakeOpMsg(0, cmd)
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		b := make([]byte, reply.MessageLength-headerLen)
+		_, err = io.ReadFull(c, b)
+		ensure.Nil(t, err)
+		var doc bson.M
+		ensure.Nil(t, bson.Unmarshal(b[5:], &doc))
+		return doc
+	}
+	find := func(db, collection string) bson.D {
+		return bson.D{{Name: "find", Value: collection}, {Name: "$db", Value: db}}
+	}
+
+	c := dial()
+	defer c.Close()
+	ensure.DeepEqual(t, roundTrip(c, find("app", "foo")), bson.M{"ok": 1})
+	ensure.DeepEqual(t, roundTrip(c, find("app", "bar")), bson.M{"ok": 1})
+	ensure.DeepEqual(t, roundTrip(c, find("app", "foo")), bson.M{"ok": 1})
+
+	// A third collection is over the limit, commands on no collection are not.
+	reply := roundTrip(c, find("other", "foo"))
+	ensure.DeepEqual(t, reply["code"], unauthorizedCode)
+	ensure.DeepEqual(t, reply["errmsg"], "dvara: connection is limited to 2 namespaces")
+	ensure.DeepEqual(t, roundTrip(c, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}}), bson.M{"ok": 1})
+	ensure.DeepEqual(t, roundTrip(c, find("app", "bar")), bson.M{"ok": 1})
+
+	// The limit is per connection.
+	other := dial()
+	defer other.Close()
+	ensure.DeepEqual(t, roundTrip(other, find("other", "foo")), bson.M{"ok": 1})
+}
@@ -0,0 +1,156 @@
+package dvara
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/facebookgo/rpool"
+	"github.com/facebookgo/stats"
+)
+
+// pooledServerConn is a server connection managed by the server pool. It
+// tracks whether the connection is sitting idle in the pool, so connections
+// which the pool closes after the ServerIdleTimeout can be told apart from the
+// ones discarded after an error.
+type pooledServerConn struct {
+	net.Conn
+	proxy      *Proxy
+	idle       int32 // accessed atomically
+	closed     int32 // accessed atomically
+	releasedAt int64 // unix nanoseconds, accessed atomically
+
+	// pool is the database pool the connection belongs to, nil for the main
+	// pool.
+	pool *rpool.Pool
+}
+
+const (
+	// staleCheckIdle is how long a server connection has to be idle in the
+	// pool to be checked before it is used. Servers only drop connections
+	// which have been idle for a while, and the check delays the request.
+	staleCheckIdle = time.Second
+
+	// staleCheckTimeout is how long the check waits for the server to have
+	// closed the connection. A closed connection is reported right away, this
+	// is how long a live one delays the request.
+	staleCheckTimeout = time.Millisecond
+)
+
+// acquired marks the connection as taken out of the pool. It returns how
+// long the connection was idle in the pool, zero if it is newly established.
+func (c *pooledServerConn) acquired() time.Duration {
+	if atomic.CompareAndSwapInt32(&c.idle, 1, 0) {
+		atomic.AddInt64(&c.proxy.idleServerConns, -1)
+		return time.Since(time.Unix(0, atomic.LoadInt64(&c.releasedAt)))
+	}
+	return 0
+}
+
+// released marks the connection as returned to the pool.
+func (c *pooledServerConn) released() {
+	atomic.StoreInt64(&c.releasedAt, time.Now().UnixNano())
+	if atomic.CompareAndSwapInt32(&c.idle, 0, 1) {
+		atomic.AddInt64(&c.proxy.idleServerConns, 1)
+	}
+}
+
+// stale checks if an idle connection was closed by the server, for example
+// after its idle timeout, before a request is sent on it. The server never
+// sends anything unsolicited, so any data or error other than a timeout from
+// a brief read means the connection cannot be used.
+func (c *pooledServerConn) stale() bool {
+	if err := c.SetReadDeadline(time.Now().Add(staleCheckTimeout)); err != nil {
+		return true
+	}
+	var b [1]byte
+	n, err := c.Read(b[:])
+	if n > 0 {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return !ok || !ne.Timeout()
+}
+
+// Close closes the connection, counting it as reaped if it was idle.
+func (c *pooledServerConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) && atomic.CompareAndSwapInt32(&c.idle, 1, 0) {
+		atomic.AddInt64(&c.proxy.idleServerConns, -1)
+		select {
+		case <-c.proxy.closed:
+			// closed as part of stopping the proxy
+		default:
+			stats.BumpSum(c.proxy.stats, "server.pool.reaped", 1)
+		}
+	}
+	return c.Conn.Close()
+}
+
+// releaseServerConn returns a server connection to its pool.
+func (p *Proxy) releaseServerConn(c net.Conn) {
+	if pc, ok := c.(*pooledServerConn); ok {
+		pc.released()
+	}
+	pool := p.poolOf(c)
+	pool.Release(c)
+	if pool == &p.serverPool {
+		atomic.AddInt64(&p.serverDemand, -1)
+	}
+}
+
+// discardServerConn closes a server connection from getServerConn after an
+// error, rather than returning it to the pool.
+func (p *Proxy) discardServerConn(c net.Conn) {
+	pool := p.poolOf(c)
+	pool.Discard(c)
+	if pool == &p.serverPool {
+		atomic.AddInt64(&p.serverDemand, -1)
+	}
+}
+
+// prewarm establishes up to PrewarmConnections server connections and leaves
+// them idle in the pool. Each connection gets a single dial, so an unreachable
+// server delays the start by at most the ConnectTimeout. It stops at the first
+// failure since the following dials would most likely fail the same way.
+func (p *Proxy) prewarm() {
+	n := p.ReplicaSet.PrewarmConnections
+	if n > p.ReplicaSet.MaxConnections {
+		n = p.ReplicaSet.MaxConnections
+	}
+	conns := make([]net.Conn, 0, n)
+	atomic.StoreInt32(&p.prewarming, 1)
+	for uint(len(conns)) < n {
+		c, err := p.getServerConn("")
+		if err != nil {
+			p.Log.Warnf("prewarming connections to %s: %s", p.MongoAddr, err)
+			break
+		}
+		conns = append(conns, c)
+	}
+	atomic.StoreInt32(&p.prewarming, 0)
+	for _, c := range conns {
+		p.releaseServerConn(c)
+	}
+	stats.BumpSum(p.stats, "server.conn.prewarmed", float64(len(conns)))
+}
+
+// idleServerConnCount returns the number of idle server connections in the
+// pool.
+func (p *Proxy) idleServerConnCount() int64 {
+	return atomic.LoadInt64(&p.idleServerConns)
+}
+
+// idleStatsLoop periodically reports the number of idle server connections
+// until the proxy is stopped.
+func (p *Proxy) idleStatsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+			stats.BumpAvg(p.stats, "server.pool.idle", float64(p.idleServerConnCount()))
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIdleServerConnReaped(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	sums := make(map[string]float64)
+	avgs := make(map[string]float64)
+	bumped := func(m map[string]float64, key string) float64 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return m[key]
+	}
+
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{
+		ServerIdleTimeout:       20 * time.Millisecond,
+		ServerIdleStatsInterval: 5 * time.Millisecond,
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				sums[key] += val
+			},
+			BumpAvgHook: func(key string, val float64) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				avgs[key] = val
+			},
+		},
+	})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	h, body := fakeQuery("test.foo", bson.D{})
+	_, err = c.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+	reply, err := readHeader(c)
+	ensure.Nil(t, err)
+	_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+	ensure.Nil(t, err)
+
+	// The server connection goes back to the pool once the reply is relayed.
+	deadline := time.Now().Add(5 * time.Second)
+	for bumped(avgs, "mongoproxy.server.pool.idle") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("server connection never became idle")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// And is closed once it has been idle for longer than the timeout.
+	for bumped(sums, "mongoproxy.server.pool.reaped") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle server connection was not reaped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ensure.DeepEqual(t, p.idleServerConnCount(), int64(0))
+	for bumped(avgs, "mongoproxy.server.pool.idle") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle count was not reported after reaping")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// closingListener keeps track of the accepted connections so they can be
+// closed from the server side.
+type closingListener struct {
+	net.Listener
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func (l *closingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.mutex.Lock()
+		l.conns = append(l.conns, c)
+		l.mutex.Unlock()
+	}
+	return c, err
+}
+
+func (l *closingListener) closeConns() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+}
+
+func TestStaleServerConnDiscarded(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	var stale float64
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	listener := &closingListener{Listener: l}
+	mongo := &fakeMongo{Listener: listener, Handler: okReply}
+	go mongo.acceptLoop()
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "mongoproxy.server.conn.stale" {
+					mutex.Lock()
+					defer mutex.Unlock()
+					stale += val
+				}
+			},
+		},
+	})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	query := func() {
+		h, body := fakeQuery("test.foo", bson.D{})
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+		ensure.Nil(t, err)
+	}
+	query()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.idleServerConnCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("server connection never became idle")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The server drops the idle connection, the next request transparently
+	// goes over a new one.
+	listener.closeConns()
+	time.Sleep(staleCheckIdle)
+	query()
+	mutex.Lock()
+	defer mutex.Unlock()
+	ensure.DeepEqual(t, stale, float64(1))
+}
+
+func TestPrewarmConnections(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	listener := &closingListener{Listener: l}
+	mongo := &fakeMongo{Listener: listener, Handler: okReply}
+	go mongo.acceptLoop()
+	defer mongo.Stop()
+	accepted := func() int {
+		listener.mutex.Lock()
+		defer listener.mutex.Unlock()
+		return len(listener.conns)
+	}
+
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{PrewarmConnections: 3})
+	defer p.Stop()
+
+	// The connections are established and idle before any client connects.
+	ensure.DeepEqual(t, p.idleServerConnCount(), int64(3))
+	deadline := time.Now().Add(5 * time.Second)
+	for accepted() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 server connections, got %d", accepted())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The first client is served over one of them.
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	h, body := fakeQuery("test.foo", bson.D{})
+	_, err = c.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+	reply, err := readHeader(c)
+	ensure.Nil(t, err)
+	_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, accepted(), 3)
+}
+
+func TestPrewarmUnreachableServer(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	addr := l.Addr().String()
+	ensure.Nil(t, l.Close())
+
+	// The failed dial is not retried, the proxy starts right away.
+	start := time.Now()
+	p := newFakeProxy(t, addr, &ReplicaSet{PrewarmConnections: 3, ConnectTimeout: time.Second})
+	defer p.Stop()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("prewarming an unreachable server delayed the start by %s", elapsed)
+	}
+	ensure.DeepEqual(t, p.idleServerConnCount(), int64(0))
+}
+
+// replicaSetMembers answers the commands sent during discovery as the members
+// of a replica set would, with the members it is given.
+type replicaSetMembers struct {
+	t       *testing.T
+	mutex   sync.Mutex
+	members []string
+}
+
+func (m *replicaSetMembers) set(members ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.members = members
+}
+
+func (m *replicaSetMembers) reply(h *messageHeader, body []byte) []byte {
+	if !h.OpCode.HasResponse() {
+		return nil
+	}
+	m.mutex.Lock()
+	members := m.members
+	m.mutex.Unlock()
+	doc := bson.D{
+		{Name: "ismaster", Value: true},
+		{Name: "setName", Value: "rs"},
+		{Name: "hosts", Value: members},
+		{Name: "primary", Value: members[0]},
+		{Name: "maxWireVersion", Value: 6},
+		{Name: "ok", Value: 1},
+	}
+	switch {
+	case bytes.Contains(body, []byte("getnonce")):
+		doc = bson.D{{Name: "nonce", Value: "2375531c32080ae8"}, {Name: "ok", Value: 1}}
+	case bytes.Contains(body, []byte("replSetGetStatus")):
+		status := make([]bson.D, len(members))
+		for i, member := range members {
+			state := ReplicaStateSecondary
+			if i == 0 {
+				state = ReplicaStatePrimary
+			}
+			status[i] = bson.D{{Name: "name", Value: member}, {Name: "stateStr", Value: state}}
+		}
+		doc = bson.D{{Name: "set", Value: "rs"}, {Name: "members", Value: status}, {Name: "ok", Value: 1}}
+	}
+	b, err := newReply(h, 0, doc)
+	ensure.Nil(m.t, err)
+	return b
+}
+
+func TestPrewarmAddedMember(t *testing.T) {
+	t.Parallel()
+	members := &replicaSetMembers{t: t}
+	var mongos []*fakeMongo
+	for i := 0; i < 3; i++ {
+		mongo := newFakeMongo(t, members.reply)
+		defer mongo.Stop()
+		mongos = append(mongos, mongo)
+	}
+	members.set(mongos[0].Addr(), mongos[1].Addr())
+	r := newStartupReplicaSet(t, mongos[0].Addr(), 0)
+	r.PrewarmConnections = 2
+	ensure.Nil(t, r.Start())
+	defer r.Stop()
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 2)
+
+	// A member joins, its proxy has connections ready before any client
+	// connects to it.
+	added := mongos[2].Addr()
+	members.set(mongos[0].Addr(), mongos[1].Addr(), added)
+	r.Restart()
+	ensure.DeepEqual(t, len(r.ProxyMembers()), 3)
+	proxyAddr, err := r.Proxy(added)
+	ensure.Nil(t, err)
+	r.mappingMutex.RLock()
+	p := r.proxies[proxyAddr]
+	r.mappingMutex.RUnlock()
+	ensure.DeepEqual(t, p.idleServerConnCount(), int64(2))
+	ensure.DeepEqual(t, atomic.LoadInt64(&p.clients), int64(0))
+}
+
+func TestMaxQueueDepth(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		<-release
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{MaxConnections: 1, MaxQueueDepth: 1})
+	defer p.Stop()
+
+	send := func() net.Conn {
+		c, err := net.Dial("tcp", p.ProxyAddr)
+		ensure.Nil(t, err)
+		h, body := fakeQuery("test.foo", bson.D{})
+		_, err = c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		return c
+	}
+	waitDemand := func(n int64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&p.serverDemand) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d requests holding or waiting for a server connection", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The first request holds the only server connection and the second one
+	// waits for it.
+	holding := send()
+	defer holding.Close()
+	waitDemand(1)
+	queued := send()
+	defer queued.Close()
+	waitDemand(2)
+
+	// The third one is over the queue depth and fails right away.
+	overloaded := send()
+	defer overloaded.Close()
+	var doc bson.M
+	r := &ReplyRW{Log: &tLogger{TB: t}}
+	_, _, _, err := r.ReadOne(overloaded, &doc)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, doc["errmsg"], DefaultCloseReasonMessages[CloseReasonServerOverloaded])
+
+	// The others are served once the server responds.
+	close(release)
+	for _, c := range []net.Conn{holding, queued} {
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+		ensure.Nil(t, err)
+	}
+	waitDemand(0)
+}
@@ -0,0 +1,159 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stats"
+)
+
+const (
+	// shadowQueueSize is the most mirrored messages waiting to be sent to the
+	// shadow server. Further ones are dropped rather than slowing clients down.
+	shadowQueueSize = 1024
+
+	// shadowTimeout bounds dialing the shadow server and each round trip.
+	shadowTimeout = 5 * time.Second
+)
+
+// shadowCommands are the reads which are mirrored. Anything else, including
+// getMore since the cursors only exist on the real server, is not.
+var shadowCommands = []string{
+	"aggregate",
+	"count",
+	"distinct",
+	"find",
+	"query",
+}
+
+// Shadow mirrors a sample of the reads proxied to the replica set to a shadow
+// mongo server, for example to validate a candidate server version under
+// production traffic. Mirroring is asynchronous and the replies of the shadow
+// server are discarded, so it neither delays clients nor affects what they
+// see. Writes are never mirrored. The shadow connection is not authenticated.
+type Shadow struct {
+	Log   Logger       `inject:""`
+	Stats stats.Client `inject:""`
+
+	// Addr is the address of the shadow mongo server. Empty disables
+	// mirroring.
+	Addr string
+
+	// Rate is the fraction of the reads which are mirrored, between 0 and 1.
+	Rate float64
+
+	queue   chan []byte
+	stopped chan struct{}
+	conn    net.Conn // only used by the mirror loop
+}
+
+// Enabled returns true if reads are mirrored.
+func (s *Shadow) Enabled() bool {
+	return s != nil && s.Addr != "" && s.Rate > 0
+}
+
+// Start starts sending mirrored messages to the shadow server.
+func (s *Shadow) Start() error {
+	if !s.Enabled() {
+		return nil
+	}
+	s.queue = make(chan []byte, shadowQueueSize)
+	s.stopped = make(chan struct{})
+	go s.mirrorLoop()
+	return nil
+}
+
+// Stop stops mirroring, dropping the messages not sent yet.
+func (s *Shadow) Stop() error {
+	if s.queue == nil {
+		return nil
+	}
+	close(s.queue)
+	<-s.stopped
+	return nil
+}
+
+// mirror queues a sample of the reads to be sent to the shadow server. The
+// body is that of the message and is copied.
+func (s *Shadow) mirror(h *messageHeader, op *TracedOperation, body []byte) {
+	if s.queue == nil || !isShadowRead(op, body) || rand.Float64() >= s.Rate {
+		return
+	}
+	msg := append(h.ToWire(), body...)
+	select {
+	case s.queue <- msg:
+		stats.BumpSum(s.Stats, "shadow.mirrored", 1)
+	default:
+		stats.BumpSum(s.Stats, "shadow.dropped", 1)
+	}
+}
+
+// isShadowRead checks if the operation is a read which can be mirrored. Its
+// reply must be a single message, so exhaust queries and unacknowledged
+// messages are not.
+func isShadowRead(op *TracedOperation, body []byte) bool {
+	if op.Write || len(body) < 4 {
+		return false
+	}
+	flags := uint32(getInt32(body, 0))
+	switch op.OpCode {
+	default:
+		return false
+	case OpQuery:
+		if flags&queryFlagExhaust != 0 {
+			return false
+		}
+	case OpMsg:
+		if flags&(msgFlagMoreToCome|msgFlagExhaustAllowed) != 0 {
+			return false
+		}
+	}
+	for _, c := range shadowCommands {
+		if strings.EqualFold(op.Command, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Shadow) mirrorLoop() {
+	defer close(s.stopped)
+	for msg := range s.queue {
+		if err := s.send(msg); err != nil {
+			s.Log.Debugf("mirroring to shadow %s: %s", s.Addr, err)
+			stats.BumpSum(s.Stats, "shadow.error", 1)
+			if s.conn != nil {
+				s.conn.Close()
+				s.conn = nil
+			}
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// send sends a message to the shadow server and discards its reply.
+func (s *Shadow) send(msg []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.Addr, shadowTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetDeadline(time.Now().Add(shadowTimeout))
+	if _, err := s.conn.Write(msg); err != nil {
+		return err
+	}
+	h, err := readHeader(s.conn)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(ioutil.Discard, s.conn, int64(h.MessageLength-headerLen))
+	return err
+}
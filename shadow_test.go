@@ -0,0 +1,102 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIsShadowRead(t *testing.T) {
+	t.Parallel()
+	withFlags := func(flags uint32) []byte {
+		body := make([]byte, 4)
+		setInt32(body, 0, int32(flags))
+		return body
+	}
+	cases := []struct {
+		Name     string
+		Op       TracedOperation
+		Body     []byte
+		Expected bool
+	}{
+		{Name: "find", Op: TracedOperation{OpCode: OpMsg, Command: "find"}, Body: withFlags(0), Expected: true},
+		{Name: "query", Op: TracedOperation{OpCode: OpQuery, Command: "query"}, Body: withFlags(0), Expected: true},
+		{Name: "count", Op: TracedOperation{OpCode: OpQuery, Command: "count"}, Body: withFlags(0), Expected: true},
+		{Name: "insert", Op: TracedOperation{OpCode: OpMsg, Command: "insert", Write: true}, Body: withFlags(0)},
+		{Name: "aggregate with $out", Op: TracedOperation{OpCode: OpMsg, Command: "aggregate", Write: true}, Body: withFlags(0)},
+		{Name: "getMore", Op: TracedOperation{OpCode: OpMsg, Command: "getMore"}, Body: withFlags(0)},
+		{Name: "exhaust query", Op: TracedOperation{OpCode: OpQuery, Command: "query"}, Body: withFlags(queryFlagExhaust)},
+		{Name: "exhaust msg", Op: TracedOperation{OpCode: OpMsg, Command: "find"}, Body: withFlags(msgFlagExhaustAllowed)},
+		{Name: "more to come", Op: TracedOperation{OpCode: OpMsg, Command: "find"}, Body: withFlags(msgFlagMoreToCome)},
+		{Name: "legacy insert", Op: TracedOperation{OpCode: OpInsert, Command: "insert"}, Body: withFlags(0)},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, isShadowRead(&c.Op, c.Body), c.Expected, c.Name)
+	}
+}
+
+func TestShadowMirrorsReads(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+
+	var mutex sync.Mutex
+	var mirrored []string
+	shadow := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		op := TracedOperation{OpCode: h.OpCode}
+		op.describe(body, nil)
+		mutex.Lock()
+		mirrored = append(mirrored, op.Command)
+		mutex.Unlock()
+		return okReply(h, body)
+	})
+	defer shadow.Stop()
+
+	s := &Shadow{Log: &tLogger{TB: t}, Addr: shadow.Addr(), Rate: 1}
+	ensure.Nil(t, s.Start())
+	defer s.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{Shadow: s})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	roundTrip := func(h *messageHeader, body []byte) {
+		_, err := c.Write(append(h.ToWire(), body...))
+		ensure.Nil(t, err)
+		reply, err := readHeader(c)
+		ensure.Nil(t, err)
+		_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+		ensure.Nil(t, err)
+	}
+	roundTrip(fakeOpMsg(0, bson.D{
+		{Name: "insert", Value: "foo"},
+		{Name: "documents", Value: []bson.D{{{Name: "a", Value: 1}}}},
+		{Name: "$db", Value: "test"},
+	}))
+	roundTrip(fakeOpMsg(0, bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}}))
+	roundTrip(fakeQuery("test.$cmd", bson.D{{Name: "delete", Value: "foo"}}))
+	roundTrip(fakeQuery("test.foo", bson.D{{Name: "a", Value: 1}}))
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mutex.Lock()
+		n := len(mirrored)
+		mutex.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The shadow handles messages in order, so the writes would have shown up
+	// before the last read.
+	mutex.Lock()
+	defer mutex.Unlock()
+	ensure.DeepEqual(t, mirrored, []string{"find", "query"})
+}
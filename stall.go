@@ -0,0 +1,70 @@
+package dvara
+
+import (
+	"net"
+	"time"
+)
+
+// stallChunk is the most bytes written to a client at once when
+// ClientWriteTimeout is set, so the timeout applies to each chunk rather
+// than to a whole reply.
+const stallChunk = 64 << 10
+
+// stallConn is a net.Conn whose writes fail once the client stops reading for
+// longer than timeout, rather than only at the deadline of the message. Since
+// replies are copied from the server as the client reads them, a client which
+// stalls holds up the server connection but nothing is buffered for it. Writes
+// to a client connection are only ever made by its clientServeLoop, so it is
+// not safe for concurrent writes.
+type stallConn struct {
+	net.Conn
+	timeout  time.Duration
+	deadline time.Time // write deadline set by the caller
+}
+
+// newStallConn returns c with writes limited to timeout without progress. A
+// zero timeout only keeps the deadlines set by the caller.
+func newStallConn(c net.Conn, timeout time.Duration) net.Conn {
+	if timeout == 0 {
+		return c
+	}
+	return &stallConn{Conn: c, timeout: timeout}
+}
+
+func (c *stallConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *stallConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if n > stallChunk {
+			n = stallChunk
+		}
+		deadline := time.Now().Add(c.timeout)
+		stall := c.deadline.IsZero() || deadline.Before(c.deadline)
+		if !stall {
+			deadline = c.deadline
+		}
+		if err := c.Conn.SetWriteDeadline(deadline); err != nil {
+			return written, err
+		}
+		w, err := c.Conn.Write(b[:n])
+		written += w
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && stall {
+				return written, &ClientStalledError{Addr: c.RemoteAddr().String(), After: c.timeout}
+			}
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
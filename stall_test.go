@@ -0,0 +1,50 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestClientWriteTimeoutClosesStalledClient(t *testing.T) {
+	t.Parallel()
+	const replyLen = 32 << 20
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		// The body is copied as is, it does not need to be valid.
+		reply := make([]byte, replyLen)
+		copy(reply, (&messageHeader{
+			MessageLength: replyLen,
+			ResponseTo:    h.RequestID,
+			OpCode:        OpReply,
+		}).ToWire())
+		return reply
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{ClientWriteTimeout: 100 * time.Millisecond})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+	h, body := fakeQuery("test.foo", bson.D{})
+	ensure.Nil(t, h.WriteTo(c))
+	_, err = c.Write(body)
+	ensure.Nil(t, err)
+
+	// Stop reading for a while, well within MessageTimeout.
+	time.Sleep(time.Second)
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err := io.Copy(ioutil.Discard, c)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("stalled client was not disconnected")
+	}
+	// At most what the socket buffers hold was sent before giving up.
+	if n >= replyLen {
+		t.Fatalf("expected a truncated reply, got all %d bytes", n)
+	}
+}
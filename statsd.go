@@ -0,0 +1,85 @@
+package dvara
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsDClient is a stats.Client which sends metrics to a StatsD server over
+// UDP. If Tags are provided they are sent using the DogStatsD extension.
+type StatsDClient struct {
+	Log Logger `inject:""`
+
+	// Addr is the address of the StatsD server.
+	Addr string
+
+	// Tags are attached to every metric, for example "env:prod".
+	Tags []string
+
+	mutex sync.Mutex
+	conn  net.Conn
+	tags  string
+}
+
+// Start connects to the StatsD server.
+func (c *StatsDClient) Start() error {
+	conn, err := net.Dial("udp", c.Addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	if len(c.Tags) > 0 {
+		c.tags = "|#" + strings.Join(c.Tags, ",")
+	}
+	return nil
+}
+
+// Stop closes the connection to the StatsD server.
+func (c *StatsDClient) Stop() error {
+	return c.conn.Close()
+}
+
+// BumpAvg sends the value as a gauge.
+func (c *StatsDClient) BumpAvg(key string, val float64) {
+	c.send(key, val, "g")
+}
+
+// BumpSum sends the value as a counter.
+func (c *StatsDClient) BumpSum(key string, val float64) {
+	c.send(key, val, "c")
+}
+
+// BumpHistogram sends the value as a histogram.
+func (c *StatsDClient) BumpHistogram(key string, val float64) {
+	c.send(key, val, "h")
+}
+
+// BumpTime sends the elapsed time in milliseconds as a timer when End is
+// called.
+func (c *StatsDClient) BumpTime(key string) interface {
+	End()
+} {
+	return statsDTimer{client: c, key: key, start: time.Now()}
+}
+
+func (c *StatsDClient) send(key string, val float64, kind string) {
+	line := fmt.Sprintf("%s:%g|%s%s", key, val, kind, c.tags)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		c.Log.Debugf("failed to send stat %s: %s", key, err)
+	}
+}
+
+type statsDTimer struct {
+	client *StatsDClient
+	key    string
+	start  time.Time
+}
+
+func (t statsDTimer) End() {
+	t.client.send(t.key, float64(time.Since(t.start))/float64(time.Millisecond), "ms")
+}
@@ -0,0 +1,60 @@
+package dvara
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/stats"
+)
+
+var _ stats.Client = &StatsDClient{}
+
+func TestStatsDClient(t *testing.T) {
+	t.Parallel()
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c := &StatsDClient{
+		Log:  &tLogger{TB: t},
+		Addr: server.LocalAddr().String(),
+		Tags: []string{"env:test", "rs:foo"},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	c.BumpSum("sum", 2)
+	c.BumpAvg("avg", 1.5)
+	c.BumpHistogram("histogram", 3)
+	c.BumpTime("time").End()
+
+	expected := []string{
+		"sum:2|c|#env:test,rs:foo",
+		"avg:1.5|g|#env:test,rs:foo",
+		"histogram:3|h|#env:test,rs:foo",
+	}
+	buf := make([]byte, 1024)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, e := range expected {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := string(buf[:n]); actual != e {
+			t.Fatalf("expected %q got %q", e, actual)
+		}
+	}
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := string(buf[:n]); !strings.HasPrefix(actual, "time:") || !strings.HasSuffix(actual, "|ms|#env:test,rs:foo") {
+		t.Fatalf("unexpected timer %q", actual)
+	}
+}
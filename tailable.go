@@ -0,0 +1,98 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// tailingCursors are the namespaces on which a client opened tailable cursors
+// with AwaitData or change streams. Cursors are tracked by namespace as their
+// id is only known from the reply, which is copied to the client as is.
+type tailingCursors map[string]struct{}
+
+// awaitsData peeks at a message to remember the namespaces of tailable
+// AwaitData queries and change streams, and reports whether the message is a
+// getMore on one of them. The server holds such a getMore until new data
+// arrives, which is not a timeout. The returned connection replays what was
+// peeked.
+//
+// The getMore is sent to the backend of the client connection like any other
+// message, which is the one that opened the cursor. A client reconnecting gets
+// its backend anew and resumes a change stream from its resume token, which
+// any member accepts.
+func (p *Proxy) awaitsData(h *messageHeader, c net.Conn, tailing tailingCursors) (net.Conn, bool, error) {
+	if p.ReplicaSet.AwaitDataTimeout == 0 ||
+		h.OpCode != OpQuery && h.OpCode != OpGetMore && h.OpCode != OpMsg ||
+		h.OpCode == OpGetMore && len(tailing) == 0 ||
+		h.MessageLength-headerLen < 4 {
+		return c, false, nil
+	}
+
+	length := int(h.MessageLength - headerLen)
+	if length > maxCommandPeekLength {
+		length = maxCommandPeekLength
+	}
+	prefix := make([]byte, length)
+	c.SetReadDeadline(time.Now().Add(p.ReplicaSet.MessageTimeout))
+	if _, err := io.ReadFull(c, prefix); err != nil {
+		return nil, false, err
+	}
+	replay := newBufferedConn(c, prefix)
+
+	switch name := peekCommand(h, prefix); {
+	case strings.EqualFold(name, "aggregate"),
+		strings.EqualFold(name, "getMore") && len(tailing) != 0:
+		return p.awaitsDataCommand(h, c, prefix, tailing)
+	case h.OpCode == OpMsg || name != "":
+		return replay, false, nil
+	}
+
+	// OpQuery starts with its flags and OpGetMore with a reserved int32, both
+	// followed by the full collection name.
+	end := bytes.IndexByte(prefix[4:], 0)
+	if end < 0 {
+		return replay, false, nil
+	}
+	namespace := string(prefix[4 : 4+end])
+	if h.OpCode == OpGetMore {
+		_, ok := tailing[namespace]
+		return replay, ok, nil
+	}
+	if flags := getInt32(prefix, 0); flags&queryFlagTailable != 0 && flags&queryFlagAwaitData != 0 {
+		tailing[namespace] = struct{}{}
+	}
+	return replay, false, nil
+}
+
+// awaitsDataCommand is awaitsData for the aggregate and getMore commands, which
+// are read whole to find their namespace.
+func (p *Proxy) awaitsDataCommand(h *messageHeader, c net.Conn, prefix []byte, tailing tailingCursors) (net.Conn, bool, error) {
+	body := make([]byte, h.MessageLength-headerLen)
+	copy(body, prefix)
+	if _, err := io.ReadFull(c, body[len(prefix):]); err != nil {
+		return nil, false, err
+	}
+	replay := newBufferedConn(c, body)
+
+	op := TracedOperation{OpCode: h.OpCode}
+	op.describe(body, p.ReplicaSet.CommandClassifier)
+	if strings.EqualFold(op.Command, "getMore") {
+		_, ok := tailing[op.Namespace]
+		return replay, ok, nil
+	}
+	class := p.ReplicaSet.CommandClassifier.Classify(databaseOf(op.Namespace), commandDocument(h, body))
+	if class.ChangeStream {
+		// The cursor of a change stream on a database or the cluster is on the
+		// pseudo collection named after the command.
+		namespace := op.Namespace
+		if strings.HasSuffix(namespace, ".$cmd") {
+			namespace += ".aggregate"
+		}
+		p.Log.Debugf("client %s opened a change stream on %s", c.RemoteAddr(), namespace)
+		tailing[namespace] = struct{}{}
+	}
+	return replay, false, nil
+}
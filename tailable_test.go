@@ -0,0 +1,137 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func fakeGetMore(collection string, cursorID int64) (*messageHeader, []byte) {
+	var body []byte
+	body = append(body, 0, 0, 0, 0) // reserved
+	body = append(body, collection...)
+	body = append(body, 0)
+	body = append(body, 0, 0, 0, 0) // numberToReturn
+	var id [8]byte
+	setInt32(id[:], 0, int32(cursorID))
+	setInt32(id[:], 4, int32(cursorID>>32))
+	body = append(body, id[:]...)
+	h := &messageHeader{
+		OpCode:        OpGetMore,
+		MessageLength: int32(headerLen + len(body)),
+	}
+	return h, body
+}
+
+// proxyRoundTrip sends a request and discards its reply.
+func proxyRoundTrip(c net.Conn, h *messageHeader, body []byte) error {
+	if err := h.WriteTo(c); err != nil {
+		return err
+	}
+	if _, err := c.Write(body); err != nil {
+		return err
+	}
+	reply, err := readHeader(c)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+	return err
+}
+
+func TestAwaitDataGetMoreWaitsForData(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		if h.OpCode == OpGetMore {
+			// No new data for longer than MessageTimeout.
+			time.Sleep(300 * time.Millisecond)
+		}
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{
+		MessageTimeout:   100 * time.Millisecond,
+		AwaitDataTimeout: time.Minute,
+	})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	h, body := fakeQuery("test.capped", bson.D{})
+	setInt32(body, 0, queryFlagTailable|queryFlagAwaitData)
+	ensure.Nil(t, proxyRoundTrip(c, h, body))
+	h, body = fakeGetMore("test.capped", 42)
+	ensure.Nil(t, proxyRoundTrip(c, h, body))
+
+	// A getMore on a cursor which does not await data still times out.
+	h, body = fakeGetMore("test.other", 43)
+	ensure.NotNil(t, proxyRoundTrip(c, h, body))
+}
+
+func TestChangeStreamGetMoreWaitsForData(t *testing.T) {
+	t.Parallel()
+	var getMores int32
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		if bytes.Contains(body, []byte("getMore")) {
+			atomic.AddInt32(&getMores, 1)
+			// No new events for longer than MessageTimeout.
+			time.Sleep(300 * time.Millisecond)
+		}
+		return okReply(h, body)
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{
+		MessageTimeout:   100 * time.Millisecond,
+		AwaitDataTimeout: time.Minute,
+	})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	command := func(cmd bson.D) error {
+		h, body := fakeOpMsg(0, cmd)
+		return proxyRoundTrip(c, h, body)
+	}
+	changeStream := []interface{}{bson.D{{Name: "$changeStream", Value: bson.D{}}}}
+	ensure.Nil(t, command(bson.D{
+		{Name: "aggregate", Value: "events"},
+		{Name: "pipeline", Value: changeStream},
+		{Name: "$db", Value: "test"},
+	}))
+	ensure.Nil(t, command(bson.D{
+		{Name: "getMore", Value: int64(42)},
+		{Name: "collection", Value: "events"},
+		{Name: "$db", Value: "test"},
+	}))
+
+	// A change stream on the whole database.
+	ensure.Nil(t, command(bson.D{
+		{Name: "aggregate", Value: 1},
+		{Name: "pipeline", Value: changeStream},
+		{Name: "$db", Value: "test"},
+	}))
+	ensure.Nil(t, command(bson.D{
+		{Name: "getMore", Value: int64(43)},
+		{Name: "collection", Value: "$cmd.aggregate"},
+		{Name: "$db", Value: "test"},
+	}))
+	ensure.DeepEqual(t, atomic.LoadInt32(&getMores), int32(2))
+
+	// A getMore on a plain aggregation still times out.
+	ensure.NotNil(t, command(bson.D{
+		{Name: "getMore", Value: int64(44)},
+		{Name: "collection", Value: "other"},
+		{Name: "$db", Value: "test"},
+	}))
+}
@@ -0,0 +1,72 @@
+package dvara
+
+import (
+	"net"
+	"time"
+)
+
+// throttledConn is a net.Conn whose writes are limited to rate bytes per
+// second, allowing bursts of up to burst bytes. Writes block until they are
+// allowed, so a throttled client also stops us from reading the rest of the
+// reply from the server. Writes to a client connection are only ever made by
+// its clientServeLoop, so it is not safe for concurrent writes.
+type throttledConn struct {
+	net.Conn
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newThrottledConn returns c throttled to rate bytes per second with the given
+// burst. A zero rate disables throttling and a zero burst allows one second
+// worth of bytes.
+func newThrottledConn(c net.Conn, rate, burst uint) net.Conn {
+	if rate == 0 {
+		return c
+	}
+	if burst == 0 {
+		burst = rate
+	}
+	return &throttledConn{
+		Conn:   c,
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if float64(n) > c.burst {
+			n = int(c.burst)
+		}
+		c.wait(float64(n))
+		w, err := c.Conn.Write(b[:n])
+		written += w
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// wait blocks until n bytes may be written and takes them from the bucket.
+func (c *throttledConn) wait(n float64) {
+	now := time.Now()
+	c.tokens += now.Sub(c.last).Seconds() * c.rate
+	if c.tokens > c.burst {
+		c.tokens = c.burst
+	}
+	c.last = now
+	if c.tokens < n {
+		time.Sleep(time.Duration((n - c.tokens) / c.rate * float64(time.Second)))
+		c.last = time.Now()
+		c.tokens = n
+	}
+	c.tokens -= n
+}
@@ -0,0 +1,82 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func TestNewThrottledConnDisabled(t *testing.T) {
+	t.Parallel()
+	c := &bufferConn{}
+	ensure.DeepEqual(t, newThrottledConn(c, 0, 10), net.Conn(c))
+}
+
+func TestThrottledConnWrite(t *testing.T) {
+	t.Parallel()
+	c := &bufferConn{}
+	tc := newThrottledConn(c, 100000, 1000)
+	in := bytes.Repeat([]byte("0123456789"), 2000)
+	start := time.Now()
+	n, err := tc.Write(in)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, n, len(in))
+	ensure.True(t, bytes.Equal(c.buf.Bytes(), in))
+
+	// The first 1000 bytes are a burst, the rest takes 190ms.
+	if took := time.Since(start); took < 150*time.Millisecond || took > time.Second {
+		t.Fatalf("write took %s", took)
+	}
+}
+
+func TestClientBandwidth(t *testing.T) {
+	t.Parallel()
+	big := strings.Repeat("x", 100*1024)
+	mongo := newFakeMongo(t, func(h *messageHeader, body []byte) []byte {
+		b, err := newReply(h, 0, bson.D{{Name: "ok", Value: 1}, {Name: "big", Value: big}})
+		if err != nil {
+			panic(err)
+		}
+		return b
+	})
+	defer mongo.Stop()
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{
+		ClientBandwidth:      200 * 1024,
+		ClientBandwidthBurst: 20 * 1024,
+	})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	start := time.Now()
+	h, body := fakeQuery("db.foo", bson.D{})
+	_, err = c.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+	reply, err := readHeader(c)
+	ensure.Nil(t, err)
+	_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+	ensure.Nil(t, err)
+
+	// About 80KB beyond the burst at 200KB/s.
+	if took := time.Since(start); took < 300*time.Millisecond || took > 2*time.Second {
+		t.Fatalf("reply took %s", took)
+	}
+}
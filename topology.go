@@ -0,0 +1,128 @@
+package dvara
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Topology is the replica set as last discovered, before it is mapped to
+// proxies. It helps diagnose why a member was dropped or mapped unexpectedly.
+type Topology struct {
+	Discovered time.Time `json:"discovered"`
+
+	// Single is the address of the server when it is not a replica set.
+	Single string `json:"single,omitempty"`
+
+	// From replSetGetStatus.
+	Name    string           `json:"name,omitempty"`
+	Members []TopologyMember `json:"members,omitempty"`
+
+	// From isMaster.
+	Primary  string      `json:"primary,omitempty"`
+	Me       string      `json:"me,omitempty"`
+	Hosts    []string    `json:"hosts,omitempty"`
+	Passives []string    `json:"passives,omitempty"`
+	Arbiters []string    `json:"arbiters,omitempty"`
+	Tags     interface{} `json:"tags,omitempty"`
+}
+
+// TopologyMember is a member as reported by replSetGetStatus. Details holds
+// the rest of what the server reported, such as health and optimes.
+type TopologyMember struct {
+	Name    string                 `json:"name"`
+	State   ReplicaState           `json:"state"`
+	Self    bool                   `json:"self,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// newTopology captures a discovered ReplicaSetState.
+func newTopology(s *ReplicaSetState, discovered time.Time) *Topology {
+	t := &Topology{Discovered: discovered, Single: s.singleAddr}
+	if rs := s.lastRS; rs != nil {
+		t.Name = rs.Name
+		for _, m := range rs.Members {
+			t.Members = append(t.Members, TopologyMember{
+				Name:    m.Name,
+				State:   m.State,
+				Self:    m.Self,
+				Details: m.Extra,
+			})
+		}
+	}
+	if im := s.lastIM; im != nil {
+		t.Primary = im.Primary
+		t.Me = im.Me
+		t.Hosts = im.Hosts
+		t.Passives = im.Passives
+		t.Arbiters = im.Arbiters
+		t.Tags = im.Extra["tags"]
+	}
+	return t
+}
+
+// summary describes the members of the topology in one line.
+func (t *Topology) summary() string {
+	if t == nil {
+		return "unknown"
+	}
+	var parts []string
+	if t.Single != "" {
+		parts = append(parts, "single "+t.Single)
+	}
+	if t.Primary != "" {
+		parts = append(parts, "primary "+t.Primary)
+	}
+	if len(t.Hosts) != 0 {
+		parts = append(parts, "hosts "+strings.Join(t.Hosts, ","))
+	}
+	if len(t.Members) != 0 {
+		members := make([]string, len(t.Members))
+		for i, m := range t.Members {
+			members[i] = fmt.Sprintf("%s/%s", m.Name, m.State)
+		}
+		parts = append(parts, "members "+strings.Join(members, ","))
+	}
+	if len(parts) == 0 {
+		return "nothing"
+	}
+	return strings.Join(parts, " ")
+}
+
+// setTopology records the ReplicaSetState just discovered.
+func (r *ReplicaSet) setTopology(s *ReplicaSetState) {
+	t := newTopology(s, time.Now())
+	r.topologyMutex.Lock()
+	defer r.topologyMutex.Unlock()
+	r.topology = t
+}
+
+// Topology returns the replica set as last discovered, or nil if it was never
+// discovered.
+func (r *ReplicaSet) Topology() *Topology {
+	r.topologyMutex.Lock()
+	defer r.topologyMutex.Unlock()
+	return r.topology
+}
+
+// TopologyHandler serves the Topology of a ReplicaSet as JSON over HTTP.
+type TopologyHandler struct {
+	ReplicaSet *ReplicaSet
+}
+
+func (h *TopologyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := h.ReplicaSet.Topology()
+	if t == nil {
+		http.Error(w, "replica set not discovered yet", http.StatusServiceUnavailable)
+		return
+	}
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,88 @@
+package dvara
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func getTopology(t *testing.T, r *ReplicaSet) (int, *Topology) {
+	w := httptest.NewRecorder()
+	(&TopologyHandler{ReplicaSet: r}).ServeHTTP(w, httptest.NewRequest("GET", "/topology", nil))
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	var topology Topology
+	ensure.Nil(t, json.Unmarshal(w.Body.Bytes(), &topology))
+	return w.Code, &topology
+}
+
+func TestTopologyHandler(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{}
+	code, _ := getTopology(t, r)
+	ensure.DeepEqual(t, code, http.StatusServiceUnavailable)
+
+	r.setTopology(&ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Name: "rs",
+			Members: []statusMember{
+				{Name: "a:1", State: ReplicaStatePrimary, Self: true, Extra: bson.M{"health": 1}},
+				{Name: "b:2", State: ReplicaStateSecondary, Extra: bson.M{"health": 1}},
+			},
+		},
+		lastIM: &isMasterResponse{
+			Hosts:   []string{"a:1", "b:2"},
+			Primary: "a:1",
+			Me:      "a:1",
+			Extra:   bson.M{"tags": bson.M{"dc": "east"}},
+		},
+	})
+	code, first := getTopology(t, r)
+	ensure.DeepEqual(t, code, http.StatusOK)
+	ensure.DeepEqual(t, first.Name, "rs")
+	ensure.DeepEqual(t, first.Primary, "a:1")
+	ensure.DeepEqual(t, first.Hosts, []string{"a:1", "b:2"})
+	ensure.DeepEqual(t, first.Tags, map[string]interface{}{"dc": "east"})
+	ensure.DeepEqual(t, len(first.Members), 2)
+	ensure.DeepEqual(t, first.Members[0].State, ReplicaStatePrimary)
+	ensure.True(t, first.Members[0].Self)
+	ensure.DeepEqual(t, first.Members[1].Details["health"], float64(1))
+
+	// The primary steps down.
+	r.setTopology(&ReplicaSetState{
+		lastRS: &replSetGetStatusResponse{
+			Name: "rs",
+			Members: []statusMember{
+				{Name: "a:1", State: ReplicaStateSecondary, Self: true},
+				{Name: "b:2", State: ReplicaStatePrimary},
+			},
+		},
+		lastIM: &isMasterResponse{Hosts: []string{"a:1", "b:2"}, Primary: "b:2", Me: "a:1"},
+	})
+	_, second := getTopology(t, r)
+	ensure.DeepEqual(t, second.Primary, "b:2")
+	ensure.DeepEqual(t, second.Members[0].State, ReplicaStateSecondary)
+	ensure.DeepEqual(t, second.Members[1].State, ReplicaStatePrimary)
+	ensure.False(t, second.Discovered.Before(first.Discovered))
+}
+
+func TestTopologySummary(t *testing.T) {
+	t.Parallel()
+	var unknown *Topology
+	ensure.DeepEqual(t, unknown.summary(), "unknown")
+	ensure.DeepEqual(t, (&Topology{}).summary(), "nothing")
+	ensure.DeepEqual(t, (&Topology{Single: "a:1"}).summary(), "single a:1")
+	ensure.DeepEqual(t, (&Topology{
+		Primary: "a:1",
+		Hosts:   []string{"a:1", "b:2"},
+		Members: []TopologyMember{
+			{Name: "a:1", State: ReplicaStatePrimary},
+			{Name: "b:2", State: ReplicaStateSecondary},
+		},
+	}).summary(), "primary a:1 hosts a:1,b:2 members a:1/PRIMARY,b:2/SECONDARY")
+}
@@ -0,0 +1,294 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Tracer starts a span for each proxied operation. Tracing is disabled when
+// ReplicaSet.Tracer is nil. An OpenTelemetry Tracer is available by building
+// with the otel tag, see NewOTelTracer.
+type Tracer interface {
+	StartSpan(op *TracedOperation) TraceSpan
+}
+
+// TraceSpan is a span started by a Tracer.
+type TraceSpan interface {
+	// End ends the span, err is the error proxying the operation if any.
+	End(err error)
+}
+
+// TracedOperation describes a proxied operation.
+type TracedOperation struct {
+	OpCode OpCode
+
+	// Namespace is the full collection name, for example "db.collection".
+	Namespace string
+
+	// Command is the command name, or "query" for a non command OpQuery.
+	Command string
+
+	// Backend is the address of the mongo server.
+	Backend string
+
+	// Write is true for commands which mutate data or metadata, including
+	// aggregations writing their results with $out or $merge.
+	Write bool
+
+	// TraceParent is the W3C trace context propagated by the driver using
+	// $comment or comment, either as a string or as a document with a
+	// traceparent field.
+	TraceParent string
+
+	// Comment is the string $comment of an OpQuery or comment of a command,
+	// which drivers let applications set to tag their operations, for example
+	// "tenant=foo". It is empty if there is none or it is not a string.
+	Comment string
+
+	// ReadPreference is the read preference mode of an OpQuery or OpMsg. An
+	// explicit $readPreference takes precedence over the slaveOk flag. It is
+	// empty if the operation has neither, which means primary.
+	ReadPreference string
+
+	// readPreferenceConflict is true if $readPreference and slaveOk disagree.
+	readPreferenceConflict bool
+}
+
+// observeMessages checks if messages need to be inspected while proxying
+// them, that is if tracing, auditing, shadowing, database or namespace
+// restrictions are enabled.
+func (r *ReplicaSet) observeMessages() bool {
+	return r.Tracer != nil || r.AuditSink != nil || len(r.AllowedDatabases) != 0 ||
+		r.MaxNamespaces != 0 || r.Shadow.Enabled()
+}
+
+// proxyObservedMessage proxies a message like proxyMessage while tracing,
+// auditing, mirroring and restricting it to the AllowedDatabases, the
+// MaxNamespaces and the ListenerOverride of the client's listener. Since the
+// operation needs to be inspected, OpQuery and OpMsg bodies are buffered and
+// then proxied from the buffer. For the mutation ops and OpGetMore only the
+// namespace is read ahead.
+func (p *Proxy) proxyObservedMessage(
+	h *messageHeader,
+	client net.Conn,
+	server net.Conn,
+	lastError *LastError,
+	held *HeldBatches,
+	timeout time.Duration,
+	conn *clientConn,
+) error {
+
+	op := &TracedOperation{OpCode: h.OpCode, Backend: p.MongoAddr}
+	var ahead []byte
+	client.SetDeadline(time.Now().Add(timeout))
+	switch {
+	case h.OpCode == OpQuery || h.OpCode == OpMsg:
+		ahead = make([]byte, h.MessageLength-headerLen)
+		if _, err := io.ReadFull(client, ahead); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		op.describe(ahead, p.ReplicaSet.CommandClassifier)
+		if op.readPreferenceConflict {
+			p.Log.Debugf(
+				"conflicting $readPreference and slaveOk from %s, using %s",
+				client.RemoteAddr(),
+				op.ReadPreference,
+			)
+		}
+	case h.OpCode.IsMutation() || h.OpCode == OpGetMore:
+		ahead = make([]byte, 4)
+		if _, err := io.ReadFull(client, ahead); err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		ns, err := readCString(client)
+		if err != nil {
+			p.Log.Error(err)
+			return err
+		}
+		ahead = append(ahead, ns...)
+		op.Namespace = string(ns[:len(ns)-1])
+		if h.OpCode == OpGetMore {
+			op.Command = "getMore"
+		} else {
+			op.Command = strings.ToLower(h.OpCode.String())
+		}
+	}
+	if ahead != nil {
+		client = newBufferedConn(client, ahead)
+	}
+	if !p.databaseAllowed(op, conn.override) {
+		return p.rejectDatabase(h, client, op, lastError)
+	}
+	if !conn.override.writeAllowed(op) {
+		return p.rejectWrite(h, client, lastError)
+	}
+	if !p.namespaceAllowed(op, conn) {
+		return p.rejectNamespace(h, client, lastError)
+	}
+
+	if p.ReplicaSet.Shadow.Enabled() && (h.OpCode == OpQuery || h.OpCode == OpMsg) {
+		p.ReplicaSet.Shadow.mirror(h, op, ahead)
+	}
+
+	var span TraceSpan
+	if p.ReplicaSet.Tracer != nil {
+		span = p.ReplicaSet.Tracer.StartSpan(op)
+	}
+	sniffer := &replySniffer{Conn: client}
+	err := p.proxyMessage(h, sniffer, server, lastError, held, timeout)
+
+	if span != nil {
+		span.End(err)
+	}
+	if err == nil {
+		p.countReplyError(sniffer.b)
+	}
+	if p.shouldAudit(op) {
+		p.audit(op, client.RemoteAddr(), sniffer, err)
+	}
+	return err
+}
+
+// countReplyError counts failed commands by the codeName the server replied
+// with.
+func (p *Proxy) countReplyError(reply []byte) {
+	s, ok := parseReplyStatus(reply)
+	if !ok || s.Ok {
+		return
+	}
+	name := s.CodeName
+	if name == "" {
+		name = "unknown"
+	}
+	stats.BumpSum(p.stats, "reply.error."+name, 1)
+}
+
+// describe fills in the operation from an OpQuery or OpMsg body, using the
+// classifier for commands. It does a best effort and leaves fields empty if the
+// body cannot be understood.
+func (op *TracedOperation) describe(body []byte, classifier *CommandClassifier) {
+	var doc bson.D
+	switch op.OpCode {
+	case OpQuery:
+		// flags, fullCollectionName, numberToSkip, numberToReturn, query
+		if len(body) < 4 {
+			return
+		}
+		end := bytes.IndexByte(body[4:], 0)
+		if end < 0 || len(body) < 4+end+1+8 {
+			return
+		}
+		op.Namespace = string(body[4 : 4+end])
+		if err := bson.Unmarshal(body[4+end+1+8:], &doc); err != nil {
+			return
+		}
+		mode := ""
+		if isWrappedQuery(doc) {
+			mode = readPreferenceMode(doc)
+		}
+		slaveOK := getInt32(body, 0)&queryFlagSlaveOK != 0
+		op.ReadPreference, op.readPreferenceConflict = resolveReadPreference(mode, slaveOK)
+		if isWrappedQuery(doc) {
+			op.TraceParent = traceParent(doc, "$comment")
+			op.Comment = comment(doc, "$comment")
+			for _, e := range doc {
+				if e.Name == "$query" {
+					doc, _ = e.Value.(bson.D)
+				}
+			}
+		}
+		if !strings.HasSuffix(op.Namespace, ".$cmd") {
+			op.Command = "query"
+			return
+		}
+	case OpMsg:
+		m, err := readOpMsg(&messageHeader{MessageLength: int32(headerLen + len(body))}, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		if doc, err = m.Command(); err != nil {
+			return
+		}
+		op.ReadPreference, _ = resolveReadPreference(readPreferenceMode(doc), false)
+		for _, e := range doc {
+			if e.Name == "$db" {
+				db, _ := e.Value.(string)
+				op.Namespace = db + ".$cmd"
+			}
+		}
+	}
+
+	if len(doc) == 0 {
+		return
+	}
+	class := classifier.Classify(databaseOf(op.Namespace), doc)
+	op.Command = class.Name
+	op.Write = class.Write
+	if class.Namespace != "" {
+		op.Namespace = class.Namespace
+	}
+	if op.TraceParent == "" {
+		op.TraceParent = traceParent(doc, "comment")
+	}
+	if op.Comment == "" {
+		op.Comment = comment(doc, "comment")
+	}
+}
+
+// comment returns the named comment field if it is a string.
+func comment(doc bson.D, field string) string {
+	for _, e := range doc {
+		if e.Name == field {
+			s, _ := e.Value.(string)
+			return s
+		}
+	}
+	return ""
+}
+
+// traceParent extracts the trace context from the named comment field.
+func traceParent(doc bson.D, field string) string {
+	for _, e := range doc {
+		if e.Name != field {
+			continue
+		}
+		switch v := e.Value.(type) {
+		case string:
+			return v
+		case bson.D:
+			for _, c := range v {
+				if c.Name == "traceparent" {
+					s, _ := c.Value.(string)
+					return s
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// bufferedConn is a net.Conn which replays what was read ahead of it before
+// reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	buffered *bytes.Reader
+}
+
+func newBufferedConn(c net.Conn, b []byte) *bufferedConn {
+	return &bufferedConn{Conn: c, buffered: bytes.NewReader(b)}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.buffered.Len() != 0 {
+		return c.buffered.Read(b)
+	}
+	return c.Conn.Read(b)
+}
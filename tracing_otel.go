@@ -0,0 +1,66 @@
+//go:build otel
+// +build otel
+
+package dvara
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OTelTracer is a Tracer which creates OpenTelemetry spans. It is only
+// available when building with the otel tag.
+type OTelTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewOTelTracer creates a Tracer using the given OpenTelemetry TracerProvider.
+// The trace context propagated by drivers is extracted as W3C trace context.
+func NewOTelTracer(provider trace.TracerProvider) *OTelTracer {
+	return &OTelTracer{
+		tracer:     provider.Tracer("github.com/facebookgo/dvara"),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// StartSpan starts a client span for the operation.
+func (t *OTelTracer) StartSpan(op *TracedOperation) TraceSpan {
+	ctx := context.Background()
+	if op.TraceParent != "" {
+		carrier := propagation.MapCarrier{"traceparent": op.TraceParent}
+		ctx = t.propagator.Extract(ctx, carrier)
+	}
+
+	name := op.Command
+	if name == "" {
+		name = op.OpCode.String()
+	}
+	_, span := t.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.operation", op.Command),
+			attribute.String("db.mongodb.namespace", op.Namespace),
+			attribute.String("db.mongodb.opcode", op.OpCode.String()),
+			attribute.String("net.peer.name", op.Backend),
+		),
+	)
+	return otelSpan{span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
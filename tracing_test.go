@@ -0,0 +1,391 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTracedOperationDescribe(t *testing.T) {
+	t.Parallel()
+	query := func(collection string, v interface{}) []byte {
+		_, body := fakeQuery(collection, v)
+		return body
+	}
+	msg := func(v interface{}) []byte {
+		_, body := fakeOpMsg(0, v)
+		return body
+	}
+	slaveOK := func(body []byte) []byte {
+		setInt32(body, 0, queryFlagSlaveOK)
+		return body
+	}
+	secondary := bson.D{{Name: "mode", Value: "secondary"}}
+	cases := []struct {
+		Name     string
+		OpCode   OpCode
+		Body     []byte
+		Expected TracedOperation
+	}{
+		{
+			Name:   "query",
+			OpCode: OpQuery,
+			Body:   query("db.foo", bson.D{{Name: "a", Value: 1}}),
+			Expected: TracedOperation{
+				OpCode:    OpQuery,
+				Namespace: "db.foo",
+				Command:   "query",
+			},
+		},
+		{
+			Name:   "wrapped query with comment",
+			OpCode: OpQuery,
+			Body: query("db.foo", bson.D{
+				{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+				{Name: "$comment", Value: testTraceParent},
+			}),
+			Expected: TracedOperation{
+				OpCode:      OpQuery,
+				Namespace:   "db.foo",
+				Command:     "query",
+				TraceParent: testTraceParent,
+				Comment:     testTraceParent,
+			},
+		},
+		{
+			Name:   "command",
+			OpCode: OpQuery,
+			Body: query("db.$cmd", bson.D{
+				{Name: "count", Value: "foo"},
+				{Name: "comment", Value: bson.D{{Name: "traceparent", Value: testTraceParent}}},
+			}),
+			Expected: TracedOperation{
+				OpCode:      OpQuery,
+				Namespace:   "db.foo",
+				Command:     "count",
+				TraceParent: testTraceParent,
+			},
+		},
+		{
+			Name:   "command without collection",
+			OpCode: OpQuery,
+			Body:   query("admin.$cmd", bson.D{{Name: "isMaster", Value: 1}}),
+			Expected: TracedOperation{
+				OpCode:    OpQuery,
+				Namespace: "admin.$cmd",
+				Command:   "isMaster",
+			},
+		},
+		{
+			Name:   "msg",
+			OpCode: OpMsg,
+			Body: msg(bson.D{
+				{Name: "find", Value: "foo"},
+				{Name: "comment", Value: testTraceParent},
+				{Name: "$db", Value: "db"},
+			}),
+			Expected: TracedOperation{
+				OpCode:      OpMsg,
+				Namespace:   "db.foo",
+				Command:     "find",
+				TraceParent: testTraceParent,
+				Comment:     testTraceParent,
+			},
+		},
+		{
+			Name:   "wrapped query with tag",
+			OpCode: OpQuery,
+			Body: query("db.foo", bson.D{
+				{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+				{Name: "$comment", Value: "tenant=foo"},
+			}),
+			Expected: TracedOperation{
+				OpCode:      OpQuery,
+				Namespace:   "db.foo",
+				Command:     "query",
+				TraceParent: "tenant=foo",
+				Comment:     "tenant=foo",
+			},
+		},
+		{
+			Name:   "msg with tag",
+			OpCode: OpMsg,
+			Body: msg(bson.D{
+				{Name: "insert", Value: "foo"},
+				{Name: "comment", Value: "tenant=foo"},
+				{Name: "$db", Value: "db"},
+			}),
+			Expected: TracedOperation{
+				OpCode:      OpMsg,
+				Namespace:   "db.foo",
+				Command:     "insert",
+				Write:       true,
+				TraceParent: "tenant=foo",
+				Comment:     "tenant=foo",
+			},
+		},
+		{
+			Name:   "msg getMore",
+			OpCode: OpMsg,
+			Body: msg(bson.D{
+				{Name: "getMore", Value: int64(42)},
+				{Name: "collection", Value: "foo"},
+				{Name: "$db", Value: "db"},
+			}),
+			Expected: TracedOperation{
+				OpCode:    OpMsg,
+				Namespace: "db.foo",
+				Command:   "getMore",
+			},
+		},
+		{
+			Name:   "msg killCursors",
+			OpCode: OpMsg,
+			Body: msg(bson.D{
+				{Name: "killCursors", Value: "foo"},
+				{Name: "cursors", Value: []int64{42, 43}},
+				{Name: "$db", Value: "db"},
+			}),
+			Expected: TracedOperation{
+				OpCode:    OpMsg,
+				Namespace: "db.foo",
+				Command:   "killCursors",
+			},
+		},
+		{
+			Name:   "command getMore",
+			OpCode: OpQuery,
+			Body: query("db.$cmd", bson.D{
+				{Name: "getMore", Value: int64(42)},
+				{Name: "collection", Value: "foo"},
+			}),
+			Expected: TracedOperation{
+				OpCode:    OpQuery,
+				Namespace: "db.foo",
+				Command:   "getMore",
+			},
+		},
+		{
+			Name:   "msg insert",
+			OpCode: OpMsg,
+			Body: msg(bson.D{
+				{Name: "insert", Value: "foo"},
+				{Name: "$db", Value: "db"},
+			}),
+			Expected: TracedOperation{
+				OpCode:    OpMsg,
+				Namespace: "db.foo",
+				Command:   "insert",
+				Write:     true,
+			},
+		},
+		{
+			Name:   "msg aggregate with $out",
+			OpCode: OpMsg,
+			Body: msg(bson.D{
+				{Name: "aggregate", Value: "foo"},
+				{Name: "pipeline", Value: []bson.D{
+					{{Name: "$match", Value: bson.D{}}},
+					{{Name: "$out", Value: "bar"}},
+				}},
+				{Name: "$db", Value: "db"},
+			}),
+			Expected: TracedOperation{
+				OpCode:    OpMsg,
+				Namespace: "db.foo",
+				Command:   "aggregate",
+				Write:     true,
+			},
+		},
+		{
+			Name:   "query with slaveOk",
+			OpCode: OpQuery,
+			Body:   slaveOK(query("db.foo", bson.D{{Name: "a", Value: 1}})),
+			Expected: TracedOperation{
+				OpCode:         OpQuery,
+				Namespace:      "db.foo",
+				Command:        "query",
+				ReadPreference: "secondaryPreferred",
+			},
+		},
+		{
+			Name:   "query with $readPreference",
+			OpCode: OpQuery,
+			Body: slaveOK(query("db.foo", bson.D{
+				{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+				{Name: "$readPreference", Value: secondary},
+			})),
+			Expected: TracedOperation{
+				OpCode:         OpQuery,
+				Namespace:      "db.foo",
+				Command:        "query",
+				ReadPreference: "secondary",
+			},
+		},
+		{
+			Name:   "query with conflicting $readPreference and slaveOk",
+			OpCode: OpQuery,
+			Body: slaveOK(query("db.foo", bson.D{
+				{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+				{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "primary"}}},
+			})),
+			Expected: TracedOperation{
+				OpCode:                 OpQuery,
+				Namespace:              "db.foo",
+				Command:                "query",
+				ReadPreference:         "primary",
+				readPreferenceConflict: true,
+			},
+		},
+		{
+			Name:   "query with partial and slaveOk",
+			OpCode: OpQuery,
+			Body: func() []byte {
+				body := query("db.foo", bson.D{{Name: "a", Value: 1}})
+				setInt32(body, 0, queryFlagPartial|queryFlagSlaveOK)
+				return body
+			}(),
+			Expected: TracedOperation{
+				OpCode:         OpQuery,
+				Namespace:      "db.foo",
+				Command:        "query",
+				ReadPreference: "secondaryPreferred",
+			},
+		},
+		{
+			Name:   "query with $readPreference without slaveOk",
+			OpCode: OpQuery,
+			Body: query("db.foo", bson.D{
+				{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+				{Name: "$readPreference", Value: secondary},
+			}),
+			Expected: TracedOperation{
+				OpCode:                 OpQuery,
+				Namespace:              "db.foo",
+				Command:                "query",
+				ReadPreference:         "secondary",
+				readPreferenceConflict: true,
+			},
+		},
+		{
+			Name:   "msg with $readPreference",
+			OpCode: OpMsg,
+			Body: msg(bson.D{
+				{Name: "find", Value: "foo"},
+				{Name: "$db", Value: "db"},
+				{Name: "$readPreference", Value: secondary},
+			}),
+			Expected: TracedOperation{
+				OpCode:         OpMsg,
+				Namespace:      "db.foo",
+				Command:        "find",
+				ReadPreference: "secondary",
+			},
+		},
+		{
+			Name:     "garbage",
+			OpCode:   OpQuery,
+			Body:     []byte{0, 0, 0, 0, 'a'},
+			Expected: TracedOperation{OpCode: OpQuery},
+		},
+	}
+	for _, c := range cases {
+		op := TracedOperation{OpCode: c.OpCode}
+		op.describe(c.Body, nil)
+		if op != c.Expected {
+			t.Fatalf("failed %s: expected %+v got %+v", c.Name, c.Expected, op)
+		}
+	}
+}
+
+type fakeTracer struct {
+	mutex sync.Mutex
+	ops   []TracedOperation
+	errs  []error
+}
+
+func (f *fakeTracer) StartSpan(op *TracedOperation) TraceSpan {
+	return fakeSpan{tracer: f, op: *op}
+}
+
+type fakeSpan struct {
+	tracer *fakeTracer
+	op     TracedOperation
+}
+
+func (s fakeSpan) End(err error) {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.tracer.ops = append(s.tracer.ops, s.op)
+	s.tracer.errs = append(s.tracer.errs, err)
+}
+
+func TestProxyTracedMessage(t *testing.T) {
+	t.Parallel()
+	mongo := newFakeMongo(t, okReply)
+	defer mongo.Stop()
+	tracer := &fakeTracer{}
+	p := newFakeProxy(t, mongo.Addr(), &ReplicaSet{Tracer: tracer})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.ProxyAddr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	h, body := fakeQuery("db.$cmd", bson.D{
+		{Name: "count", Value: "foo"},
+		{Name: "comment", Value: testTraceParent},
+	})
+	h.RequestID = 1
+	_, err = c.Write(append(h.ToWire(), body...))
+	ensure.Nil(t, err)
+
+	reply, err := readHeader(c)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, reply.ResponseTo, int32(1))
+	_, err = io.CopyN(ioutil.Discard, c, int64(reply.MessageLength-headerLen))
+	ensure.Nil(t, err)
+
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	ensure.DeepEqual(t, tracer.ops, []TracedOperation{{
+		OpCode:      OpQuery,
+		Namespace:   "db.foo",
+		Command:     "count",
+		Backend:     mongo.Addr(),
+		TraceParent: testTraceParent,
+		Comment:     testTraceParent,
+	}})
+	ensure.DeepEqual(t, tracer.errs, []error{nil})
+}
+
+func TestCountReplyError(t *testing.T) {
+	t.Parallel()
+	bumped := make(map[string]float64)
+	p := &Proxy{
+		stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) { bumped[key] += val },
+		},
+	}
+	reply := func(v interface{}) []byte {
+		b, err := newReply(&messageHeader{OpCode: OpMsg}, 0, v)
+		ensure.Nil(t, err)
+		return b
+	}
+	p.countReplyError(reply(bson.D{{Name: "ok", Value: 1}}))
+	p.countReplyError(reply(bson.D{{Name: "ok", Value: 0}, {Name: "codeName", Value: "NamespaceNotFound"}}))
+	p.countReplyError(reply(bson.D{{Name: "ok", Value: 0}}))
+	p.countReplyError(nil)
+	ensure.DeepEqual(t, bumped, map[string]float64{
+		"reply.error.NamespaceNotFound": 1,
+		"reply.error.unknown":           1,
+	})
+}
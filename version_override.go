@@ -0,0 +1,133 @@
+package dvara
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BuildInfoVersionOverride advertises a consistent server version to clients
+// when fronting servers running different versions. Overrides only ever
+// downgrade what a server reports, they never advertise a higher version.
+type BuildInfoVersionOverride struct {
+	// Version is the version reported in buildInfo responses, for example
+	// "3.0.0". Empty disables the override.
+	Version string
+
+	// MaxWireVersion is the maxWireVersion reported in isMaster responses. Zero
+	// disables the override.
+	MaxWireVersion int
+}
+
+// RewriteBuildInfo overrides the version and versionArray fields of a buildInfo
+// response if Version is lower than the one reported. It returns the new
+// document and true if it was modified.
+func (o *BuildInfoVersionOverride) RewriteBuildInfo(doc bson.D) (bson.D, bool) {
+	override, ok := parseVersion(o.Version)
+	if !ok {
+		return doc, false
+	}
+	for i, e := range doc {
+		if e.Name != "version" {
+			continue
+		}
+		s, _ := e.Value.(string)
+		current, ok := parseVersion(s)
+		if !ok || !versionLess(override, current) {
+			return doc, false
+		}
+		newDoc := append(bson.D(nil), doc...)
+		newDoc[i].Value = o.Version
+		for j, e := range newDoc {
+			if e.Name == "versionArray" {
+				newDoc[j].Value = []int32{override[0], override[1], override[2], 0}
+			}
+		}
+		return newDoc, true
+	}
+	return doc, false
+}
+
+// RewriteIsMaster clamps the maxWireVersion of an isMaster response to
+// MaxWireVersion. The response is left as is if the server does not support
+// MaxWireVersion, that is if its minWireVersion is higher.
+func (o *BuildInfoVersionOverride) RewriteIsMaster(q *isMasterResponse) bool {
+	if o.MaxWireVersion == 0 {
+		return false
+	}
+	max, ok := int64Value(q.Extra["maxWireVersion"])
+	if !ok || max <= int64(o.MaxWireVersion) {
+		return false
+	}
+	if min, ok := int64Value(q.Extra["minWireVersion"]); ok && min > int64(o.MaxWireVersion) {
+		return false
+	}
+	q.Extra["maxWireVersion"] = int32(o.MaxWireVersion)
+	return true
+}
+
+// parseVersion parses the leading major.minor.patch of a version string like
+// "3.0.7" or "3.2.0-rc1".
+func parseVersion(s string) ([3]int32, bool) {
+	var v [3]int32
+	if s == "" {
+		return v, false
+	}
+	if i := strings.IndexAny(s, "-+ "); i != -1 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 32)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = int32(n)
+	}
+	return v, true
+}
+
+func versionLess(a, b [3]int32) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// BuildInfoResponseRewriter rewrites the "buildInfo" response to apply the
+// BuildInfoVersionOverride. Responses which are not overridden are forwarded
+// without being re-marshalled.
+type BuildInfoResponseRewriter struct {
+	Log             Logger                    `inject:""`
+	ReplyRW         *ReplyRW                  `inject:""`
+	VersionOverride *BuildInfoVersionOverride `inject:""`
+}
+
+// Rewrite rewrites the "buildInfo" response.
+func (r *BuildInfoResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
+	var raw bson.Raw
+	h, prefix, docLen, rest, err := r.ReplyRW.ReadFirst(server, &raw)
+	if err != nil {
+		return err
+	}
+	if r.VersionOverride.Version == "" {
+		return r.ReplyRW.WriteFirst(client, h, prefix, docLen, rest, raw)
+	}
+
+	var q bson.D
+	if err := raw.Unmarshal(&q); err != nil {
+		r.Log.Error(err)
+		return err
+	}
+	if newQ, ok := r.VersionOverride.RewriteBuildInfo(q); ok {
+		return r.ReplyRW.WriteFirst(client, h, prefix, docLen, rest, newQ)
+	}
+	return r.ReplyRW.WriteFirst(client, h, prefix, docLen, rest, raw)
+}
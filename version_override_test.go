@@ -0,0 +1,145 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func fakeBuildInfo(version string, versionArray ...int32) bson.D {
+	return bson.D{
+		{Name: "version", Value: version},
+		{Name: "gitVersion", Value: "abc"},
+		{Name: "versionArray", Value: versionArray},
+		{Name: "ok", Value: 1.0},
+	}
+}
+
+func TestRewriteBuildInfo(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Version  string
+		In       bson.D
+		Expected bson.D
+	}{
+		{
+			Name:     "downgrade",
+			Version:  "3.0.0",
+			In:       fakeBuildInfo("3.2.7", 3, 2, 7, 0),
+			Expected: fakeBuildInfo("3.0.0", 3, 0, 0, 0),
+		},
+		{
+			Name:     "downgrade release candidate",
+			Version:  "3.0.0",
+			In:       fakeBuildInfo("3.2.0-rc1", 3, 2, 0, -49),
+			Expected: fakeBuildInfo("3.0.0", 3, 0, 0, 0),
+		},
+		{
+			Name:    "never upgrade",
+			Version: "3.4.0",
+			In:      fakeBuildInfo("3.2.7", 3, 2, 7, 0),
+		},
+		{
+			Name:    "same",
+			Version: "3.2.7",
+			In:      fakeBuildInfo("3.2.7", 3, 2, 7, 0),
+		},
+		{
+			Name: "disabled",
+			In:   fakeBuildInfo("3.2.7", 3, 2, 7, 0),
+		},
+		{
+			Name:    "invalid override",
+			Version: "three",
+			In:      fakeBuildInfo("3.2.7", 3, 2, 7, 0),
+		},
+		{
+			Name:    "no version",
+			Version: "3.0.0",
+			In:      bson.D{{Name: "ok", Value: 1.0}},
+		},
+	}
+	for _, c := range cases {
+		o := BuildInfoVersionOverride{Version: c.Version}
+		actual, ok := o.RewriteBuildInfo(c.In)
+		if ok != (c.Expected != nil) {
+			t.Fatalf("unexpected rewrite for case %s", c.Name)
+		}
+		if ok && !reflect.DeepEqual(actual, c.Expected) {
+			t.Fatalf("for case %s expected %v got %v", c.Name, c.Expected, actual)
+		}
+	}
+}
+
+func TestRewriteIsMasterWireVersion(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name           string
+		MaxWireVersion int
+		Min            interface{}
+		Max            interface{}
+		Expected       interface{}
+	}{
+		{Name: "clamp", MaxWireVersion: 3, Min: 0, Max: 4, Expected: int32(3)},
+		{Name: "never upgrade", MaxWireVersion: 5, Min: 0, Max: 4, Expected: 4},
+		{Name: "unsupported by server", MaxWireVersion: 3, Min: 4, Max: 5, Expected: 5},
+		{Name: "disabled", Min: 0, Max: 4, Expected: 4},
+	}
+	for _, c := range cases {
+		o := BuildInfoVersionOverride{MaxWireVersion: c.MaxWireVersion}
+		q := isMasterResponse{Extra: bson.M{"minWireVersion": c.Min, "maxWireVersion": c.Max}}
+		o.RewriteIsMaster(&q)
+		if q.Extra["maxWireVersion"] != c.Expected {
+			t.Fatalf("for case %s expected %v got %v", c.Name, c.Expected, q.Extra["maxWireVersion"])
+		}
+	}
+}
+
+func TestBuildInfoResponseRewriter(t *testing.T) {
+	t.Parallel()
+	for _, version := range []string{"", "3.4.0"} {
+		r := &BuildInfoResponseRewriter{
+			Log:             &tLogger{TB: t},
+			ReplyRW:         &ReplyRW{Log: &tLogger{TB: t}},
+			VersionOverride: &BuildInfoVersionOverride{Version: version},
+		}
+		in, err := ioutil.ReadAll(fakeSingleDocReply(fakeBuildInfo("3.2.7", 3, 2, 7, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var client bytes.Buffer
+		if err := r.Rewrite(&client, bytes.NewReader(in)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(client.Bytes(), in) {
+			t.Fatalf("response was not forwarded verbatim for version %q", version)
+		}
+	}
+
+	r := &BuildInfoResponseRewriter{
+		Log:             &tLogger{TB: t},
+		ReplyRW:         &ReplyRW{Log: &tLogger{TB: t}},
+		VersionOverride: &BuildInfoVersionOverride{Version: "3.0.0"},
+	}
+	var client bytes.Buffer
+	if err := r.Rewrite(&client, fakeSingleDocReply(fakeBuildInfo("3.2.7", 3, 2, 7, 0))); err != nil {
+		t.Fatal(err)
+	}
+	var actual bson.D
+	if err := bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{
+		{Name: "version", Value: "3.0.0"},
+		{Name: "gitVersion", Value: "abc"},
+		{Name: "versionArray", Value: []interface{}{3, 0, 0, 0}},
+		{Name: "ok", Value: 1.0},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+}